@@ -2,19 +2,21 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-package tag_values
+// Package btree is generic in-memory B+tree based ordered map.
+//
+// It is cznic/b with key and value types turned into type parameters,
+// so every ordered map of the index shares one implementation. Unlike
+// cznic/b it doesn't pool trees and enumerators: Close just clears them.
+package btree
 
 import (
 	"fmt"
 	"io"
-	"sync"
-
-	"github.com/spuzirev/metricsindex/types"
 )
 
 const (
-	kx = 32 //TODO benchmark tune this number if using custom key/value type(s).
-	kd = 32 //TODO benchmark tune this number if using custom key/value type(s).
+	kx = 32 // order of index pages
+	kd = 32 // order of data pages
 )
 
 func init() {
@@ -27,29 +29,6 @@ func init() {
 	}
 }
 
-var (
-	btDPool = sync.Pool{New: func() interface{} { return &d{} }}
-	btEPool = btEpool{sync.Pool{New: func() interface{} { return &Enumerator{} }}}
-	btTPool = btTpool{sync.Pool{New: func() interface{} { return &Tree{} }}}
-	btXPool = sync.Pool{New: func() interface{} { return &x{} }}
-)
-
-type btTpool struct{ sync.Pool }
-
-func (p *btTpool) get(cmp Cmp) *Tree {
-	x := p.Get().(*Tree)
-	x.cmp = cmp
-	return x
-}
-
-type btEpool struct{ sync.Pool }
-
-func (p *btEpool) get(err error, hit bool, i int, k types.TagValue, q *d, t *Tree, ver int64) *Enumerator {
-	x := p.Get().(*Enumerator)
-	x.err, x.hit, x.i, x.k, x.q, x.t, x.ver = err, hit, i, k, q, t, ver
-	return x
-}
-
 type (
 	// Cmp compares a and b. Return value is:
 	//
@@ -57,18 +36,18 @@ type (
 	//	  0 if a == b
 	//	> 0 if a >  b
 	//
-	Cmp func(a, b types.TagValue) int
+	Cmp[K any] func(a, b K) int
 
-	d struct { // data page
+	d[K, V any] struct { // data page
 		c int
-		d [2*kd + 1]de
-		n *d
-		p *d
+		d [2*kd + 1]de[K, V]
+		n *d[K, V]
+		p *d[K, V]
 	}
 
-	de struct { // d element
-		k types.TagValue
-		v bool
+	de[K, V any] struct { // d element
+		k K
+		v V
 	}
 
 	// Enumerator captures the state of enumerating a tree. It is returned
@@ -79,80 +58,80 @@ type (
 	// However, once an Enumerator returns io.EOF to signal "no more
 	// items", it does no more attempt to "resync" on tree mutation(s).  In
 	// other words, io.EOF from an Enumerator is "sticky" (idempotent).
-	Enumerator struct {
+	Enumerator[K, V any] struct {
 		err error
 		hit bool
 		i   int
-		k   types.TagValue
-		q   *d
-		t   *Tree
+		k   K
+		q   *d[K, V]
+		t   *Tree[K, V]
 		ver int64
 	}
 
 	// Tree is a B+tree.
-	Tree struct {
+	Tree[K, V any] struct {
 		c     int
-		cmp   Cmp
-		first *d
-		last  *d
+		cmp   Cmp[K]
+		first *d[K, V]
+		last  *d[K, V]
 		r     interface{}
 		ver   int64
 	}
 
-	xe struct { // x element
+	xe[K, V any] struct { // x element
 		ch interface{}
-		k  types.TagValue
+		k  K
 	}
 
-	x struct { // index page
+	x[K, V any] struct { // index page
 		c int
-		x [2*kx + 2]xe
+		x [2*kx + 2]xe[K, V]
 	}
 )
 
-var ( // R/O zero values
-	zd  d
-	zde de
-	ze  Enumerator
-	zk  types.TagValue
-	zt  Tree
-	zx  x
-	zxe xe
-)
+// reset methods zero pages for GC. Zero values can't be written inline in
+// the code below as variables named x shadow type x there.
 
-func clr(q interface{}) {
-	switch x := q.(type) {
-	case *x:
-		for i := 0; i <= x.c; i++ { // Ch0 Sep0 ... Chn-1 Sepn-1 Chn
-			clr(x.x[i].ch)
-		}
-		*x = zx
-		btXPool.Put(x)
-	case *d:
-		*x = zd
-		btDPool.Put(x)
+func (q *x[K, V]) reset() {
+	*q = x[K, V]{}
+}
+
+func (q *d[K, V]) reset() {
+	*q = d[K, V]{}
+}
+
+func newEnumerator[K, V any](err error, hit bool, i int, k K, q *d[K, V], t *Tree[K, V], ver int64) *Enumerator[K, V] {
+	return &Enumerator[K, V]{
+		err: err,
+		hit: hit,
+		i:   i,
+		k:   k,
+		q:   q,
+		t:   t,
+		ver: ver,
 	}
 }
 
 // -------------------------------------------------------------------------- x
 
-func newX(ch0 interface{}) *x {
-	r := btXPool.Get().(*x)
+func newX[K, V any](ch0 interface{}) *x[K, V] {
+	r := &x[K, V]{}
 	r.x[0].ch = ch0
 	return r
 }
 
-func (q *x) extract(i int) {
+func (q *x[K, V]) extract(i int) {
+	var zk K
 	q.c--
 	if i < q.c {
 		copy(q.x[i:], q.x[i+1:q.c+1])
 		q.x[q.c].ch = q.x[q.c+1].ch
-		q.x[q.c].k = zk  // GC
-		q.x[q.c+1] = zxe // GC
+		q.x[q.c].k = zk         // GC
+		q.x[q.c+1] = xe[K, V]{} // GC
 	}
 }
 
-func (q *x) insert(i int, k types.TagValue, ch interface{}) *x {
+func (q *x[K, V]) insert(i int, k K, ch interface{}) *x[K, V] {
 	c := q.c
 	if i < c {
 		q.x[c+1].ch = q.x[c].ch
@@ -166,13 +145,13 @@ func (q *x) insert(i int, k types.TagValue, ch interface{}) *x {
 	return q
 }
 
-func (q *x) siblings(i int) (l, r *d) {
+func (q *x[K, V]) siblings(i int) (l, r *d[K, V]) {
 	if i >= 0 {
 		if i > 0 {
-			l = q.x[i-1].ch.(*d)
+			l = q.x[i-1].ch.(*d[K, V])
 		}
 		if i < q.c {
-			r = q.x[i+1].ch.(*d)
+			r = q.x[i+1].ch.(*d[K, V])
 		}
 	}
 	return
@@ -180,14 +159,14 @@ func (q *x) siblings(i int) (l, r *d) {
 
 // -------------------------------------------------------------------------- d
 
-func (l *d) mvL(r *d, c int) {
+func (l *d[K, V]) mvL(r *d[K, V], c int) {
 	copy(l.d[l.c:], r.d[:c])
 	copy(r.d[:], r.d[c:r.c])
 	l.c += c
 	r.c -= c
 }
 
-func (l *d) mvR(r *d, c int) {
+func (l *d[K, V]) mvR(r *d[K, V], c int) {
 	copy(r.d[c:], r.d[:r.c])
 	copy(r.d[:c], l.d[l.c-c:])
 	r.c += c
@@ -198,30 +177,28 @@ func (l *d) mvR(r *d, c int) {
 
 // TreeNew returns a newly created, empty Tree. The compare function is used
 // for key collation.
-func TreeNew(cmp Cmp) *Tree {
-	return btTPool.get(cmp)
+func TreeNew[K, V any](cmp Cmp[K]) *Tree[K, V] {
+	return &Tree[K, V]{cmp: cmp}
 }
 
 // Clear removes all K/V pairs from the tree.
-func (t *Tree) Clear() {
+func (t *Tree[K, V]) Clear() {
 	if t.r == nil {
 		return
 	}
 
-	clr(t.r)
 	t.c, t.first, t.last, t.r = 0, nil, nil, nil
 	t.ver++
 }
 
-// Close performs Clear and recycles t to a pool for possible later reuse. No
-// references to t should exist or such references must not be used afterwards.
-func (t *Tree) Close() {
+// Close performs Clear and releases everything t holds. No references to t
+// should exist or such references must not be used afterwards.
+func (t *Tree[K, V]) Close() {
 	t.Clear()
-	*t = zt
-	btTPool.Put(t)
+	*t = Tree[K, V]{}
 }
 
-func (t *Tree) cat(p *x, q, r *d, pi int) {
+func (t *Tree[K, V]) cat(p *x[K, V], q, r *d[K, V], pi int) {
 	t.ver++
 	q.mvL(r, r.c)
 	if r.n != nil {
@@ -230,8 +207,7 @@ func (t *Tree) cat(p *x, q, r *d, pi int) {
 		t.last = q
 	}
 	q.n = r.n
-	*r = zd
-	btDPool.Put(r)
+	r.reset()
 	if p.c > 1 {
 		p.extract(pi)
 		p.x[pi].ch = q
@@ -239,24 +215,22 @@ func (t *Tree) cat(p *x, q, r *d, pi int) {
 	}
 
 	switch x := t.r.(type) {
-	case *x:
-		*x = zx
-		btXPool.Put(x)
-	case *d:
-		*x = zd
-		btDPool.Put(x)
+	case *x[K, V]:
+		x.reset()
+	case *d[K, V]:
+		x.reset()
 	}
 	t.r = q
 }
 
-func (t *Tree) catX(p, q, r *x, pi int) {
+func (t *Tree[K, V]) catX(p, q, r *x[K, V], pi int) {
+	var zk K
 	t.ver++
 	q.x[q.c].k = p.x[pi].k
 	copy(q.x[q.c+1:], r.x[:r.c])
 	q.c += r.c + 1
 	q.x[q.c].ch = r.x[r.c].ch
-	*r = zx
-	btXPool.Put(r)
+	r.reset()
 	if p.c > 1 {
 		p.c--
 		pc := p.c
@@ -271,21 +245,19 @@ func (t *Tree) catX(p, q, r *x, pi int) {
 	}
 
 	switch x := t.r.(type) {
-	case *x:
-		*x = zx
-		btXPool.Put(x)
-	case *d:
-		*x = zd
-		btDPool.Put(x)
+	case *x[K, V]:
+		x.reset()
+	case *d[K, V]:
+		x.reset()
 	}
 	t.r = q
 }
 
 // Delete removes the k's KV pair, if it exists, in which case Delete returns
 // true.
-func (t *Tree) Delete(k types.TagValue) (ok bool) {
+func (t *Tree[K, V]) Delete(k K) (ok bool) {
 	pi := -1
-	var p *x
+	var p *x[K, V]
 	q := t.r
 	if q == nil {
 		return false
@@ -296,7 +268,7 @@ func (t *Tree) Delete(k types.TagValue) (ok bool) {
 		i, ok = t.find(q, k)
 		if ok {
 			switch x := q.(type) {
-			case *x:
+			case *x[K, V]:
 				if x.c < kx && q != t.r {
 					x, i = t.underflowX(p, x, pi, i)
 				}
@@ -304,7 +276,7 @@ func (t *Tree) Delete(k types.TagValue) (ok bool) {
 				p = x
 				q = x.x[pi].ch
 				continue
-			case *d:
+			case *d[K, V]:
 				t.extract(x, i)
 				if x.c >= kd {
 					return true
@@ -320,35 +292,35 @@ func (t *Tree) Delete(k types.TagValue) (ok bool) {
 		}
 
 		switch x := q.(type) {
-		case *x:
+		case *x[K, V]:
 			if x.c < kx && q != t.r {
 				x, i = t.underflowX(p, x, pi, i)
 			}
 			pi = i
 			p = x
 			q = x.x[i].ch
-		case *d:
+		case *d[K, V]:
 			return false
 		}
 	}
 }
 
-func (t *Tree) extract(q *d, i int) { // (r bool) {
+func (t *Tree[K, V]) extract(q *d[K, V], i int) { // (r V) {
 	t.ver++
 	//r = q.d[i].v // prepared for Extract
 	q.c--
 	if i < q.c {
 		copy(q.d[i:], q.d[i+1:q.c+1])
 	}
-	q.d[q.c] = zde // GC
+	q.d[q.c] = de[K, V]{} // GC
 	t.c--
 }
 
-func (t *Tree) find(q interface{}, k types.TagValue) (i int, ok bool) {
-	var mk types.TagValue
+func (t *Tree[K, V]) find(q interface{}, k K) (i int, ok bool) {
+	var mk K
 	l := 0
 	switch x := q.(type) {
-	case *x:
+	case *x[K, V]:
 		h := x.c - 1
 		for l <= h {
 			m := (l + h) >> 1
@@ -362,7 +334,7 @@ func (t *Tree) find(q interface{}, k types.TagValue) (i int, ok bool) {
 				h = m - 1
 			}
 		}
-	case *d:
+	case *d[K, V]:
 		h := x.c - 1
 		for l <= h {
 			m := (l + h) >> 1
@@ -382,7 +354,7 @@ func (t *Tree) find(q interface{}, k types.TagValue) (i int, ok bool) {
 
 // First returns the first item of the tree in the key collating order, or
 // (zero-value, zero-value) if the tree is empty.
-func (t *Tree) First() (k types.TagValue, v bool) {
+func (t *Tree[K, V]) First() (k K, v V) {
 	if q := t.first; q != nil {
 		q := &q.d[0]
 		k, v = q.k, q.v
@@ -392,7 +364,7 @@ func (t *Tree) First() (k types.TagValue, v bool) {
 
 // Get returns the value associated with k and true if it exists. Otherwise Get
 // returns (zero-value, false).
-func (t *Tree) Get(k types.TagValue) (v bool, ok bool) {
+func (t *Tree[K, V]) Get(k K) (v V, ok bool) {
 	q := t.r
 	if q == nil {
 		return
@@ -402,15 +374,15 @@ func (t *Tree) Get(k types.TagValue) (v bool, ok bool) {
 		var i int
 		if i, ok = t.find(q, k); ok {
 			switch x := q.(type) {
-			case *x:
+			case *x[K, V]:
 				q = x.x[i+1].ch
 				continue
-			case *d:
+			case *d[K, V]:
 				return x.d[i].v, true
 			}
 		}
 		switch x := q.(type) {
-		case *x:
+		case *x[K, V]:
 			q = x.x[i].ch
 		default:
 			return
@@ -418,7 +390,7 @@ func (t *Tree) Get(k types.TagValue) (v bool, ok bool) {
 	}
 }
 
-func (t *Tree) insert(q *d, i int, k types.TagValue, v bool) *d {
+func (t *Tree[K, V]) insert(q *d[K, V], i int, k K, v V) *d[K, V] {
 	t.ver++
 	c := q.c
 	if i < c {
@@ -433,7 +405,7 @@ func (t *Tree) insert(q *d, i int, k types.TagValue, v bool) *d {
 
 // Last returns the last item of the tree in the key collating order, or
 // (zero-value, zero-value) if the tree is empty.
-func (t *Tree) Last() (k types.TagValue, v bool) {
+func (t *Tree[K, V]) Last() (k K, v V) {
 	if q := t.last; q != nil {
 		q := &q.d[q.c-1]
 		k, v = q.k, q.v
@@ -442,11 +414,11 @@ func (t *Tree) Last() (k types.TagValue, v bool) {
 }
 
 // Len returns the number of items in the tree.
-func (t *Tree) Len() int {
+func (t *Tree[K, V]) Len() int {
 	return t.c
 }
 
-func (t *Tree) overflow(p *x, q *d, pi, i int, k types.TagValue, v bool) {
+func (t *Tree[K, V]) overflow(p *x[K, V], q *d[K, V], pi, i int, k K, v V) {
 	t.ver++
 	l, r := p.siblings(pi)
 
@@ -476,10 +448,10 @@ func (t *Tree) overflow(p *x, q *d, pi, i int, k types.TagValue, v bool) {
 // Seek returns an Enumerator positioned on an item such that k >= item's key.
 // ok reports if k == item.key The Enumerator's position is possibly after the
 // last item in the tree.
-func (t *Tree) Seek(k types.TagValue) (e *Enumerator, ok bool) {
+func (t *Tree[K, V]) Seek(k K) (e *Enumerator[K, V], ok bool) {
 	q := t.r
 	if q == nil {
-		e = btEPool.get(nil, false, 0, k, nil, t, t.ver)
+		e = newEnumerator(nil, false, 0, k, nil, t, t.ver)
 		return
 	}
 
@@ -487,57 +459,57 @@ func (t *Tree) Seek(k types.TagValue) (e *Enumerator, ok bool) {
 		var i int
 		if i, ok = t.find(q, k); ok {
 			switch x := q.(type) {
-			case *x:
+			case *x[K, V]:
 				q = x.x[i+1].ch
 				continue
-			case *d:
-				return btEPool.get(nil, ok, i, k, x, t, t.ver), true
+			case *d[K, V]:
+				return newEnumerator(nil, ok, i, k, x, t, t.ver), true
 			}
 		}
 
 		switch x := q.(type) {
-		case *x:
+		case *x[K, V]:
 			q = x.x[i].ch
-		case *d:
-			return btEPool.get(nil, ok, i, k, x, t, t.ver), false
+		case *d[K, V]:
+			return newEnumerator(nil, ok, i, k, x, t, t.ver), false
 		}
 	}
 }
 
 // SeekFirst returns an enumerator positioned on the first KV pair in the tree,
 // if any. For an empty tree, err == io.EOF is returned and e will be nil.
-func (t *Tree) SeekFirst() (e *Enumerator, err error) {
+func (t *Tree[K, V]) SeekFirst() (e *Enumerator[K, V], err error) {
 	q := t.first
 	if q == nil {
 		return nil, io.EOF
 	}
 
-	return btEPool.get(nil, true, 0, q.d[0].k, q, t, t.ver), nil
+	return newEnumerator(nil, true, 0, q.d[0].k, q, t, t.ver), nil
 }
 
 // SeekLast returns an enumerator positioned on the last KV pair in the tree,
 // if any. For an empty tree, err == io.EOF is returned and e will be nil.
-func (t *Tree) SeekLast() (e *Enumerator, err error) {
+func (t *Tree[K, V]) SeekLast() (e *Enumerator[K, V], err error) {
 	q := t.last
 	if q == nil {
 		return nil, io.EOF
 	}
 
-	return btEPool.get(nil, true, q.c-1, q.d[q.c-1].k, q, t, t.ver), nil
+	return newEnumerator(nil, true, q.c-1, q.d[q.c-1].k, q, t, t.ver), nil
 }
 
 // Set sets the value associated with k.
-func (t *Tree) Set(k types.TagValue, v bool) {
+func (t *Tree[K, V]) Set(k K, v V) {
 	//dbg("--- PRE Set(%v, %v)\n%s", k, v, t.dump())
 	//defer func() {
 	//	dbg("--- POST\n%s\n====\n", t.dump())
 	//}()
 
 	pi := -1
-	var p *x
+	var p *x[K, V]
 	q := t.r
 	if q == nil {
-		z := t.insert(btDPool.Get().(*d), 0, k, v)
+		z := t.insert(&d[K, V]{}, 0, k, v)
 		t.r, t.first, t.last = z, z, z
 		return
 	}
@@ -546,7 +518,7 @@ func (t *Tree) Set(k types.TagValue, v bool) {
 		i, ok := t.find(q, k)
 		if ok {
 			switch x := q.(type) {
-			case *x:
+			case *x[K, V]:
 				i++
 				if x.c > 2*kx {
 					x, i = t.splitX(p, x, pi, i)
@@ -555,21 +527,21 @@ func (t *Tree) Set(k types.TagValue, v bool) {
 				p = x
 				q = x.x[i].ch
 				continue
-			case *d:
+			case *d[K, V]:
 				x.d[i].v = v
 			}
 			return
 		}
 
 		switch x := q.(type) {
-		case *x:
+		case *x[K, V]:
 			if x.c > 2*kx {
 				x, i = t.splitX(p, x, pi, i)
 			}
 			pi = i
 			p = x
 			q = x.x[i].ch
-		case *d:
+		case *d[K, V]:
 			switch {
 			case x.c < 2*kd:
 				t.insert(x, i, k, v)
@@ -588,16 +560,16 @@ func (t *Tree) Set(k types.TagValue, v bool) {
 // (whatever, false) if it decides not to create or not to update the value of
 // the KV pair.
 //
-// 	tree.Set(k, v) call conceptually equals calling
+//	tree.Set(k, v) call conceptually equals calling
 //
-// 	tree.Put(k, func(types.TagValue, bool){ return v, true })
+//	tree.Put(k, func(K, bool){ return v, true })
 //
 // modulo the differing return values.
-func (t *Tree) Put(k types.TagValue, upd func(oldV bool, exists bool) (newV bool, write bool)) (oldV bool, written bool) {
+func (t *Tree[K, V]) Put(k K, upd func(oldV V, exists bool) (newV V, write bool)) (oldV V, written bool) {
 	pi := -1
-	var p *x
+	var p *x[K, V]
 	q := t.r
-	var newV bool
+	var newV V
 	if q == nil {
 		// new KV pair in empty tree
 		newV, written = upd(newV, false)
@@ -605,7 +577,7 @@ func (t *Tree) Put(k types.TagValue, upd func(oldV bool, exists bool) (newV bool
 			return
 		}
 
-		z := t.insert(btDPool.Get().(*d), 0, k, newV)
+		z := t.insert(&d[K, V]{}, 0, k, newV)
 		t.r, t.first, t.last = z, z, z
 		return
 	}
@@ -614,7 +586,7 @@ func (t *Tree) Put(k types.TagValue, upd func(oldV bool, exists bool) (newV bool
 		i, ok := t.find(q, k)
 		if ok {
 			switch x := q.(type) {
-			case *x:
+			case *x[K, V]:
 				i++
 				if x.c > 2*kx {
 					x, i = t.splitX(p, x, pi, i)
@@ -623,7 +595,7 @@ func (t *Tree) Put(k types.TagValue, upd func(oldV bool, exists bool) (newV bool
 				p = x
 				q = x.x[i].ch
 				continue
-			case *d:
+			case *d[K, V]:
 				oldV = x.d[i].v
 				newV, written = upd(oldV, true)
 				if !written {
@@ -636,14 +608,14 @@ func (t *Tree) Put(k types.TagValue, upd func(oldV bool, exists bool) (newV bool
 		}
 
 		switch x := q.(type) {
-		case *x:
+		case *x[K, V]:
 			if x.c > 2*kx {
 				x, i = t.splitX(p, x, pi, i)
 			}
 			pi = i
 			p = x
 			q = x.x[i].ch
-		case *d: // new KV pair
+		case *d[K, V]: // new KV pair
 			newV, written = upd(newV, false)
 			if !written {
 				return
@@ -660,9 +632,9 @@ func (t *Tree) Put(k types.TagValue, upd func(oldV bool, exists bool) (newV bool
 	}
 }
 
-func (t *Tree) split(p *x, q *d, pi, i int, k types.TagValue, v bool) {
+func (t *Tree[K, V]) split(p *x[K, V], q *d[K, V], pi, i int, k K, v V) {
 	t.ver++
-	r := btDPool.Get().(*d)
+	r := &d[K, V]{}
 	if q.n != nil {
 		r.n = q.n
 		r.n.p = r
@@ -674,7 +646,7 @@ func (t *Tree) split(p *x, q *d, pi, i int, k types.TagValue, v bool) {
 
 	copy(r.d[:], q.d[kd:2*kd])
 	for i := range q.d[kd:] {
-		q.d[kd+i] = zde
+		q.d[kd+i] = de[K, V]{}
 	}
 	q.c = kd
 	r.c = kd
@@ -686,7 +658,7 @@ func (t *Tree) split(p *x, q *d, pi, i int, k types.TagValue, v bool) {
 	if pi >= 0 {
 		p.insert(pi, r.d[0].k, r)
 	} else {
-		t.r = newX(q).insert(0, r.d[0].k, r)
+		t.r = newX[K, V](q).insert(0, r.d[0].k, r)
 	}
 	if done {
 		return
@@ -695,21 +667,22 @@ func (t *Tree) split(p *x, q *d, pi, i int, k types.TagValue, v bool) {
 	t.insert(q, i, k, v)
 }
 
-func (t *Tree) splitX(p *x, q *x, pi int, i int) (*x, int) {
+func (t *Tree[K, V]) splitX(p *x[K, V], q *x[K, V], pi int, i int) (*x[K, V], int) {
+	var zk K
 	t.ver++
-	r := btXPool.Get().(*x)
+	r := &x[K, V]{}
 	copy(r.x[:], q.x[kx+1:])
 	q.c = kx
 	r.c = kx
 	if pi >= 0 {
 		p.insert(pi, q.x[kx].k, r)
 	} else {
-		t.r = newX(q).insert(0, q.x[kx].k, r)
+		t.r = newX[K, V](q).insert(0, q.x[kx].k, r)
 	}
 
 	q.x[kx].k = zk
 	for i := range q.x[kx+1:] {
-		q.x[kx+i+1] = zxe
+		q.x[kx+i+1] = xe[K, V]{}
 	}
 	if i > kx {
 		q = r
@@ -719,7 +692,7 @@ func (t *Tree) splitX(p *x, q *x, pi int, i int) (*x, int) {
 	return q, i
 }
 
-func (t *Tree) underflow(p *x, q *d, pi int) {
+func (t *Tree[K, V]) underflow(p *x[K, V], q *d[K, V], pi int) {
 	t.ver++
 	l, r := p.siblings(pi)
 
@@ -732,7 +705,7 @@ func (t *Tree) underflow(p *x, q *d, pi int) {
 	if r != nil && q.c+r.c >= 2*kd {
 		q.mvL(r, 1)
 		p.x[pi].k = r.d[0].k
-		r.d[r.c] = zde // GC
+		r.d[r.c] = de[K, V]{} // GC
 		return
 	}
 
@@ -744,16 +717,17 @@ func (t *Tree) underflow(p *x, q *d, pi int) {
 	t.cat(p, q, r, pi)
 }
 
-func (t *Tree) underflowX(p *x, q *x, pi int, i int) (*x, int) {
+func (t *Tree[K, V]) underflowX(p *x[K, V], q *x[K, V], pi int, i int) (*x[K, V], int) {
+	var zk K
 	t.ver++
-	var l, r *x
+	var l, r *x[K, V]
 
 	if pi >= 0 {
 		if pi > 0 {
-			l = p.x[pi-1].ch.(*x)
+			l = p.x[pi-1].ch.(*x[K, V])
 		}
 		if pi < p.c {
-			r = p.x[pi+1].ch.(*x)
+			r = p.x[pi+1].ch.(*x[K, V])
 		}
 	}
 
@@ -796,17 +770,16 @@ func (t *Tree) underflowX(p *x, q *x, pi int, i int) (*x, int) {
 
 // ----------------------------------------------------------------- Enumerator
 
-// Close recycles e to a pool for possible later reuse. No references to e
-// should exist or such references must not be used afterwards.
-func (e *Enumerator) Close() {
-	*e = ze
-	btEPool.Put(e)
+// Close releases everything e holds. No references to e should exist or
+// such references must not be used afterwards.
+func (e *Enumerator[K, V]) Close() {
+	*e = Enumerator[K, V]{}
 }
 
 // Next returns the currently enumerated item, if it exists and moves to the
 // next item in the key collation order. If there is no item to return, err ==
 // io.EOF is returned.
-func (e *Enumerator) Next() (k types.TagValue, v bool, err error) {
+func (e *Enumerator[K, V]) Next() (k K, v V, err error) {
 	if err = e.err; err != nil {
 		return
 	}
@@ -834,7 +807,7 @@ func (e *Enumerator) Next() (k types.TagValue, v bool, err error) {
 	return
 }
 
-func (e *Enumerator) next() error {
+func (e *Enumerator[K, V]) next() error {
 	if e.q == nil {
 		e.err = io.EOF
 		return io.EOF
@@ -854,7 +827,7 @@ func (e *Enumerator) next() error {
 // Prev returns the currently enumerated item, if it exists and moves to the
 // previous item in the key collation order. If there is no item to return, err
 // == io.EOF is returned.
-func (e *Enumerator) Prev() (k types.TagValue, v bool, err error) {
+func (e *Enumerator[K, V]) Prev() (k K, v V, err error) {
 	if err = e.err; err != nil {
 		return
 	}
@@ -889,7 +862,7 @@ func (e *Enumerator) Prev() (k types.TagValue, v bool, err error) {
 	return
 }
 
-func (e *Enumerator) prev() error {
+func (e *Enumerator[K, V]) prev() error {
 	if e.q == nil {
 		e.err = io.EOF
 		return io.EOF
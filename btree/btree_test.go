@@ -0,0 +1,389 @@
+// Copyright 2014 The b Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package btree
+
+import (
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func cmpInt(a, b int) int {
+	return a - b
+}
+
+func newIntTree() *Tree[int, int] {
+	return TreeNew[int, int](cmpInt)
+}
+
+// enough items for several levels of index pages
+const n = 4 * (2*kx + 2) * (2 * kd)
+
+// drain returns keys returned by next until io.EOF
+func drain(t *testing.T, next func() (int, int, error)) []int {
+	t.Helper()
+	res := make([]int, 0)
+	for {
+		k, v, err := next()
+		if err == io.EOF {
+			return res
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != 10*k {
+			t.Fatalf("%d has value %d", k, v)
+		}
+		res = append(res, k)
+	}
+}
+
+func seq(from, to, step int) []int {
+	res := make([]int, 0)
+	if step > 0 {
+		for k := from; k < to; k += step {
+			res = append(res, k)
+		}
+	} else {
+		for k := from; k > to; k += step {
+			res = append(res, k)
+		}
+	}
+	return res
+}
+
+func TestSetGet0(t *testing.T) {
+	r := newIntTree()
+	if g, e := r.Len(), 0; g != e {
+		t.Fatal(g, e)
+	}
+
+	r.Set(42, 420)
+	if g, e := r.Len(), 1; g != e {
+		t.Fatal(g, e)
+	}
+
+	r.Set(42, 421)
+	if g, e := r.Len(), 1; g != e {
+		t.Fatal(g, e)
+	}
+
+	v, ok := r.Get(42)
+	if !ok || v != 421 {
+		t.Fatal(v, ok)
+	}
+	if _, ok := r.Get(43); ok {
+		t.Fatal("Get(43) found missing key")
+	}
+}
+
+func TestSetGet1(t *testing.T) {
+	for _, x := range []int{0, -1, 0x5555, 0x3333} {
+		r := newIntTree()
+		rng := rand.New(rand.NewSource(int64(x)))
+		a := rng.Perm(n)
+		for i, k := range a {
+			r.Set(k, 10*k)
+			if g, e := r.Len(), i+1; g != e {
+				t.Fatal(i, g, e)
+			}
+		}
+		for i, k := range a {
+			v, ok := r.Get(k)
+			if !ok || v != 10*k {
+				t.Fatal(i, k, v, ok)
+			}
+		}
+		if _, ok := r.Get(n); ok {
+			t.Fatal("Get found missing key")
+		}
+		if k, _ := r.First(); k != 0 {
+			t.Fatal(k)
+		}
+		if k, _ := r.Last(); k != n-1 {
+			t.Fatal(k)
+		}
+	}
+}
+
+func TestPut(t *testing.T) {
+	r := newIntTree()
+	for k := 0; k < n; k++ {
+		if _, written := r.Put(k, func(old int, exists bool) (int, bool) {
+			if exists {
+				t.Fatalf("%d exists", k)
+			}
+			return 10 * k, true
+		}); !written {
+			t.Fatal(k)
+		}
+	}
+	// updater decides not to write
+	old, written := r.Put(7, func(old int, exists bool) (int, bool) {
+		return 0, false
+	})
+	if written || old != 70 {
+		t.Fatal(old, written)
+	}
+	if _, written := r.Put(n, func(int, bool) (int, bool) { return 0, false }); written || r.Len() != n {
+		t.Fatal(written, r.Len())
+	}
+	old, written = r.Put(7, func(old int, exists bool) (int, bool) {
+		return old + 1, exists
+	})
+	if v, _ := r.Get(7); !written || old != 70 || v != 71 {
+		t.Fatal(old, written, v)
+	}
+}
+
+func TestDelete0(t *testing.T) {
+	r := newIntTree()
+	if ok := r.Delete(0); ok {
+		t.Fatal(ok)
+	}
+
+	r.Set(0, 0)
+	if ok := r.Delete(1); ok {
+		t.Fatal(ok)
+	}
+	if g, e := r.Len(), 1; g != e {
+		t.Fatal(g, e)
+	}
+	if ok := r.Delete(0); !ok {
+		t.Fatal(ok)
+	}
+	if g, e := r.Len(), 0; g != e {
+		t.Fatal(g, e)
+	}
+	if ok := r.Delete(0); ok {
+		t.Fatal(ok)
+	}
+}
+
+func TestDelete1(t *testing.T) {
+	for _, x := range []int{0, -1, 0x5555, 0x3333} {
+		r := newIntTree()
+		rng := rand.New(rand.NewSource(int64(x)))
+		a := rng.Perm(n)
+		for _, k := range a {
+			r.Set(k, 10*k)
+		}
+		// delete odd keys in random order, so pages underflow and
+		// get concatenated all over the tree
+		for _, k := range a {
+			if k%2 == 0 {
+				continue
+			}
+			if ok := r.Delete(k); !ok {
+				t.Fatal(k)
+			}
+			if ok := r.Delete(k); ok {
+				t.Fatal(k)
+			}
+		}
+		if g, e := r.Len(), n/2; g != e {
+			t.Fatal(g, e)
+		}
+		for k := 0; k < n; k++ {
+			if _, ok := r.Get(k); ok != (k%2 == 0) {
+				t.Fatal(k, ok)
+			}
+		}
+		e, err := r.SeekFirst()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g, w := drain(t, e.Next), seq(0, n, 2); !reflect.DeepEqual(g, w) {
+			t.Fatalf("tree has %d keys after delete, want %d", len(g), len(w))
+		}
+
+		for _, k := range a {
+			if k%2 == 0 {
+				r.Delete(k)
+			}
+		}
+		if g := r.Len(); g != 0 {
+			t.Fatal(g)
+		}
+		if _, err := r.SeekFirst(); err != io.EOF {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestClear(t *testing.T) {
+	r := newIntTree()
+	for k := 0; k < n; k++ {
+		r.Set(k, 10*k)
+	}
+	r.Clear()
+	if r.Len() != 0 {
+		t.Fatal(r.Len())
+	}
+	if _, ok := r.Get(0); ok {
+		t.Fatal("Get found key of cleared tree")
+	}
+	r.Set(1, 10)
+	if v, ok := r.Get(1); !ok || v != 10 {
+		t.Fatal(v, ok)
+	}
+}
+
+func TestEnumeratorNext(t *testing.T) {
+	// keys 10, 20, 30
+	tab := []struct {
+		k    int
+		hit  bool
+		keys []int
+	}{
+		{5, false, []int{10, 20, 30}},
+		{10, true, []int{10, 20, 30}},
+		{15, false, []int{20, 30}},
+		{20, true, []int{20, 30}},
+		{25, false, []int{30}},
+		{30, true, []int{30}},
+		{35, false, []int{}},
+	}
+
+	for i, test := range tab {
+		r := newIntTree()
+		r.Set(10, 100)
+		r.Set(20, 200)
+		r.Set(30, 300)
+
+		en, hit := r.Seek(test.k)
+		if g, e := hit, test.hit; g != e {
+			t.Fatal(i, g, e)
+		}
+		if g := drain(t, en.Next); !reflect.DeepEqual(g, test.keys) {
+			t.Fatal(i, g, test.keys)
+		}
+		// io.EOF is sticky
+		if _, _, err := en.Next(); err != io.EOF {
+			t.Fatal(i, err)
+		}
+	}
+}
+
+func TestEnumeratorPrev(t *testing.T) {
+	// keys 10, 20, 30
+	tab := []struct {
+		k    int
+		hit  bool
+		keys []int
+	}{
+		{5, false, []int{}},
+		{10, true, []int{10}},
+		{15, false, []int{10}},
+		{20, true, []int{20, 10}},
+		{25, false, []int{20, 10}},
+		{30, true, []int{30, 20, 10}},
+		{35, false, []int{30, 20, 10}},
+	}
+
+	for i, test := range tab {
+		r := newIntTree()
+		r.Set(10, 100)
+		r.Set(20, 200)
+		r.Set(30, 300)
+
+		en, hit := r.Seek(test.k)
+		if g, e := hit, test.hit; g != e {
+			t.Fatal(i, g, e)
+		}
+		if g := drain(t, en.Prev); !reflect.DeepEqual(g, test.keys) {
+			t.Fatal(i, g, test.keys)
+		}
+	}
+}
+
+func TestSeekFirstLast(t *testing.T) {
+	r := newIntTree()
+	if _, err := r.SeekFirst(); err != io.EOF {
+		t.Fatal(err)
+	}
+	if _, err := r.SeekLast(); err != io.EOF {
+		t.Fatal(err)
+	}
+	// Seek of empty tree returns enumerator at io.EOF
+	en, hit := r.Seek(0)
+	if _, _, err := en.Next(); hit || err != io.EOF {
+		t.Fatal(hit, err)
+	}
+
+	for _, k := range rand.New(rand.NewSource(42)).Perm(n) {
+		r.Set(k, 10*k)
+	}
+	en, err := r.SeekFirst()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, w := drain(t, en.Next), seq(0, n, 1); !reflect.DeepEqual(g, w) {
+		t.Fatal("SeekFirst didn't enumerate keys in order")
+	}
+	en, err = r.SeekLast()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, w := drain(t, en.Prev), seq(n-1, -1, -1); !reflect.DeepEqual(g, w) {
+		t.Fatal("SeekLast didn't enumerate keys in reverse order")
+	}
+}
+
+// TestEnumeratorResync checks that enumerator resumes at the last
+// returned key after the tree is mutated. The key is returned once more
+// if it still exists, callers skipping duplicates rely on that.
+func TestEnumeratorResync(t *testing.T) {
+	r := newIntTree()
+	for k := 0; k < n; k += 2 {
+		r.Set(k, 10*k)
+	}
+	en, hit := r.Seek(100)
+	if !hit {
+		t.Fatal(hit)
+	}
+	for _, e := range []int{100, 102} {
+		if k, _, err := en.Next(); err != nil || k != e {
+			t.Fatal(k, err, e)
+		}
+	}
+
+	// split pages ahead of the enumerator and delete some keys
+	for k := 105; k < n; k += 2 {
+		r.Set(k, 10*k)
+	}
+	r.Delete(106)
+	r.Delete(108)
+	for k := n / 2; k < n; k++ {
+		r.Delete(k)
+	}
+	want := []int{102, 104, 105, 107, 109}
+	want = append(want, seq(110, n/2, 1)...)
+	if got := drain(t, en.Next); !reflect.DeepEqual(got, want) {
+		t.Fatalf("enumerator returned %d keys starting with %v after mutation, want %d", len(got), got[:2], len(want))
+	}
+
+	// the next key is returned if the last returned one was deleted
+	en, _ = r.Seek(200)
+	if k, _, _ := en.Next(); k != 200 {
+		t.Fatal(k)
+	}
+	r.Delete(200)
+	if k, _, _ := en.Next(); k != 201 {
+		t.Fatalf("enumerator resumed at %d, want 201", k)
+	}
+
+	// backwards as well
+	en, _ = r.Seek(300)
+	if k, _, _ := en.Prev(); k != 300 {
+		t.Fatal(k)
+	}
+	r.Delete(300)
+	r.Delete(299)
+	if k, _, _ := en.Prev(); k != 298 {
+		t.Fatalf("enumerator resumed at %d, want 298", k)
+	}
+}
@@ -0,0 +1,335 @@
+// Package carbon implements Carbon ingestion listeners feeding the index.
+//
+// Plaintext protocol lines `name;tag=value value timestamp` are accepted
+// over TCP and UDP, pickle protocol (length-prefixed pickled list of
+// (name, (timestamp, value)) tuples) over TCP. Only series names are
+// extracted, datapoints themselves are dropped.
+//
+// Names received by all listeners are queued and inserted in batches by
+// background workers. Queue is bounded, so when the index can't keep up
+// listeners stop reading and clients are slowed down by TCP flow control.
+package carbon
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrServerClosed is returned by Serve methods after Close
+	ErrServerClosed = errors.New("carbon: server closed")
+)
+
+// Inserter is the part of index API used by Server. It is implemented by
+// every index type.
+type Inserter interface {
+	InsertMetricsBatch(metricsStr []string) error
+}
+
+// Options configures Server
+type Options struct {
+	// BatchSize is max number of names inserted at once, default is 1000
+	BatchSize int
+	// FlushInterval is max time name waits for its batch to fill up,
+	// default is 1s
+	FlushInterval time.Duration
+	// QueueSize is number of batches waiting for insertion, when they
+	// are all full listeners block. Default is 16.
+	QueueSize int
+	// Workers is number of goroutines inserting batches, default is 1
+	Workers int
+	// MaxErrorsPerConn makes TCP connection to be closed once it sent
+	// that many malformed lines or names rejected by the index. Zero
+	// means no limit.
+	MaxErrorsPerConn int
+	// MaxPickleSize is max size of a single pickle message, default
+	// is 1MiB. Connection sending larger message is closed.
+	MaxPickleSize int
+	// MaxLineSize is max length of plaintext line, default is 64KiB.
+	// TCP connection sending longer line is closed.
+	MaxLineSize int
+	// OnConnClose is called with counters of TCP connection when it
+	// is closed
+	OnConnClose func(addr net.Addr, stats ConnStats)
+}
+
+// ConnStats are counters of a single connection
+type ConnStats struct {
+	// Received is number of received names
+	Received uint64
+	// ParseErrors is number of malformed lines, pickle messages
+	// and items
+	ParseErrors uint64
+	// InsertErrors is number of names rejected by the index
+	InsertErrors uint64
+}
+
+// Stats are counters of Server
+type Stats struct {
+	ConnStats
+	// Connections is number of accepted TCP connections
+	Connections uint64
+	// Inserted is number of names successfully inserted, including
+	// the ones which were in the index already
+	Inserted uint64
+}
+
+// connState holds counters of connection, UDP socket has single one.
+// Insert errors are counted by workers, so counters are atomic.
+type connState struct {
+	received     uint64
+	parseErrors  uint64
+	insertErrors uint64
+
+	addr net.Addr
+}
+
+func (c *connState) stats() ConnStats {
+	return ConnStats{
+		Received:     atomic.LoadUint64(&c.received),
+		ParseErrors:  atomic.LoadUint64(&c.parseErrors),
+		InsertErrors: atomic.LoadUint64(&c.insertErrors),
+	}
+}
+
+func (c *connState) errors() uint64 {
+	return atomic.LoadUint64(&c.parseErrors) + atomic.LoadUint64(&c.insertErrors)
+}
+
+// item is name waiting for insertion
+type item struct {
+	name string
+	conn *connState
+}
+
+// Server accepts Carbon connections and inserts received names to index
+type Server struct {
+	stats Stats
+
+	index Inserter
+	opts  Options
+
+	items   chan item
+	batches chan []item
+	workers sync.WaitGroup
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[interface{ Close() error }]struct{}
+	conns     map[net.Conn]struct{}
+	serving   sync.WaitGroup
+}
+
+// New is *Server builder and initializer. It starts insertion workers,
+// listeners are started with Serve methods.
+func New(index Inserter, opts Options) *Server {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = time.Second
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 16
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+	if opts.MaxPickleSize <= 0 {
+		opts.MaxPickleSize = 1 << 20
+	}
+	if opts.MaxLineSize <= 0 {
+		opts.MaxLineSize = 64 << 10
+	}
+	s := &Server{
+		index:     index,
+		opts:      opts,
+		items:     make(chan item, opts.BatchSize),
+		batches:   make(chan []item, opts.QueueSize),
+		listeners: make(map[interface{ Close() error }]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+	go s.batchLoop()
+	for i := 0; i < opts.Workers; i++ {
+		s.workers.Add(1)
+		go s.insertLoop()
+	}
+	return s
+}
+
+// Stats returns counters of the server
+func (s *Server) Stats() Stats {
+	return Stats{
+		ConnStats: ConnStats{
+			Received:     atomic.LoadUint64(&s.stats.Received),
+			ParseErrors:  atomic.LoadUint64(&s.stats.ParseErrors),
+			InsertErrors: atomic.LoadUint64(&s.stats.InsertErrors),
+		},
+		Connections: atomic.LoadUint64(&s.stats.Connections),
+		Inserted:    atomic.LoadUint64(&s.stats.Inserted),
+	}
+}
+
+// track registers listener, so Close can close it
+func (s *Server) track(l interface{ Close() error }) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.listeners[l] = struct{}{}
+	s.serving.Add(1)
+	return true
+}
+
+func (s *Server) untrack(l interface{ Close() error }) {
+	s.mu.Lock()
+	delete(s.listeners, l)
+	s.mu.Unlock()
+	s.serving.Done()
+}
+
+// serveTCP accepts connections from l and serves each of them with
+// handle in its own goroutine
+func (s *Server) serveTCP(l net.Listener, handle func(conn net.Conn, c *connState)) error {
+	if !s.track(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.untrack(l)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.serving.Add(1)
+		s.mu.Unlock()
+		atomic.AddUint64(&s.stats.Connections, 1)
+
+		go func() {
+			defer s.serving.Done()
+			c := &connState{addr: conn.RemoteAddr()}
+			handle(conn, c)
+			conn.Close()
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+			if s.opts.OnConnClose != nil {
+				s.opts.OnConnClose(c.addr, c.stats())
+			}
+		}()
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// tooManyErrors returns true if connection has to be closed
+func (s *Server) tooManyErrors(c *connState) bool {
+	return s.opts.MaxErrorsPerConn > 0 && c.errors() >= uint64(s.opts.MaxErrorsPerConn)
+}
+
+func (s *Server) parseError(c *connState) {
+	atomic.AddUint64(&c.parseErrors, 1)
+	atomic.AddUint64(&s.stats.ParseErrors, 1)
+}
+
+// enqueue queues name for insertion, it blocks while queue is full
+func (s *Server) enqueue(c *connState, name string) {
+	atomic.AddUint64(&c.received, 1)
+	atomic.AddUint64(&s.stats.Received, 1)
+	s.items <- item{name: name, conn: c}
+}
+
+// batchLoop groups queued names into batches
+func (s *Server) batchLoop() {
+	defer close(s.batches)
+	ticker := time.NewTicker(s.opts.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]item, 0, s.opts.BatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			s.batches <- batch
+			batch = make([]item, 0, s.opts.BatchSize)
+		}
+	}
+	for {
+		select {
+		case it, ok := <-s.items:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, it)
+			if len(batch) >= s.opts.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// insertLoop inserts batches to the index. If batch is rejected its
+// names are inserted one by one to find out which of them are bad.
+func (s *Server) insertLoop() {
+	defer s.workers.Done()
+	names := make([]string, 0, s.opts.BatchSize)
+	for batch := range s.batches {
+		names = names[:0]
+		for _, it := range batch {
+			names = append(names, it.name)
+		}
+		if s.index.InsertMetricsBatch(names) == nil {
+			atomic.AddUint64(&s.stats.Inserted, uint64(len(names)))
+			continue
+		}
+		for i, it := range batch {
+			if s.index.InsertMetricsBatch(names[i:i+1]) == nil {
+				atomic.AddUint64(&s.stats.Inserted, 1)
+				continue
+			}
+			atomic.AddUint64(&it.conn.insertErrors, 1)
+			atomic.AddUint64(&s.stats.InsertErrors, 1)
+		}
+	}
+}
+
+// Close closes all listeners and connections, waits for names received
+// so far to be inserted and stops workers
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.serving.Wait()
+	close(s.items)
+	s.workers.Wait()
+	return nil
+}
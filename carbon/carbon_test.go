@@ -0,0 +1,123 @@
+package carbon
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errRejected = errors.New("rejected")
+
+// recordingIndex records inserted names and rejects batches containing
+// names with "bad" in them
+type recordingIndex struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (ri *recordingIndex) InsertMetricsBatch(metricsStr []string) error {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	for _, metricStr := range metricsStr {
+		if strings.Contains(metricStr, "bad") {
+			return errRejected
+		}
+	}
+	ri.names = append(ri.names, metricsStr...)
+	return nil
+}
+
+// sorted returns sorted inserted names
+func (ri *recordingIndex) sorted() []string {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	res := append([]string{}, ri.names...)
+	sort.Strings(res)
+	return res
+}
+
+// startServer starts server with listener of given kind and returns
+// address it listens on. Server is closed when the test ends.
+func startServer(t *testing.T, ri *recordingIndex, opts Options, kind string) (*Server, string) {
+	t.Helper()
+	if opts.FlushInterval == 0 {
+		opts.FlushInterval = time.Millisecond
+	}
+	s := New(ri, opts)
+	served := make(chan error, 1)
+	var addr string
+	switch kind {
+	case "udp":
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = conn.LocalAddr().String()
+		go func() { served <- s.ServeUDP(conn) }()
+	default:
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = l.Addr().String()
+		serve := s.ServePlaintext
+		if kind == "pickle" {
+			serve = s.ServePickle
+		}
+		go func() { served <- serve(l) }()
+	}
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-served; err != ErrServerClosed {
+			t.Errorf("Serve returned %v, want ErrServerClosed", err)
+		}
+	})
+	return s, addr
+}
+
+// waitStats polls server stats until cond is true
+func waitStats(t *testing.T, s *Server, cond func(st Stats) bool) Stats {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		st := s.Stats()
+		if cond(st) {
+			return st
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stats %+v aren't reached in time", st)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCloseFlushesQueue(t *testing.T) {
+	ri := &recordingIndex{}
+	// batch is never full and never flushed by timer
+	s := New(ri, Options{BatchSize: 1000, FlushInterval: time.Hour})
+	c := &connState{}
+	s.enqueue(c, "a")
+	s.enqueue(c, "b")
+	s.Close()
+	if got := ri.sorted(); len(got) != 2 {
+		t.Fatalf("inserted %q after Close, want a and b", got)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ServePlaintext(l); err != ErrServerClosed {
+		t.Fatalf("ServePlaintext after Close returned %v", err)
+	}
+	// listener is closed
+	if _, err := l.Accept(); err == nil {
+		t.Fatal("listener accepts connections after Close")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,504 @@
+package carbon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Pickle protocol message is 4-byte big endian length followed by
+// pickled list of (name, (timestamp, value)) tuples. Pickle is decoded by
+// a minimal stack machine which knows only opcodes producing lists,
+// tuples, strings and numbers (protocols 0-4), anything else, e.g. global
+// lookups or object construction, is rejected.
+
+var (
+	// ErrBadPickle represents situation when pickle message is malformed
+	// or uses unsupported opcodes
+	ErrBadPickle = errors.New("carbon: malformed pickle")
+)
+
+// pickleList is pickled list, it is a pointer, so lists stored in memo
+// see items appended later
+type pickleList struct {
+	items []interface{}
+}
+
+type unpickler struct {
+	data  []byte
+	pos   int
+	stack []interface{}
+	marks []int
+	memo  map[uint64]interface{}
+}
+
+func (u *unpickler) read(n int) ([]byte, error) {
+	if n < 0 || n > len(u.data)-u.pos {
+		return nil, ErrBadPickle
+	}
+	b := u.data[u.pos : u.pos+n]
+	u.pos += n
+	return b, nil
+}
+
+func (u *unpickler) readLine() (string, error) {
+	i := bytes.IndexByte(u.data[u.pos:], '\n')
+	if i < 0 {
+		return "", ErrBadPickle
+	}
+	line := string(u.data[u.pos : u.pos+i])
+	u.pos += i + 1
+	return line, nil
+}
+
+func (u *unpickler) readUint(size int) (uint64, error) {
+	b, err := u.read(size)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for i := size - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, nil
+}
+
+func (u *unpickler) push(v interface{}) {
+	u.stack = append(u.stack, v)
+}
+
+func (u *unpickler) pop() (interface{}, error) {
+	if len(u.stack) == 0 || (len(u.marks) > 0 && len(u.stack) == u.marks[len(u.marks)-1]) {
+		return nil, ErrBadPickle
+	}
+	v := u.stack[len(u.stack)-1]
+	u.stack = u.stack[:len(u.stack)-1]
+	return v, nil
+}
+
+func (u *unpickler) top() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, ErrBadPickle
+	}
+	return u.stack[len(u.stack)-1], nil
+}
+
+// popMark pops items pushed since the last MARK
+func (u *unpickler) popMark() ([]interface{}, error) {
+	if len(u.marks) == 0 {
+		return nil, ErrBadPickle
+	}
+	m := u.marks[len(u.marks)-1]
+	u.marks = u.marks[:len(u.marks)-1]
+	items := append([]interface{}(nil), u.stack[m:]...)
+	u.stack = u.stack[:m]
+	return items, nil
+}
+
+func (u *unpickler) popTuple(n int) error {
+	if len(u.stack) < n || (len(u.marks) > 0 && len(u.stack)-n < u.marks[len(u.marks)-1]) {
+		return ErrBadPickle
+	}
+	t := append([]interface{}(nil), u.stack[len(u.stack)-n:]...)
+	u.stack = u.stack[:len(u.stack)-n]
+	u.push(t)
+	return nil
+}
+
+func (u *unpickler) appendItems(items ...interface{}) error {
+	v, err := u.top()
+	if err != nil {
+		return err
+	}
+	l, ok := v.(*pickleList)
+	if !ok {
+		return ErrBadPickle
+	}
+	l.items = append(l.items, items...)
+	return nil
+}
+
+func (u *unpickler) put(key uint64) error {
+	v, err := u.top()
+	if err != nil {
+		return err
+	}
+	u.memo[key] = v
+	return nil
+}
+
+func (u *unpickler) get(key uint64) error {
+	v, ok := u.memo[key]
+	if !ok {
+		return ErrBadPickle
+	}
+	u.push(v)
+	return nil
+}
+
+func (u *unpickler) pushString(size int) error {
+	b, err := u.read(size)
+	if err != nil {
+		return err
+	}
+	u.push(string(b))
+	return nil
+}
+
+// unquote decodes Python repr of str used by STRING opcode
+func unquote(s string) (string, error) {
+	if len(s) < 2 || s[0] != s[len(s)-1] || (s[0] != '\'' && s[0] != '"') {
+		return "", ErrBadPickle
+	}
+	body := s[1 : len(s)-1]
+	if s[0] == '\'' {
+		body = strings.ReplaceAll(strings.ReplaceAll(body, `\'`, `'`), `"`, `\"`)
+	}
+	res, err := strconv.Unquote(`"` + body + `"`)
+	if err != nil {
+		return "", ErrBadPickle
+	}
+	return res, nil
+}
+
+// unescapeUnicode decodes raw-unicode-escape encoding used by UNICODE
+// opcode
+func unescapeUnicode(s string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(s); {
+		size := 0
+		if s[i] == '\\' && i+1 < len(s) {
+			switch s[i+1] {
+			case 'u':
+				size = 4
+			case 'U':
+				size = 8
+			}
+		}
+		if size == 0 {
+			// raw bytes are latin-1
+			sb.WriteRune(rune(s[i]))
+			i++
+			continue
+		}
+		if i+2+size > len(s) {
+			return "", ErrBadPickle
+		}
+		r, err := strconv.ParseUint(s[i+2:i+2+size], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(r)) {
+			return "", ErrBadPickle
+		}
+		sb.WriteRune(rune(r))
+		i += 2 + size
+	}
+	return sb.String(), nil
+}
+
+// unpickle decodes pickled value. Lists are returned as *pickleList,
+// tuples as []interface{}, strings and bytes as string, numbers as int64
+// or float64 (integers not fitting into int64 are nil).
+func unpickle(data []byte) (interface{}, error) {
+	u := &unpickler{
+		data: data,
+		memo: make(map[uint64]interface{}),
+	}
+	for {
+		op, err := u.read(1)
+		if err != nil {
+			return nil, err
+		}
+		switch op[0] {
+		case 0x80: // PROTO
+			_, err = u.read(1)
+		case 0x95: // FRAME
+			_, err = u.read(8)
+		case '.': // STOP
+			v, err := u.pop()
+			if err != nil || len(u.stack) != 0 {
+				return nil, ErrBadPickle
+			}
+			return v, nil
+
+		case '(': // MARK
+			u.marks = append(u.marks, len(u.stack))
+		case ']': // EMPTY_LIST
+			u.push(&pickleList{})
+		case 'l': // LIST
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				u.push(&pickleList{items: items})
+			}
+		case 'a': // APPEND
+			var v interface{}
+			if v, err = u.pop(); err == nil {
+				err = u.appendItems(v)
+			}
+		case 'e': // APPENDS
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				err = u.appendItems(items...)
+			}
+		case ')': // EMPTY_TUPLE
+			u.push([]interface{}{})
+		case 't': // TUPLE
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				u.push(items)
+			}
+		case 0x85, 0x86, 0x87: // TUPLE1, TUPLE2, TUPLE3
+			err = u.popTuple(int(op[0] - 0x84))
+
+		case 'S': // STRING
+			var line string
+			if line, err = u.readLine(); err == nil {
+				if line, err = unquote(line); err == nil {
+					u.push(line)
+				}
+			}
+		case 'V': // UNICODE
+			var line string
+			if line, err = u.readLine(); err == nil {
+				if line, err = unescapeUnicode(line); err == nil {
+					u.push(line)
+				}
+			}
+		case 'U', 'C', 0x8c: // SHORT_BINSTRING, SHORT_BINBYTES, SHORT_BINUNICODE
+			var size uint64
+			if size, err = u.readUint(1); err == nil {
+				err = u.pushString(int(size))
+			}
+		case 'T', 'B', 'X': // BINSTRING, BINBYTES, BINUNICODE
+			var size uint64
+			if size, err = u.readUint(4); err == nil {
+				err = u.pushString(int(size))
+			}
+		case 0x8d, 0x8e: // BINUNICODE8, BINBYTES8
+			var size uint64
+			if size, err = u.readUint(8); err == nil {
+				if size > uint64(len(u.data)) {
+					return nil, ErrBadPickle
+				}
+				err = u.pushString(int(size))
+			}
+
+		case 'N': // NONE
+			u.push(nil)
+		case 0x88: // NEWTRUE
+			u.push(true)
+		case 0x89: // NEWFALSE
+			u.push(false)
+		case 'I': // INT
+			var line string
+			if line, err = u.readLine(); err == nil {
+				switch line {
+				case "01":
+					u.push(true)
+				case "00":
+					u.push(false)
+				default:
+					var v int64
+					if v, err = strconv.ParseInt(line, 10, 64); err == nil {
+						u.push(v)
+					}
+				}
+			}
+		case 'L': // LONG
+			var line string
+			if line, err = u.readLine(); err == nil {
+				var v int64
+				if v, err = strconv.ParseInt(strings.TrimSuffix(line, "L"), 10, 64); err == nil {
+					u.push(v)
+				} else if errors.Is(err, strconv.ErrRange) {
+					u.push(nil)
+					err = nil
+				}
+			}
+		case 'J': // BININT
+			var v uint64
+			if v, err = u.readUint(4); err == nil {
+				u.push(int64(int32(v)))
+			}
+		case 'K': // BININT1
+			var v uint64
+			if v, err = u.readUint(1); err == nil {
+				u.push(int64(v))
+			}
+		case 'M': // BININT2
+			var v uint64
+			if v, err = u.readUint(2); err == nil {
+				u.push(int64(v))
+			}
+		case 0x8a, 0x8b: // LONG1, LONG4
+			var size uint64
+			if op[0] == 0x8a {
+				size, err = u.readUint(1)
+			} else {
+				size, err = u.readUint(4)
+			}
+			if err != nil {
+				break
+			}
+			if size > 8 {
+				_, err = u.read(int(size))
+				u.push(nil)
+				break
+			}
+			var v uint64
+			if v, err = u.readUint(int(size)); err == nil {
+				// sign extend two's complement
+				if size > 0 && size < 8 && v&(1<<(8*size-1)) != 0 {
+					v |= ^uint64(0) << (8 * size)
+				}
+				u.push(int64(v))
+			}
+		case 'F': // FLOAT
+			var line string
+			if line, err = u.readLine(); err == nil {
+				var v float64
+				if v, err = strconv.ParseFloat(line, 64); err == nil {
+					u.push(v)
+				}
+			}
+		case 'G': // BINFLOAT
+			var b []byte
+			if b, err = u.read(8); err == nil {
+				u.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+			}
+
+		case 'p', 'g': // PUT, GET
+			var line string
+			if line, err = u.readLine(); err == nil {
+				var key uint64
+				if key, err = strconv.ParseUint(line, 10, 64); err == nil {
+					if op[0] == 'p' {
+						err = u.put(key)
+					} else {
+						err = u.get(key)
+					}
+				}
+			}
+		case 'q', 'h': // BINPUT, BINGET
+			var key uint64
+			if key, err = u.readUint(1); err == nil {
+				if op[0] == 'q' {
+					err = u.put(key)
+				} else {
+					err = u.get(key)
+				}
+			}
+		case 'r', 'j': // LONG_BINPUT, LONG_BINGET
+			var key uint64
+			if key, err = u.readUint(4); err == nil {
+				if op[0] == 'r' {
+					err = u.put(key)
+				} else {
+					err = u.get(key)
+				}
+			}
+		case 0x94: // MEMOIZE
+			err = u.put(uint64(len(u.memo)))
+
+		default:
+			return nil, ErrBadPickle
+		}
+		if err != nil {
+			return nil, ErrBadPickle
+		}
+	}
+}
+
+// sequence returns items of pickled list or tuple
+func sequence(v interface{}) ([]interface{}, bool) {
+	switch v := v.(type) {
+	case *pickleList:
+		return v.items, true
+	case []interface{}:
+		return v, true
+	}
+	return nil, false
+}
+
+// pickleNames returns series names of unpickled message and number of
+// malformed datapoints in it
+func pickleNames(v interface{}) (names []string, bad int, err error) {
+	datapoints, ok := sequence(v)
+	if !ok {
+		return nil, 0, ErrBadPickle
+	}
+	names = make([]string, 0, len(datapoints))
+	for _, datapoint := range datapoints {
+		pair, ok := sequence(datapoint)
+		if !ok || len(pair) != 2 {
+			bad++
+			continue
+		}
+		name, ok := pair[0].(string)
+		if !ok || name == "" {
+			bad++
+			continue
+		}
+		if point, ok := sequence(pair[1]); !ok || len(point) != 2 {
+			bad++
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, bad, nil
+}
+
+// ServePickle accepts connections from l and reads pickle messages from
+// them. It blocks until l fails or Close is called, then ErrServerClosed
+// is returned.
+func (s *Server) ServePickle(l net.Listener) error {
+	return s.serveTCP(l, s.handlePickleConn)
+}
+
+func (s *Server) handlePickleConn(conn net.Conn, c *connState) {
+	r := bufio.NewReader(conn)
+	header := make([]byte, 4)
+	buf := make([]byte, 0)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return
+		}
+		size := binary.BigEndian.Uint32(header)
+		if size > uint32(s.opts.MaxPickleSize) {
+			// can't skip it without reading, so give up on connection
+			s.parseError(c)
+			return
+		}
+		if cap(buf) < int(size) {
+			buf = make([]byte, size)
+		}
+		buf = buf[:size]
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return
+		}
+
+		v, err := unpickle(buf)
+		if err != nil {
+			s.parseError(c)
+		} else {
+			names, bad, err := pickleNames(v)
+			if err != nil {
+				bad = 1
+			}
+			for i := 0; i < bad; i++ {
+				s.parseError(c)
+			}
+			for _, name := range names {
+				s.enqueue(c, name)
+			}
+		}
+		if s.tooManyErrors(c) {
+			return
+		}
+	}
+}
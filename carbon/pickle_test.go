@@ -0,0 +1,205 @@
+package carbon
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// testPickles are messages of [("cpu;dc=ams", (1600000000, 1.5)),
+// ("mem", (1600000000, 2))] pickled by Python with different protocols
+var testPickles = map[string]string{
+	"protocol 0":          "(lp0\n(Vcpu;dc=ams\np1\n(I1600000000\nF1.5\ntp2\ntp3\na(Vmem\np4\n(I1600000000\nI2\ntp5\ntp6\na.",
+	"protocol 0 python 2": "(lp0\n(S'cpu;dc=ams'\np1\n(L1600000000L\nF1.5\ntp2\ntp3\na(S\"mem\"\np4\n(I1600000000\nI2\ntp5\ntp6\na.",
+	"protocol 1":          "]q\x00((X\n\x00\x00\x00cpu;dc=amsq\x01(J\x00\x10^_G?\xf8\x00\x00\x00\x00\x00\x00tq\x02tq\x03(X\x03\x00\x00\x00memq\x04(J\x00\x10^_K\x02tq\x05tq\x06e.",
+	"protocol 2":          "\x80\x02]q\x00(X\n\x00\x00\x00cpu;dc=amsq\x01J\x00\x10^_G?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x03\x00\x00\x00memq\x04J\x00\x10^_K\x02\x86q\x05\x86q\x06e.",
+	"protocol 4":          "\x80\x04\x955\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\ncpu;dc=ams\x94J\x00\x10^_G?\xf8\x00\x00\x00\x00\x00\x00\x86\x94\x86\x94\x8c\x03mem\x94J\x00\x10^_K\x02\x86\x94\x86\x94e.",
+}
+
+func TestUnpickle(t *testing.T) {
+	want := []string{"cpu;dc=ams", "mem"}
+	for name, data := range testPickles {
+		v, err := unpickle([]byte(data))
+		if err != nil {
+			t.Errorf("%s: unpickle returned %v", name, err)
+			continue
+		}
+		names, bad, err := pickleNames(v)
+		if err != nil || bad != 0 || !reflect.DeepEqual(names, want) {
+			t.Errorf("%s: pickleNames = %q, %d, %v, want %q", name, names, bad, err, want)
+		}
+	}
+}
+
+func TestUnpickleValues(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want interface{}
+	}{
+		{"unicode escapes", "Vz\xfcrich;a=\\u20ac\\U0001F600\n.", "zürich;a=€😀"},
+		{"string escapes", "S'it\\'s \"q\"\\n\\x41'\n.", "it's \"q\"\nA"},
+		{"binunicode", "\x80\x02X\r\x00\x00\x00z\xc3\xbcrich;a=\xe2\x82\xac.", "zürich;a=€"},
+		{"binbytes8", "\x8e\x02\x00\x00\x00\x00\x00\x00\x00ab.", "ab"},
+		{"negative binint", "J\xff\xff\xff\xff.", int64(-1)},
+		{"long1", "\x8a\x02\xff\x7f.", int64(32767)},
+		{"negative long1", "\x8a\x01\xff.", int64(-1)},
+		{"huge long1", "\x8a\x09\x00\x00\x00\x00\x00\x00\x00\x00\x01.", nil},
+		{"huge long", "L123456789012345678901234567890L\n.", nil},
+		{"bools", "\x88\x89I01\n\x87.", []interface{}{true, false, true}},
+		{"int bools", "I01\nI00\n\x86.", []interface{}{true, false}},
+		{"none in tuple", "N\x85.", []interface{}{nil}},
+		{"empty tuple", ").", []interface{}{}},
+		{"memo", "]q\x00h\x00\x86.", []interface{}{&pickleList{}, &pickleList{}}},
+		{"memoize", "\x80\x04K\x01\x94\x94h\x01\x86.", []interface{}{int64(1), int64(1)}},
+		{"long binget", "K\x07r\x05\x00\x00\x00j\x05\x00\x00\x00\x86.", []interface{}{int64(7), int64(7)}},
+		{"float", "F-0.25\n.", -0.25},
+	}
+	for _, tt := range tests {
+		got, err := unpickle([]byte(tt.data))
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: unpickle = %#v, %v, want %#v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestUnpickleErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"empty", ""},
+		{"no stop", "]"},
+		{"empty stack", "."},
+		{"extra items", "K\x01K\x02."},
+		{"global", "cos\nsystem\n."},
+		{"reduce", "]R."},
+		{"unknown opcode", "\xff."},
+		{"append to tuple", ")K\x01a."},
+		{"append without list", "K\x01a."},
+		{"tuple without mark", "K\x01t."},
+		{"tuple2 on short stack", "K\x01\x86."},
+		{"truncated binunicode", "X\x05\x00\x00\x00ab."},
+		{"huge binunicode8", "\x8d\xff\xff\xff\xff\xff\xff\xff\xff."},
+		{"unterminated string", "S'abc"},
+		{"bad quotes", "S'abc\"\n."},
+		{"bad escape", "S'\\q'\n."},
+		{"bad unicode escape", "V\\u12\n."},
+		{"surrogate", "V\\ud800\n."},
+		{"bad int", "Iabc\n."},
+		{"unknown memo", "h\x05."},
+		{"put on empty stack", "q\x00."},
+		{"truncated binfloat", "G\x00\x00."},
+	}
+	for _, tt := range tests {
+		if v, err := unpickle([]byte(tt.data)); err != ErrBadPickle {
+			t.Errorf("%s: unpickle = %#v, %v, want ErrBadPickle", tt.name, v, err)
+		}
+	}
+}
+
+func TestPickleNames(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		names []string
+		bad   int
+	}{
+		{"empty list", "].", []string{}, 0},
+		{"tuple of datapoints", "X\x01\x00\x00\x00aK\x01K\x02\x86\x86\x85.", []string{"a"}, 0},
+		{"not a pair", "](K\x01X\x01\x00\x00\x00a\x85e.", []string{}, 2},
+		{"name is not string", "](K\x01K\x01K\x02\x86\x86e.", []string{}, 1},
+		{"empty name", "](X\x00\x00\x00\x00K\x01K\x02\x86\x86e.", []string{}, 1},
+		{"point is not pair", "](X\x01\x00\x00\x00aK\x01\x86X\x01\x00\x00\x00bK\x01\x85\x86X\x01\x00\x00\x00cK\x01K\x02\x86\x86e.", []string{"c"}, 2},
+	}
+	for _, tt := range tests {
+		v, err := unpickle([]byte(tt.data))
+		if err != nil {
+			t.Errorf("%s: unpickle returned %v", tt.name, err)
+			continue
+		}
+		names, bad, err := pickleNames(v)
+		if err != nil || bad != tt.bad || !reflect.DeepEqual(names, tt.names) {
+			t.Errorf("%s: pickleNames = %q, %d, %v, want %q, %d", tt.name, names, bad, err, tt.names, tt.bad)
+		}
+	}
+
+	// message which isn't a sequence is bad as a whole
+	if _, _, err := pickleNames(int64(1)); err != ErrBadPickle {
+		t.Errorf("pickleNames(1) returned %v, want ErrBadPickle", err)
+	}
+}
+
+// pickleMessage prefixes pickle with its length
+func pickleMessage(data string) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(data))), data...)
+}
+
+func FuzzPickle(f *testing.F) {
+	for _, data := range testPickles {
+		f.Add([]byte(data))
+	}
+	f.Add([]byte("\x80\x02]q\x00(X\x01\x00\x00\x00aq\x01K\x01K\x01\x86q\x02\x86q\x03h\x03e."))
+	f.Add([]byte("\x8a\x09\x00\x00\x00\x00\x00\x00\x00\x00\x01."))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		v, err := unpickle(data)
+		if err != nil {
+			if err != ErrBadPickle {
+				t.Fatalf("unpickle returned %v, want ErrBadPickle", err)
+			}
+			return
+		}
+		names, _, err := pickleNames(v)
+		if err != nil {
+			return
+		}
+		for _, name := range names {
+			if name == "" {
+				t.Fatal("empty name is returned")
+			}
+		}
+	})
+}
+
+func TestServePickle(t *testing.T) {
+	ri := &recordingIndex{}
+	s, addr := startServer(t, ri, Options{MaxPickleSize: 1024}, "pickle")
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	messages := [][]byte{
+		pickleMessage(testPickles["protocol 2"]),
+		pickleMessage("cos\nsystem\n."),
+		pickleMessage("](K\x01K\x01K\x02\x86\x86X\x08\x00\x00\x00bad.nameK\x01K\x02\x86\x86X\x04\x00\x00\x00diskK\x01K\x02\x86\x86e."),
+		pickleMessage(testPickles["protocol 0"]),
+	}
+	for _, msg := range messages {
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st := waitStats(t, s, func(st Stats) bool { return st.Inserted+st.InsertErrors == 6 })
+	want := Stats{
+		ConnStats:   ConnStats{Received: 6, ParseErrors: 2, InsertErrors: 1},
+		Connections: 1,
+		Inserted:    5,
+	}
+	if st != want {
+		t.Fatalf("stats are %+v, want %+v", st, want)
+	}
+	if got, want := ri.sorted(), []string{"cpu;dc=ams", "cpu;dc=ams", "disk", "mem", "mem"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("inserted %q, want %q", got, want)
+	}
+
+	// too large message closes connection
+	if _, err := conn.Write(binary.BigEndian.AppendUint32(nil, 1025)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection is still open")
+	}
+	waitStats(t, s, func(st Stats) bool { return st.ParseErrors == 3 })
+}
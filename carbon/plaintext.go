@@ -0,0 +1,97 @@
+package carbon
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strconv"
+)
+
+// maxDatagramSize is the largest UDP payload
+const maxDatagramSize = 64 << 10
+
+// parsePlaintextLine returns series name of `name value timestamp` line
+// with trailing newline trimmed. ok is false if line is malformed.
+func parsePlaintextLine(line []byte) (name string, ok bool) {
+	fields := bytes.Fields(line)
+	if len(fields) != 3 {
+		return "", false
+	}
+	if _, err := strconv.ParseFloat(string(fields[1]), 64); err != nil {
+		return "", false
+	}
+	if _, err := strconv.ParseFloat(string(fields[2]), 64); err != nil {
+		return "", false
+	}
+	return string(fields[0]), true
+}
+
+// handleLine queues name of plaintext line, empty lines are skipped
+func (s *Server) handleLine(c *connState, line []byte) {
+	if len(bytes.TrimSpace(line)) == 0 {
+		return
+	}
+	name, ok := parsePlaintextLine(line)
+	if !ok {
+		s.parseError(c)
+		return
+	}
+	s.enqueue(c, name)
+}
+
+// ServePlaintext accepts connections from l and reads plaintext lines
+// from them. It blocks until l fails or Close is called, then
+// ErrServerClosed is returned.
+func (s *Server) ServePlaintext(l net.Listener) error {
+	return s.serveTCP(l, s.handlePlaintextConn)
+}
+
+func (s *Server) handlePlaintextConn(conn net.Conn, c *connState) {
+	scanner := bufio.NewScanner(conn)
+	// scanner allows tokens up to buffer capacity if it's larger than max
+	size := 4096
+	if s.opts.MaxLineSize < size {
+		size = s.opts.MaxLineSize
+	}
+	scanner.Buffer(make([]byte, 0, size), s.opts.MaxLineSize)
+	for scanner.Scan() {
+		s.handleLine(c, scanner.Bytes())
+		if s.tooManyErrors(c) {
+			return
+		}
+	}
+	if scanner.Err() == bufio.ErrTooLong {
+		s.parseError(c)
+	}
+}
+
+// ServeUDP reads datagrams of plaintext lines from conn. Line can't span
+// several datagrams. It blocks until conn fails or Close is called, then
+// ErrServerClosed is returned.
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	if !s.track(conn) {
+		conn.Close()
+		return ErrServerClosed
+	}
+	defer s.untrack(conn)
+	c := &connState{addr: conn.LocalAddr()}
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		for data := buf[:n]; len(data) > 0; {
+			line := data
+			if i := bytes.IndexByte(data, '\n'); i >= 0 {
+				line, data = data[:i], data[i+1:]
+			} else {
+				data = nil
+			}
+			s.handleLine(c, line)
+		}
+	}
+}
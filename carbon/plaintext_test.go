@@ -0,0 +1,144 @@
+package carbon
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParsePlaintextLine(t *testing.T) {
+	tests := []struct {
+		line string
+		name string
+		ok   bool
+	}{
+		{"cpu;dc=ams 1.5 1600000000", "cpu;dc=ams", true},
+		{"cpu 1 1600000000\r", "cpu", true},
+		{"  cpu\t-1e3   1600000000.5 ", "cpu", true},
+		{"cpu nan 1600000000", "cpu", true},
+		{"cpu 1", "", false},
+		{"cpu", "", false},
+		{"cpu 1 1600000000 extra", "", false},
+		{"cpu x 1600000000", "", false},
+		{"cpu 1 now", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		name, ok := parsePlaintextLine([]byte(tt.line))
+		if name != tt.name || ok != tt.ok {
+			t.Errorf("parsePlaintextLine(%q) = %q, %v, want %q, %v", tt.line, name, ok, tt.name, tt.ok)
+		}
+	}
+}
+
+func TestServePlaintext(t *testing.T) {
+	ri := &recordingIndex{}
+	s, addr := startServer(t, ri, Options{BatchSize: 2}, "tcp")
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{
+		"cpu;dc=ams 1 1600000000",
+		"",
+		"malformed",
+		"mem 2 1600000000",
+		"bad.name 3 1600000000",
+		"disk;dc=fra 4 1600000000",
+		"cpu;dc=ams 5 1600000060",
+	}
+	// the last line has no newline and is read at EOF
+	if _, err := conn.Write([]byte(strings.Join(lines, "\n"))); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	st := waitStats(t, s, func(st Stats) bool { return st.Inserted+st.InsertErrors == 5 })
+	want := Stats{
+		ConnStats:   ConnStats{Received: 5, ParseErrors: 1, InsertErrors: 1},
+		Connections: 1,
+		Inserted:    4,
+	}
+	if st != want {
+		t.Fatalf("stats are %+v, want %+v", st, want)
+	}
+	if got, want := ri.sorted(), []string{"cpu;dc=ams", "cpu;dc=ams", "disk;dc=fra", "mem"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("inserted %q, want %q", got, want)
+	}
+}
+
+func TestServePlaintextErrorLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  Options
+		input string
+		stats ConnStats
+	}{
+		{
+			name:  "too many errors",
+			opts:  Options{MaxErrorsPerConn: 2},
+			input: "x\ny\nlost 1 1\n",
+			stats: ConnStats{ParseErrors: 2},
+		},
+		{
+			name:  "too long line",
+			opts:  Options{MaxLineSize: 16},
+			input: "ok 1 1\n" + strings.Repeat("a", 100) + " 1 1\nlost 1 1\n",
+			stats: ConnStats{Received: 1, ParseErrors: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			closed := make(chan ConnStats, 1)
+			tt.opts.OnConnClose = func(addr net.Addr, stats ConnStats) {
+				mu.Lock()
+				defer mu.Unlock()
+				closed <- stats
+			}
+			_, addr := startServer(t, &recordingIndex{}, tt.opts, "tcp")
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte(tt.input))
+			// server closes connection without waiting for client
+			if stats := <-closed; stats != tt.stats {
+				t.Fatalf("connection stats are %+v, want %+v", stats, tt.stats)
+			}
+			buf := make([]byte, 1)
+			if _, err := conn.Read(buf); err == nil {
+				t.Fatal("connection is still open")
+			}
+		})
+	}
+}
+
+func TestServeUDP(t *testing.T) {
+	ri := &recordingIndex{}
+	s, addr := startServer(t, ri, Options{}, "udp")
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	datagrams := []string{
+		"cpu 1 1600000000\nmem 2 1600000000\n",
+		"malformed\n\ndisk 3 1600000000",
+	}
+	for _, datagram := range datagrams {
+		if _, err := conn.Write([]byte(datagram)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st := waitStats(t, s, func(st Stats) bool { return st.Inserted == 3 })
+	if st.ParseErrors != 1 || st.Connections != 0 {
+		t.Fatalf("stats are %+v", st)
+	}
+	if got, want := ri.sorted(), []string{"cpu", "disk", "mem"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("inserted %q, want %q", got, want)
+	}
+}
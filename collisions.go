@@ -0,0 +1,262 @@
+package metricsindex
+
+import (
+	"github.com/OneOfOne/xxhash"
+	"github.com/spuzirev/metricsindex/types"
+)
+
+// IDs used as keys of the trees are 64-bit hashes, so two different keys
+// may get the same ID. To keep them apart every assigned ID is remembered
+// together with the key it belongs to. Key whose hash is already taken by
+// another key gets the next free ID (collision chain) and is recorded in
+// overrides, so later lookups by that key find it without probing.
+// Overrides are consulted only if the hash is the one some key in
+// overrides has, so lookups of keys which never collided don't touch them.
+
+// metricHash hashes types.Metric.HashKey() to MetricID. It is the same as
+// types.Metric.ID() and is a variable only so tests can make metrics
+// collide.
+var metricHash = xxhash.Checksum64
+
+// hashMetric returns MetricID metric has unless it collided
+func hashMetric(metric *types.Metric) types.MetricID {
+	return types.MetricID(metricHash(metric.HashKey()))
+}
+
+// idRegistry detects and resolves hash collisions in one ID space.
+// Keys are TagNames, MetricNames and TagNameValues made of interned
+// strings (see intern.go), so registry doesn't keep its own copies of them.
+type idRegistry[K comparable] struct {
+	keys      map[uint64]K
+	overrides map[K]uint64
+	// collided counts overrides by hash of their keys
+	collided map[uint64]int
+}
+
+func newIDRegistry[K comparable]() *idRegistry[K] {
+	return &idRegistry[K]{
+		keys:      make(map[uint64]K),
+		overrides: make(map[K]uint64),
+		collided:  make(map[uint64]int),
+	}
+}
+
+// lookup returns ID assigned to key with given hash
+func (r *idRegistry[K]) lookup(key K, hash uint64) (uint64, bool) {
+	if k, ok := r.keys[hash]; ok && k == key {
+		return hash, true
+	}
+	if r.collided[hash] > 0 {
+		if id, ok := r.overrides[key]; ok {
+			return id, true
+		}
+	}
+	return hash, false
+}
+
+// assign returns ID assigned to key assigning a new one if key is not
+// known yet. collided reports that key's hash was taken by another key.
+func (r *idRegistry[K]) assign(key K, hash uint64) (id uint64, collided bool) {
+	if id, ok := r.lookup(key, hash); ok {
+		return id, false
+	}
+	id = hash
+	for {
+		if _, taken := r.keys[id]; !taken {
+			break
+		}
+		collided = true
+		id++
+	}
+	r.keys[id] = key
+	if collided {
+		r.overrides[key] = id
+		r.collided[hash]++
+	}
+	return id, collided
+}
+
+// release frees ID assigned to key with given hash
+func (r *idRegistry[K]) release(key K, hash, id uint64) {
+	delete(r.keys, id)
+	if id != hash {
+		delete(r.overrides, key)
+		if r.collided[hash]--; r.collided[hash] == 0 {
+			delete(r.collided, hash)
+		}
+	}
+}
+
+// sameMetric returns true if a and b are the same metric
+func sameMetric(a, b *types.Metric) bool {
+	if a.Name != b.Name || len(a.Tags) != len(b.Tags) {
+		return false
+	}
+	for tagName, tagValue := range a.Tags {
+		if v, ok := b.Tags[tagName]; !ok || v != tagValue {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupMetricID returns MetricID of metric in the index or its hash if
+// it is not there.
+// Metrics are compared with the ones stored in MetricIDToMetric, so no
+// extra copy of them is kept.
+// Caller must hold read lock.
+func (mi *MetricsIndex) lookupMetricID(metric *types.Metric) (types.MetricID, bool) {
+	hash := hashMetric(metric)
+	if stored, ok := mi.MetricIDToMetric.Get(hash); ok && sameMetric(&stored, metric) {
+		return hash, true
+	}
+	if mi.collidedHashes[hash] == 0 {
+		return hash, false
+	}
+	return mi.lookupMetricIDOverride(metric.SerializeToByteSlice(), hash)
+}
+
+// lookupMetricIDOverride returns MetricID of metric with serialized
+// representation b and given hash if it was moved by collision.
+// Overrides are keyed by serialized metric, which is unambiguous unlike
+// HashKey.
+// Caller must hold read lock.
+func (mi *MetricsIndex) lookupMetricIDOverride(b []byte, hash types.MetricID) (types.MetricID, bool) {
+	if mi.collidedHashes[hash] > 0 {
+		if metricID, ok := mi.metricIDOverrides[string(b)]; ok {
+			return metricID, true
+		}
+	}
+	return hash, false
+}
+
+// addMetricIDOverride records that metric with given hash is moved by
+// collision to metricID
+// Caller must hold write lock.
+func (mi *MetricsIndex) addMetricIDOverride(metric *types.Metric, hash, metricID types.MetricID) {
+	mi.metricIDOverrides[metric.Serialize()] = metricID
+	mi.collidedHashes[hash]++
+	mi.collisions++
+}
+
+// assignMetricID returns MetricID for metric and reports if metric is
+// already in the index.
+// Colliding metric is moved by metricIDStep, so ShardedMetricsIndex can
+// still route it by MetricID. The step is a power of two, so wrapping
+// around 2^64 doesn't change the shard either.
+// Caller must hold write lock.
+func (mi *MetricsIndex) assignMetricID(metric *types.Metric) (types.MetricID, bool) {
+	hash, ok := mi.lookupMetricID(metric)
+	if ok {
+		return hash, true
+	}
+	metricID := hash
+	collided := false
+	for mi.metricExists(metricID) {
+		collided = true
+		metricID += types.MetricID(mi.metricIDStep)
+	}
+	if collided {
+		mi.addMetricIDOverride(metric, hash, metricID)
+	}
+	return metricID, false
+}
+
+// restoreMetricID is assignMetricID for metric loaded from snapshot.
+// delta is the difference between MetricID metric had and its hash, so
+// metric moved by collision keeps its MetricID even if the other party
+// of the collision is gone, unless the ID is taken by another metric.
+// Caller must hold write lock.
+func (mi *MetricsIndex) restoreMetricID(metric *types.Metric, delta uint64) (types.MetricID, bool) {
+	hash, ok := mi.lookupMetricID(metric)
+	if ok {
+		return hash, true
+	}
+	metricID := hash + types.MetricID(delta)
+	if mi.metricExists(metricID) {
+		return mi.assignMetricID(metric)
+	}
+	if delta != 0 {
+		mi.addMetricIDOverride(metric, hash, metricID)
+	}
+	return metricID, false
+}
+
+// releaseMetricID forgets collision chain entry of deleted metric
+// Caller must hold write lock.
+func (mi *MetricsIndex) releaseMetricID(metric *types.Metric) {
+	if len(mi.metricIDOverrides) == 0 {
+		return
+	}
+	key := metric.Serialize()
+	if _, ok := mi.metricIDOverrides[key]; !ok {
+		return
+	}
+	delete(mi.metricIDOverrides, key)
+	hash := hashMetric(metric)
+	if mi.collidedHashes[hash]--; mi.collidedHashes[hash] == 0 {
+		delete(mi.collidedHashes, hash)
+	}
+}
+
+// tagNameID returns TagNameID of tagName in the index
+// Caller must hold read lock.
+func (mi *MetricsIndex) tagNameID(tagName types.TagName) (types.TagNameID, bool) {
+	id, ok := mi.tagNameIDs.lookup(tagName, uint64(tagName.ID()))
+	return types.TagNameID(id), ok
+}
+
+// assignTagNameID returns TagNameID of tagName, assigning a new one
+// if necessary
+// Caller must hold write lock.
+func (mi *MetricsIndex) assignTagNameID(tagName types.TagName) types.TagNameID {
+	id, collided := mi.tagNameIDs.assign(tagName, uint64(tagName.ID()))
+	if collided {
+		mi.collisions++
+	}
+	return types.TagNameID(id)
+}
+
+// tagNameValueID returns TagNameValueID of tnv in the index
+// Caller must hold read lock.
+func (mi *MetricsIndex) tagNameValueID(tnv types.TagNameValue) (types.TagNameValueID, bool) {
+	id, ok := mi.tagNameValueIDs.lookup(tnv, uint64(tnv.ID()))
+	return types.TagNameValueID(id), ok
+}
+
+// assignTagNameValueID returns TagNameValueID of tnv, assigning a new one
+// if necessary
+// Caller must hold write lock.
+func (mi *MetricsIndex) assignTagNameValueID(tnv types.TagNameValue) types.TagNameValueID {
+	id, collided := mi.tagNameValueIDs.assign(tnv, uint64(tnv.ID()))
+	if collided {
+		mi.collisions++
+	}
+	return types.TagNameValueID(id)
+}
+
+// metricNameID returns MetricNameID of metricName in the index
+// Caller must hold read lock.
+func (mi *MetricsIndex) metricNameID(metricName types.MetricName) (types.MetricNameID, bool) {
+	id, ok := mi.metricNameIDs.lookup(metricName, uint64(metricName.ID()))
+	return types.MetricNameID(id), ok
+}
+
+// assignMetricNameID returns MetricNameID of metricName, assigning a new
+// one if necessary
+// Caller must hold write lock.
+func (mi *MetricsIndex) assignMetricNameID(metricName types.MetricName) types.MetricNameID {
+	id, collided := mi.metricNameIDs.assign(metricName, uint64(metricName.ID()))
+	if collided {
+		mi.collisions++
+	}
+	return types.MetricNameID(id)
+}
+
+// Collisions returns number of hash collisions of MetricIDs, TagNameIDs,
+// TagNameValueIDs and MetricNameIDs detected and resolved so far
+func (mi *MetricsIndex) Collisions() uint64 {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	return mi.collisions
+}
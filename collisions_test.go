@@ -0,0 +1,302 @@
+package metricsindex
+
+import (
+	"testing"
+
+	"github.com/OneOfOne/xxhash"
+	"github.com/spuzirev/metricsindex/types"
+)
+
+// collidingHash is hash every metric passed to collideMetrics gets
+const collidingHash = 1000
+
+// collideMetrics makes metrics to have the same hash until the end of
+// the test
+func collideMetrics(t testing.TB, metricsStr ...string) {
+	colliding := make(map[string]bool)
+	for _, metricStr := range metricsStr {
+		metric, err := types.ParseMetric(metricStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		colliding[metric.Serialize()] = true
+	}
+	metricHash = func(b []byte) uint64 {
+		if colliding[string(b)] {
+			return collidingHash
+		}
+		return xxhash.Checksum64(b)
+	}
+	t.Cleanup(func() {
+		metricHash = xxhash.Checksum64
+	})
+}
+
+// metricIndex is part of API shared by MetricsIndex and
+// ShardedMetricsIndex used by collision tests
+type metricIndex interface {
+	InsertMetric(metricStr string) error
+	InsertMetricBytes(b []byte) error
+	DeleteMetric(metricStr string) error
+	DeleteMetricByID(metricID types.MetricID) error
+	MetricExistsByMetricStr(metricStr string) bool
+	MetricExistsByMetricID(metricID types.MetricID) bool
+	GetMetricNameByID(metricID types.MetricID) (string, error)
+	GetMetricIDsIteratorByName(metricNameStr string) (*MetricIDIterator, error)
+	GetCardinalityByTag(tagNameStr, tagValueStr string) int
+	Collisions() uint64
+}
+
+// checkMetricIDs verifies that every metric exists and has expected
+// MetricID
+func checkMetricIDs(t *testing.T, index metricIndex, want map[string]types.MetricID) {
+	t.Helper()
+	for metricStr, metricID := range want {
+		if !index.MetricExistsByMetricStr(metricStr) {
+			t.Fatalf("%s doesn't exist", metricStr)
+		}
+		if !index.MetricExistsByMetricID(metricID) {
+			t.Fatalf("%s doesn't exist by MetricID %d", metricStr, metricID)
+		}
+		got, err := index.GetMetricNameByID(metricID)
+		if err != nil || got != metricStr {
+			t.Fatalf("GetMetricNameByID(%d) = %q, %v, want %q", metricID, got, err, metricStr)
+		}
+	}
+}
+
+func TestMetricIDCollision(t *testing.T) {
+	const a, b, c = "cpu;host=a", "cpu;host=b", "mem;host=c"
+	collideMetrics(t, a, b, c)
+	mi := NewMetricsIndex()
+	mustInsert(t, mi, a, b, c)
+	checkMetricIDs(t, mi, map[string]types.MetricID{
+		a: collidingHash,
+		b: collidingHash + 1,
+		c: collidingHash + 2,
+	})
+	if n := mi.Collisions(); n != 2 {
+		t.Fatalf("Collisions() = %d, want 2", n)
+	}
+
+	// inserting again doesn't add anything, slow and fast path alike
+	mustInsert(t, mi, b, c)
+	for _, metricStr := range []string{a, b, c} {
+		if err := mi.InsertMetricBytes([]byte(metricStr)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := mi.MetricIDToMetric.Len(); n != 3 {
+		t.Fatalf("index has %d metrics, want 3", n)
+	}
+	if n := mi.Collisions(); n != 2 {
+		t.Fatalf("Collisions() = %d, want 2", n)
+	}
+
+	it, err := mi.GetMetricIDsIteratorByName("cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := drainMetricIDs(t, it)
+	if len(got) != 2 || got[0] != collidingHash || got[1] != collidingHash+1 {
+		t.Fatalf("cpu iterator returned %v", got)
+	}
+	for _, host := range []string{"a", "b", "c"} {
+		if n := mi.GetCardinalityByTag("host", host); n != 1 {
+			t.Fatalf("GetCardinalityByTag(host, %s) = %d, want 1", host, n)
+		}
+	}
+	checkRefs(t, mi)
+}
+
+func TestMetricIDCollisionOwnerDeleted(t *testing.T) {
+	const a, b, c = "cpu;host=a", "cpu;host=b", "cpu;host=c"
+	collideMetrics(t, a, b, c)
+	mi := NewMetricsIndex()
+	mustInsert(t, mi, a, b)
+
+	// b keeps its MetricID when the owner of the hash is gone
+	if err := mi.DeleteMetric(a); err != nil {
+		t.Fatal(err)
+	}
+	if mi.MetricExistsByMetricStr(a) {
+		t.Fatalf("%s exists after delete", a)
+	}
+	mustInsert(t, mi, b)
+	if err := mi.InsertMetricBytes([]byte(b)); err != nil {
+		t.Fatal(err)
+	}
+	checkMetricIDs(t, mi, map[string]types.MetricID{b: collidingHash + 1})
+	if n := mi.MetricIDToMetric.Len(); n != 1 {
+		t.Fatalf("index has %d metrics, want 1", n)
+	}
+
+	// freed hash is taken by the next metric
+	mustInsert(t, mi, c, a)
+	checkMetricIDs(t, mi, map[string]types.MetricID{
+		c: collidingHash,
+		b: collidingHash + 1,
+		a: collidingHash + 2,
+	})
+
+	// deleted metric which collided is inserted to the first free ID
+	if err := mi.DeleteMetricByID(collidingHash + 1); err != nil {
+		t.Fatal(err)
+	}
+	if mi.MetricExistsByMetricStr(b) {
+		t.Fatalf("%s exists after delete", b)
+	}
+	mustInsert(t, mi, b)
+	checkMetricIDs(t, mi, map[string]types.MetricID{
+		c: collidingHash,
+		b: collidingHash + 1,
+		a: collidingHash + 2,
+	})
+	checkRefs(t, mi)
+}
+
+func TestShardedMetricIDCollision(t *testing.T) {
+	const a, b, c = "cpu;host=a", "cpu;host=b", "cpu;host=c"
+	collideMetrics(t, a, b, c)
+	smi, err := NewShardedMetricsIndex(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, metricStr := range []string{a, b} {
+		if err := smi.InsertMetric(metricStr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := smi.InsertMetricsBatch([]string{c, a}); err != nil {
+		t.Fatal(err)
+	}
+	// colliding metrics step by shards count, so all of them stay in
+	// the shard their hash points to
+	want := map[string]types.MetricID{
+		a: collidingHash,
+		b: collidingHash + 4,
+		c: collidingHash + 8,
+	}
+	checkMetricIDs(t, smi, want)
+	shard := smi.shard(collidingHash)
+	for _, metricID := range want {
+		if smi.shard(metricID) != shard {
+			t.Fatalf("MetricID %d is routed to other shard", metricID)
+		}
+	}
+	if n := shard.MetricIDToMetric.Len(); n != 3 {
+		t.Fatalf("shard has %d metrics, want 3", n)
+	}
+	if n := smi.Collisions(); n != 2 {
+		t.Fatalf("Collisions() = %d, want 2", n)
+	}
+
+	if err := smi.DeleteMetric(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := smi.InsertMetricBytes([]byte(c)); err != nil {
+		t.Fatal(err)
+	}
+	if err := smi.DeleteMetricByID(collidingHash + 4); err != nil {
+		t.Fatal(err)
+	}
+	checkMetricIDs(t, smi, map[string]types.MetricID{c: collidingHash + 8})
+	if smi.MetricExistsByMetricStr(a) || smi.MetricExistsByMetricStr(b) {
+		t.Fatal("deleted metric exists")
+	}
+	if n := smi.GetCardinalityByTag("host", "c"); n != 1 {
+		t.Fatalf("GetCardinalityByTag(host, c) = %d, want 1", n)
+	}
+}
+
+func TestIDRegistry(t *testing.T) {
+	r := newIDRegistry[string]()
+	tests := []struct {
+		key      string
+		hash     uint64
+		id       uint64
+		collided bool
+	}{
+		{"a", 10, 10, false},
+		{"b", 10, 11, true},
+		{"c", 11, 12, true},
+		{"a", 10, 10, false},
+		{"b", 10, 11, false},
+		{"d", 20, 20, false},
+	}
+	for _, tt := range tests {
+		id, collided := r.assign(tt.key, tt.hash)
+		if id != tt.id || collided != tt.collided {
+			t.Fatalf("assign(%q, %d) = %d, %v, want %d, %v", tt.key, tt.hash, id, collided, tt.id, tt.collided)
+		}
+		if id, ok := r.lookup(tt.key, tt.hash); !ok || id != tt.id {
+			t.Fatalf("lookup(%q, %d) = %d, %v", tt.key, tt.hash, id, ok)
+		}
+	}
+
+	r.release("a", 10, 10)
+	if _, ok := r.lookup("a", 10); ok {
+		t.Fatal("released key is found")
+	}
+	if id, ok := r.lookup("b", 10); !ok || id != 11 {
+		t.Fatalf("lookup(b) = %d, %v after owner of the hash is released", id, ok)
+	}
+	if id, _ := r.assign("e", 10); id != 10 {
+		t.Fatalf("released ID isn't reused, got %d", id)
+	}
+	r.release("b", 10, 11)
+	if _, ok := r.overrides["b"]; ok || r.collided[10] != 0 {
+		t.Fatalf("override of b is left after release: %v, %v", r.overrides, r.collided)
+	}
+	if id, collided := r.assign("b", 10); id != 11 || !collided {
+		t.Fatalf("assign(b) = %d, %v after release", id, collided)
+	}
+	if r.collided[10] != 1 {
+		t.Fatalf("collided[10] = %d, want 1", r.collided[10])
+	}
+}
+
+func TestMetricIDOverridesReleased(t *testing.T) {
+	const a, b, c = "cpu;host=a", "cpu;host=b", "cpu;host=c"
+	collideMetrics(t, a, b, c)
+	mi := NewMetricsIndex()
+	mustInsert(t, mi, a, b, c, "mem")
+	if n := mi.collidedHashes[collidingHash]; n != 2 || len(mi.collidedHashes) != 1 {
+		t.Fatalf("collidedHashes is %v, want 2 overrides of %d", mi.collidedHashes, collidingHash)
+	}
+	// moved metrics are found after the owner of the hash is gone
+	if err := mi.DeleteMetric(a); err != nil {
+		t.Fatal(err)
+	}
+	checkMetricIDs(t, mi, map[string]types.MetricID{
+		b: collidingHash + 1,
+		c: collidingHash + 2,
+	})
+	for _, metricStr := range []string{b, c} {
+		if err := mi.DeleteMetric(metricStr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(mi.metricIDOverrides) != 0 || len(mi.collidedHashes) != 0 {
+		t.Fatalf("overrides %v, collidedHashes %v are left after delete", mi.metricIDOverrides, mi.collidedHashes)
+	}
+	checkRefs(t, mi)
+}
+
+// TestAmbiguousHashKey checks that metrics with the same HashKey, which
+// always collide, are kept apart
+func TestAmbiguousHashKey(t *testing.T) {
+	const a, b = `a\;b\=c`, "a;b=c"
+	mi := NewMetricsIndex()
+	mustInsert(t, mi, a, b)
+	hash := metricIDOf(t, mi, a)
+	checkMetricIDs(t, mi, map[string]types.MetricID{a: hash, b: hash + 1})
+	if n := mi.Collisions(); n != 1 {
+		t.Fatalf("Collisions() = %d, want 1", n)
+	}
+	if err := mi.DeleteMetric(a); err != nil {
+		t.Fatal(err)
+	}
+	checkMetricIDs(t, mi, map[string]types.MetricID{b: hash + 1})
+	checkRefs(t, mi)
+}
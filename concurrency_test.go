@@ -0,0 +1,163 @@
+package metricsindex
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spuzirev/metricsindex/types"
+)
+
+// TestConcurrentAccess runs writers and readers of every kind against one
+// index, it is meant to be run with -race
+func TestConcurrentAccess(t *testing.T) {
+	mi := NewMetricsIndex()
+	const (
+		writers = 4
+		metrics = 300
+		// reads is number of runs of every reader
+		reads = 30
+	)
+	metricStr := func(w, i int) string {
+		return fmt.Sprintf("cpu;dc=dc%d;host=h%d", w, i)
+	}
+	mustInsert(t, mi, "mem;dc=dc0")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	report := func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < metrics; i++ {
+				var err error
+				switch i % 3 {
+				case 0:
+					err = mi.InsertMetric(metricStr(w, i))
+				case 1:
+					err = mi.InsertMetricBytes([]byte(metricStr(w, i)))
+				case 2:
+					err = mi.InsertMetricsBatch([]string{metricStr(w, i), "mem;dc=dc0"})
+				}
+				if err != nil {
+					report(err)
+					return
+				}
+				if i%5 == 0 {
+					if err := mi.DeleteMetric(metricStr(w, i)); err != nil {
+						report(err)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+
+	reader := func(read func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < reads; i++ {
+				if err := read(); err != nil {
+					report(err)
+					return
+				}
+			}
+		}()
+	}
+	drain := func(it *MetricIDIterator, err error) error {
+		if err == ErrNoSuchMetricName || err == ErrNoSuchTagNameValue {
+			// not inserted yet
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		seen := make(map[types.MetricID]bool)
+		for {
+			metricID, err := it.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if seen[metricID] {
+				return fmt.Errorf("iterator returned %d twice", metricID)
+			}
+			seen[metricID] = true
+		}
+	}
+	reader(func() error {
+		return drain(mi.GetMetricIDsIteratorByName("cpu"))
+	})
+	reader(func() error {
+		return drain(mi.GetMetricIDsIteratorByTag("dc", "dc1"))
+	})
+	reader(func() error {
+		return drain(mi.Select(`cpu{dc=~"dc[02]"}`))
+	})
+	reader(func() error {
+		_, err := mi.WriteTo(io.Discard)
+		return err
+	})
+	reader(func() error {
+		mi.GetAllTagValues("host")
+		mi.GetCardinalityByTag("dc", "dc2")
+		if !mi.MetricExistsByMetricStr("mem;dc=dc0") {
+			return fmt.Errorf("mem;dc=dc0 is missing")
+		}
+		return nil
+	})
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for w := 0; w < writers; w++ {
+		for i := 0; i < metrics; i++ {
+			if exists, want := mi.MetricExistsByMetricStr(metricStr(w, i)), i%5 != 0; exists != want {
+				t.Fatalf("%s exists: %v, want %v", metricStr(w, i), exists, want)
+			}
+		}
+	}
+	checkRefs(t, mi)
+}
+
+// TestInsertKnownMetricUnderReadLock checks that inserting known series
+// doesn't wait for readers
+func TestInsertKnownMetricUnderReadLock(t *testing.T) {
+	clock := newTestClock()
+	start := clock.now()
+	mi := NewMetricsIndex()
+	mi.now = clock.now
+	mustInsert(t, mi, "cpu;dc=ams")
+	clock.add(time.Minute)
+
+	mi.mu.RLock()
+	done := make(chan error)
+	go func() {
+		done <- mi.InsertMetricsBatch([]string{"cpu;dc=ams"})
+	}()
+	select {
+	case err := <-done:
+		mi.mu.RUnlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("insert of known metric waits for readers")
+	}
+	checkSeen(t, mi, "cpu;dc=ams", start, start.Add(time.Minute))
+}
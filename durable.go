@@ -0,0 +1,429 @@
+package metricsindex
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/spuzirev/metricsindex/types"
+	"github.com/spuzirev/metricsindex/wal"
+)
+
+const (
+	snapshotFileName = "index.snapshot"
+	walFileName      = "index.wal"
+)
+
+// DurableMetricsIndex is MetricsIndex which survives restarts and crashes.
+// It keeps snapshot and write-ahead log in a directory: every mutation is
+// logged before it is applied and Snapshot() writes new snapshot and
+// truncates the log.
+// The index isn't embedded, so only read methods of MetricsIndex are
+// forwarded (see below) and there is no way to change it bypassing the log.
+type DurableMetricsIndex struct {
+	index *MetricsIndex
+	dir   string
+	wal   *wal.WAL
+	// mu serializes writers so mutations are logged in the order they are
+	// applied and no mutation is lost between writing snapshot and
+	// truncating the log. It is taken before MetricsIndex lock.
+	mu sync.Mutex
+}
+
+// DurableOptions configures DurableMetricsIndex
+type DurableOptions struct {
+	WAL wal.Options
+	// ParseOptions are validation rules of the index, they are applied
+	// to the log as it is replayed too. Default is
+	// types.DefaultParseOptions().
+	ParseOptions *types.ParseOptions
+}
+
+// OpenDurableMetricsIndex loads index from snapshot in dir (if any) and
+// replays write-ahead log on top of it
+func OpenDurableMetricsIndex(dir string, opts wal.Options) (*DurableMetricsIndex, error) {
+	return OpenDurableMetricsIndexWithOptions(dir, DurableOptions{WAL: opts})
+}
+
+// OpenDurableMetricsIndexWithOptions is OpenDurableMetricsIndex taking
+// DurableOptions
+func OpenDurableMetricsIndexWithOptions(dir string, opts DurableOptions) (*DurableMetricsIndex, error) {
+	mi := NewMetricsIndex()
+	if opts.ParseOptions != nil {
+		mi.SetParseOptions(*opts.ParseOptions)
+	}
+	err := mi.LoadFromFile(filepath.Join(dir, snapshotFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	w, err := wal.Open(filepath.Join(dir, walFileName), opts.WAL)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Replay(func(op wal.Op, metricStr string) error {
+		switch op {
+		case wal.OpInsert:
+			return mi.InsertMetric(metricStr)
+		case wal.OpDelete:
+			if err := mi.DeleteMetric(metricStr); err != ErrNoSuchMetric {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	return &DurableMetricsIndex{
+		index: mi,
+		dir:   dir,
+		wal:   w,
+	}, nil
+}
+
+// InsertMetric logs and inserts new metric to index by metric string
+// representation
+func (dmi *DurableMetricsIndex) InsertMetric(metricStr string) error {
+	dmi.mu.Lock()
+	defer dmi.mu.Unlock()
+	return dmi.insertMetric(metricStr)
+}
+
+func (dmi *DurableMetricsIndex) insertMetric(metricStr string) error {
+	metric, err := dmi.index.parseMetric(metricStr)
+	if err != nil {
+		return err
+	}
+	if dmi.index.touchMetric(metric) {
+		return nil
+	}
+	if err := dmi.wal.Append(wal.OpInsert, metricStr); err != nil {
+		return err
+	}
+	dmi.index.mu.Lock()
+	defer dmi.index.mu.Unlock()
+	return dmi.index.insertMetric(metric)
+}
+
+// InsertMetricBytes logs and inserts new metric to index by metric string
+// representation. Already known series are recognized without allocation,
+// see MetricsIndex.InsertMetricBytes.
+func (dmi *DurableMetricsIndex) InsertMetricBytes(b []byte) error {
+	if dmi.index.touchKnownMetricBytes(b) {
+		return nil
+	}
+	return dmi.InsertMetric(string(b))
+}
+
+// InsertMetricsBatch logs and inserts metrics to index
+func (dmi *DurableMetricsIndex) InsertMetricsBatch(metricsStr []string) error {
+	dmi.mu.Lock()
+	defer dmi.mu.Unlock()
+	for _, metricStr := range metricsStr {
+		if err := dmi.insertMetric(metricStr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteMetric logs and removes metric from index by metric string
+// representation
+func (dmi *DurableMetricsIndex) DeleteMetric(metricStr string) error {
+	dmi.mu.Lock()
+	defer dmi.mu.Unlock()
+	metric, err := dmi.index.parseMetric(metricStr)
+	if err != nil {
+		return err
+	}
+	dmi.index.mu.RLock()
+	metricID, ok := dmi.index.lookupMetricID(metric)
+	dmi.index.mu.RUnlock()
+	if !ok {
+		return ErrNoSuchMetric
+	}
+	if err := dmi.wal.Append(wal.OpDelete, metricStr); err != nil {
+		return err
+	}
+	dmi.index.mu.Lock()
+	defer dmi.index.mu.Unlock()
+	return dmi.index.deleteMetric(metricID)
+}
+
+// DeleteMetricByID logs and removes metric with given metricID from index
+func (dmi *DurableMetricsIndex) DeleteMetricByID(metricID types.MetricID) error {
+	dmi.mu.Lock()
+	defer dmi.mu.Unlock()
+	metricStr, err := dmi.index.GetMetricNameByID(metricID)
+	if err != nil {
+		return err
+	}
+	if err := dmi.wal.Append(wal.OpDelete, metricStr); err != nil {
+		return err
+	}
+	dmi.index.mu.Lock()
+	defer dmi.index.mu.Unlock()
+	return dmi.index.deleteMetric(metricID)
+}
+
+// Snapshot writes snapshot of the index and truncates write-ahead log
+func (dmi *DurableMetricsIndex) Snapshot() error {
+	dmi.mu.Lock()
+	defer dmi.mu.Unlock()
+	if err := dmi.index.SaveToFile(filepath.Join(dmi.dir, snapshotFileName)); err != nil {
+		return err
+	}
+	return dmi.wal.Truncate()
+}
+
+// ExpireOlderThan deletes series which were last seen before t, logs
+// their deletes and returns number of deleted series. It has the same
+// signature as MetricsIndex.ExpireOlderThan, so the index can be expired
+// through the same interface.
+// Series is checked for staleness and deleted under the same lock and its
+// delete is logged afterwards, so series touched meanwhile is neither
+// deleted nor logged. Expiration stops at the first failed log write and
+// its error is dropped, the series deleted before that write is back
+// after replay and is expired again.
+// Log records don't carry timestamps, so series replayed from the log
+// are considered seen at the time of replay.
+func (dmi *DurableMetricsIndex) ExpireOlderThan(t time.Time) int {
+	deadline := t.UnixNano()
+	expired := 0
+	for _, metricID := range dmi.index.staleMetricIDs(t) {
+		ok, err := dmi.expireMetric(metricID, deadline)
+		if ok {
+			expired++
+		}
+		if err != nil {
+			break
+		}
+	}
+	return expired
+}
+
+func (dmi *DurableMetricsIndex) expireMetric(metricID types.MetricID, deadline int64) (bool, error) {
+	dmi.mu.Lock()
+	defer dmi.mu.Unlock()
+	dmi.index.mu.Lock()
+	metricStr, err := dmi.index.metricNameByID(metricID)
+	expired := err == nil && dmi.index.expireMetric(metricID, deadline)
+	dmi.index.mu.Unlock()
+	if !expired {
+		return false, nil
+	}
+	return true, dmi.wal.Append(wal.OpDelete, metricStr)
+}
+
+// StartExpiry starts background goroutine which logs and deletes series
+// not seen for ttl every interval (ttl/10 if interval is not positive).
+// See MetricsIndex.StartExpiry.
+func (dmi *DurableMetricsIndex) StartExpiry(ttl, interval time.Duration) {
+	dmi.StopExpiry()
+	dmi.index.expiry = startExpiryLoop(dmi.ExpireOlderThan, dmi.index.now, ttl, interval)
+}
+
+// Close stops background expiration and closes write-ahead log.
+// It doesn't write snapshot.
+func (dmi *DurableMetricsIndex) Close() error {
+	dmi.StopExpiry()
+	dmi.mu.Lock()
+	defer dmi.mu.Unlock()
+	return dmi.wal.Close()
+}
+
+// StopExpiry stops background expiration started by StartExpiry
+func (dmi *DurableMetricsIndex) StopExpiry() {
+	dmi.index.StopExpiry()
+}
+
+// Read methods below are forwarded to the index as is.
+
+// MetricExistsByMetricID see MetricsIndex.MetricExistsByMetricID
+func (dmi *DurableMetricsIndex) MetricExistsByMetricID(metricID types.MetricID) bool {
+	return dmi.index.MetricExistsByMetricID(metricID)
+}
+
+// MetricExistsByMetricStr see MetricsIndex.MetricExistsByMetricStr
+func (dmi *DurableMetricsIndex) MetricExistsByMetricStr(metricStr string) bool {
+	return dmi.index.MetricExistsByMetricStr(metricStr)
+}
+
+// GetMetricSeenTimesByID see MetricsIndex.GetMetricSeenTimesByID
+func (dmi *DurableMetricsIndex) GetMetricSeenTimesByID(metricID types.MetricID) (firstSeen, lastSeen time.Time, err error) {
+	return dmi.index.GetMetricSeenTimesByID(metricID)
+}
+
+// GetMetricIDsIteratorByTag see MetricsIndex.GetMetricIDsIteratorByTag
+func (dmi *DurableMetricsIndex) GetMetricIDsIteratorByTag(tagNameStr, tagValueStr string) (*MetricIDIterator, error) {
+	return dmi.index.GetMetricIDsIteratorByTag(tagNameStr, tagValueStr)
+}
+
+// GetMetricIDsIteratorByName see MetricsIndex.GetMetricIDsIteratorByName
+func (dmi *DurableMetricsIndex) GetMetricIDsIteratorByName(metricNameStr string) (*MetricIDIterator, error) {
+	return dmi.index.GetMetricIDsIteratorByName(metricNameStr)
+}
+
+// GetMetricIDsIteratorByMatchers see MetricsIndex.GetMetricIDsIteratorByMatchers
+func (dmi *DurableMetricsIndex) GetMetricIDsIteratorByMatchers(matchers []types.Matcher) (*MetricIDIterator, error) {
+	return dmi.index.GetMetricIDsIteratorByMatchers(matchers)
+}
+
+// GetMetricIDsIteratorByTagRegexp see MetricsIndex.GetMetricIDsIteratorByTagRegexp
+func (dmi *DurableMetricsIndex) GetMetricIDsIteratorByTagRegexp(tagNameStr, expr string) (*MetricIDIterator, error) {
+	return dmi.index.GetMetricIDsIteratorByTagRegexp(tagNameStr, expr)
+}
+
+// Select see MetricsIndex.Select
+func (dmi *DurableMetricsIndex) Select(selectorStr string) (*MetricIDIterator, error) {
+	return dmi.index.Select(selectorStr)
+}
+
+// SeriesByTag see MetricsIndex.SeriesByTag
+func (dmi *DurableMetricsIndex) SeriesByTag(expr string) ([]string, error) {
+	return dmi.index.SeriesByTag(expr)
+}
+
+// GetCardinalityByName see MetricsIndex.GetCardinalityByName
+func (dmi *DurableMetricsIndex) GetCardinalityByName(metricNameStr string) int {
+	return dmi.index.GetCardinalityByName(metricNameStr)
+}
+
+// GetCardinalityByTag see MetricsIndex.GetCardinalityByTag
+func (dmi *DurableMetricsIndex) GetCardinalityByTag(tagNameStr, tagValueStr string) int {
+	return dmi.index.GetCardinalityByTag(tagNameStr, tagValueStr)
+}
+
+// GetCardinalityByTagName see MetricsIndex.GetCardinalityByTagName
+func (dmi *DurableMetricsIndex) GetCardinalityByTagName(tagNameStr string) int {
+	return dmi.index.GetCardinalityByTagName(tagNameStr)
+}
+
+// GetMetricNames see MetricsIndex.GetMetricNames
+func (dmi *DurableMetricsIndex) GetMetricNames(prefix string) []string {
+	return dmi.index.GetMetricNames(prefix)
+}
+
+// GetMetricNamesIterator see MetricsIndex.GetMetricNamesIterator
+func (dmi *DurableMetricsIndex) GetMetricNamesIterator(prefix string) (*MetricNameIterator, error) {
+	return dmi.index.GetMetricNamesIterator(prefix)
+}
+
+// GetAllMetricNames see MetricsIndex.GetAllMetricNames
+func (dmi *DurableMetricsIndex) GetAllMetricNames() []string {
+	return dmi.index.GetAllMetricNames()
+}
+
+// GetTagNames see MetricsIndex.GetTagNames
+func (dmi *DurableMetricsIndex) GetTagNames(prefix string) []string {
+	return dmi.index.GetTagNames(prefix)
+}
+
+// GetTagNamesIterator see MetricsIndex.GetTagNamesIterator
+func (dmi *DurableMetricsIndex) GetTagNamesIterator(prefix string) (*TagNameIterator, error) {
+	return dmi.index.GetTagNamesIterator(prefix)
+}
+
+// GetAllTagNames see MetricsIndex.GetAllTagNames
+func (dmi *DurableMetricsIndex) GetAllTagNames() []string {
+	return dmi.index.GetAllTagNames()
+}
+
+// GetAllTagNamesIterator see MetricsIndex.GetAllTagNamesIterator
+func (dmi *DurableMetricsIndex) GetAllTagNamesIterator() (*TagNameIterator, error) {
+	return dmi.index.GetAllTagNamesIterator()
+}
+
+// GetTagValues see MetricsIndex.GetTagValues
+func (dmi *DurableMetricsIndex) GetTagValues(tagNameStr, prefix string) []string {
+	return dmi.index.GetTagValues(tagNameStr, prefix)
+}
+
+// GetTagValuesIterator see MetricsIndex.GetTagValuesIterator
+func (dmi *DurableMetricsIndex) GetTagValuesIterator(tagNameStr, prefix string) (*TagValueIterator, error) {
+	return dmi.index.GetTagValuesIterator(tagNameStr, prefix)
+}
+
+// GetAllTagValues see MetricsIndex.GetAllTagValues
+func (dmi *DurableMetricsIndex) GetAllTagValues(tagNameStr string) []string {
+	return dmi.index.GetAllTagValues(tagNameStr)
+}
+
+// GetAllTagValuesIterator see MetricsIndex.GetAllTagValuesIterator
+func (dmi *DurableMetricsIndex) GetAllTagValuesIterator(tagNameStr string) (*TagValueIterator, error) {
+	return dmi.index.GetAllTagValuesIterator(tagNameStr)
+}
+
+// GetMetricNameByID see MetricsIndex.GetMetricNameByID
+func (dmi *DurableMetricsIndex) GetMetricNameByID(metricID types.MetricID) (string, error) {
+	return dmi.index.GetMetricNameByID(metricID)
+}
+
+// GetMetricByID see MetricsIndex.GetMetricByID
+func (dmi *DurableMetricsIndex) GetMetricByID(metricID types.MetricID) (types.Metric, error) {
+	return dmi.index.GetMetricByID(metricID)
+}
+
+// GetMetricsNamesByIDs see MetricsIndex.GetMetricsNamesByIDs
+func (dmi *DurableMetricsIndex) GetMetricsNamesByIDs(metricIDs []types.MetricID) ([]string, error) {
+	return dmi.index.GetMetricsNamesByIDs(metricIDs)
+}
+
+// HasMetricsInRange see MetricsIndex.HasMetricsInRange
+func (dmi *DurableMetricsIndex) HasMetricsInRange(tr TimeRange) bool {
+	return dmi.index.HasMetricsInRange(tr)
+}
+
+// GetMetricNamesInRange see MetricsIndex.GetMetricNamesInRange
+func (dmi *DurableMetricsIndex) GetMetricNamesInRange(prefix string, tr TimeRange) []string {
+	return dmi.index.GetMetricNamesInRange(prefix, tr)
+}
+
+// GetTagNamesInRange see MetricsIndex.GetTagNamesInRange
+func (dmi *DurableMetricsIndex) GetTagNamesInRange(prefix string, tr TimeRange) []string {
+	return dmi.index.GetTagNamesInRange(prefix, tr)
+}
+
+// GetTagValuesInRange see MetricsIndex.GetTagValuesInRange
+func (dmi *DurableMetricsIndex) GetTagValuesInRange(tagNameStr, prefix string, tr TimeRange) []string {
+	return dmi.index.GetTagValuesInRange(tagNameStr, prefix, tr)
+}
+
+// GetMetricIDsIteratorByTagInRange see MetricsIndex.GetMetricIDsIteratorByTagInRange
+func (dmi *DurableMetricsIndex) GetMetricIDsIteratorByTagInRange(tagNameStr, tagValueStr string, tr TimeRange) (*MetricIDIterator, error) {
+	return dmi.index.GetMetricIDsIteratorByTagInRange(tagNameStr, tagValueStr, tr)
+}
+
+// GetMetricIDsIteratorByMatchersInRange see MetricsIndex.GetMetricIDsIteratorByMatchersInRange
+func (dmi *DurableMetricsIndex) GetMetricIDsIteratorByMatchersInRange(matchers []types.Matcher, tr TimeRange) (*MetricIDIterator, error) {
+	return dmi.index.GetMetricIDsIteratorByMatchersInRange(matchers, tr)
+}
+
+// GetCardinalityByNameInRange see MetricsIndex.GetCardinalityByNameInRange
+func (dmi *DurableMetricsIndex) GetCardinalityByNameInRange(metricNameStr string, tr TimeRange) int {
+	return dmi.index.GetCardinalityByNameInRange(metricNameStr, tr)
+}
+
+// GetCardinalityByTagInRange see MetricsIndex.GetCardinalityByTagInRange
+func (dmi *DurableMetricsIndex) GetCardinalityByTagInRange(tagNameStr, tagValueStr string, tr TimeRange) int {
+	return dmi.index.GetCardinalityByTagInRange(tagNameStr, tagValueStr, tr)
+}
+
+// GetCardinalityByTagNameInRange see MetricsIndex.GetCardinalityByTagNameInRange
+func (dmi *DurableMetricsIndex) GetCardinalityByTagNameInRange(tagNameStr string, tr TimeRange) int {
+	return dmi.index.GetCardinalityByTagNameInRange(tagNameStr, tr)
+}
+
+// Collisions see MetricsIndex.Collisions
+func (dmi *DurableMetricsIndex) Collisions() uint64 {
+	return dmi.index.Collisions()
+}
+
+// InternStats see MetricsIndex.InternStats
+func (dmi *DurableMetricsIndex) InternStats() InternStats {
+	return dmi.index.InternStats()
+}
@@ -0,0 +1,269 @@
+package metricsindex
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/spuzirev/metricsindex/types"
+	"github.com/spuzirev/metricsindex/wal"
+)
+
+func openDurable(t *testing.T, dir string) *DurableMetricsIndex {
+	t.Helper()
+	// durability itself is tested by wal, no need to fsync here
+	dmi, err := OpenDurableMetricsIndex(dir, wal.Options{SyncPolicy: wal.SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dmi
+}
+
+func allMetrics(t *testing.T, mi *MetricsIndex) []string {
+	t.Helper()
+	mi.mu.RLock()
+	metricIDs := make([]types.MetricID, 0, len(mi.MetricIDToBool))
+	for metricID := range mi.MetricIDToBool {
+		metricIDs = append(metricIDs, metricID)
+	}
+	mi.mu.RUnlock()
+	names, err := mi.GetMetricsNamesByIDs(metricIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDurableReopen(t *testing.T) {
+	dir := t.TempDir()
+	dmi := openDurable(t, dir)
+	mustInsert(t, dmi.index, "before.snapshot")
+	// inserted directly into MetricsIndex, so it is only in snapshot
+	if err := dmi.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dmi.InsertMetricsBatch([]string{"cpu;dc=ams", "cpu;dc=fra", "mem"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dmi.InsertMetricBytes([]byte("disk;dc=ams")); err != nil {
+		t.Fatal(err)
+	}
+	if err := dmi.DeleteMetric("cpu;dc=fra"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dmi.DeleteMetricByID(metricIDOf(t, dmi.index, "mem")); err != nil {
+		t.Fatal(err)
+	}
+	want := allMetrics(t, dmi.index)
+	if err := dmi.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dmi = openDurable(t, dir)
+	defer dmi.Close()
+	if got := allMetrics(t, dmi.index); !reflect.DeepEqual(got, want) {
+		t.Fatalf("reopened index has %q, want %q", got, want)
+	}
+	checkRefs(t, dmi.index)
+}
+
+func TestDurableTornLog(t *testing.T) {
+	dir := t.TempDir()
+	dmi := openDurable(t, dir)
+	if err := dmi.InsertMetric("cpu;dc=fra"); err != nil {
+		t.Fatal(err)
+	}
+	dmi.Close()
+
+	// crash while appending leaves partial record and zeroes
+	f, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{20, 0, 0, 0, 1, 2})
+	f.Write(make([]byte, 1024))
+	f.Close()
+
+	dmi = openDurable(t, dir)
+	defer dmi.Close()
+	if got, want := allMetrics(t, dmi.index), []string{"cpu;dc=fra"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("reopened index has %q, want %q", got, want)
+	}
+}
+
+func TestDurableParseOptions(t *testing.T) {
+	dir := t.TempDir()
+	dmi := openDurable(t, dir)
+	if err := dmi.InsertMetric("cpu;dc="); err != nil {
+		t.Fatal(err)
+	}
+	dmi.Close()
+
+	// options are applied to the log while it is replayed
+	opts := DurableOptions{
+		WAL:          wal.Options{SyncPolicy: wal.SyncNever},
+		ParseOptions: &types.ParseOptions{},
+	}
+	if _, err := OpenDurableMetricsIndexWithOptions(dir, opts); !errors.Is(err, types.ErrCannotParseMetricName) {
+		t.Fatalf("OpenDurableMetricsIndexWithOptions returned %v, want parse error", err)
+	}
+
+	opts.ParseOptions = &types.ParseOptions{AllowEmptyTagValues: true, MaxNameLen: 3}
+	dmi, err := OpenDurableMetricsIndexWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dmi.Close()
+	if !dmi.MetricExistsByMetricStr("cpu;dc=") {
+		t.Fatal("replayed metric is missing")
+	}
+	if err := dmi.InsertMetric("memory"); !errors.Is(err, types.ErrCannotParseMetricName) {
+		t.Fatalf("InsertMetric returned %v, want parse error", err)
+	}
+}
+
+// expirer is expiration API shared by every index type
+type expirer interface {
+	ExpireOlderThan(t time.Time) int
+	StartExpiry(ttl, interval time.Duration)
+	StopExpiry()
+}
+
+var (
+	_ expirer = (*MetricsIndex)(nil)
+	_ expirer = (*ShardedMetricsIndex)(nil)
+	_ expirer = (*DurableMetricsIndex)(nil)
+)
+
+func TestDurableTouchOnInsert(t *testing.T) {
+	clock := newTestClock()
+	start := clock.now()
+	dmi := openDurable(t, t.TempDir())
+	defer dmi.Close()
+	dmi.index.now = clock.now
+	if err := dmi.InsertMetric("cpu;dc=ams"); err != nil {
+		t.Fatal(err)
+	}
+	clock.add(time.Minute)
+	if err := dmi.InsertMetricBytes([]byte("cpu;dc=ams")); err != nil {
+		t.Fatal(err)
+	}
+	checkSeen(t, dmi.index, "cpu;dc=ams", start, start.Add(time.Minute))
+	clock.add(time.Minute)
+	if err := dmi.InsertMetric("cpu;dc=ams"); err != nil {
+		t.Fatal(err)
+	}
+	checkSeen(t, dmi.index, "cpu;dc=ams", start, start.Add(2*time.Minute))
+}
+
+func TestDurableExpireOlderThan(t *testing.T) {
+	dir := t.TempDir()
+	clock := newTestClock()
+	dmi := openDurable(t, dir)
+	dmi.index.now = clock.now
+	if err := dmi.InsertMetricsBatch([]string{"cpu;dc=ams", "cpu;dc=fra", "mem"}); err != nil {
+		t.Fatal(err)
+	}
+	// expired series from snapshot are deleted by the log
+	if err := dmi.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	clock.add(time.Minute)
+	if err := dmi.InsertMetricBytes([]byte("mem")); err != nil {
+		t.Fatal(err)
+	}
+	if n := dmi.ExpireOlderThan(clock.now()); n != 2 {
+		t.Fatalf("ExpireOlderThan expired %d series, want 2", n)
+	}
+	want := []string{"mem"}
+	if got := allMetrics(t, dmi.index); !reflect.DeepEqual(got, want) {
+		t.Fatalf("index has %q after expiration, want %q", got, want)
+	}
+	if err := dmi.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dmi = openDurable(t, dir)
+	defer dmi.Close()
+	if got := allMetrics(t, dmi.index); !reflect.DeepEqual(got, want) {
+		t.Fatalf("reopened index has %q, want %q", got, want)
+	}
+}
+
+func TestDurableExpiryLoop(t *testing.T) {
+	dir := t.TempDir()
+	clock := newTestClock()
+	dmi := openDurable(t, dir)
+	dmi.index.now = clock.now
+	if err := dmi.InsertMetricsBatch([]string{"cpu", "mem"}); err != nil {
+		t.Fatal(err)
+	}
+	dmi.StartExpiry(time.Minute, time.Millisecond)
+	clock.add(time.Hour)
+	waitFor(t, func() bool {
+		return !dmi.MetricExistsByMetricStr("cpu") && !dmi.MetricExistsByMetricStr("mem")
+	})
+	// Close stops the loop
+	if err := dmi.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dmi = openDurable(t, dir)
+	defer dmi.Close()
+	if got := allMetrics(t, dmi.index); len(got) != 0 {
+		t.Fatalf("reopened index has %q, want nothing", got)
+	}
+}
+
+func TestDurableExpireTouchedMetric(t *testing.T) {
+	dir := t.TempDir()
+	clock := newTestClock()
+	dmi := openDurable(t, dir)
+	dmi.index.now = clock.now
+	if err := dmi.InsertMetric("cpu"); err != nil {
+		t.Fatal(err)
+	}
+	clock.add(time.Minute)
+	deadline := clock.now()
+	stale := dmi.index.staleMetricIDs(deadline)
+	if len(stale) != 1 {
+		t.Fatalf("stale metrics are %v, want 1", stale)
+	}
+	// touched after it was found stale
+	clock.add(time.Minute)
+	if err := dmi.InsertMetricBytes([]byte("cpu")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := dmi.expireMetric(stale[0], deadline.UnixNano()); ok || err != nil {
+		t.Fatalf("expireMetric returned %v, %v, want false", ok, err)
+	}
+	if !dmi.MetricExistsByMetricStr("cpu") {
+		t.Fatal("touched metric is expired")
+	}
+	if err := dmi.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing but the insert is logged
+	w, err := wal.Open(filepath.Join(dir, walFileName), wal.Options{SyncPolicy: wal.SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	ops := make([]wal.Op, 0)
+	err = w.Replay(func(op wal.Op, metricStr string) error {
+		ops = append(ops, op)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []wal.Op{wal.OpInsert}; !reflect.DeepEqual(ops, want) {
+		t.Fatalf("log has %v, want %v", ops, want)
+	}
+}
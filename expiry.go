@@ -0,0 +1,166 @@
+package metricsindex
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/spuzirev/metricsindex/types"
+)
+
+// Every series remembers when it was inserted first and last time.
+// Inserting metric which is already in the index touches it, i.e. moves
+// its last seen time, so series which stopped reporting can be expired.
+
+// touchRef moves first seen time of series back and last seen time
+// forward. Both are updated atomically, so concurrent inserts of the same
+// series only need read lock.
+// Caller must hold at least read lock.
+func (mi *MetricsIndex) touchRef(ref uint64, firstSeen, lastSeen int64) {
+	p := &mi.refs.firstSeen[ref]
+	for {
+		old := atomic.LoadInt64(p)
+		if old <= firstSeen || atomic.CompareAndSwapInt64(p, old, firstSeen) {
+			break
+		}
+	}
+	p = &mi.refs.lastSeen[ref]
+	for {
+		old := atomic.LoadInt64(p)
+		if old >= lastSeen || atomic.CompareAndSwapInt64(p, old, lastSeen) {
+			return
+		}
+	}
+}
+
+// touchMetricID updates last seen time of metric with given metricID
+// Caller must hold at least read lock.
+func (mi *MetricsIndex) touchMetricID(metricID types.MetricID) {
+	if ref, ok := mi.refs.ref(metricID); ok {
+		now := mi.now().UnixNano()
+		mi.touchRef(ref, now, now)
+	}
+}
+
+// touchMetric updates last seen time of metric and returns true if
+// metric exists in the index
+func (mi *MetricsIndex) touchMetric(metric *types.Metric) bool {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	metricID, ok := mi.lookupMetricID(metric)
+	if ok {
+		mi.touchMetricID(metricID)
+	}
+	return ok
+}
+
+// GetMetricSeenTimesByID returns when metric with given metricID was
+// inserted first and last time
+// It returns ErrNoSuchMetric if there is no such metric in the index
+func (mi *MetricsIndex) GetMetricSeenTimesByID(metricID types.MetricID) (firstSeen, lastSeen time.Time, err error) {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	ref, ok := mi.refs.ref(metricID)
+	if !ok {
+		return time.Time{}, time.Time{}, ErrNoSuchMetric
+	}
+	firstSeen = time.Unix(0, atomic.LoadInt64(&mi.refs.firstSeen[ref]))
+	lastSeen = time.Unix(0, atomic.LoadInt64(&mi.refs.lastSeen[ref]))
+	return firstSeen, lastSeen, nil
+}
+
+// staleMetricIDs returns metricIDs of series last seen before t
+func (mi *MetricsIndex) staleMetricIDs(t time.Time) []types.MetricID {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	deadline := t.UnixNano()
+	res := make([]types.MetricID, 0)
+	for ref := range mi.refs.lastSeen {
+		if atomic.LoadInt64(&mi.refs.lastSeen[ref]) < deadline && mi.refs.live(uint64(ref)) {
+			res = append(res, mi.refs.metricIDs[ref])
+		}
+	}
+	return res
+}
+
+// expireMetric deletes metric if it is still last seen before deadline
+// It returns true if metric was deleted.
+// Caller must hold write lock.
+func (mi *MetricsIndex) expireMetric(metricID types.MetricID, deadline int64) bool {
+	ref, ok := mi.refs.ref(metricID)
+	if !ok || mi.refs.lastSeen[ref] >= deadline {
+		// deleted or touched since it was found stale
+		return false
+	}
+	return mi.deleteMetric(metricID) == nil
+}
+
+// ExpireOlderThan deletes series which were last seen before t and
+// returns number of deleted series.
+// Stale series are looked up under read lock and deleted one by one, so
+// writers and readers are not blocked for the whole run.
+func (mi *MetricsIndex) ExpireOlderThan(t time.Time) int {
+	deadline := t.UnixNano()
+	expired := 0
+	for _, metricID := range mi.staleMetricIDs(t) {
+		mi.mu.Lock()
+		if mi.expireMetric(metricID, deadline) {
+			expired++
+		}
+		mi.mu.Unlock()
+	}
+	return expired
+}
+
+// expiryLoop periodically expires series not seen for ttl
+type expiryLoop struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startExpiryLoop(expire func(t time.Time) int, now func() time.Time, ttl, interval time.Duration) *expiryLoop {
+	if interval <= 0 {
+		interval = ttl / 10
+	}
+	l := &expiryLoop{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(l.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				expire(now().Add(-ttl))
+			case <-l.stop:
+				return
+			}
+		}
+	}()
+	return l
+}
+
+// close stops the loop and waits for running expiration to finish
+func (l *expiryLoop) close() {
+	if l == nil {
+		return
+	}
+	close(l.stop)
+	<-l.done
+}
+
+// StartExpiry starts background goroutine which deletes series not seen
+// for ttl every interval (ttl/10 if interval is not positive). Running
+// loop is stopped first. StartExpiry and StopExpiry must not be called
+// concurrently.
+func (mi *MetricsIndex) StartExpiry(ttl, interval time.Duration) {
+	mi.StopExpiry()
+	mi.expiry = startExpiryLoop(mi.ExpireOlderThan, mi.now, ttl, interval)
+}
+
+// StopExpiry stops background expiration started by StartExpiry
+func (mi *MetricsIndex) StopExpiry() {
+	mi.expiry.close()
+	mi.expiry = nil
+}
@@ -0,0 +1,164 @@
+package metricsindex
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClock is time source of the index which is moved by the test
+type testClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{t: time.Unix(1000, 0)}
+}
+
+func (c *testClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *testClock) add(d time.Duration) {
+	c.mu.Lock()
+	c.t = c.t.Add(d)
+	c.mu.Unlock()
+}
+
+// checkSeen verifies seen times of metric
+func checkSeen(t *testing.T, mi *MetricsIndex, metricStr string, firstSeen, lastSeen time.Time) {
+	t.Helper()
+	first, last, err := mi.GetMetricSeenTimesByID(metricIDOf(t, mi, metricStr))
+	if err != nil || !first.Equal(firstSeen) || !last.Equal(lastSeen) {
+		t.Fatalf("%s is seen %v - %v, %v, want %v - %v", metricStr, first, last, err, firstSeen, lastSeen)
+	}
+}
+
+// waitFor polls cond until it is true or a few seconds passed
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition isn't met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTouchOnInsert(t *testing.T) {
+	clock := newTestClock()
+	start := clock.now()
+	mi := NewMetricsIndex()
+	mi.now = clock.now
+	mustInsert(t, mi, "cpu;dc=ams", "cpu;dc=fra", "mem")
+	checkSeen(t, mi, "cpu;dc=ams", start, start)
+
+	clock.add(time.Minute)
+	mustInsert(t, mi, "cpu;dc=ams")
+	checkSeen(t, mi, "cpu;dc=ams", start, start.Add(time.Minute))
+
+	// fast path of known metric touches too
+	clock.add(time.Minute)
+	if err := mi.InsertMetricBytes([]byte("cpu;dc=fra")); err != nil {
+		t.Fatal(err)
+	}
+	checkSeen(t, mi, "cpu;dc=fra", start, start.Add(2*time.Minute))
+
+	if err := mi.InsertMetricsBatch([]string{"mem"}); err != nil {
+		t.Fatal(err)
+	}
+	checkSeen(t, mi, "mem", start, start.Add(2*time.Minute))
+
+	// clock went back: first seen time is the earliest one and last seen
+	// time doesn't go back
+	clock.add(-time.Hour)
+	mustInsert(t, mi, "mem")
+	checkSeen(t, mi, "mem", clock.now(), start.Add(2*time.Minute))
+
+	if _, _, err := mi.GetMetricSeenTimesByID(1); err != ErrNoSuchMetric {
+		t.Fatalf("GetMetricSeenTimesByID returned %v, want ErrNoSuchMetric", err)
+	}
+}
+
+func TestExpireOlderThan(t *testing.T) {
+	clock := newTestClock()
+	mi := NewMetricsIndex()
+	mi.now = clock.now
+	mustInsert(t, mi, "cpu;dc=ams;host=a", "cpu;dc=ams;host=b", "mem;dc=fra")
+	clock.add(time.Minute)
+	mustInsert(t, mi, "cpu;dc=ams;host=a")
+
+	if n := mi.ExpireOlderThan(clock.now().Add(-time.Hour)); n != 0 {
+		t.Fatalf("ExpireOlderThan expired %d fresh series", n)
+	}
+	if n := mi.ExpireOlderThan(clock.now()); n != 2 {
+		t.Fatalf("ExpireOlderThan expired %d series, want 2", n)
+	}
+	if got, want := allMetrics(t, mi), []string{"cpu;dc=ams;host=a"}; len(got) != 1 || got[0] != want[0] {
+		t.Fatalf("index has %q after expiration, want %q", got, want)
+	}
+	if n := mi.GetCardinalityByTag("dc", "fra"); n != 0 {
+		t.Fatalf("GetCardinalityByTag(dc, fra) = %d after expiration", n)
+	}
+	if names := mi.GetAllMetricNames(); len(names) != 1 || names[0] != "cpu" {
+		t.Fatalf("GetAllMetricNames() = %q after expiration", names)
+	}
+	checkRefs(t, mi)
+
+	// expired series is inserted again as new one
+	mustInsert(t, mi, "mem;dc=fra")
+	checkSeen(t, mi, "mem;dc=fra", clock.now(), clock.now())
+}
+
+func TestShardedExpireOlderThan(t *testing.T) {
+	clock := newTestClock()
+	smi, err := NewShardedMetricsIndex(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, shard := range smi.Shards {
+		shard.now = clock.now
+	}
+	if err := smi.InsertMetricsBatch([]string{"cpu;host=a", "cpu;host=b", "cpu;host=c"}); err != nil {
+		t.Fatal(err)
+	}
+	clock.add(time.Minute)
+	if err := smi.InsertMetric("cpu;host=a"); err != nil {
+		t.Fatal(err)
+	}
+	if n := smi.ExpireOlderThan(clock.now()); n != 2 {
+		t.Fatalf("ExpireOlderThan expired %d series, want 2", n)
+	}
+	if !smi.MetricExistsByMetricStr("cpu;host=a") || smi.MetricExistsByMetricStr("cpu;host=b") {
+		t.Fatal("wrong series are expired")
+	}
+}
+
+func TestExpiryLoop(t *testing.T) {
+	clock := newTestClock()
+	mi := NewMetricsIndex()
+	mi.now = clock.now
+	mustInsert(t, mi, "cpu", "mem")
+
+	mi.StartExpiry(time.Minute, time.Millisecond)
+	clock.add(time.Hour)
+	waitFor(t, func() bool {
+		return !mi.MetricExistsByMetricStr("cpu") && !mi.MetricExistsByMetricStr("mem")
+	})
+	// restarting the loop replaces the running one
+	mi.StartExpiry(time.Minute, time.Millisecond)
+	mi.StopExpiry()
+	mi.StopExpiry()
+
+	// stopped loop doesn't expire anything
+	mustInsert(t, mi, "disk")
+	clock.add(time.Hour)
+	time.Sleep(10 * time.Millisecond)
+	if !mi.MetricExistsByMetricStr("disk") {
+		t.Fatal("series is expired after StopExpiry")
+	}
+}
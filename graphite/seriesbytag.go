@@ -0,0 +1,178 @@
+// Package graphite implements evaluation helpers for Graphite tagged series
+// such as seriesByTag('name=cpu','dc=~ams.*','env!=dev') expressions.
+package graphite
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/spuzirev/metricsindex/types"
+)
+
+// NameTag is the tag Graphite uses for the metric name
+const NameTag = "name"
+
+var (
+	// ErrNoNonEmptyMatcher represents situation when every tag expression
+	// matches empty value, which Graphite doesn't allow as such query would
+	// return the whole index
+	ErrNoNonEmptyMatcher = errors.New("at least one tag expression must not match empty value")
+)
+
+// ParseError is returned when seriesByTag expression is malformed.
+// Pos is the byte offset in the expression where the problem was found.
+type ParseError struct {
+	Pos int
+	Msg string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("cannot parse seriesByTag expression at position %d: %s", e.Pos, e.Msg)
+}
+
+// ParseSeriesByTag parses `seriesByTag('tag=value', ...)` expression
+// and returns matchers it consists of
+func ParseSeriesByTag(expr string) ([]types.Matcher, error) {
+	const fn = "seriesByTag"
+
+	pos := skipSpaces(expr, 0)
+	if !strings.HasPrefix(expr[pos:], fn) {
+		return nil, &ParseError{Pos: pos, Msg: "expected " + fn}
+	}
+	pos = skipSpaces(expr, pos+len(fn))
+	if pos >= len(expr) || expr[pos] != '(' {
+		return nil, &ParseError{Pos: pos, Msg: "expected '('"}
+	}
+	pos++
+
+	tagExprs := make([]string, 0)
+	tagExprsPos := make([]int, 0)
+	for {
+		pos = skipSpaces(expr, pos)
+		if pos < len(expr) && expr[pos] == ')' && len(tagExprs) == 0 {
+			break
+		}
+		start := pos
+		s, next, err := parseString(expr, pos)
+		if err != nil {
+			return nil, err
+		}
+		tagExprs = append(tagExprs, s)
+		tagExprsPos = append(tagExprsPos, start)
+		pos = skipSpaces(expr, next)
+		if pos < len(expr) && expr[pos] == ',' {
+			pos++
+			continue
+		}
+		break
+	}
+	if pos >= len(expr) || expr[pos] != ')' {
+		return nil, &ParseError{Pos: pos, Msg: "expected ',' or ')'"}
+	}
+	pos = skipSpaces(expr, pos+1)
+	if pos != len(expr) {
+		return nil, &ParseError{Pos: pos, Msg: "unexpected trailing characters"}
+	}
+	if len(tagExprs) == 0 {
+		return nil, &ParseError{Pos: pos, Msg: fn + " requires at least one argument"}
+	}
+
+	matchers := make([]types.Matcher, 0, len(tagExprs))
+	nonEmpty := false
+	for i, tagExpr := range tagExprs {
+		m, matchesEmpty, err := ParseTagExpression(tagExpr)
+		if err != nil {
+			// point to the opening quote of the argument
+			return nil, &ParseError{Pos: tagExprsPos[i], Msg: err.Error()}
+		}
+		if !matchesEmpty {
+			nonEmpty = true
+		}
+		matchers = append(matchers, m)
+	}
+	if !nonEmpty {
+		return nil, ErrNoNonEmptyMatcher
+	}
+	return matchers, nil
+}
+
+// ParseTagExpression parses single Graphite tag expression like `dc=~ams.*`
+// and reports if the resulting matcher matches empty (or absent) value.
+// Graphite regular expressions are anchored at the beginning only, so they
+// are converted to fully anchored ones types.Matcher expects.
+func ParseTagExpression(tagExpr string) (m types.Matcher, matchesEmpty bool, err error) {
+	i := strings.IndexAny(tagExpr, "!=")
+	if i <= 0 {
+		return m, false, fmt.Errorf("invalid tag expression %q", tagExpr)
+	}
+	tagName, rest := tagExpr[:i], tagExpr[i:]
+	if tagName == NameTag {
+		tagName = string(types.NameTagName)
+	}
+
+	var value string
+	switch {
+	case strings.HasPrefix(rest, "!=~"):
+		m.Type, value = types.MatchNotRegexp, rest[3:]
+	case strings.HasPrefix(rest, "=~"):
+		m.Type, value = types.MatchRegexp, rest[2:]
+	case strings.HasPrefix(rest, "!="):
+		m.Type, value = types.MatchNotEqual, rest[2:]
+	case strings.HasPrefix(rest, "="):
+		m.Type, value = types.MatchEqual, rest[1:]
+	default:
+		return m, false, fmt.Errorf("invalid tag expression %q", tagExpr)
+	}
+	m.TagName = types.TagName(tagName)
+
+	switch m.Type {
+	case types.MatchEqual:
+		matchesEmpty = value == ""
+	case types.MatchNotEqual:
+		matchesEmpty = value != ""
+	case types.MatchRegexp, types.MatchNotRegexp:
+		re, err := regexp.Compile("^(?:" + value + ")")
+		if err != nil {
+			return m, false, err
+		}
+		matchesEmpty = re.MatchString("") == (m.Type == types.MatchRegexp)
+		value = "(?:" + value + ").*"
+	}
+	m.TagValue = types.TagValue(value)
+	return m, matchesEmpty, nil
+}
+
+func skipSpaces(s string, pos int) int {
+	for pos < len(s) && (s[pos] == ' ' || s[pos] == '\t') {
+		pos++
+	}
+	return pos
+}
+
+// parseString parses single or double quoted string starting at pos and
+// returns it with position right after closing quote
+func parseString(s string, pos int) (string, int, error) {
+	if pos >= len(s) || (s[pos] != '\'' && s[pos] != '"') {
+		return "", pos, &ParseError{Pos: pos, Msg: "expected quoted string"}
+	}
+	start := pos
+	quote := s[pos]
+	pos++
+	var b strings.Builder
+	for pos < len(s) {
+		c := s[pos]
+		switch {
+		case c == quote:
+			return b.String(), pos + 1, nil
+		case c == '\\' && pos+1 < len(s):
+			b.WriteByte(s[pos+1])
+			pos += 2
+		default:
+			b.WriteByte(c)
+			pos++
+		}
+	}
+	return "", pos, &ParseError{Pos: start, Msg: "unterminated string"}
+}
@@ -0,0 +1,136 @@
+package graphite
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spuzirev/metricsindex/types"
+)
+
+func m(mt types.MatchType, tagName, tagValue string) types.Matcher {
+	return types.Matcher{Type: mt, TagName: types.TagName(tagName), TagValue: types.TagValue(tagValue)}
+}
+
+func TestParseSeriesByTag(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []types.Matcher
+	}{
+		{
+			"seriesByTag('name=cpu','dc=~ams.*','env!=dev')",
+			[]types.Matcher{
+				m(types.MatchEqual, "__name__", "cpu"),
+				m(types.MatchRegexp, "dc", "(?:ams.*).*"),
+				m(types.MatchNotEqual, "env", "dev"),
+			},
+		},
+		{
+			"  seriesByTag ( 'a=b' ,\t\"c!=~x|y\" )  ",
+			[]types.Matcher{
+				m(types.MatchEqual, "a", "b"),
+				m(types.MatchNotRegexp, "c", "(?:x|y).*"),
+			},
+		},
+		{`seriesByTag("a=b\"c")`, []types.Matcher{m(types.MatchEqual, "a", `b"c`)}},
+		{`seriesByTag('a=it\'s')`, []types.Matcher{m(types.MatchEqual, "a", "it's")}},
+		{"seriesByTag('a=b=c')", []types.Matcher{m(types.MatchEqual, "a", "b=c")}},
+		{"seriesByTag('a=(b,c)')", []types.Matcher{m(types.MatchEqual, "a", "(b,c)")}},
+		{
+			// matchers matching empty value are fine next to one which doesn't
+			"seriesByTag('dc=','host=~.*','name=cpu')",
+			[]types.Matcher{
+				m(types.MatchEqual, "dc", ""),
+				m(types.MatchRegexp, "host", "(?:.*).*"),
+				m(types.MatchEqual, "__name__", "cpu"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		got, err := ParseSeriesByTag(tt.in)
+		if err != nil {
+			t.Errorf("ParseSeriesByTag(%q) returned %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseSeriesByTag(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseSeriesByTagErrors(t *testing.T) {
+	tests := []struct {
+		in  string
+		pos int
+		// msg is not checked if empty
+		msg string
+	}{
+		{"", 0, "expected seriesByTag"},
+		{"  seriesByTags('a=b')", 13, "expected '('"},
+		{"series('a=b')", 0, "expected seriesByTag"},
+		{"seriesByTag", 11, "expected '('"},
+		{"seriesByTag 'a=b'", 12, "expected '('"},
+		{"seriesByTag()", 13, "seriesByTag requires at least one argument"},
+		{"seriesByTag(a=b)", 12, "expected quoted string"},
+		{"seriesByTag('a=b)", 12, "unterminated string"},
+		{"seriesByTag('a=b'", 17, "expected ',' or ')'"},
+		{"seriesByTag('a=b' 'c=d')", 18, "expected ',' or ')'"},
+		{"seriesByTag('a=b',)", 18, "expected quoted string"},
+		{"seriesByTag('a=b') x", 19, "unexpected trailing characters"},
+		// errors of tag expressions point to the argument
+		{"seriesByTag('a=b', 'dc')", 19, `invalid tag expression "dc"`},
+		{"seriesByTag('=b')", 12, `invalid tag expression "=b"`},
+		{"seriesByTag('a=b','c!~d')", 18, `invalid tag expression "c!~d"`},
+		{"seriesByTag('a=b', \"c=~(\")", 19, ""},
+	}
+	for _, tt := range tests {
+		_, err := ParseSeriesByTag(tt.in)
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("ParseSeriesByTag(%q) returned %v, want *ParseError", tt.in, err)
+			continue
+		}
+		if perr.Pos != tt.pos || (tt.msg != "" && perr.Msg != tt.msg) {
+			t.Errorf("ParseSeriesByTag(%q) returned error at %d: %s, want at %d: %s", tt.in, perr.Pos, perr.Msg, tt.pos, tt.msg)
+		}
+	}
+
+	for _, in := range []string{
+		"seriesByTag('dc=')",
+		"seriesByTag('dc!=ams')",
+		"seriesByTag('dc=~.*','env!=~prod')",
+	} {
+		if _, err := ParseSeriesByTag(in); err != ErrNoNonEmptyMatcher {
+			t.Errorf("ParseSeriesByTag(%q) returned %v, want ErrNoNonEmptyMatcher", in, err)
+		}
+	}
+}
+
+func TestParseTagExpression(t *testing.T) {
+	tests := []struct {
+		in           string
+		want         types.Matcher
+		matchesEmpty bool
+	}{
+		{"dc=ams", m(types.MatchEqual, "dc", "ams"), false},
+		{"dc=", m(types.MatchEqual, "dc", ""), true},
+		{"dc!=ams", m(types.MatchNotEqual, "dc", "ams"), true},
+		{"dc!=", m(types.MatchNotEqual, "dc", ""), false},
+		{"dc=~a.*", m(types.MatchRegexp, "dc", "(?:a.*).*"), false},
+		{"dc=~.*", m(types.MatchRegexp, "dc", "(?:.*).*"), true},
+		{"dc=~a|", m(types.MatchRegexp, "dc", "(?:a|).*"), true},
+		{"dc!=~.*", m(types.MatchNotRegexp, "dc", "(?:.*).*"), false},
+		{"dc!=~a", m(types.MatchNotRegexp, "dc", "(?:a).*"), true},
+		{"name=cpu", m(types.MatchEqual, "__name__", "cpu"), false},
+	}
+	for _, tt := range tests {
+		got, matchesEmpty, err := ParseTagExpression(tt.in)
+		if err != nil || got != tt.want || matchesEmpty != tt.matchesEmpty {
+			t.Errorf("ParseTagExpression(%q) = %v, %v, %v, want %v, %v", tt.in, got, matchesEmpty, err, tt.want, tt.matchesEmpty)
+		}
+	}
+	for _, in := range []string{"", "dc", "=ams", "!=ams", "dc!ams", "dc=~("} {
+		if _, _, err := ParseTagExpression(in); err == nil {
+			t.Errorf("ParseTagExpression(%q) accepted invalid expression", in)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package influx
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/spuzirev/metricsindex/types"
+)
+
+// Inserter is the part of index API used by Handler. It is implemented by
+// every index type.
+type Inserter interface {
+	InsertMetricsBatch(metricsStr []string) error
+}
+
+// Handler serves InfluxDB /write endpoint. As in InfluxDB it responds
+// with 204 if every point was written, with 400 and "partial write"
+// error if some lines or series were rejected (the rest is written
+// anyway), with 413 if body is too large and with 500 if index failed.
+// db, precision and other parameters are ignored.
+type Handler struct {
+	index Inserter
+	opts  Options
+}
+
+// NewHandler is *Handler builder and initializer
+func NewHandler(index Inserter, opts Options) *Handler {
+	if opts.MaxBodySize <= 0 {
+		opts.MaxBodySize = 25 << 20
+	}
+	return &Handler{
+		index: index,
+		opts:  opts,
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Influxdb-Error", msg)
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{msg})
+}
+
+// insert inserts metrics skipping duplicates. If batch is rejected
+// metrics are inserted one by one, so only bad ones are lost. It returns
+// the first error of rejected metric and the first error of the index
+// itself.
+func (h *Handler) insert(metrics []*types.Metric) (rejected, failed error) {
+	seen := make(map[string]struct{}, len(metrics))
+	metricsStr := make([]string, 0, len(metrics))
+	for _, metric := range metrics {
+		metricStr := metric.Serialize()
+		if _, ok := seen[metricStr]; !ok {
+			seen[metricStr] = struct{}{}
+			metricsStr = append(metricsStr, metricStr)
+		}
+	}
+	if len(metricsStr) == 0 || h.index.InsertMetricsBatch(metricsStr) == nil {
+		return nil, nil
+	}
+	for i := range metricsStr {
+		err := h.index.InsertMetricsBatch(metricsStr[i : i+1])
+		switch {
+		case err == nil:
+		case errors.Is(err, types.ErrCannotParseMetricName):
+			if rejected == nil {
+				rejected = err
+			}
+		case failed == nil:
+			failed = err
+		}
+	}
+	return rejected, failed
+}
+
+// ServeHTTP implements http.Handler
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var body io.Reader = http.MaxBytesReader(w, r.Body, h.opts.MaxBodySize)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		defer gz.Close()
+		// limit decompressed size too
+		body = io.LimitReader(gz, h.opts.MaxBodySize+1)
+	}
+	data, err := io.ReadAll(body)
+	if err == nil && int64(len(data)) > h.opts.MaxBodySize {
+		err = &http.MaxBytesError{Limit: h.opts.MaxBodySize}
+	}
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, "request entity too large")
+			return
+		}
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	metrics, parseErr := Parse(data, &h.opts)
+	rejected, failed := h.insert(metrics)
+	if failed != nil {
+		writeError(w, http.StatusInternalServerError, failed.Error())
+		return
+	}
+	if parseErr == nil {
+		parseErr = rejected
+	}
+	if parseErr != nil {
+		writeError(w, http.StatusBadRequest, "partial write: "+parseErr.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
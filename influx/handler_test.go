@@ -0,0 +1,158 @@
+package influx
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/spuzirev/metricsindex/types"
+)
+
+var errFailed = errors.New("failed")
+
+// recordingInserter records inserted names. It rejects batches with
+// names containing "bad" and fails on ones containing "fail".
+type recordingInserter struct {
+	names   []string
+	batches int
+}
+
+func (ri *recordingInserter) InsertMetricsBatch(metricsStr []string) error {
+	ri.batches++
+	for _, metricStr := range metricsStr {
+		if strings.Contains(metricStr, "fail") {
+			return errFailed
+		}
+		if strings.Contains(metricStr, "bad") {
+			return fmt.Errorf("%w: %q", types.ErrCannotParseMetricName, metricStr)
+		}
+	}
+	ri.names = append(ri.names, metricsStr...)
+	return nil
+}
+
+func gzipped(s string) string {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	gz.Write([]byte(s))
+	gz.Close()
+	return b.String()
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		body     string
+		gzip     bool
+		code     int
+		errorMsg string
+		inserted []string
+	}{
+		{
+			name: "written", method: http.MethodPost,
+			body: "cpu,host=a usage=1,idle=2 1\ncpu,host=a usage=3 2\nmem free=1i\n",
+			code: http.StatusNoContent,
+			// duplicates are inserted once
+			inserted: []string{"cpu.idle;host=a", "cpu.usage;host=a", "mem.free"},
+		},
+		{name: "empty body", method: http.MethodPost, code: http.StatusNoContent},
+		{
+			name: "gzip", method: http.MethodPost, body: gzipped("cpu usage=1"), gzip: true,
+			code: http.StatusNoContent, inserted: []string{"cpu.usage"},
+		},
+		{
+			name: "bad line", method: http.MethodPost, body: "cpu usage=1\nmem\ndisk free=1",
+			code:     http.StatusBadRequest,
+			errorMsg: "partial write: cannot parse line 2 at position 3: missing fields",
+			inserted: []string{"cpu.usage", "disk.free"},
+		},
+		{
+			name: "rejected series", method: http.MethodPost, body: "cpu usage=1,bad=2\nmem free=1",
+			code:     http.StatusBadRequest,
+			errorMsg: `partial write: Cannot parse metric name: "cpu.bad"`,
+			inserted: []string{"cpu.usage", "mem.free"},
+		},
+		{
+			name: "index failure", method: http.MethodPost, body: "cpu usage=1,fail=2",
+			code: http.StatusInternalServerError, errorMsg: errFailed.Error(),
+			inserted: []string{"cpu.usage"},
+		},
+		{
+			name: "too large", method: http.MethodPost, body: "cpu usage=1" + strings.Repeat(" ", 100),
+			code: http.StatusRequestEntityTooLarge, errorMsg: "request entity too large",
+		},
+		{
+			name: "too large decompressed", method: http.MethodPost,
+			body: gzipped("cpu usage=1" + strings.Repeat(" ", 100)), gzip: true,
+			code: http.StatusRequestEntityTooLarge, errorMsg: "request entity too large",
+		},
+		{
+			name: "bad gzip", method: http.MethodPost, body: "cpu usage=1", gzip: true,
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "get", method: http.MethodGet,
+			code: http.StatusMethodNotAllowed, errorMsg: "method not allowed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ri := &recordingInserter{}
+			h := NewHandler(ri, Options{MaxBodySize: 100})
+			r := httptest.NewRequest(tt.method, "/write?db=test&precision=s", strings.NewReader(tt.body))
+			if tt.gzip {
+				r.Header.Set("Content-Encoding", "gzip")
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.code {
+				t.Fatalf("code is %d, want %d: %s", w.Code, tt.code, w.Body)
+			}
+			if tt.code == http.StatusNoContent {
+				if w.Body.Len() != 0 {
+					t.Fatalf("body of 204 response is %q", w.Body)
+				}
+			} else {
+				msg := w.Header().Get("X-Influxdb-Error")
+				if msg == "" || (tt.errorMsg != "" && msg != tt.errorMsg) {
+					t.Fatalf("X-Influxdb-Error is %q, want %q", msg, tt.errorMsg)
+				}
+				if want := fmt.Sprintf(`{"error":%q}`, msg); strings.TrimSpace(w.Body.String()) != want {
+					t.Fatalf("body is %s, want %s", w.Body, want)
+				}
+			}
+			if tt.method != http.MethodPost && w.Header().Get("Allow") != "POST" {
+				t.Fatalf("Allow header is %q", w.Header().Get("Allow"))
+			}
+
+			sort.Strings(ri.names)
+			if !reflect.DeepEqual(ri.names, tt.inserted) {
+				t.Fatalf("inserted %q, want %q", ri.names, tt.inserted)
+			}
+		})
+	}
+}
+
+func TestHandlerSingleBatch(t *testing.T) {
+	ri := &recordingInserter{}
+	h := NewHandler(ri, Options{})
+	body := strings.Repeat("cpu,host=a usage=1,idle=2\n", 1000)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/write", strings.NewReader(body)))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("code is %d: %s", w.Code, w.Body)
+	}
+	// accepted request is inserted by single batch
+	if ri.batches != 1 || len(ri.names) != 2 {
+		t.Fatalf("inserted %q in %d batches", ri.names, ri.batches)
+	}
+}
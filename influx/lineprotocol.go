@@ -0,0 +1,268 @@
+// Package influx implements ingestion of InfluxDB line protocol
+//
+//	measurement[,tag=value...] field=value[,field=value...] [timestamp]
+//
+// Every field of a point becomes a separate series named
+// measurement.field with point's tags. Only series are extracted, field
+// values and timestamps are validated and dropped.
+package influx
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spuzirev/metricsindex/types"
+)
+
+// Escaping: in measurement ',' and ' ' are written as "\," and "\ ", in
+// tag keys, tag values and field keys '=' is escaped as well. Backslash
+// followed by any other character is kept as is. In string field values
+// '"' and '\' are escaped.
+
+// Options configures conversion of points to metrics
+type Options struct {
+	// Separator is put between measurement and field key in metric
+	// name, default is "."
+	Separator string
+	// FieldTag, if set, makes metric name to be just measurement and
+	// field key to be stored as tag with this name
+	FieldTag string
+
+	// MaxBodySize limits size of request accepted by Handler, default
+	// is 25MiB
+	MaxBodySize int64
+}
+
+// ParseError is returned when line is malformed. Line is 1-based number
+// of the line, Pos is the byte offset in the line where the problem was
+// found.
+type ParseError struct {
+	Line int
+	Pos  int
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("cannot parse line %d at position %d: %s", e.Line, e.Pos, e.Msg)
+}
+
+// scan returns end of token starting at pos which ends with one of stops
+// or at the end of line. Escaped characters don't end token.
+func scan(line []byte, pos int, stops string) int {
+	for pos < len(line) {
+		c := line[pos]
+		if c == '\\' && pos+1 < len(line) {
+			pos += 2
+			continue
+		}
+		for i := 0; i < len(stops); i++ {
+			if c == stops[i] {
+				return pos
+			}
+		}
+		pos++
+	}
+	return pos
+}
+
+// unescape removes '\' in front of special characters
+func unescape(b []byte, special string) string {
+	if bytes.IndexByte(b, '\\') < 0 {
+		return string(b)
+	}
+	res := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		if b[i] == '\\' && i+1 < len(b) && strings.IndexByte(special, b[i+1]) >= 0 {
+			i++
+		}
+		res = append(res, b[i])
+	}
+	return string(res)
+}
+
+// validFieldValue returns true if v is float, integer (1i), unsigned
+// (1u) or boolean field value. String values are handled by scanString.
+func validFieldValue(v []byte) bool {
+	if len(v) == 0 {
+		return false
+	}
+	s := string(v)
+	switch s {
+	case "t", "T", "true", "True", "TRUE", "f", "F", "false", "False", "FALSE":
+		return true
+	}
+	switch s[len(s)-1] {
+	case 'i':
+		_, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		return err == nil
+	case 'u':
+		_, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+		return err == nil
+	}
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil
+}
+
+// scanString returns position following closing quote of string field
+// value starting with opening quote at pos
+func scanString(line []byte, pos int) (int, bool) {
+	for pos++; pos < len(line); pos++ {
+		switch line[pos] {
+		case '\\':
+			pos++
+		case '"':
+			return pos + 1, true
+		}
+	}
+	return pos, false
+}
+
+func skipSpaces(line []byte, pos int) int {
+	for pos < len(line) && (line[pos] == ' ' || line[pos] == '\t') {
+		pos++
+	}
+	return pos
+}
+
+// metricName returns name of metric of measurement's field
+func (opts *Options) metricName(measurement, field string) string {
+	if opts.FieldTag != "" {
+		return measurement
+	}
+	sep := opts.Separator
+	if sep == "" {
+		sep = "."
+	}
+	return measurement + sep + field
+}
+
+// ParseLine converts single line to metrics, one per field. Empty lines
+// and comments return no metrics. Line number of returned *ParseError
+// is 1.
+func ParseLine(line []byte, opts *Options) ([]*types.Metric, error) {
+	errorf := func(pos int, format string, args ...interface{}) error {
+		return &ParseError{Line: 1, Pos: pos, Msg: fmt.Sprintf(format, args...)}
+	}
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
+	}
+	pos := skipSpaces(line, 0)
+	if pos == len(line) || line[pos] == '#' {
+		return nil, nil
+	}
+
+	end := scan(line, pos, ", ")
+	if end == pos {
+		return nil, errorf(pos, "missing measurement")
+	}
+	measurement := unescape(line[pos:end], ", ")
+	pos = end
+
+	tags := make(map[string]string)
+	for pos < len(line) && line[pos] == ',' {
+		pos++
+		end = scan(line, pos, "=, ")
+		if end == pos || end == len(line) || line[end] != '=' {
+			return nil, errorf(pos, "invalid tag")
+		}
+		tagName := unescape(line[pos:end], ",= ")
+		pos = end + 1
+		end = scan(line, pos, ", ")
+		if end == pos {
+			return nil, errorf(pos, "missing value of tag %q", tagName)
+		}
+		tags[tagName] = unescape(line[pos:end], ",= ")
+		pos = end
+	}
+
+	pos = skipSpaces(line, pos)
+	if pos == len(line) {
+		return nil, errorf(pos, "missing fields")
+	}
+	fields := make([]string, 0, 1)
+	for {
+		end = scan(line, pos, "=, ")
+		if end == pos || end == len(line) || line[end] != '=' {
+			return nil, errorf(pos, "invalid field")
+		}
+		field := unescape(line[pos:end], ",= ")
+		pos = end + 1
+		if pos < len(line) && line[pos] == '"' {
+			var ok bool
+			if end, ok = scanString(line, pos); !ok {
+				return nil, errorf(pos, "unterminated string value of field %q", field)
+			}
+		} else {
+			end = scan(line, pos, ", ")
+			if !validFieldValue(line[pos:end]) {
+				return nil, errorf(pos, "invalid value of field %q", field)
+			}
+		}
+		fields = append(fields, field)
+		pos = end
+		if pos == len(line) || line[pos] != ',' {
+			break
+		}
+		pos++
+	}
+
+	if pos < len(line) {
+		if line[pos] != ' ' && line[pos] != '\t' {
+			return nil, errorf(pos, "unexpected character %q", line[pos])
+		}
+		pos = skipSpaces(line, pos)
+		end = scan(line, pos, " \t")
+		if end > pos {
+			if _, err := strconv.ParseInt(string(line[pos:end]), 10, 64); err != nil {
+				return nil, errorf(pos, "invalid timestamp")
+			}
+		}
+		if pos = skipSpaces(line, end); pos != len(line) {
+			return nil, errorf(pos, "unexpected trailing characters")
+		}
+	}
+
+	metrics := make([]*types.Metric, len(fields))
+	for i, field := range fields {
+		metricTags := make(map[string]string, len(tags)+1)
+		for k, v := range tags {
+			metricTags[k] = v
+		}
+		if opts.FieldTag != "" {
+			metricTags[opts.FieldTag] = field
+		}
+		metrics[i] = &types.Metric{
+			Name: opts.metricName(measurement, field),
+			Tags: metricTags,
+		}
+	}
+	return metrics, nil
+}
+
+// Parse converts lines of data to metrics. Lines which can't be parsed
+// are skipped, error of the first of them is returned along with metrics
+// of the rest.
+func Parse(data []byte, opts *Options) ([]*types.Metric, error) {
+	metrics := make([]*types.Metric, 0)
+	var firstErr error
+	for lineNo := 1; len(data) > 0; lineNo++ {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+		lineMetrics, err := ParseLine(line, opts)
+		if err != nil {
+			if firstErr == nil {
+				err.(*ParseError).Line = lineNo
+				firstErr = err
+			}
+			continue
+		}
+		metrics = append(metrics, lineMetrics...)
+	}
+	return metrics, firstErr
+}
@@ -0,0 +1,162 @@
+package influx
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spuzirev/metricsindex/types"
+)
+
+func metric(name string, tags ...string) *types.Metric {
+	m := &types.Metric{Name: name, Tags: map[string]string{}}
+	for i := 0; i < len(tags); i += 2 {
+		m.Tags[tags[i]] = tags[i+1]
+	}
+	return m
+}
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		opts Options
+		want []*types.Metric
+	}{
+		{"empty", "", Options{}, nil},
+		{"spaces", " \t", Options{}, nil},
+		{"comment", "# cpu,host=a usage=1", Options{}, nil},
+		{
+			"tags and fields", "cpu,host=a,dc=ams usage=1.5,idle=2i 1600000000000000000", Options{},
+			[]*types.Metric{metric("cpu.usage", "host", "a", "dc", "ams"), metric("cpu.idle", "host", "a", "dc", "ams")},
+		},
+		{"no tags", "cpu usage=1", Options{}, []*types.Metric{metric("cpu.usage")}},
+		{"surrounding spaces", "  cpu,host=a \t usage=1 \t 1 \r", Options{}, []*types.Metric{metric("cpu.usage", "host", "a")}},
+		{
+			"field values", "m a=t,b=FALSE,c=1u,d=-1i,e=-1.5e3,f=\"\"", Options{},
+			[]*types.Metric{metric("m.a"), metric("m.b"), metric("m.c"), metric("m.d"), metric("m.e"), metric("m.f")},
+		},
+		{"separator", "cpu usage=1", Options{Separator: "_"}, []*types.Metric{metric("cpu_usage")}},
+		{
+			"field tag", "cpu,host=a usage=1,idle=2", Options{FieldTag: "field"},
+			[]*types.Metric{metric("cpu", "host", "a", "field", "usage"), metric("cpu", "host", "a", "field", "idle")},
+		},
+
+		// escaping
+		{"escaped measurement", `my\ cpu\,x f=1`, Options{}, []*types.Metric{metric("my cpu,x.f")}},
+		{"equals in measurement isn't escaped", `a\=b f=1`, Options{}, []*types.Metric{metric(`a\=b.f`)}},
+		{"unknown escape is kept", `c\pu,h\ost=w\eb f\ield=1`, Options{}, []*types.Metric{metric(`c\pu.f\ield`, `h\ost`, `w\eb`)}},
+		{
+			"escaped tag", `cpu,ta\ g\=1\,x=v\,a\ l\=ue f=1`, Options{},
+			[]*types.Metric{metric("cpu.f", "ta g=1,x", "v,a l=ue")},
+		},
+		{"escaped field key", `cpu f\=x\,y\ z=1`, Options{}, []*types.Metric{metric("cpu.f=x,y z")}},
+		{
+			"string value", `m s="a \"quoted\", b=c \\",t=1 1`, Options{},
+			[]*types.Metric{metric("m.s"), metric("m.t")},
+		},
+	}
+	for _, tt := range tests {
+		got, err := ParseLine([]byte(tt.line), &tt.opts)
+		if err != nil {
+			t.Errorf("%s: ParseLine(%q) returned %v", tt.name, tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ParseLine(%q) = %v, want %v", tt.name, tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseLineErrors(t *testing.T) {
+	tests := []struct {
+		line string
+		pos  int
+		msg  string
+	}{
+		{",a=b f=1", 0, "missing measurement"},
+		{"m,a f=1", 2, "invalid tag"},
+		{"m,a", 2, "invalid tag"},
+		{"m,=b f=1", 2, "invalid tag"},
+		{"m,a= f=1", 4, `missing value of tag "a"`},
+		{"m", 1, "missing fields"},
+		// escaped space doesn't separate fields
+		{`cpu\ f=1`, 8, "missing fields"},
+		{"m,a=b ", 6, "missing fields"},
+		{"m f", 2, "invalid field"},
+		{"m =1", 2, "invalid field"},
+		{"m f=1,", 6, "invalid field"},
+		{"m f=", 4, `invalid value of field "f"`},
+		{"m f=abc", 4, `invalid value of field "f"`},
+		{"m f=1.5i", 4, `invalid value of field "f"`},
+		{"m f=-1u", 4, `invalid value of field "f"`},
+		{`m f="abc`, 4, `unterminated string value of field "f"`},
+		{`m f="abc\"`, 4, `unterminated string value of field "f"`},
+		{`m f="a"x`, 7, "unexpected character 'x'"},
+		{"m f=1 abc", 6, "invalid timestamp"},
+		{"m f=1 1.5", 6, "invalid timestamp"},
+		{"m f=1 1 2", 8, "unexpected trailing characters"},
+	}
+	for _, tt := range tests {
+		_, err := ParseLine([]byte(tt.line), &Options{})
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("ParseLine(%q) returned %v, want *ParseError", tt.line, err)
+			continue
+		}
+		want := ParseError{Line: 1, Pos: tt.pos, Msg: tt.msg}
+		if *perr != want {
+			t.Errorf("ParseLine(%q) returned %+v, want %+v", tt.line, *perr, want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	data := "# comment\ncpu,host=a usage=1\r\n\nbad\nmem free=1 abc\ndisk free=1u"
+	metrics, err := Parse([]byte(data), &Options{})
+	want := []*types.Metric{metric("cpu.usage", "host", "a"), metric("disk.free")}
+	if !reflect.DeepEqual(metrics, want) {
+		t.Fatalf("Parse returned %v, want %v", metrics, want)
+	}
+	// error of the first bad line is returned
+	perr, ok := err.(*ParseError)
+	if !ok || perr.Line != 4 || perr.Pos != 3 {
+		t.Fatalf("Parse returned %v, want error at line 4 position 3", err)
+	}
+
+	metrics, err = Parse(nil, &Options{})
+	if err != nil || metrics == nil || len(metrics) != 0 {
+		t.Fatalf("Parse(nil) = %v, %v, want empty slice", metrics, err)
+	}
+}
+
+func FuzzLineProtocol(f *testing.F) {
+	for _, line := range []string{
+		"cpu,host=a,dc=ams usage=1.5,idle=2i 1600000000000000000",
+		`my\ cpu\,x,ta\ g\=1=v\,a\ l\=ue f\=x=1`,
+		`m s="a \"quoted\", b=c \\",t=1u 1`,
+		"# comment",
+		"m,a= f=1",
+	} {
+		f.Add([]byte(line))
+	}
+	f.Fuzz(func(t *testing.T, line []byte) {
+		metrics, err := ParseLine(line, &Options{})
+		if err != nil {
+			perr, ok := err.(*ParseError)
+			if !ok || perr.Line != 1 || perr.Pos < 0 || perr.Pos > len(line) {
+				t.Fatalf("ParseLine returned %#v", err)
+			}
+			return
+		}
+		for _, m := range metrics {
+			if m.Name == "" {
+				t.Fatalf("bad metric name %q", m.Name)
+			}
+			for k, v := range m.Tags {
+				if k == "" || v == "" {
+					t.Fatalf("empty tag %q=%q", k, v)
+				}
+			}
+		}
+	})
+}
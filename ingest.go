@@ -0,0 +1,168 @@
+package metricsindex
+
+import (
+	"bytes"
+	"unicode/utf8"
+
+	"github.com/spuzirev/metricsindex/types"
+)
+
+// Fast path of ingestion. Metric string which has no escape sequences and
+// has tags sorted by name is exactly what Metric.Serialize and
+// Metric.HashKey return, so its MetricID is the hash of the input itself
+// and neither parsing nor serialization is needed to find out whether the
+// series is already known.
+// Anything else takes the usual ParseMetric path.
+
+// validBytes returns true if every character of s is allowed by opts
+func validBytes(s []byte, opts *types.ParseOptions) bool {
+	if opts.AllowedChar == nil {
+		return true
+	}
+	for i := 0; i < len(s); {
+		r, size := rune(s[i]), 1
+		if r >= utf8.RuneSelf {
+			r, size = utf8.DecodeRune(s[i:])
+		}
+		if !opts.AllowedChar(r) {
+			return false
+		}
+		i += size
+	}
+	return true
+}
+
+// nextTag returns bounds of the tag which starts right after ';' at start:
+// position of '=' and end of the tag value.
+// ok is false if the tag is not in canonical form.
+func nextTag(b []byte, start int) (eq, end int, ok bool) {
+	eq = -1
+	for end = start; end < len(b) && b[end] != ';'; end++ {
+		switch b[end] {
+		case '\\':
+			return 0, 0, false
+		case '=':
+			if eq >= 0 {
+				return 0, 0, false
+			}
+			eq = end
+		}
+	}
+	// empty tag name or no value at all
+	if eq <= start {
+		return 0, 0, false
+	}
+	return eq, end, true
+}
+
+// canonicalMetricID returns MetricID of metric string representation b
+// if b is canonical and passes validation of opts. Otherwise ok is false
+// and b has to be parsed.
+func canonicalMetricID(b []byte, opts *types.ParseOptions) (types.MetricID, bool) {
+	end := bytes.IndexByte(b, ';')
+	if end < 0 {
+		end = len(b)
+	}
+	name := b[:end]
+	// '=' is escaped in canonical metric name
+	if bytes.IndexAny(name, "\\=") >= 0 || !validBytes(name, opts) {
+		return 0, false
+	}
+	if opts.MaxNameLen > 0 && len(name) > opts.MaxNameLen {
+		return 0, false
+	}
+
+	var prev []byte
+	for end < len(b) {
+		start := end + 1
+		eq, tagEnd, ok := nextTag(b, start)
+		if !ok {
+			return 0, false
+		}
+		tagName, tagValue := b[start:eq], b[eq+1:tagEnd]
+		// strictly ascending, so there are no duplicates either
+		if prev != nil && bytes.Compare(prev, tagName) >= 0 {
+			return 0, false
+		}
+		if len(tagValue) == 0 && !opts.AllowEmptyTagValues {
+			return 0, false
+		}
+		if opts.MaxTagNameLen > 0 && len(tagName) > opts.MaxTagNameLen {
+			return 0, false
+		}
+		if opts.MaxTagValueLen > 0 && len(tagValue) > opts.MaxTagValueLen {
+			return 0, false
+		}
+		if !validBytes(tagName, opts) || !validBytes(tagValue, opts) {
+			return 0, false
+		}
+		prev = tagName
+		end = tagEnd
+	}
+	return types.MetricID(metricHash(b)), true
+}
+
+// sameMetricBytes returns true if canonical metric string representation b
+// represents metric
+func sameMetricBytes(metric *types.Metric, b []byte) bool {
+	end := bytes.IndexByte(b, ';')
+	if end < 0 {
+		end = len(b)
+	}
+	if metric.Name != string(b[:end]) {
+		return false
+	}
+	tagsCount := 0
+	for end < len(b) {
+		start := end + 1
+		eq, tagEnd, _ := nextTag(b, start)
+		tagValue, ok := metric.Tags[string(b[start:eq])]
+		if !ok || tagValue != string(b[eq+1:tagEnd]) {
+			return false
+		}
+		tagsCount++
+		end = tagEnd
+	}
+	return tagsCount == len(metric.Tags)
+}
+
+// touchMetricBytes updates last seen time of metric with canonical string
+// representation b and given hash and returns true if it exists in the
+// index
+// Caller must hold read lock.
+func (mi *MetricsIndex) touchMetricBytes(b []byte, hash types.MetricID) bool {
+	metricID := hash
+	metric, ok := mi.MetricIDToMetric.Get(hash)
+	if !ok || !sameMetricBytes(&metric, b) {
+		if metricID, ok = mi.lookupMetricIDOverride(b, hash); !ok {
+			return false
+		}
+	}
+	mi.touchMetricID(metricID)
+	return true
+}
+
+// touchKnownMetricBytes returns true if b is canonical metric string
+// representation of metric which exists in the index and updates its last
+// seen time.
+// It doesn't allocate.
+func (mi *MetricsIndex) touchKnownMetricBytes(b []byte) bool {
+	metricID, ok := canonicalMetricID(b, mi.parseOptions)
+	if !ok {
+		return false
+	}
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	return mi.touchMetricBytes(b, metricID)
+}
+
+// InsertMetricBytes inserts metric to index by metric string representation.
+// Already known series in canonical form (no escape sequences, tags sorted
+// by name) are recognized without any allocation, so it is the preferred
+// way to ingest metrics received from network. b is not retained.
+func (mi *MetricsIndex) InsertMetricBytes(b []byte) error {
+	if mi.touchKnownMetricBytes(b) {
+		return nil
+	}
+	return mi.InsertMetric(string(b))
+}
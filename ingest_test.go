@@ -0,0 +1,127 @@
+package metricsindex
+
+import (
+	"fmt"
+	"testing"
+)
+
+// bytesInserter is implemented by MetricsIndex and ShardedMetricsIndex
+type bytesInserter interface {
+	InsertMetric(metricStr string) error
+	InsertMetricBytes(b []byte) error
+	MetricExistsByMetricStr(metricStr string) bool
+}
+
+func bytesInserters(t testing.TB) map[string]bytesInserter {
+	smi, err := NewShardedMetricsIndex(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]bytesInserter{
+		"MetricsIndex":        NewMetricsIndex(),
+		"ShardedMetricsIndex": smi,
+	}
+}
+
+// knownMetrics are canonical metric strings inserted before measuring
+var knownMetrics = [][]byte{
+	[]byte("cpu.load"),
+	[]byte("cpu.load;dc=ams;host=web-1"),
+	[]byte("disk.used;dc=fra;host=db-1;mount=/var"),
+}
+
+func TestInsertMetricBytesKnownDoesNotAllocate(t *testing.T) {
+	for name, index := range bytesInserters(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, b := range knownMetrics {
+				if err := index.InsertMetricBytes(b); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, b := range knownMetrics {
+				allocs := testing.AllocsPerRun(100, func() {
+					if err := index.InsertMetricBytes(b); err != nil {
+						t.Fatal(err)
+					}
+				})
+				if allocs != 0 {
+					t.Errorf("InsertMetricBytes(%q) allocates %v times, want 0", b, allocs)
+				}
+			}
+		})
+	}
+}
+
+func TestInsertMetricBytes(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"cpu;host=a;dc=ams", "cpu;dc=ams;host=a"},
+		{"cpu;dc=ams;host=a", "cpu;dc=ams;host=a"},
+		{`path;dir=C:\\temp`, `path;dir=C:\\temp`},
+		{"m", "m"},
+		{"name=x;a=b", `name\=x;a=b`},
+		{"v;a=b=c", `v;a=b\=c`},
+		{`w;dir=C:\temp`, `w;dir=C:\\temp`},
+	}
+	for name, index := range bytesInserters(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, tt := range tests {
+				if err := index.InsertMetricBytes([]byte(tt.in)); err != nil {
+					t.Fatalf("InsertMetricBytes(%q): %v", tt.in, err)
+				}
+				if !index.MetricExistsByMetricStr(tt.want) {
+					t.Fatalf("InsertMetricBytes(%q) didn't insert %q", tt.in, tt.want)
+				}
+			}
+			if err := index.InsertMetricBytes([]byte("cpu;host")); err == nil {
+				t.Fatal("InsertMetricBytes accepted malformed metric")
+			}
+		})
+	}
+}
+
+func BenchmarkInsertMetricBytesKnown(b *testing.B) {
+	metrics := make([][]byte, 1000)
+	for i := range metrics {
+		metrics[i] = []byte(fmt.Sprintf("cpu.load;dc=ams;host=web-%d;role=frontend", i))
+	}
+	for name, index := range bytesInserters(b) {
+		for _, metric := range metrics {
+			if err := index.InsertMetricBytes(metric); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := index.InsertMetricBytes(metrics[i%len(metrics)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkInsertMetricKnown(b *testing.B) {
+	metrics := make([]string, 1000)
+	for i := range metrics {
+		metrics[i] = fmt.Sprintf("cpu.load;dc=ams;host=web-%d;role=frontend", i)
+	}
+	for name, index := range bytesInserters(b) {
+		for _, metric := range metrics {
+			if err := index.InsertMetric(metric); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := index.InsertMetric(metrics[i%len(metrics)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package metricsindex
+
+import (
+	"strings"
+
+	"github.com/spuzirev/metricsindex/types"
+)
+
+// Names and values of tags repeat across millions of metrics, so every
+// string stored in the index goes through internTable and all metrics,
+// TagNames, MetricNames and tag_values trees and ID registries (see
+// collisions.go) share a single copy of it.
+// Strings are reference counted by metrics using them and dropped from
+// the table when the last such metric is deleted.
+
+// InternStats describes strings interning table of the index
+type InternStats struct {
+	// Strings is number of unique strings in the table
+	Strings int
+	// Bytes is total length of unique strings
+	Bytes uint64
+	// Refs is number of references to strings made by metrics
+	Refs uint64
+	// SavedBytes is how much string data would be duplicated if every
+	// metric had its own copy of name, tag names and tag values
+	SavedBytes uint64
+}
+
+type internEntry struct {
+	s    string
+	refs uint64
+}
+
+// internTable is reference counted strings deduplication table
+type internTable struct {
+	entries map[string]*internEntry
+	stats   InternStats
+}
+
+func newInternTable() *internTable {
+	return &internTable{
+		entries: make(map[string]*internEntry),
+	}
+}
+
+// intern returns shared copy of s and takes a reference to it
+func (t *internTable) intern(s string) string {
+	if e, ok := t.entries[s]; ok {
+		e.refs++
+		t.stats.Refs++
+		t.stats.SavedBytes += uint64(len(s))
+		return e.s
+	}
+	// clone so s doesn't pin memory of a bigger string it is cut from
+	s = strings.Clone(s)
+	t.entries[s] = &internEntry{
+		s:    s,
+		refs: 1,
+	}
+	t.stats.Strings++
+	t.stats.Bytes += uint64(len(s))
+	t.stats.Refs++
+	return s
+}
+
+// release drops a reference to s taken by intern
+func (t *internTable) release(s string) {
+	e, ok := t.entries[s]
+	if !ok {
+		return
+	}
+	e.refs--
+	t.stats.Refs--
+	if e.refs > 0 {
+		t.stats.SavedBytes -= uint64(len(s))
+		return
+	}
+	delete(t.entries, s)
+	t.stats.Strings--
+	t.stats.Bytes -= uint64(len(s))
+}
+
+// internMetric returns copy of metric made of interned strings
+func (t *internTable) internMetric(metric *types.Metric) *types.Metric {
+	tags := make(map[string]string, len(metric.Tags))
+	for tagName, tagValue := range metric.Tags {
+		tags[t.intern(tagName)] = t.intern(tagValue)
+	}
+	return &types.Metric{
+		Name: t.intern(metric.Name),
+		Tags: tags,
+	}
+}
+
+// releaseMetric drops references taken by internMetric
+func (t *internTable) releaseMetric(metric *types.Metric) {
+	t.release(metric.Name)
+	for tagName, tagValue := range metric.Tags {
+		t.release(tagName)
+		t.release(tagValue)
+	}
+}
+
+// InternStats returns statistics of strings interning table
+func (mi *MetricsIndex) InternStats() InternStats {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	return mi.interned.stats
+}
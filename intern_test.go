@@ -0,0 +1,104 @@
+package metricsindex
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/spuzirev/metricsindex/types"
+)
+
+// sameString returns true if a and b share the same memory
+func sameString(a, b string) bool {
+	return len(a) == len(b) && unsafe.StringData(a) == unsafe.StringData(b)
+}
+
+func TestInternTable(t *testing.T) {
+	table := newInternTable()
+	a := table.intern(string([]byte("web")))
+	b := table.intern(string([]byte("web")))
+	if !sameString(a, b) {
+		t.Fatal("interned strings don't share memory")
+	}
+	want := InternStats{Strings: 1, Bytes: 3, Refs: 2, SavedBytes: 3}
+	if table.stats != want {
+		t.Fatalf("stats are %+v, want %+v", table.stats, want)
+	}
+
+	table.release("web")
+	want = InternStats{Strings: 1, Bytes: 3, Refs: 1}
+	if table.stats != want {
+		t.Fatalf("stats are %+v after release, want %+v", table.stats, want)
+	}
+	// the last reference drops the string
+	table.release("web")
+	if table.stats != (InternStats{}) || len(table.entries) != 0 {
+		t.Fatalf("stats are %+v, %d entries after the last release", table.stats, len(table.entries))
+	}
+	// unknown string is ignored
+	table.release("web")
+	if table.stats != (InternStats{}) {
+		t.Fatalf("stats are %+v after release of unknown string", table.stats)
+	}
+
+	if c := table.intern("web"); sameString(c, a) {
+		t.Fatal("dropped string is reused")
+	}
+}
+
+func TestInternStats(t *testing.T) {
+	mi := NewMetricsIndex()
+	mustInsert(t, mi, "cpu;dc=ams;host=a", "cpu;dc=ams;host=b")
+	// cpu dc ams host a b, the second metric shares all but "b"
+	inserted := InternStats{Strings: 6, Bytes: 14, Refs: 10, SavedBytes: 12}
+	if got := mi.InternStats(); got != inserted {
+		t.Fatalf("InternStats() = %+v, want %+v", got, inserted)
+	}
+	// touching known metric takes no references
+	mustInsert(t, mi, "cpu;dc=ams;host=a")
+	if got := mi.InternStats(); got != inserted {
+		t.Fatalf("InternStats() = %+v after touch, want %+v", got, inserted)
+	}
+
+	if err := mi.DeleteMetric("cpu;dc=ams;host=a"); err != nil {
+		t.Fatal(err)
+	}
+	want := InternStats{Strings: 5, Bytes: 13, Refs: 5}
+	if got := mi.InternStats(); got != want {
+		t.Fatalf("InternStats() = %+v after delete, want %+v", got, want)
+	}
+
+	// re-inserted metric reuses strings of the other one
+	mustInsert(t, mi, "cpu;dc=ams;host=a")
+	if got := mi.InternStats(); got != inserted {
+		t.Fatalf("InternStats() = %+v after re-insert, want %+v", got, inserted)
+	}
+	a, _ := mi.MetricIDToMetric.Get(metricIDOf(t, mi, "cpu;dc=ams;host=a"))
+	b, _ := mi.MetricIDToMetric.Get(metricIDOf(t, mi, "cpu;dc=ams;host=b"))
+	if !sameString(a.Name, b.Name) || !sameString(a.Tags["dc"], b.Tags["dc"]) {
+		t.Fatal("metrics don't share interned strings")
+	}
+
+	// keys of ID registries are interned strings too
+	tnv := types.TagNameValue{TagName: "dc", TagValue: "ams"}
+	tnvid, ok := mi.tagNameValueID(tnv)
+	if !ok {
+		t.Fatal("dc=ams has no TagNameValueID")
+	}
+	key := mi.tagNameValueIDs.keys[uint64(tnvid)]
+	if !sameString(string(key.TagValue), a.Tags["dc"]) {
+		t.Fatal("TagNameValue registry keeps its own copy of the value")
+	}
+	mnid, _ := mi.metricNameID("cpu")
+	if !sameString(string(mi.metricNameIDs.keys[uint64(mnid)]), a.Name) {
+		t.Fatal("MetricName registry keeps its own copy of the name")
+	}
+
+	for _, metricStr := range []string{"cpu;dc=ams;host=a", "cpu;dc=ams;host=b"} {
+		if err := mi.DeleteMetric(metricStr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := mi.InternStats(); got != (InternStats{}) {
+		t.Fatalf("InternStats() = %+v after everything is deleted", got)
+	}
+}
@@ -0,0 +1,258 @@
+package metricsindex
+
+import (
+	"errors"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spuzirev/metricsindex/graphite"
+	"github.com/spuzirev/metricsindex/postings"
+	"github.com/spuzirev/metricsindex/selector"
+	"github.com/spuzirev/metricsindex/types"
+)
+
+var (
+	// ErrUnknownMatchType represents situation when matcher has
+	// unsupported type
+	ErrUnknownMatchType = errors.New("unknown match type")
+)
+
+// tagPostings returns metricIDs of metrics having given tag with any
+// value, include tells if they have to be included to or excluded from
+// the result, see matcherPostings.
+// Every metric has a name, so instead of postings of the whole index nil
+// is returned for types.NameTagName: excluding nothing matches every
+// metric and including nothing matches none.
+func (mi *MetricsIndex) tagPostings(tagName types.TagName, include bool) (*postings.List, bool, error) {
+	if tagName == types.NameTagName {
+		return nil, !include, nil
+	}
+	metricIDs, _ := mi.getTagMetricIDs(tagName)
+	return metricIDs, include, nil
+}
+
+// tagValuePostings returns metricIDs of metrics having given tag
+// with given value or nil if there are no such metrics
+func (mi *MetricsIndex) tagValuePostings(tagName types.TagName, tagValue types.TagValue) *postings.List {
+	if tagName == types.NameTagName {
+		metricIDs, _ := mi.getNameMetricIDs(types.MetricName(tagValue))
+		return metricIDs
+	}
+	metricIDs, _ := mi.getTagNameValueMetricIDs(types.TagNameValue{
+		TagName:  tagName,
+		TagValue: tagValue,
+	})
+	return metricIDs
+}
+
+// compileRegexp compiles regular expression which has to match
+// whole string
+func compileRegexp(expr string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+// regexpPostings returns union of metricIDs of metrics having given tag
+// with value matching (or not matching if want is false) re.
+// If want is true literal prefix of re is used to seek to the first
+// candidate value instead of scanning every value of the tag.
+func (mi *MetricsIndex) regexpPostings(tagName types.TagName, re *regexp.Regexp, want bool) *postings.List {
+	lists := make([]*postings.List, 0)
+	prefix := ""
+	if want {
+		var complete bool
+		prefix, complete = re.LiteralPrefix()
+		if complete {
+			// re is just a literal, no need to scan anything
+			return mi.tagValuePostings(tagName, types.TagValue(prefix))
+		}
+	}
+
+	union := func(value string) {
+		if re.MatchString(value) != want {
+			return
+		}
+		if metricIDs := mi.tagValuePostings(tagName, types.TagValue(value)); metricIDs != nil {
+			lists = append(lists, metricIDs)
+		}
+	}
+
+	if tagName == types.NameTagName {
+		e, _ := mi.MetricNames.Seek(types.MetricName(prefix))
+		defer e.Close()
+		for {
+			metricName, _, err := e.Next()
+			if err == io.EOF || !strings.HasPrefix(string(metricName), prefix) {
+				break
+			}
+			union(string(metricName))
+		}
+		return postings.Union(lists...)
+	}
+
+	values, ok := mi.getTagValues(tagName)
+	if !ok {
+		return nil
+	}
+	e, _ := values.Seek(types.TagValue(prefix))
+	defer e.Close()
+	for {
+		tagValue, _, err := e.Next()
+		if err == io.EOF || !strings.HasPrefix(string(tagValue), prefix) {
+			break
+		}
+		union(string(tagValue))
+	}
+	return postings.Union(lists...)
+}
+
+// matcherPostings returns metricIDs for given matcher and reports if
+// they have to be included to or excluded from the result.
+// Metric which doesn't have a tag is treated as having it with an empty
+// value, so e.g. `role!=canary` matches metrics without role tag too.
+func (mi *MetricsIndex) matcherPostings(m types.Matcher) (metricIDs *postings.List, include bool, err error) {
+	switch m.Type {
+	case types.MatchEqual:
+		if m.TagValue == "" {
+			return mi.tagPostings(m.TagName, false)
+		}
+		return mi.tagValuePostings(m.TagName, m.TagValue), true, nil
+	case types.MatchNotEqual:
+		if m.TagValue == "" {
+			return mi.tagPostings(m.TagName, true)
+		}
+		return mi.tagValuePostings(m.TagName, m.TagValue), false, nil
+	case types.MatchExists:
+		return mi.tagPostings(m.TagName, true)
+	case types.MatchNotExists:
+		return mi.tagPostings(m.TagName, false)
+	case types.MatchRegexp, types.MatchNotRegexp:
+		re, err := compileRegexp(string(m.TagValue))
+		if err != nil {
+			return nil, false, err
+		}
+		// if re matches empty value metrics without the tag match it as
+		// well, so it is cheaper to subtract the ones which don't match
+		include := !re.MatchString("")
+		if m.Type == types.MatchNotRegexp {
+			include = !include
+		}
+		want := include == (m.Type == types.MatchRegexp)
+		return mi.regexpPostings(m.TagName, re, want), include, nil
+	}
+	return nil, false, ErrUnknownMatchType
+}
+
+// selectMetricIDs returns refs of metrics matching all given matchers
+// Caller must hold read lock.
+func (mi *MetricsIndex) selectMetricIDs(matchers []types.Matcher) (refSet, error) {
+	includes := make([]*postings.List, 0, len(matchers))
+	excludes := make([]*postings.List, 0, len(matchers))
+	for _, m := range matchers {
+		metricIDs, include, err := mi.matcherPostings(m)
+		if err != nil {
+			return refSet{}, err
+		}
+		if include {
+			if metricIDs == nil || metricIDs.Len() == 0 {
+				// intersection with empty set is empty
+				return refSet{include: postings.New()}, nil
+			}
+			includes = append(includes, metricIDs)
+		} else if metricIDs != nil {
+			excludes = append(excludes, metricIDs)
+		}
+	}
+	if len(includes) == 0 {
+		// live refs are checked against excludes one by one
+		return refSet{excludes: excludes}, nil
+	}
+
+	// start from the smallest set, so intermediate results stay small
+	sort.Slice(includes, func(i, j int) bool {
+		return includes[i].Len() < includes[j].Len()
+	})
+	// postings of the index must never be modified, so res is always
+	// a new list unless it is returned as is
+	res := includes[0]
+	for _, metricIDs := range includes[1:] {
+		res = postings.Intersect(res, metricIDs)
+	}
+	for _, metricIDs := range excludes {
+		res = postings.Difference(res, metricIDs)
+	}
+	return refSet{include: res}, nil
+}
+
+// GetMetricIDsIteratorByMatchers returns MetricIDIterator over metrics
+// matching all given matchers.
+// Use types.NameTagName as matcher's TagName to match metric name.
+// If there is no matcher which requires some tag to be present, whole
+// index is scanned to subtract negative matches.
+func (mi *MetricsIndex) GetMetricIDsIteratorByMatchers(matchers []types.Matcher) (*MetricIDIterator, error) {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	refs, err := mi.selectMetricIDs(matchers)
+	if err != nil {
+		return nil, err
+	}
+	return mi.newRefSetIterator(refs), nil
+}
+
+// GetMetricIDsIteratorByTagRegexp returns MetricIDIterator over metrics
+// having tagNameStr tag with value matching regular expression expr.
+// Unlike types.MatchRegexp matcher it never matches metrics without
+// the tag.
+func (mi *MetricsIndex) GetMetricIDsIteratorByTagRegexp(tagNameStr, expr string) (*MetricIDIterator, error) {
+	re, err := compileRegexp(expr)
+	if err != nil {
+		return nil, err
+	}
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	return mi.newMetricIDIterator(mi.regexpPostings(types.TagName(tagNameStr), re, true)), nil
+}
+
+// Select returns MetricIDIterator over metrics matching Prometheus-style
+// selector like `cpu.load{env="prod",host=~"web-.*",role!="canary"}`.
+// Parse errors are returned as *selector.ParseError.
+func (mi *MetricsIndex) Select(selectorStr string) (*MetricIDIterator, error) {
+	matchers, err := selector.Parse(selectorStr)
+	if err != nil {
+		return nil, err
+	}
+	return mi.GetMetricIDsIteratorByMatchers(matchers)
+}
+
+// SeriesByTag evaluates Graphite seriesByTag('name=cpu','dc=~ams.*',...)
+// expression and returns sorted serialized names of matching metrics.
+// As in Graphite at least one tag expression must not match empty value.
+func (mi *MetricsIndex) SeriesByTag(expr string) ([]string, error) {
+	matchers, err := graphite.ParseSeriesByTag(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	refs, err := mi.selectMetricIDs(matchers)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0)
+	it := mi.refs.iterator(refs)
+	for {
+		ref, ok := it.Next()
+		if !ok {
+			break
+		}
+		metricStr, err := mi.metricNameByID(mi.refs.metricIDs[ref])
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, metricStr)
+	}
+	sort.Strings(res)
+	return res, nil
+}
@@ -0,0 +1,188 @@
+package metricsindex
+
+import (
+	"io"
+
+	"github.com/spuzirev/metricsindex/types"
+)
+
+// metricIDMerge returns MetricIDs of several MetricIDIterators one
+// iterator after another. If seen is not nil MetricID present in several
+// of them is returned only once, which costs a map entry per MetricID, so
+// it is used only for iterators which may overlap.
+type metricIDMerge struct {
+	its  []*MetricIDIterator
+	seen map[types.MetricID]bool
+}
+
+// newMergedMetricIDIterator returns MetricIDIterator merging its
+func newMergedMetricIDIterator(its []*MetricIDIterator, distinct bool) *MetricIDIterator {
+	m := &metricIDMerge{its: its}
+	if distinct {
+		m.seen = make(map[types.MetricID]bool)
+	}
+	return &MetricIDIterator{merge: m}
+}
+
+// mergeMetricIDIterators calls get for every index and merges returned
+// iterators. Indexes returning notFound are skipped, notFound is returned
+// only if every index returned it. distinct has to be set if the same
+// metric may be returned by several indexes.
+func mergeMetricIDIterators(indexes []*MetricsIndex, get func(mi *MetricsIndex) (*MetricIDIterator, error), notFound error, distinct bool) (*MetricIDIterator, error) {
+	its := make([]*MetricIDIterator, 0, len(indexes))
+	for _, mi := range indexes {
+		it, err := get(mi)
+		if err == notFound && notFound != nil {
+			continue
+		}
+		if err != nil {
+			for _, it := range its {
+				it.Close()
+			}
+			return nil, err
+		}
+		its = append(its, it)
+	}
+	if len(its) == 0 && notFound != nil {
+		return nil, notFound
+	}
+	return newMergedMetricIDIterator(its, distinct), nil
+}
+
+func (m *metricIDMerge) next() (types.MetricID, error) {
+	for len(m.its) > 0 {
+		k, err := m.its[0].Next()
+		if err == io.EOF {
+			m.its[0].Close()
+			m.its = m.its[1:]
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if m.seen != nil {
+			if m.seen[k] {
+				continue
+			}
+			m.seen[k] = true
+		}
+		return k, nil
+	}
+	return 0, io.EOF
+}
+
+func (m *metricIDMerge) close() {
+	for _, it := range m.its {
+		it.Close()
+	}
+	m.its = nil
+}
+
+// stringIterator is implemented by MetricNameIterator, TagNameIterator
+// and TagValueIterator
+type stringIterator interface {
+	Next() (string, error)
+	Close()
+}
+
+// stringMerge merges several sorted string iterators into one sorted
+// stream without duplicates
+type stringMerge struct {
+	its     []stringIterator
+	heads   []string
+	valid   []bool
+	started bool
+}
+
+func newStringMerge(its []stringIterator) *stringMerge {
+	return &stringMerge{
+		its:   its,
+		heads: make([]string, len(its)),
+		valid: make([]bool, len(its)),
+	}
+}
+
+func (m *stringMerge) advance(i int) error {
+	k, err := m.its[i].Next()
+	if err == io.EOF {
+		m.valid[i] = false
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	m.heads[i], m.valid[i] = k, true
+	return nil
+}
+
+func (m *stringMerge) next() (string, error) {
+	if !m.started {
+		m.started = true
+		for i := range m.its {
+			if err := m.advance(i); err != nil {
+				return "", err
+			}
+		}
+	}
+	min := -1
+	for i := range m.its {
+		if m.valid[i] && (min < 0 || m.heads[i] < m.heads[min]) {
+			min = i
+		}
+	}
+	if min < 0 {
+		return "", io.EOF
+	}
+	k := m.heads[min]
+	for i := range m.its {
+		if m.valid[i] && m.heads[i] == k {
+			if err := m.advance(i); err != nil {
+				return "", err
+			}
+		}
+	}
+	return k, nil
+}
+
+func (m *stringMerge) close() {
+	for _, it := range m.its {
+		it.Close()
+	}
+}
+
+// mergeSortedStrings merges sorted slices into one sorted slice
+// without duplicates
+func mergeSortedStrings(slices [][]string) []string {
+	its := make([]stringIterator, len(slices))
+	for i, s := range slices {
+		its[i] = &sliceIterator{s: s}
+	}
+	m := newStringMerge(its)
+	res := make([]string, 0)
+	for {
+		k, err := m.next()
+		if err != nil {
+			break
+		}
+		res = append(res, k)
+	}
+	return res
+}
+
+// sliceIterator is stringIterator over slice
+type sliceIterator struct {
+	s []string
+}
+
+func (si *sliceIterator) Next() (string, error) {
+	if len(si.s) == 0 {
+		return "", io.EOF
+	}
+	k := si.s[0]
+	si.s = si.s[1:]
+	return k, nil
+}
+
+func (si *sliceIterator) Close() {
+	si.s = nil
+}
@@ -0,0 +1,125 @@
+package metricsindex
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/spuzirev/metricsindex/types"
+)
+
+// drainStrings returns everything left in it and closes it
+func drainStrings(t *testing.T, it stringIterator) []string {
+	t.Helper()
+	defer it.Close()
+	res := make([]string, 0)
+	for {
+		s, err := it.Next()
+		if err == io.EOF {
+			return res
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, s)
+	}
+}
+
+func TestMergeSortedStrings(t *testing.T) {
+	tests := []struct {
+		slices [][]string
+		want   []string
+	}{
+		{nil, []string{}},
+		{[][]string{{}, nil}, []string{}},
+		{[][]string{{"a", "b"}}, []string{"a", "b"}},
+		{[][]string{{"a", "c", "e"}, {"b", "c", "d"}, {}, {"a", "f"}}, []string{"a", "b", "c", "d", "e", "f"}},
+		{[][]string{{"x"}, {"x"}, {"x"}}, []string{"x"}},
+	}
+	for _, tt := range tests {
+		if got := mergeSortedStrings(tt.slices); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("mergeSortedStrings(%q) = %q, want %q", tt.slices, got, tt.want)
+		}
+	}
+}
+
+func TestStringMerge(t *testing.T) {
+	m := newStringMerge([]stringIterator{
+		&sliceIterator{s: []string{"cpu", "mem"}},
+		&sliceIterator{s: []string{"cpu", "disk", "net"}},
+	})
+	it := &MetricNameIterator{merge: m}
+	if got, want := drainNames(t, it), []string{"cpu", "disk", "mem", "net"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("merged %q, want %q", got, want)
+	}
+	// iterator is drained after EOF
+	if _, err := it.Next(); err != io.EOF {
+		t.Fatalf("Next() after EOF returned %v", err)
+	}
+}
+
+func TestMergeMetricIDIterators(t *testing.T) {
+	indexes := []*MetricsIndex{NewMetricsIndex(), NewMetricsIndex(), NewMetricsIndex()}
+	mustInsert(t, indexes[0], "cpu;host=a", "cpu;host=b", "mem")
+	mustInsert(t, indexes[1], "cpu;host=b", "cpu;host=c")
+	// indexes[2] has no cpu at all
+	mustInsert(t, indexes[2], "mem")
+
+	byName := func(mi *MetricsIndex) (*MetricIDIterator, error) {
+		return mi.GetMetricIDsIteratorByName("cpu")
+	}
+	id := func(metricStr string) types.MetricID {
+		metric, _ := types.ParseMetric(metricStr)
+		return metric.ID()
+	}
+	a, b, c := id("cpu;host=a"), id("cpu;host=b"), id("cpu;host=c")
+
+	// index by index, cpu;host=b is returned once
+	it, err := mergeMetricIDIterators(indexes, byName, ErrNoSuchMetricName, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := drainMetricIDs(t, it), []types.MetricID{a, b, c}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("merged %v, want %v", got, want)
+	}
+	// indexes are expected to be disjoint unless distinct is set
+	it, err = mergeMetricIDIterators(indexes, byName, ErrNoSuchMetricName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := drainMetricIDs(t, it), []types.MetricID{a, b, b, c}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("merged %v, want %v", got, want)
+	}
+
+	// notFound is returned only if every index returns it
+	_, err = mergeMetricIDIterators(indexes, func(mi *MetricsIndex) (*MetricIDIterator, error) {
+		return mi.GetMetricIDsIteratorByName("disk")
+	}, ErrNoSuchMetricName, true)
+	if err != ErrNoSuchMetricName {
+		t.Fatalf("merge of missing name returned %v, want ErrNoSuchMetricName", err)
+	}
+
+	// other errors are returned as is
+	errGet := errors.New("get failed")
+	calls := 0
+	_, err = mergeMetricIDIterators(indexes, func(mi *MetricsIndex) (*MetricIDIterator, error) {
+		calls++
+		if calls == 2 {
+			return nil, errGet
+		}
+		return byName(mi)
+	}, ErrNoSuchMetricName, true)
+	if err != errGet || calls != 2 {
+		t.Fatalf("merge returned %v after %d calls, want %v after 2", err, calls, errGet)
+	}
+
+	// empty merge without notFound is empty iterator
+	it, err = mergeMetricIDIterators(nil, byName, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := drainMetricIDs(t, it); len(got) != 0 {
+		t.Fatalf("empty merge returned %v", got)
+	}
+}
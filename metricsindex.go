@@ -4,14 +4,11 @@ import (
 	"errors"
 	"io"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/spuzirev/metricsindex/trees/metric_id_to_metric"
-	"github.com/spuzirev/metricsindex/trees/metric_ids"
-	"github.com/spuzirev/metricsindex/trees/tag_name_id_to_metric_ids"
-	"github.com/spuzirev/metricsindex/trees/tag_name_id_to_tag_values"
-	"github.com/spuzirev/metricsindex/trees/tag_name_value_id_to_metric_ids"
-	"github.com/spuzirev/metricsindex/trees/tag_names"
-	"github.com/spuzirev/metricsindex/trees/tag_values"
+	"github.com/spuzirev/metricsindex/btree"
+	"github.com/spuzirev/metricsindex/postings"
 	"github.com/spuzirev/metricsindex/types"
 )
 
@@ -19,6 +16,9 @@ var (
 	// ErrNoSuchMetric represents situation when metric not found
 	ErrNoSuchMetric = errors.New("no such metric")
 
+	// ErrNoSuchMetricName represents situation when metric name not found
+	ErrNoSuchMetricName = errors.New("no such metric name")
+
 	// ErrNoSuchTag represents situation when tag not found
 	ErrNoSuchTag = errors.New("no such tag")
 
@@ -31,68 +31,237 @@ var (
 )
 
 // MetricsIndex is the main Index object
+//
+// MetricsIndex is safe for concurrent use: any number of readers may run
+// in parallel while writers (InsertMetric, DeleteMetric, ...) are serialized
+// and exclude readers for the duration of a single call. Iterators don't
+// hold the lock between Next calls, so inserts and deletes may happen while
+// iteration is in progress; name and tag iterators then continue from the
+// item following the last one they returned, MetricIDIterator iterates over
+// metrics matched when it was created skipping the ones deleted since.
+// A single iterator must not be used from several goroutines at once.
+// Exported trees must not be accessed directly while index is used
+// concurrently.
 type MetricsIndex struct {
-	MetricIDToMetric          *metric_id_to_metric.Tree
-	TagNameIDToTagValues      *tag_name_id_to_tag_values.Tree
-	TagNameIDToMetricIDs      *tag_name_id_to_metric_ids.Tree
-	TagNameValueIDToMetricIDs *tag_name_value_id_to_metric_ids.Tree
-	TagNames                  *tag_names.Tree
+	MetricIDToMetric          *btree.Tree[types.MetricID, types.Metric]
+	TagNameIDToTagValues      *btree.Tree[types.TagNameID, *btree.Tree[types.TagValue, bool]]
+	TagNameIDToMetricIDs      *btree.Tree[types.TagNameID, *postings.List]
+	TagNameValueIDToMetricIDs *btree.Tree[types.TagNameValueID, *postings.List]
+	TagNames                  *btree.Tree[types.TagName, bool]
+	MetricNameIDToMetricIDs   *btree.Tree[types.MetricNameID, *postings.List]
+	MetricNames               *btree.Tree[types.MetricName, bool]
 	MetricIDToBool            map[types.MetricID]bool
+
+	mu sync.RWMutex
+
+	parseOptions *types.ParseOptions
+
+	// strings shared by metrics and trees, see intern.go
+	interned *internTable
+
+	// dense series numbers used in postings, see refs.go
+	refs *seriesRefs
+
+	// now returns current time, it is replaced in tests
+	now func() time.Time
+	// background expiration of stale series, see expiry.go
+	expiry *expiryLoop
+
+	// hash collisions resolution, see collisions.go
+	metricIDOverrides map[string]types.MetricID
+	collidedHashes    map[types.MetricID]int
+	metricIDStep      uint64
+	tagNameIDs        *idRegistry[types.TagName]
+	tagNameValueIDs   *idRegistry[types.TagNameValue]
+	metricNameIDs     *idRegistry[types.MetricName]
+	collisions        uint64
 }
 
+// defaultParseOptions are shared by indexes until SetParseOptions is
+// called, indexes never change them
+var defaultParseOptions = types.DefaultParseOptions()
+
 // NewMetricsIndex is *MetricsIndex builder and initializer
 func NewMetricsIndex() *MetricsIndex {
 	return &MetricsIndex{
+		metricIDOverrides: make(map[string]types.MetricID),
+		collidedHashes:    make(map[types.MetricID]int),
+		metricIDStep:      1,
+		parseOptions:      &defaultParseOptions,
+		interned:          newInternTable(),
+		refs:              newSeriesRefs(),
+		now:               time.Now,
+		tagNameIDs:        newIDRegistry[types.TagName](),
+		tagNameValueIDs:   newIDRegistry[types.TagNameValue](),
+		metricNameIDs:     newIDRegistry[types.MetricName](),
+
 		MetricIDToBool: make(map[types.MetricID]bool),
-		MetricIDToMetric: metric_id_to_metric.TreeNew(func(a, b types.MetricID) int {
+		MetricIDToMetric: btree.TreeNew[types.MetricID, types.Metric](func(a, b types.MetricID) int {
 			return types.CmpMetricIDs(a, b)
 		}),
-		TagNameIDToTagValues: tag_name_id_to_tag_values.TreeNew(func(a, b types.TagNameID) int {
+		TagNameIDToTagValues: btree.TreeNew[types.TagNameID, *btree.Tree[types.TagValue, bool]](func(a, b types.TagNameID) int {
 			return types.CmpTagNameIDs(a, b)
 		}),
-		TagNameIDToMetricIDs: tag_name_id_to_metric_ids.TreeNew(func(a, b types.TagNameID) int {
+		TagNameIDToMetricIDs: btree.TreeNew[types.TagNameID, *postings.List](func(a, b types.TagNameID) int {
 			return types.CmpTagNameIDs(a, b)
 		}),
-		TagNameValueIDToMetricIDs: tag_name_value_id_to_metric_ids.TreeNew(func(a, b types.TagNameValueID) int {
+		TagNameValueIDToMetricIDs: btree.TreeNew[types.TagNameValueID, *postings.List](func(a, b types.TagNameValueID) int {
 			return types.CmpTagNameValueID(a, b)
 		}),
-		TagNames: tag_names.TreeNew(func(a, b types.TagName) int {
+		TagNames: btree.TreeNew[types.TagName, bool](func(a, b types.TagName) int {
 			return types.CmpTagNames(a, b)
 		}),
+		MetricNameIDToMetricIDs: btree.TreeNew[types.MetricNameID, *postings.List](func(a, b types.MetricNameID) int {
+			return types.CmpMetricNameIDs(a, b)
+		}),
+		MetricNames: btree.TreeNew[types.MetricName, bool](func(a, b types.MetricName) int {
+			return types.CmpMetricNames(a, b)
+		}),
 	}
 }
 
 // MetricIDIterator is iterator over type.MetricID
+// MetricIDs are returned in order of refs rather than sorted, which is
+// roughly order of insertion, see refs.go. Matches are read lazily, so
+// metrics deleted during iteration are skipped and metrics inserted
+// during iteration are not returned.
+// Iterator with nil mi is iterator over empty set
 type MetricIDIterator struct {
-	e *metric_ids.Enumerator
+	mi    *MetricsIndex
+	refs  *refIterator
+	seq   uint64
+	merge *metricIDMerge
+}
+
+// newRefSetIterator returns MetricIDIterator over metrics with refs of s
+// Caller must hold read lock.
+func (mi *MetricsIndex) newRefSetIterator(s refSet) *MetricIDIterator {
+	return &MetricIDIterator{
+		mi:   mi,
+		refs: mi.refs.iterator(s),
+		seq:  mi.refs.seq,
+	}
+}
+
+// newMetricIDIterator returns MetricIDIterator over metrics with refs
+// in postings
+// Caller must hold read lock.
+func (mi *MetricsIndex) newMetricIDIterator(refs *postings.List) *MetricIDIterator {
+	if refs == nil {
+		return &MetricIDIterator{}
+	}
+	return mi.newRefSetIterator(refSet{include: refs})
 }
 
 // Next returns item if it exists and moves to next position
 // If there is no item to return err == io.EOF is returned
 func (midi *MetricIDIterator) Next() (types.MetricID, error) {
-	k, _, err := midi.e.Next()
-	return k, err
+	if midi.merge != nil {
+		return midi.merge.next()
+	}
+	if midi.mi == nil {
+		return 0, io.EOF
+	}
+	midi.mi.mu.RLock()
+	defer midi.mi.mu.RUnlock()
+	refs := midi.mi.refs
+	for {
+		ref, ok := midi.refs.Next()
+		if !ok {
+			return 0, io.EOF
+		}
+		// skip refs released after iterator was created and the ones
+		// reused by metrics inserted since then
+		if refs.live(ref) && refs.assigned[ref] <= midi.seq {
+			return refs.metricIDs[ref], nil
+		}
+	}
 }
 
 // Close closes the MetricIDIterator
 func (midi *MetricIDIterator) Close() {
-	midi.e.Close()
+	if midi.merge != nil {
+		midi.merge.close()
+		midi.merge = nil
+	}
+	midi.mi = nil
+	midi.refs = nil
+}
+
+// MetricNameIterator is iterator over type.MetricName
+type MetricNameIterator struct {
+	e       *btree.Enumerator[types.MetricName, bool]
+	mu      *sync.RWMutex
+	filter  func(k types.MetricName) bool
+	eofSent bool
+	last    types.MetricName
+	hasLast bool
+	merge   *stringMerge
+}
+
+// Next returns item if it exists and moves to next position
+// If there is no item to return err == io.EOF is returned
+func (mni *MetricNameIterator) Next() (string, error) {
+	if mni.merge != nil {
+		return mni.merge.next()
+	}
+	if mni.eofSent {
+		return "", io.EOF
+	}
+	mni.mu.RLock()
+	k, _, err := mni.e.Next()
+	if err == nil && mni.hasLast && k == mni.last {
+		// see MetricIDIterator.Next
+		k, _, err = mni.e.Next()
+	}
+	mni.mu.RUnlock()
+	mni.last, mni.hasLast = k, err == nil
+	if !mni.filter(k) {
+		mni.eofSent = true
+		return "", io.EOF
+	}
+	return string(k), err
+}
+
+// Close closes MetricNameIterator
+func (mni *MetricNameIterator) Close() {
+	if mni.merge != nil {
+		mni.merge.close()
+		mni.eofSent = true
+		return
+	}
+	mni.e.Close()
+	mni.eofSent = true
 }
 
 // TagNameIterator is iterator over type.TagName
 type TagNameIterator struct {
-	e       *tag_names.Enumerator
+	e       *btree.Enumerator[types.TagName, bool]
+	mu      *sync.RWMutex
 	filter  func(k types.TagName) bool
 	eofSent bool
+	last    types.TagName
+	hasLast bool
+	merge   *stringMerge
 }
 
 // Next returns item if it exists and moves to next position
 // If there is no item to return err == io.EOF is returned
 func (tni *TagNameIterator) Next() (string, error) {
+	if tni.merge != nil {
+		return tni.merge.next()
+	}
 	if tni.eofSent {
 		return "", io.EOF
 	}
+	tni.mu.RLock()
 	k, _, err := tni.e.Next()
+	if err == nil && tni.hasLast && k == tni.last {
+		// see MetricIDIterator.Next
+		k, _, err = tni.e.Next()
+	}
+	tni.mu.RUnlock()
+	tni.last, tni.hasLast = k, err == nil
 	if !tni.filter(k) {
 		tni.eofSent = true
 		return "", io.EOF
@@ -102,24 +271,43 @@ func (tni *TagNameIterator) Next() (string, error) {
 
 // Close closes TagNameIterator
 func (tni *TagNameIterator) Close() {
+	if tni.merge != nil {
+		tni.merge.close()
+		tni.eofSent = true
+		return
+	}
 	tni.e.Close()
 	tni.eofSent = true
 }
 
 // TagValueIterator is iterator over type.TagValue
 type TagValueIterator struct {
-	e       *tag_values.Enumerator
+	e       *btree.Enumerator[types.TagValue, bool]
+	mu      *sync.RWMutex
 	filter  func(k types.TagValue) bool
 	eofSent bool
+	last    types.TagValue
+	hasLast bool
+	merge   *stringMerge
 }
 
 // Next returns item if it exists and moves to next position
 // If there is no item to return err == io.EOF is returned
 func (tvi *TagValueIterator) Next() (string, error) {
+	if tvi.merge != nil {
+		return tvi.merge.next()
+	}
 	if tvi.eofSent {
 		return "", io.EOF
 	}
+	tvi.mu.RLock()
 	k, _, err := tvi.e.Next()
+	if err == nil && tvi.hasLast && k == tvi.last {
+		// see MetricIDIterator.Next
+		k, _, err = tvi.e.Next()
+	}
+	tvi.mu.RUnlock()
+	tvi.last, tvi.hasLast = k, err == nil
 	if !tvi.filter(k) {
 		tvi.eofSent = true
 		return "", io.EOF
@@ -129,6 +317,11 @@ func (tvi *TagValueIterator) Next() (string, error) {
 
 // Close closes TagValueIterator
 func (tvi *TagValueIterator) Close() {
+	if tvi.merge != nil {
+		tvi.merge.close()
+		tvi.eofSent = true
+		return
+	}
 	tvi.e.Close()
 	tvi.eofSent = true
 }
@@ -136,49 +329,153 @@ func (tvi *TagValueIterator) Close() {
 // MetricExistsByMetricID returns true if metric with given metricID
 // exists in the index, otherwise it returns false
 func (mi *MetricsIndex) MetricExistsByMetricID(metricID types.MetricID) bool {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	return mi.metricExists(metricID)
+}
+
+// metricExists is internal lock-free version of MetricExistsByMetricID
+func (mi *MetricsIndex) metricExists(metricID types.MetricID) bool {
 	_, ok := mi.MetricIDToBool[metricID]
 	return ok
 }
 
-//MetricExistsByMetricStr returns true if metric with given full name (with tags)
+// SetParseOptions sets validation rules applied to metric strings
+// passed to the index. It must not be called concurrently with other
+// methods.
+func (mi *MetricsIndex) SetParseOptions(opts types.ParseOptions) {
+	mi.parseOptions = &opts
+}
+
+// parseMetric parses metricStr according to index's ParseOptions
+func (mi *MetricsIndex) parseMetric(metricStr string) (*types.Metric, error) {
+	return types.ParseMetricWithOptions(metricStr, mi.parseOptions)
+}
+
+// MetricExistsByMetricStr returns true if metric with given full name (with tags)
 // exists in the index, otherwise it returns false
 func (mi *MetricsIndex) MetricExistsByMetricStr(metricStr string) bool {
-	metric, err := types.ParseMetric(metricStr)
+	metric, err := mi.parseMetric(metricStr)
 	// if we unable to parse, that means we don't have that
 	// "metric" in index, so we suppress the error from Parser
 	if err != nil {
 		return false
 	}
-	return mi.MetricExistsByMetricID(metric.ID())
+	return mi.metricExistsByMetric(metric)
+}
+
+// metricExistsByMetric returns true if metric exists in the index
+func (mi *MetricsIndex) metricExistsByMetric(metric *types.Metric) bool {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	_, ok := mi.lookupMetricID(metric)
+	return ok
+}
+
+// getTagValues returns tree of values of given tag
+// Caller must hold read lock.
+func (mi *MetricsIndex) getTagValues(tagName types.TagName) (*btree.Tree[types.TagValue, bool], bool) {
+	tnid, ok := mi.tagNameID(tagName)
+	if !ok {
+		return nil, false
+	}
+	return mi.TagNameIDToTagValues.Get(tnid)
+}
+
+// getTagMetricIDs returns tree of metricIDs of metrics having given tag
+// Caller must hold read lock.
+func (mi *MetricsIndex) getTagMetricIDs(tagName types.TagName) (*postings.List, bool) {
+	tnid, ok := mi.tagNameID(tagName)
+	if !ok {
+		return nil, false
+	}
+	return mi.TagNameIDToMetricIDs.Get(tnid)
+}
+
+// getTagNameValueMetricIDs returns tree of metricIDs of metrics having
+// given tag with given value
+// Caller must hold read lock.
+func (mi *MetricsIndex) getTagNameValueMetricIDs(tnv types.TagNameValue) (*postings.List, bool) {
+	tnvid, ok := mi.tagNameValueID(tnv)
+	if !ok {
+		return nil, false
+	}
+	return mi.TagNameValueIDToMetricIDs.Get(tnvid)
+}
+
+// getNameMetricIDs returns tree of metricIDs of metrics with given name
+// Caller must hold read lock.
+func (mi *MetricsIndex) getNameMetricIDs(metricName types.MetricName) (*postings.List, bool) {
+	mnid, ok := mi.metricNameID(metricName)
+	if !ok {
+		return nil, false
+	}
+	return mi.MetricNameIDToMetricIDs.Get(mnid)
 }
 
 // insertMetric is internal method which inserts new types.Metric to index
+// or updates its last seen time if it is already there
+// Caller must hold write lock.
 func (mi *MetricsIndex) insertMetric(metric *types.Metric) error {
-	metricID := metric.ID()
-	if mi.MetricExistsByMetricID(metricID) {
-		// this metric is already in index, return
+	now := mi.now().UnixNano()
+	return mi.insertMetricSeen(metric, now, now)
+}
+
+// insertMetricSeen is insertMetric which takes series first and last
+// seen times, it is used to restore them from snapshot
+// Caller must hold write lock.
+func (mi *MetricsIndex) insertMetricSeen(metric *types.Metric, firstSeen, lastSeen int64) error {
+	metricID, exists := mi.assignMetricID(metric)
+	return mi.addMetric(metric, metricID, exists, firstSeen, lastSeen)
+}
+
+// addMetric adds metric with MetricID assigned to it to every tree or,
+// if it exists, just touches it
+// Caller must hold write lock.
+func (mi *MetricsIndex) addMetric(metric *types.Metric, metricID types.MetricID, exists bool, firstSeen, lastSeen int64) error {
+	if exists {
+		// this metric is already in index, just touch it
+		ref, _ := mi.refs.ref(metricID)
+		mi.touchRef(ref, firstSeen, lastSeen)
 		return nil
 	}
+	metric = mi.interned.internMetric(metric)
 
 	// MetricIDToBool
 	mi.MetricIDToBool[metricID] = true
+	ref := mi.refs.assign(metricID)
+	mi.refs.firstSeen[ref] = firstSeen
+	mi.refs.lastSeen[ref] = lastSeen
 
 	// MetricIDToMetric
 	mi.MetricIDToMetric.Set(metricID, *metric)
 
+	// MetricNameIDToMetricIDs
+	metricName := types.MetricName(metric.Name)
+	mnid := mi.assignMetricNameID(metricName)
+	nameMetricIDs, ok := mi.MetricNameIDToMetricIDs.Get(mnid)
+	if !ok {
+		nameMetricIDs = postings.New()
+		mi.MetricNameIDToMetricIDs.Set(mnid, nameMetricIDs)
+	}
+	nameMetricIDs.Add(ref)
+
+	// MetricNames
+	mi.MetricNames.Set(metricName, true)
+
 	// Tag* indexes
 	for tn, tv := range metric.Tags {
 		tagName := types.TagName(tn)
 		tagValue := types.TagValue(tv)
-		tnid := tagName.ID()
+		tnid := mi.assignTagNameID(tagName)
 
-		var values *tag_values.Tree
-		var metricIDs *metric_ids.Tree
+		var values *btree.Tree[types.TagValue, bool]
+		var metricIDs *postings.List
 		var ok bool
 
 		// TagNameIDToTagValues
 		if values, ok = mi.TagNameIDToTagValues.Get(tnid); !ok {
-			values = tag_values.TreeNew(func(a, b types.TagValue) int {
+			values = btree.TreeNew[types.TagValue, bool](func(a, b types.TagValue) int {
 				return types.CmpTagValues(a, b)
 			})
 			mi.TagNameIDToTagValues.Set(tnid, values)
@@ -187,25 +484,21 @@ func (mi *MetricsIndex) insertMetric(metric *types.Metric) error {
 
 		// TagNameIDToMetricIDs
 		if metricIDs, ok = mi.TagNameIDToMetricIDs.Get(tnid); !ok {
-			metricIDs = metric_ids.TreeNew(func(a, b types.MetricID) int {
-				return types.CmpMetricIDs(a, b)
-			})
+			metricIDs = postings.New()
 			mi.TagNameIDToMetricIDs.Set(tnid, metricIDs)
 		}
-		metricIDs.Set(metricID, true)
+		metricIDs.Add(ref)
 
 		// TagNameValueIDToMetricIDs
-		tnvid := types.TagNameValue{
+		tnvid := mi.assignTagNameValueID(types.TagNameValue{
 			TagName:  tagName,
 			TagValue: tagValue,
-		}.ID()
+		})
 		if metricIDs, ok = mi.TagNameValueIDToMetricIDs.Get(tnvid); !ok {
-			metricIDs = metric_ids.TreeNew(func(a, b types.MetricID) int {
-				return types.CmpMetricIDs(a, b)
-			})
+			metricIDs = postings.New()
 			mi.TagNameValueIDToMetricIDs.Set(tnvid, metricIDs)
 		}
-		metricIDs.Set(metricID, true)
+		metricIDs.Add(ref)
 
 		// TagNames
 		mi.TagNames.Set(tagName, true)
@@ -215,16 +508,25 @@ func (mi *MetricsIndex) insertMetric(metric *types.Metric) error {
 
 // InsertMetric inserts new metric to index by metric string representation
 // it may return error if fails
+// Known series are touched under read lock, write lock is taken only
+// to insert new ones.
 func (mi *MetricsIndex) InsertMetric(metricStr string) error {
-	metric, err := types.ParseMetric(metricStr)
+	metric, err := mi.parseMetric(metricStr)
 	if err != nil {
 		return err
 	}
+	if mi.touchMetric(metric) {
+		return nil
+	}
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
 	return mi.insertMetric(metric)
 }
 
 // InsertMetricsBatch takes slice of metric strings representations
 // and inserts them to index
+// Readers are not blocked for the whole batch, write lock is taken
+// for each new metric separately.
 func (mi *MetricsIndex) InsertMetricsBatch(metricsStr []string) error {
 	for _, metricStr := range metricsStr {
 		err := mi.InsertMetric(metricStr)
@@ -235,33 +537,152 @@ func (mi *MetricsIndex) InsertMetricsBatch(metricsStr []string) error {
 	return nil
 }
 
+// deleteMetric is internal method which removes metric with given metricID
+// from index and cleans up every secondary index it was referenced from
+// Caller must hold write lock.
+func (mi *MetricsIndex) deleteMetric(metricID types.MetricID) error {
+	metric, ok := mi.MetricIDToMetric.Get(metricID)
+	if !ok {
+		return ErrNoSuchMetric
+	}
+
+	// MetricIDToBool
+	delete(mi.MetricIDToBool, metricID)
+	ref, _ := mi.refs.ref(metricID)
+	mi.refs.release(metricID)
+
+	// MetricIDToMetric
+	mi.MetricIDToMetric.Delete(metricID)
+	mi.releaseMetricID(&metric)
+	mi.interned.releaseMetric(&metric)
+
+	// Emptied tag_values trees are only unlinked, not Close()d, so
+	// iterators that are still held by callers keep working on them.
+
+	// MetricNameIDToMetricIDs and MetricNames
+	metricName := types.MetricName(metric.Name)
+	mnid, _ := mi.metricNameID(metricName)
+	if metricIDs, ok := mi.MetricNameIDToMetricIDs.Get(mnid); ok {
+		metricIDs.Remove(ref)
+		if metricIDs.Len() == 0 {
+			mi.MetricNameIDToMetricIDs.Delete(mnid)
+			mi.MetricNames.Delete(metricName)
+			mi.metricNameIDs.release(metricName, uint64(metricName.ID()), uint64(mnid))
+		}
+	}
+
+	// Tag* indexes
+	for tn, tv := range metric.Tags {
+		tagName := types.TagName(tn)
+		tagValue := types.TagValue(tv)
+		tnid, _ := mi.tagNameID(tagName)
+
+		// TagNameValueIDToMetricIDs and TagNameIDToTagValues
+		tnv := types.TagNameValue{
+			TagName:  tagName,
+			TagValue: tagValue,
+		}
+		hash := uint64(tnv.ID())
+		id, _ := mi.tagNameValueIDs.lookup(tnv, hash)
+		tnvid := types.TagNameValueID(id)
+		if metricIDs, ok := mi.TagNameValueIDToMetricIDs.Get(tnvid); ok {
+			metricIDs.Remove(ref)
+			if metricIDs.Len() == 0 {
+				mi.TagNameValueIDToMetricIDs.Delete(tnvid)
+				mi.tagNameValueIDs.release(tnv, hash, id)
+				if values, ok := mi.TagNameIDToTagValues.Get(tnid); ok {
+					values.Delete(tagValue)
+				}
+			}
+		}
+
+		// TagNameIDToMetricIDs, TagNameIDToTagValues and TagNames
+		if metricIDs, ok := mi.TagNameIDToMetricIDs.Get(tnid); ok {
+			metricIDs.Remove(ref)
+			if metricIDs.Len() == 0 {
+				mi.TagNameIDToMetricIDs.Delete(tnid)
+				mi.TagNameIDToTagValues.Delete(tnid)
+				mi.TagNames.Delete(tagName)
+				mi.tagNameIDs.release(tagName, uint64(tagName.ID()), uint64(tnid))
+			}
+		}
+	}
+	return nil
+}
+
+// DeleteMetric removes metric from index by metric string representation
+// It returns ErrNoSuchMetric if there is no such metric in the index
+func (mi *MetricsIndex) DeleteMetric(metricStr string) error {
+	metric, err := mi.parseMetric(metricStr)
+	if err != nil {
+		return err
+	}
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	metricID, ok := mi.lookupMetricID(metric)
+	if !ok {
+		return ErrNoSuchMetric
+	}
+	return mi.deleteMetric(metricID)
+}
+
+// DeleteMetricByID removes metric with given metricID from index
+// It returns ErrNoSuchMetric if there is no such metric in the index
+func (mi *MetricsIndex) DeleteMetricByID(metricID types.MetricID) error {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	return mi.deleteMetric(metricID)
+}
+
 // GetMetricIDsIteratorByTag returns MetricIDIterator for given
 // tagNameStr:tagValueStr pair
 func (mi *MetricsIndex) GetMetricIDsIteratorByTag(tagNameStr, tagValueStr string) (*MetricIDIterator, error) {
-	tvid := types.TagNameValue{
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	metricIDs, ok := mi.getTagNameValueMetricIDs(types.TagNameValue{
 		TagName:  types.TagName(tagNameStr),
 		TagValue: types.TagValue(tagValueStr),
-	}.ID()
-	metricIDs, ok := mi.TagNameValueIDToMetricIDs.Get(tvid)
+	})
 	if !ok {
 		return nil, ErrNoSuchTagNameValue
 	}
-	e, _ := metricIDs.SeekFirst()
-	iterator := &MetricIDIterator{
-		e: e,
+	return mi.newMetricIDIterator(metricIDs), nil
+}
+
+// GetMetricIDsIteratorByName returns MetricIDIterator over all metrics
+// with given name
+func (mi *MetricsIndex) GetMetricIDsIteratorByName(metricNameStr string) (*MetricIDIterator, error) {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	metricIDs, ok := mi.getNameMetricIDs(types.MetricName(metricNameStr))
+	if !ok {
+		return nil, ErrNoSuchMetricName
+	}
+	return mi.newMetricIDIterator(metricIDs), nil
+}
+
+// GetCardinalityByName returns total number of metrics with given name.
+// It returns 0 if there is no such metricNameStr in the index
+func (mi *MetricsIndex) GetCardinalityByName(metricNameStr string) int {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	if v, ok := mi.getNameMetricIDs(types.MetricName(metricNameStr)); ok {
+		return v.Len()
 	}
-	return iterator, nil
+	return 0
 }
 
 // GetCardinalityByTag returns total number of metrics which matches
 // given condition.
 // It returns 0 if there is no such tagNameStr:tagValueStr combination
 func (mi *MetricsIndex) GetCardinalityByTag(tagNameStr, tagValueStr string) int {
-	tnvid := types.TagNameValue{
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	tnv := types.TagNameValue{
 		TagName:  types.TagName(tagNameStr),
 		TagValue: types.TagValue(tagValueStr),
-	}.ID()
-	if v, ok := mi.TagNameValueIDToMetricIDs.Get(tnvid); ok {
+	}
+	if v, ok := mi.getTagNameValueMetricIDs(tnv); ok {
 		return v.Len()
 	}
 	return 0
@@ -271,20 +692,74 @@ func (mi *MetricsIndex) GetCardinalityByTag(tagNameStr, tagValueStr string) int
 // given tag.
 // It returns 0 if there is no such tagNameStr in the index
 func (mi *MetricsIndex) GetCardinalityByTagName(tagNameStr string) int {
-	tnid := types.TagName(tagNameStr).ID()
-	if v, ok := mi.TagNameIDToMetricIDs.Get(tnid); ok {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	if v, ok := mi.getTagMetricIDs(types.TagName(tagNameStr)); ok {
 		return v.Len()
 	}
 	return 0
 }
 
+// GetMetricNames returns slice of strings representing all possible
+// names of metrics in the index with prefix
+// If there is no metric with given prefix empty slice is returned
+func (mi *MetricsIndex) GetMetricNames(prefix string) []string {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	res := make([]string, 0)
+	var err error
+	var e *btree.Enumerator[types.MetricName, bool]
+	var metricName types.MetricName
+
+	e, _ = mi.MetricNames.Seek(types.MetricName(prefix))
+	defer e.Close()
+	for {
+		metricName, _, err = e.Next()
+		if err == io.EOF {
+			break
+		}
+		metricNameStr := string(metricName)
+		if strings.HasPrefix(metricNameStr, prefix) {
+			res = append(res, metricNameStr)
+		} else {
+			break
+		}
+	}
+	return res
+}
+
+// GetMetricNamesIterator returns a *MetricNameIterator which will return
+// all metric names with a given prefix
+func (mi *MetricsIndex) GetMetricNamesIterator(prefix string) (*MetricNameIterator, error) {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	e, _ := mi.MetricNames.Seek(types.MetricName(prefix))
+	iterator := &MetricNameIterator{
+		e:       e,
+		mu:      &mi.mu,
+		eofSent: false,
+
+		filter: func(k types.MetricName) bool {
+			return strings.HasPrefix(string(k), prefix)
+		},
+	}
+	return iterator, nil
+}
+
+// GetAllMetricNames is shortcut for GetMetricNames("")
+func (mi *MetricsIndex) GetAllMetricNames() []string {
+	return mi.GetMetricNames("")
+}
+
 // GetTagNames returns slice of strings representing all possible
 // names of tags in the index with prefix
 // If there is no metric with given prefix empty slice is returned
 func (mi *MetricsIndex) GetTagNames(prefix string) []string {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
 	res := make([]string, 0)
 	var err error
-	var e *tag_names.Enumerator
+	var e *btree.Enumerator[types.TagName, bool]
 	var tagName types.TagName
 
 	e, _ = mi.TagNames.Seek(types.TagName(prefix))
@@ -308,9 +783,12 @@ func (mi *MetricsIndex) GetTagNames(prefix string) []string {
 // GetTagNamesIterator returns a *TagNameIterator which will return
 // all tag names with a given prefix
 func (mi *MetricsIndex) GetTagNamesIterator(prefix string) (*TagNameIterator, error) {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
 	e, _ := mi.TagNames.Seek(types.TagName(prefix))
 	iterator := &TagNameIterator{
 		e:       e,
+		mu:      &mi.mu,
 		eofSent: false,
 
 		filter: func(k types.TagName) bool {
@@ -327,12 +805,15 @@ func (mi *MetricsIndex) GetAllTagNames() []string {
 
 // GetAllTagNamesIterator returns a *TagNameIterator over all tags in index
 func (mi *MetricsIndex) GetAllTagNamesIterator() (*TagNameIterator, error) {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
 	e, err := mi.TagNames.SeekFirst()
 	if err != nil {
 		return nil, err
 	}
 	iterator := &TagNameIterator{
 		e:       e,
+		mu:      &mi.mu,
 		eofSent: false,
 
 		filter: func(k types.TagName) bool {
@@ -345,17 +826,18 @@ func (mi *MetricsIndex) GetAllTagNamesIterator() (*TagNameIterator, error) {
 // GetTagValues return slice of strings representing all possible
 // values for given tagNameStr in the index
 func (mi *MetricsIndex) GetTagValues(tagNameStr, prefix string) []string {
-	tnid := types.TagName(tagNameStr).ID()
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
 
 	res := make([]string, 0)
 	var err error
-	var e *tag_values.Enumerator
-	var tagValues *tag_values.Tree
+	var e *btree.Enumerator[types.TagValue, bool]
+	var tagValues *btree.Tree[types.TagValue, bool]
 	var tagValue types.TagValue
 	var ok bool
 
 	// if no such tag return empty slice
-	if tagValues, ok = mi.TagNameIDToTagValues.Get(tnid); !ok {
+	if tagValues, ok = mi.getTagValues(types.TagName(tagNameStr)); !ok {
 		return res
 	}
 
@@ -380,13 +862,16 @@ func (mi *MetricsIndex) GetTagValues(tagNameStr, prefix string) []string {
 // GetTagValuesIterator returns a *TagValueIterator which will return
 // all tag values with a given prefix for given tag
 func (mi *MetricsIndex) GetTagValuesIterator(tagNameStr, prefix string) (*TagValueIterator, error) {
-	tagValues, ok := mi.TagNameIDToTagValues.Get(types.TagName(tagNameStr).ID())
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	tagValues, ok := mi.getTagValues(types.TagName(tagNameStr))
 	if !ok {
 		return nil, ErrNoSuchTag
 	}
 	e, _ := tagValues.Seek(types.TagValue(prefix))
 	iterator := &TagValueIterator{
 		e:       e,
+		mu:      &mi.mu,
 		eofSent: false,
 
 		filter: func(k types.TagValue) bool {
@@ -403,13 +888,16 @@ func (mi *MetricsIndex) GetAllTagValues(tagNameStr string) []string {
 
 // GetAllTagValuesIterator returns a *TagNameIterator over all tag values for given tag
 func (mi *MetricsIndex) GetAllTagValuesIterator(tagNameStr string) (*TagValueIterator, error) {
-	tagValues, ok := mi.TagNameIDToTagValues.Get(types.TagName(tagNameStr).ID())
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	tagValues, ok := mi.getTagValues(types.TagName(tagNameStr))
 	if !ok {
 		return nil, ErrNoSuchTag
 	}
 	e, _ := tagValues.SeekFirst()
 	iterator := &TagValueIterator{
 		e:       e,
+		mu:      &mi.mu,
 		eofSent: false,
 
 		filter: func(k types.TagValue) bool {
@@ -421,6 +909,13 @@ func (mi *MetricsIndex) GetAllTagValuesIterator(tagNameStr string) (*TagValueIte
 
 // GetMetricNameByID suddenly returns metric name by metricID
 func (mi *MetricsIndex) GetMetricNameByID(metricID types.MetricID) (string, error) {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	return mi.metricNameByID(metricID)
+}
+
+// metricNameByID is internal lock-free version of GetMetricNameByID
+func (mi *MetricsIndex) metricNameByID(metricID types.MetricID) (string, error) {
 	metric, ok := mi.MetricIDToMetric.Get(metricID)
 	if !ok {
 		return "", ErrNoSuchMetric
@@ -428,12 +923,27 @@ func (mi *MetricsIndex) GetMetricNameByID(metricID types.MetricID) (string, erro
 	return metric.Serialize(), nil
 }
 
+// GetMetricByID returns metric by metricID. Returned metric shares its
+// tags with the index, so it must not be modified.
+// It returns ErrNoSuchMetric if there is no such metric in the index
+func (mi *MetricsIndex) GetMetricByID(metricID types.MetricID) (types.Metric, error) {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	metric, ok := mi.MetricIDToMetric.Get(metricID)
+	if !ok {
+		return types.Metric{}, ErrNoSuchMetric
+	}
+	return metric, nil
+}
+
 // GetMetricsNamesByIDs is a batch version of GetMetricNameByID
 func (mi *MetricsIndex) GetMetricsNamesByIDs(metricIDs []types.MetricID) ([]string, error) {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
 	res := make([]string, len(metricIDs))
 	var errRes error
 	for i, metricID := range metricIDs {
-		metricStr, err := mi.GetMetricNameByID(metricID)
+		metricStr, err := mi.metricNameByID(metricID)
 		if err != nil {
 			errRes = ErrSomeMetricsNotFound
 		}
@@ -0,0 +1,502 @@
+package metricsindex
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/spuzirev/metricsindex/types"
+)
+
+// TestAmbiguousTagPairs checks that tags which have the same
+// "name:value" representation don't share postings
+func TestAmbiguousTagPairs(t *testing.T) {
+	pairs := []struct {
+		name1, value1 string
+		name2, value2 string
+	}{
+		{"a:b", "c", "a", "b:c"},
+		{"a", ":b", "a:", "b"},
+		{"1:a", "b", "1", "a:b"},
+		{"3:a", "b", "", "3:a:b"},
+		{"12", "x", "1", "2x"},
+		{"x", "1:a", "x1", "a"},
+		{"x", "1:a", "x:1", "a"},
+		{"a", "", "", "a"},
+		{"", "", "0", ""},
+		{"a", "1:", "a1", ":"},
+	}
+	for _, pair := range pairs {
+		t.Run(fmt.Sprintf("%s=%s vs %s=%s", pair.name1, pair.value1, pair.name2, pair.value2), func(t *testing.T) {
+			mi := NewMetricsIndex()
+			m1 := &types.Metric{Name: "m1", Tags: map[string]string{pair.name1: pair.value1}}
+			m2 := &types.Metric{Name: "m2", Tags: map[string]string{pair.name2: pair.value2}}
+			mi.mu.Lock()
+			// parser rejects empty tag names, so metrics are inserted
+			// directly
+			for _, m := range []*types.Metric{m1, m2} {
+				if err := mi.insertMetric(m); err != nil {
+					mi.mu.Unlock()
+					t.Fatal(err)
+				}
+			}
+			tnvid1, _ := mi.tagNameValueID(types.TagNameValue{TagName: types.TagName(pair.name1), TagValue: types.TagValue(pair.value1)})
+			tnvid2, _ := mi.tagNameValueID(types.TagNameValue{TagName: types.TagName(pair.name2), TagValue: types.TagValue(pair.value2)})
+			postings1, _ := mi.TagNameValueIDToMetricIDs.Get(tnvid1)
+			postings2, _ := mi.TagNameValueIDToMetricIDs.Get(tnvid2)
+			mi.mu.Unlock()
+
+			if tnvid1 == tnvid2 {
+				t.Fatal("tags have the same TagNameValueID")
+			}
+			if postings1 == postings2 || postings1.Len() != 1 || postings2.Len() != 1 {
+				t.Fatal("tags share postings")
+			}
+			for _, tag := range [][2]string{{pair.name1, pair.value1}, {pair.name2, pair.value2}} {
+				if got := mi.GetCardinalityByTag(tag[0], tag[1]); got != 1 {
+					t.Errorf("GetCardinalityByTag(%q, %q) = %d, want 1", tag[0], tag[1], got)
+				}
+			}
+
+			// seriesByTag can't express empty tag names and matches
+			// absent tags with empty values
+			for _, m := range []*types.Metric{m1, m2} {
+				for tn, tv := range m.Tags {
+					if tn == "" || tv == "" || strings.ContainsAny(tn, "!=") {
+						continue
+					}
+					expr := fmt.Sprintf("seriesByTag('%s=%s')", tn, tv)
+					got, err := mi.SeriesByTag(expr)
+					if err != nil {
+						t.Fatalf("%s: %v", expr, err)
+					}
+					if want := m.Serialize(); len(got) != 1 || got[0] != want {
+						t.Errorf("%s returned %q, want [%q]", expr, got, want)
+					}
+				}
+			}
+
+			// deleting one of metrics must not affect the other
+			mi.mu.Lock()
+			metricID, _ := mi.lookupMetricID(m1)
+			err := mi.deleteMetric(metricID)
+			mi.mu.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := mi.GetCardinalityByTag(pair.name1, pair.value1); got != 0 {
+				t.Errorf("GetCardinalityByTag(%q, %q) = %d after delete, want 0", pair.name1, pair.value1, got)
+			}
+			if got := mi.GetCardinalityByTag(pair.name2, pair.value2); got != 1 {
+				t.Errorf("GetCardinalityByTag(%q, %q) = %d after delete, want 1", pair.name2, pair.value2, got)
+			}
+			checkRefs(t, mi)
+		})
+	}
+}
+
+func TestGetTagValuesWithSeparators(t *testing.T) {
+	mi := NewMetricsIndex()
+	mustInsert(t, mi, "m;a=b:c", "m;a=1:x", "m;a:b=c")
+	got := mi.GetAllTagValues("a")
+	sort.Strings(got)
+	if want := []string{"1:x", "b:c"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("GetAllTagValues(a) = %q, want %q", got, want)
+	}
+	if got := mi.GetAllTagValues("a:b"); len(got) != 1 || got[0] != "c" {
+		t.Fatalf("GetAllTagValues(a:b) = %q, want [c]", got)
+	}
+}
+
+func TestDeleteMetric(t *testing.T) {
+	mi := NewMetricsIndex()
+	mustInsert(t, mi, "cpu;dc=ams;host=a", "cpu;dc=ams;host=b", "mem;dc=fra")
+	b := metricIDOf(t, mi, "cpu;dc=ams;host=b")
+
+	if err := mi.DeleteMetric("cpu;dc=ams;host=a"); err != nil {
+		t.Fatal(err)
+	}
+	if mi.MetricExistsByMetricStr("cpu;dc=ams;host=a") {
+		t.Fatal("deleted metric exists")
+	}
+	// host and dc=ams are still used by the other cpu metric
+	if got := mi.GetAllTagValues("host"); len(got) != 1 || got[0] != "b" {
+		t.Fatalf("GetAllTagValues(host) = %q, want [b]", got)
+	}
+	if got := mi.GetCardinalityByTag("dc", "ams"); got != 1 {
+		t.Fatalf("GetCardinalityByTag(dc, ams) = %d, want 1", got)
+	}
+	if got := mi.GetCardinalityByTagName("host"); got != 1 {
+		t.Fatalf("GetCardinalityByTagName(host) = %d, want 1", got)
+	}
+	checkRefs(t, mi)
+
+	if err := mi.DeleteMetricByID(b); err != nil {
+		t.Fatal(err)
+	}
+	if mi.MetricExistsByMetricID(b) {
+		t.Fatal("deleted metric exists by MetricID")
+	}
+	// the last metric having host tag and dc=ams is gone
+	if got := mi.GetAllTagNames(); strings.Join(got, ",") != "dc" {
+		t.Fatalf("GetAllTagNames() = %q, want [dc]", got)
+	}
+	if got := mi.GetAllTagValues("host"); len(got) != 0 {
+		t.Fatalf("GetAllTagValues(host) = %q, want none", got)
+	}
+	if _, err := mi.GetAllTagValuesIterator("host"); err != ErrNoSuchTag {
+		t.Fatalf("GetAllTagValuesIterator(host) returned %v, want ErrNoSuchTag", err)
+	}
+	if got := mi.GetAllTagValues("dc"); strings.Join(got, ",") != "fra" {
+		t.Fatalf("GetAllTagValues(dc) = %q, want [fra]", got)
+	}
+	if _, err := mi.GetMetricIDsIteratorByTag("dc", "ams"); err != ErrNoSuchTagNameValue {
+		t.Fatalf("GetMetricIDsIteratorByTag(dc, ams) returned %v, want ErrNoSuchTagNameValue", err)
+	}
+	if got := mi.GetCardinalityByTagName("host"); got != 0 {
+		t.Fatalf("GetCardinalityByTagName(host) = %d, want 0", got)
+	}
+
+	// emptied trees are removed, not left empty
+	if n := mi.TagNameIDToTagValues.Len(); n != 1 {
+		t.Fatalf("TagNameIDToTagValues has %d tags, want 1", n)
+	}
+	if n := mi.TagNameIDToMetricIDs.Len(); n != 1 {
+		t.Fatalf("TagNameIDToMetricIDs has %d tags, want 1", n)
+	}
+	if n := mi.TagNameValueIDToMetricIDs.Len(); n != 1 {
+		t.Fatalf("TagNameValueIDToMetricIDs has %d pairs, want 1", n)
+	}
+	if n := mi.MetricIDToMetric.Len(); n != 1 || len(mi.MetricIDToBool) != 1 {
+		t.Fatalf("index has %d metrics and %d MetricIDs, want 1", n, len(mi.MetricIDToBool))
+	}
+	checkRefs(t, mi)
+}
+
+func TestDeleteUnknownMetric(t *testing.T) {
+	mi := NewMetricsIndex()
+	mustInsert(t, mi, "cpu;host=a")
+	metricID := metricIDOf(t, mi, "cpu;host=a")
+
+	if err := mi.DeleteMetric("cpu;host=b"); err != ErrNoSuchMetric {
+		t.Fatalf("DeleteMetric of unknown metric returned %v, want ErrNoSuchMetric", err)
+	}
+	if err := mi.DeleteMetricByID(metricID + 1); err != ErrNoSuchMetric {
+		t.Fatalf("DeleteMetricByID of unknown MetricID returned %v, want ErrNoSuchMetric", err)
+	}
+	if err := mi.DeleteMetric("cpu;host"); !errors.Is(err, types.ErrCannotParseMetricName) {
+		t.Fatalf("DeleteMetric of malformed metric returned %v", err)
+	}
+	// nothing is deleted by failed calls
+	if !mi.MetricExistsByMetricID(metricID) {
+		t.Fatal("metric is deleted")
+	}
+
+	if err := mi.DeleteMetricByID(metricID); err != nil {
+		t.Fatal(err)
+	}
+	if err := mi.DeleteMetricByID(metricID); err != ErrNoSuchMetric {
+		t.Fatalf("second DeleteMetricByID returned %v, want ErrNoSuchMetric", err)
+	}
+	if err := mi.DeleteMetric("cpu;host=a"); err != ErrNoSuchMetric {
+		t.Fatalf("DeleteMetric of deleted metric returned %v, want ErrNoSuchMetric", err)
+	}
+	if got := mi.GetAllTagNames(); len(got) != 0 {
+		t.Fatalf("GetAllTagNames() = %q after everything is deleted", got)
+	}
+	checkRefs(t, mi)
+}
+
+// drainNames returns everything left in it and closes it
+func drainNames(t *testing.T, it *MetricNameIterator) []string {
+	t.Helper()
+	defer it.Close()
+	res := make([]string, 0)
+	for {
+		name, err := it.Next()
+		if err == io.EOF {
+			return res
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, name)
+	}
+}
+
+func TestMetricNames(t *testing.T) {
+	mi := NewMetricsIndex()
+	mustInsert(t, mi, "cpu.load;host=a", "cpu.load;host=b", "cpu.idle;host=a", "mem;host=a", "cpu")
+
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"", "cpu,cpu.idle,cpu.load,mem"},
+		{"cpu", "cpu,cpu.idle,cpu.load"},
+		{"cpu.", "cpu.idle,cpu.load"},
+		{"cpu.load", "cpu.load"},
+		{"m", "mem"},
+		{"disk", ""},
+		{"z", ""},
+	}
+	for _, tt := range tests {
+		if got := mi.GetMetricNames(tt.prefix); strings.Join(got, ",") != tt.want {
+			t.Errorf("GetMetricNames(%q) = %q, want %s", tt.prefix, got, tt.want)
+		}
+		it, err := mi.GetMetricNamesIterator(tt.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := drainNames(t, it); strings.Join(got, ",") != tt.want {
+			t.Errorf("GetMetricNamesIterator(%q) returned %q, want %s", tt.prefix, got, tt.want)
+		}
+	}
+	if got := mi.GetAllMetricNames(); strings.Join(got, ",") != "cpu,cpu.idle,cpu.load,mem" {
+		t.Errorf("GetAllMetricNames() = %q", got)
+	}
+	if got := mi.GetMetricNames("disk"); got == nil {
+		t.Error("GetMetricNames returned nil instead of empty slice")
+	}
+
+	if got := mi.GetCardinalityByName("cpu.load"); got != 2 {
+		t.Errorf("GetCardinalityByName(cpu.load) = %d, want 2", got)
+	}
+	it, err := mi.GetMetricIDsIteratorByName("cpu.load")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := drainMetricIDs(t, it)
+	a, b := metricIDOf(t, mi, "cpu.load;host=a"), metricIDOf(t, mi, "cpu.load;host=b")
+	if a > b {
+		a, b = b, a
+	}
+	if len(got) != 2 || got[0] != a || got[1] != b {
+		t.Fatalf("GetMetricIDsIteratorByName(cpu.load) returned %v, want [%v %v]", got, a, b)
+	}
+
+	// name stays while any metric has it
+	if err := mi.DeleteMetric("cpu.load;host=a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := mi.GetCardinalityByName("cpu.load"); got != 1 {
+		t.Errorf("GetCardinalityByName(cpu.load) = %d after delete, want 1", got)
+	}
+	if err := mi.DeleteMetric("cpu.load;host=b"); err != nil {
+		t.Fatal(err)
+	}
+	if got := mi.GetMetricNames("cpu."); strings.Join(got, ",") != "cpu.idle" {
+		t.Errorf("GetMetricNames(cpu.) = %q after delete, want [cpu.idle]", got)
+	}
+	if got := mi.GetCardinalityByName("cpu.load"); got != 0 {
+		t.Errorf("GetCardinalityByName(cpu.load) = %d after delete, want 0", got)
+	}
+	if _, err := mi.GetMetricIDsIteratorByName("cpu.load"); err != ErrNoSuchMetricName {
+		t.Errorf("GetMetricIDsIteratorByName(cpu.load) returned %v after delete, want ErrNoSuchMetricName", err)
+	}
+
+	// name is indexed again when it comes back
+	mustInsert(t, mi, "cpu.load;host=c")
+	if got := mi.GetCardinalityByName("cpu.load"); got != 1 {
+		t.Errorf("GetCardinalityByName(cpu.load) = %d after reinsert, want 1", got)
+	}
+	checkRefs(t, mi)
+}
+
+func TestMetricNamesIteratorWithInserts(t *testing.T) {
+	mi := NewMetricsIndex()
+	mustInsert(t, mi, "a", "c", "e")
+	it, err := mi.GetMetricNamesIterator("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	if name, err := it.Next(); err != nil || name != "a" {
+		t.Fatalf("Next() = %q, %v, want a", name, err)
+	}
+	// iterator continues after the last returned name
+	mustInsert(t, mi, "b", "d")
+	if err := mi.DeleteMetric("c"); err != nil {
+		t.Fatal(err)
+	}
+	if got := drainNames(t, it); strings.Join(got, ",") != "b,d,e" {
+		t.Fatalf("iterator returned %q after changes, want [b d e]", got)
+	}
+}
+
+// matcherTestMetrics are metrics used by matcher tests, some of them
+// lack env or role tags
+var matcherTestMetrics = []string{
+	"cpu;env=prod;role=db",
+	"cpu;env=prod;role=canary",
+	"cpu;env=dev",
+	"mem;role=web",
+	"disk",
+}
+
+// matchedNames returns sorted serialized names of metrics returned by it
+func matchedNames(t *testing.T, mi *MetricsIndex, it *MetricIDIterator) string {
+	t.Helper()
+	names, err := mi.GetMetricsNamesByIDs(drainMetricIDs(t, it))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+func TestMatchers(t *testing.T) {
+	mi := NewMetricsIndex()
+	mustInsert(t, mi, matcherTestMetrics...)
+	tests := []struct {
+		name     string
+		matchers []types.Matcher
+		want     string
+	}{
+		{"equal", []types.Matcher{matcher(types.MatchEqual, "role", "db")}, "cpu;env=prod;role=db"},
+		{"equal unknown value", []types.Matcher{matcher(types.MatchEqual, "role", "x")}, ""},
+		{"equal unknown tag", []types.Matcher{matcher(types.MatchEqual, "x", "db")}, ""},
+		// metric without tag has it with empty value
+		{"equal empty", []types.Matcher{matcher(types.MatchEqual, "role", "")}, "cpu;env=dev disk"},
+		{"equal empty unknown tag", []types.Matcher{matcher(types.MatchEqual, "x", "")}, strings.Join(sortedStrings(matcherTestMetrics), " ")},
+
+		{"not equal", []types.Matcher{matcher(types.MatchNotEqual, "role", "canary")}, "cpu;env=dev cpu;env=prod;role=db disk mem;role=web"},
+		{"not equal unknown value", []types.Matcher{matcher(types.MatchNotEqual, "role", "x")}, strings.Join(sortedStrings(matcherTestMetrics), " ")},
+		{"not equal empty", []types.Matcher{matcher(types.MatchNotEqual, "role", "")}, "cpu;env=prod;role=canary cpu;env=prod;role=db mem;role=web"},
+		{"not equal empty unknown tag", []types.Matcher{matcher(types.MatchNotEqual, "x", "")}, ""},
+
+		{"exists", []types.Matcher{matcher(types.MatchExists, "env", "")}, "cpu;env=dev cpu;env=prod;role=canary cpu;env=prod;role=db"},
+		{"exists unknown tag", []types.Matcher{matcher(types.MatchExists, "x", "")}, ""},
+		{"not exists", []types.Matcher{matcher(types.MatchNotExists, "role", "")}, "cpu;env=dev disk"},
+		{"not exists unknown tag", []types.Matcher{matcher(types.MatchNotExists, "x", "")}, strings.Join(sortedStrings(matcherTestMetrics), " ")},
+
+		{"name", []types.Matcher{matcher(types.MatchEqual, types.NameTagName, "cpu")}, "cpu;env=dev cpu;env=prod;role=canary cpu;env=prod;role=db"},
+		{"not name", []types.Matcher{matcher(types.MatchNotEqual, types.NameTagName, "cpu")}, "disk mem;role=web"},
+		{
+			"combined",
+			[]types.Matcher{matcher(types.MatchEqual, "env", "prod"), matcher(types.MatchNotEqual, "role", "canary")},
+			"cpu;env=prod;role=db",
+		},
+		{
+			"only negative",
+			[]types.Matcher{matcher(types.MatchNotEqual, "role", "canary"), matcher(types.MatchNotExists, "env", "")},
+			"disk mem;role=web",
+		},
+		{
+			"contradiction",
+			[]types.Matcher{matcher(types.MatchExists, "role", ""), matcher(types.MatchNotExists, "role", "")},
+			"",
+		},
+		{"no matchers", []types.Matcher{}, strings.Join(sortedStrings(matcherTestMetrics), " ")},
+	}
+	for _, tt := range tests {
+		it, err := mi.GetMetricIDsIteratorByMatchers(tt.matchers)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := matchedNames(t, mi, it); got != tt.want {
+			t.Errorf("%s: %v matched %q, want %q", tt.name, tt.matchers, got, tt.want)
+		}
+	}
+
+	if _, err := mi.GetMetricIDsIteratorByMatchers([]types.Matcher{{Type: 100, TagName: "role"}}); err != ErrUnknownMatchType {
+		t.Errorf("unknown match type returned %v, want ErrUnknownMatchType", err)
+	}
+}
+
+func matcher(mt types.MatchType, tagName types.TagName, tagValue string) types.Matcher {
+	return types.Matcher{Type: mt, TagName: tagName, TagValue: types.TagValue(tagValue)}
+}
+
+func sortedStrings(s []string) []string {
+	res := append([]string{}, s...)
+	sort.Strings(res)
+	return res
+}
+
+func TestRegexpMatchers(t *testing.T) {
+	mi := NewMetricsIndex()
+	mustInsert(t, mi, matcherTestMetrics...)
+	all := strings.Join(sortedStrings(matcherTestMetrics), " ")
+	tests := []struct {
+		name    string
+		matcher types.Matcher
+		want    string
+	}{
+		{"regexp", matcher(types.MatchRegexp, "role", "d.*"), "cpu;env=prod;role=db"},
+		{"regexp is anchored", matcher(types.MatchRegexp, "role", "b"), ""},
+		{"regexp literal", matcher(types.MatchRegexp, "role", "web"), "mem;role=web"},
+		{"regexp alternation", matcher(types.MatchRegexp, "role", "db|web"), "cpu;env=prod;role=db mem;role=web"},
+		// regexp matching empty value matches metrics without the tag
+		{"regexp matching empty", matcher(types.MatchRegexp, "role", "|db"), "cpu;env=dev cpu;env=prod;role=db disk"},
+		{"regexp matching anything", matcher(types.MatchRegexp, "role", ".*"), all},
+		{"regexp matching nothing", matcher(types.MatchRegexp, "role", "x.*"), ""},
+		{"regexp unknown tag", matcher(types.MatchRegexp, "x", "a.*"), ""},
+		{"regexp matching empty unknown tag", matcher(types.MatchRegexp, "x", "a*"), all},
+		{"regexp name", matcher(types.MatchRegexp, types.NameTagName, "c.*|m.*"), "cpu;env=dev cpu;env=prod;role=canary cpu;env=prod;role=db mem;role=web"},
+
+		{"not regexp", matcher(types.MatchNotRegexp, "role", "d.*"), "cpu;env=dev cpu;env=prod;role=canary disk mem;role=web"},
+		{"not regexp matching empty", matcher(types.MatchNotRegexp, "role", "|db"), "cpu;env=prod;role=canary mem;role=web"},
+		{"not regexp matching anything", matcher(types.MatchNotRegexp, "role", ".*"), ""},
+		{"not regexp unknown tag", matcher(types.MatchNotRegexp, "x", "a.*"), all},
+		{"not regexp matching empty unknown tag", matcher(types.MatchNotRegexp, "x", "a*"), ""},
+		{"not regexp name", matcher(types.MatchNotRegexp, types.NameTagName, "cpu"), "disk mem;role=web"},
+	}
+	for _, tt := range tests {
+		it, err := mi.GetMetricIDsIteratorByMatchers([]types.Matcher{tt.matcher})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := matchedNames(t, mi, it); got != tt.want {
+			t.Errorf("%s: %v matched %q, want %q", tt.name, tt.matcher, got, tt.want)
+		}
+	}
+
+	for _, mt := range []types.MatchType{types.MatchRegexp, types.MatchNotRegexp} {
+		if _, err := mi.GetMetricIDsIteratorByMatchers([]types.Matcher{matcher(mt, "role", "(")}); err == nil {
+			t.Errorf("%v with invalid regexp is accepted", mt)
+		}
+	}
+}
+
+func TestGetMetricIDsIteratorByTagRegexp(t *testing.T) {
+	mi := NewMetricsIndex()
+	mustInsert(t, mi, matcherTestMetrics...)
+	mustInsert(t, mi, "cpu;role=dba", "cpu;role=d")
+	tests := []struct {
+		tagName string
+		expr    string
+		want    string
+	}{
+		{"role", "d.*", "cpu;env=prod;role=db cpu;role=d cpu;role=dba"},
+		{"role", "db.+", "cpu;role=dba"},
+		{"role", "db", "cpu;env=prod;role=db"},
+		{"role", "c.*|w.*", "cpu;env=prod;role=canary mem;role=web"},
+		// unlike MatchRegexp metrics without the tag never match
+		{"role", "|db", "cpu;env=prod;role=db"},
+		{"role", ".*", "cpu;env=prod;role=canary cpu;env=prod;role=db cpu;role=d cpu;role=dba mem;role=web"},
+		{"role", "x.*", ""},
+		{"role", "", ""},
+		{"env", "p.*", "cpu;env=prod;role=canary cpu;env=prod;role=db"},
+		{"unknown", ".*", ""},
+		{string(types.NameTagName), "m.*|d.*", "disk mem;role=web"},
+	}
+	for _, tt := range tests {
+		it, err := mi.GetMetricIDsIteratorByTagRegexp(tt.tagName, tt.expr)
+		if err != nil {
+			t.Errorf("%s=~%q: %v", tt.tagName, tt.expr, err)
+			continue
+		}
+		if got := matchedNames(t, mi, it); got != tt.want {
+			t.Errorf("%s=~%q matched %q, want %q", tt.tagName, tt.expr, got, tt.want)
+		}
+	}
+	if _, err := mi.GetMetricIDsIteratorByTagRegexp("role", "("); err == nil {
+		t.Error("invalid regexp is accepted")
+	}
+}
@@ -0,0 +1,453 @@
+package metricsindex
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/spuzirev/metricsindex/graphite"
+	"github.com/spuzirev/metricsindex/selector"
+	"github.com/spuzirev/metricsindex/types"
+)
+
+var (
+	// ErrBadBlockDuration represents situation when PartitionedMetricsIndex
+	// is created with non-positive block duration
+	ErrBadBlockDuration = errors.New("block duration must be positive")
+)
+
+// Block is MetricsIndex holding series inserted within [MinTime, MaxTime)
+type Block struct {
+	MinTime time.Time
+	MaxTime time.Time
+	Index   *MetricsIndex
+}
+
+// overlaps returns true if block's window overlaps tr
+func (b *Block) overlaps(tr TimeRange) bool {
+	if !tr.From.IsZero() && !b.MaxTime.After(tr.From) {
+		return false
+	}
+	if !tr.To.IsZero() && b.MinTime.After(tr.To) {
+		return false
+	}
+	return true
+}
+
+// PartitionedMetricsIndex splits metrics by insertion time into blocks of
+// fixed duration. Inserts go to the head block covering current time,
+// once time passes its end new head is cut and the old one is sealed, i.e.
+// it is never inserted to again. Series reported in several windows are
+// present in every block they were inserted to.
+// Queries take TimeRange and fan out to blocks overlapping it, so results
+// are as precise as block boundaries. MetricIDs found in several blocks
+// are returned once. Retention is done by dropping whole blocks which is
+// much cheaper than deleting series one by one.
+// Every block resolves hash collisions on its own, so series whose hash
+// collided may get different MetricIDs in different blocks, depending on
+// which of them was inserted to the block first, and the same MetricID may
+// stand for different series in different blocks. Methods taking MetricID
+// use the newest block having it. Collisions of 64-bit hashes are rare
+// enough to accept that instead of sharing state between blocks.
+type PartitionedMetricsIndex struct {
+	mu sync.RWMutex
+	// sorted by MinTime, the last one is the head
+	blocks        []*Block
+	blockDuration time.Duration
+	parseOptions  types.ParseOptions
+
+	now       func() time.Time
+	retention *expiryLoop
+}
+
+// NewPartitionedMetricsIndex is *PartitionedMetricsIndex builder and
+// initializer. Blocks are aligned to multiples of blockDuration since
+// zero time, so e.g. 24h blocks are UTC days.
+func NewPartitionedMetricsIndex(blockDuration time.Duration) (*PartitionedMetricsIndex, error) {
+	if blockDuration <= 0 {
+		return nil, ErrBadBlockDuration
+	}
+	return &PartitionedMetricsIndex{
+		blocks:        make([]*Block, 0),
+		blockDuration: blockDuration,
+		parseOptions:  types.DefaultParseOptions(),
+		now:           time.Now,
+	}, nil
+}
+
+// SetParseOptions sets validation rules applied to metric strings
+// passed to the index. It must not be called concurrently with other
+// methods.
+func (pmi *PartitionedMetricsIndex) SetParseOptions(opts types.ParseOptions) {
+	pmi.parseOptions = opts
+	for _, b := range pmi.blocks {
+		b.Index.SetParseOptions(opts)
+	}
+}
+
+// Blocks returns blocks of the index sorted by MinTime. All of them but
+// the last one are sealed and may be e.g. saved with SaveToFile.
+func (pmi *PartitionedMetricsIndex) Blocks() []*Block {
+	pmi.mu.RLock()
+	defer pmi.mu.RUnlock()
+	return append([]*Block(nil), pmi.blocks...)
+}
+
+// head returns head block if it covers t
+// Caller must hold read lock.
+func (pmi *PartitionedMetricsIndex) head(t time.Time) (*Block, bool) {
+	if len(pmi.blocks) == 0 {
+		return nil, false
+	}
+	b := pmi.blocks[len(pmi.blocks)-1]
+	// clock going backwards doesn't reopen sealed blocks
+	return b, t.Before(b.MaxTime)
+}
+
+// cutHead seals current head and starts new one covering t unless it
+// was done meanwhile
+// Caller must hold write lock.
+func (pmi *PartitionedMetricsIndex) cutHead(t time.Time) *Block {
+	if b, ok := pmi.head(t); ok {
+		return b
+	}
+	minTime := t.Truncate(pmi.blockDuration)
+	b := &Block{
+		MinTime: minTime,
+		MaxTime: minTime.Add(pmi.blockDuration),
+		Index:   NewMetricsIndex(),
+	}
+	b.Index.SetParseOptions(pmi.parseOptions)
+	b.Index.now = pmi.now
+	pmi.blocks = append(pmi.blocks, b)
+	return b
+}
+
+// withHead calls f with head block covering current time holding read
+// lock, so the block can't be sealed while f is running
+func (pmi *PartitionedMetricsIndex) withHead(f func(head *MetricsIndex) error) error {
+	t := pmi.now()
+	pmi.mu.RLock()
+	b, ok := pmi.head(t)
+	if !ok {
+		pmi.mu.RUnlock()
+		pmi.mu.Lock()
+		pmi.cutHead(t)
+		pmi.mu.Unlock()
+		pmi.mu.RLock()
+		// head may be cut again meanwhile, it's fine to use the newer one
+		b = pmi.blocks[len(pmi.blocks)-1]
+	}
+	defer pmi.mu.RUnlock()
+	return f(b.Index)
+}
+
+// InsertMetric inserts new metric to head block by metric string
+// representation
+func (pmi *PartitionedMetricsIndex) InsertMetric(metricStr string) error {
+	return pmi.withHead(func(head *MetricsIndex) error {
+		return head.InsertMetric(metricStr)
+	})
+}
+
+// InsertMetricBytes inserts metric to head block by metric string
+// representation. See MetricsIndex.InsertMetricBytes.
+func (pmi *PartitionedMetricsIndex) InsertMetricBytes(b []byte) error {
+	return pmi.withHead(func(head *MetricsIndex) error {
+		return head.InsertMetricBytes(b)
+	})
+}
+
+// InsertMetricsBatch takes slice of metric strings representations
+// and inserts them to head block
+func (pmi *PartitionedMetricsIndex) InsertMetricsBatch(metricsStr []string) error {
+	return pmi.withHead(func(head *MetricsIndex) error {
+		return head.InsertMetricsBatch(metricsStr)
+	})
+}
+
+// DeleteMetric removes metric from every block by metric string
+// representation
+// It returns ErrNoSuchMetric if there is no such metric in the index
+func (pmi *PartitionedMetricsIndex) DeleteMetric(metricStr string) error {
+	return pmi.deleteFromBlocks(func(mi *MetricsIndex) error {
+		return mi.DeleteMetric(metricStr)
+	})
+}
+
+// DeleteMetricByID removes metric with given metricID from every block
+// It returns ErrNoSuchMetric if there is no such metric in the index
+func (pmi *PartitionedMetricsIndex) DeleteMetricByID(metricID types.MetricID) error {
+	return pmi.deleteFromBlocks(func(mi *MetricsIndex) error {
+		return mi.DeleteMetricByID(metricID)
+	})
+}
+
+func (pmi *PartitionedMetricsIndex) deleteFromBlocks(del func(mi *MetricsIndex) error) error {
+	pmi.mu.RLock()
+	defer pmi.mu.RUnlock()
+	res := ErrNoSuchMetric
+	for _, b := range pmi.blocks {
+		err := del(b.Index)
+		if err == ErrNoSuchMetric {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		res = nil
+	}
+	return res
+}
+
+// DropBlocksBefore drops blocks which end not after t and returns
+// number of dropped blocks. Head block is never dropped.
+func (pmi *PartitionedMetricsIndex) DropBlocksBefore(t time.Time) int {
+	pmi.mu.Lock()
+	defer pmi.mu.Unlock()
+	n := 0
+	for n < len(pmi.blocks)-1 && !pmi.blocks[n].MaxTime.After(t) {
+		n++
+	}
+	pmi.blocks = append(pmi.blocks[:0:0], pmi.blocks[n:]...)
+	return n
+}
+
+// StartRetention starts background goroutine which drops blocks older
+// than retention every interval (retention/10 if interval is not
+// positive). StartRetention and StopRetention must not be called
+// concurrently.
+func (pmi *PartitionedMetricsIndex) StartRetention(retention, interval time.Duration) {
+	pmi.StopRetention()
+	pmi.retention = startExpiryLoop(pmi.DropBlocksBefore, pmi.now, retention, interval)
+}
+
+// StopRetention stops background retention started by StartRetention
+func (pmi *PartitionedMetricsIndex) StopRetention() {
+	pmi.retention.close()
+	pmi.retention = nil
+}
+
+// indexes returns indexes of blocks overlapping tr, the newest first
+func (pmi *PartitionedMetricsIndex) indexes(tr TimeRange) []*MetricsIndex {
+	pmi.mu.RLock()
+	defer pmi.mu.RUnlock()
+	res := make([]*MetricsIndex, 0, len(pmi.blocks))
+	for i := len(pmi.blocks) - 1; i >= 0; i-- {
+		if pmi.blocks[i].overlaps(tr) {
+			res = append(res, pmi.blocks[i].Index)
+		}
+	}
+	return res
+}
+
+// MetricExistsByMetricID returns true if metric with given metricID
+// exists in any block, otherwise it returns false
+func (pmi *PartitionedMetricsIndex) MetricExistsByMetricID(metricID types.MetricID) bool {
+	for _, mi := range pmi.indexes(TimeRange{}) {
+		if mi.MetricExistsByMetricID(metricID) {
+			return true
+		}
+	}
+	return false
+}
+
+// MetricExistsByMetricStr returns true if metric with given full name
+// (with tags) exists in any block, otherwise it returns false
+func (pmi *PartitionedMetricsIndex) MetricExistsByMetricStr(metricStr string) bool {
+	for _, mi := range pmi.indexes(TimeRange{}) {
+		if mi.MetricExistsByMetricStr(metricStr) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetMetricSeenTimesByID returns when metric with given metricID was
+// inserted first and last time across all blocks
+// It returns ErrNoSuchMetric if there is no such metric in the index
+func (pmi *PartitionedMetricsIndex) GetMetricSeenTimesByID(metricID types.MetricID) (firstSeen, lastSeen time.Time, err error) {
+	err = ErrNoSuchMetric
+	for _, mi := range pmi.indexes(TimeRange{}) {
+		f, l, blockErr := mi.GetMetricSeenTimesByID(metricID)
+		if blockErr != nil {
+			continue
+		}
+		if err != nil || f.Before(firstSeen) {
+			firstSeen = f
+		}
+		if err != nil || l.After(lastSeen) {
+			lastSeen = l
+		}
+		err = nil
+	}
+	return firstSeen, lastSeen, err
+}
+
+// GetMetricNameByID returns full metric name (with tags) by metricID
+// It returns ErrNoSuchMetric if there is no such metric in the index
+func (pmi *PartitionedMetricsIndex) GetMetricNameByID(metricID types.MetricID) (string, error) {
+	for _, mi := range pmi.indexes(TimeRange{}) {
+		if metricStr, err := mi.GetMetricNameByID(metricID); err == nil {
+			return metricStr, nil
+		}
+	}
+	return "", ErrNoSuchMetric
+}
+
+// GetMetricsNamesByIDs is a batch version of GetMetricNameByID
+func (pmi *PartitionedMetricsIndex) GetMetricsNamesByIDs(metricIDs []types.MetricID) ([]string, error) {
+	res := make([]string, len(metricIDs))
+	var errRes error
+	for i, metricID := range metricIDs {
+		metricStr, err := pmi.GetMetricNameByID(metricID)
+		if err != nil {
+			errRes = ErrSomeMetricsNotFound
+		}
+		res[i] = metricStr
+	}
+	return res, errRes
+}
+
+// GetMetricNames returns sorted metric names starting with prefix
+// inserted within tr
+func (pmi *PartitionedMetricsIndex) GetMetricNames(prefix string, tr TimeRange) []string {
+	indexes := pmi.indexes(tr)
+	slices := make([][]string, len(indexes))
+	for i, mi := range indexes {
+		slices[i] = mi.GetMetricNames(prefix)
+	}
+	return mergeSortedStrings(slices)
+}
+
+// GetTagNames returns sorted tag names starting with prefix of metrics
+// inserted within tr
+func (pmi *PartitionedMetricsIndex) GetTagNames(prefix string, tr TimeRange) []string {
+	indexes := pmi.indexes(tr)
+	slices := make([][]string, len(indexes))
+	for i, mi := range indexes {
+		slices[i] = mi.GetTagNames(prefix)
+	}
+	return mergeSortedStrings(slices)
+}
+
+// GetTagValues returns sorted values of tagNameStr tag starting with
+// prefix of metrics inserted within tr
+func (pmi *PartitionedMetricsIndex) GetTagValues(tagNameStr, prefix string, tr TimeRange) []string {
+	indexes := pmi.indexes(tr)
+	slices := make([][]string, len(indexes))
+	for i, mi := range indexes {
+		slices[i] = mi.GetTagValues(tagNameStr, prefix)
+	}
+	return mergeSortedStrings(slices)
+}
+
+// GetMetricIDsIteratorByTag returns MetricIDIterator over metrics having
+// tagNameStr:tagValueStr pair inserted within tr
+func (pmi *PartitionedMetricsIndex) GetMetricIDsIteratorByTag(tagNameStr, tagValueStr string, tr TimeRange) (*MetricIDIterator, error) {
+	return mergeMetricIDIterators(pmi.indexes(tr), func(mi *MetricsIndex) (*MetricIDIterator, error) {
+		return mi.GetMetricIDsIteratorByTag(tagNameStr, tagValueStr)
+	}, ErrNoSuchTagNameValue, true)
+}
+
+// GetMetricIDsIteratorByName returns MetricIDIterator over metrics with
+// given name inserted within tr
+func (pmi *PartitionedMetricsIndex) GetMetricIDsIteratorByName(metricNameStr string, tr TimeRange) (*MetricIDIterator, error) {
+	return mergeMetricIDIterators(pmi.indexes(tr), func(mi *MetricsIndex) (*MetricIDIterator, error) {
+		return mi.GetMetricIDsIteratorByName(metricNameStr)
+	}, ErrNoSuchMetricName, true)
+}
+
+// GetMetricIDsIteratorByMatchers returns MetricIDIterator over metrics
+// matching all given matchers inserted within tr
+func (pmi *PartitionedMetricsIndex) GetMetricIDsIteratorByMatchers(matchers []types.Matcher, tr TimeRange) (*MetricIDIterator, error) {
+	return mergeMetricIDIterators(pmi.indexes(tr), func(mi *MetricsIndex) (*MetricIDIterator, error) {
+		return mi.GetMetricIDsIteratorByMatchers(matchers)
+	}, nil, true)
+}
+
+// Select returns MetricIDIterator over metrics matching Prometheus-style
+// selector inserted within tr. See MetricsIndex.Select.
+func (pmi *PartitionedMetricsIndex) Select(selectorStr string, tr TimeRange) (*MetricIDIterator, error) {
+	matchers, err := selector.Parse(selectorStr)
+	if err != nil {
+		return nil, err
+	}
+	return pmi.GetMetricIDsIteratorByMatchers(matchers, tr)
+}
+
+// SeriesByTag evaluates Graphite seriesByTag expression and returns
+// sorted serialized names of matching metrics inserted within tr.
+// See MetricsIndex.SeriesByTag.
+func (pmi *PartitionedMetricsIndex) SeriesByTag(expr string, tr TimeRange) ([]string, error) {
+	if _, err := graphite.ParseSeriesByTag(expr); err != nil {
+		return nil, err
+	}
+	indexes := pmi.indexes(tr)
+	slices := make([][]string, 0, len(indexes))
+	for _, mi := range indexes {
+		res, err := mi.SeriesByTag(expr)
+		if err != nil {
+			return nil, err
+		}
+		slices = append(slices, res)
+	}
+	return mergeSortedStrings(slices), nil
+}
+
+// countMetricIDs returns number of distinct MetricIDs returned by get
+// from blocks overlapping tr. Single block is asked for cardinality
+// directly with count.
+func (pmi *PartitionedMetricsIndex) countMetricIDs(tr TimeRange, count func(mi *MetricsIndex) int, get func(mi *MetricsIndex) (*MetricIDIterator, error), notFound error) int {
+	indexes := pmi.indexes(tr)
+	if len(indexes) == 1 {
+		return count(indexes[0])
+	}
+	it, err := mergeMetricIDIterators(indexes, get, notFound, true)
+	if err != nil {
+		return 0
+	}
+	defer it.Close()
+	res := 0
+	for {
+		if _, err := it.Next(); err == io.EOF {
+			return res
+		}
+		res++
+	}
+}
+
+// GetCardinalityByName returns number of metrics with given name
+// inserted within tr
+func (pmi *PartitionedMetricsIndex) GetCardinalityByName(metricNameStr string, tr TimeRange) int {
+	return pmi.countMetricIDs(tr, func(mi *MetricsIndex) int {
+		return mi.GetCardinalityByName(metricNameStr)
+	}, func(mi *MetricsIndex) (*MetricIDIterator, error) {
+		return mi.GetMetricIDsIteratorByName(metricNameStr)
+	}, ErrNoSuchMetricName)
+}
+
+// GetCardinalityByTag returns number of metrics having
+// tagNameStr:tagValueStr pair inserted within tr
+func (pmi *PartitionedMetricsIndex) GetCardinalityByTag(tagNameStr, tagValueStr string, tr TimeRange) int {
+	return pmi.countMetricIDs(tr, func(mi *MetricsIndex) int {
+		return mi.GetCardinalityByTag(tagNameStr, tagValueStr)
+	}, func(mi *MetricsIndex) (*MetricIDIterator, error) {
+		return mi.GetMetricIDsIteratorByTag(tagNameStr, tagValueStr)
+	}, ErrNoSuchTagNameValue)
+}
+
+// GetCardinalityByTagName returns number of metrics having given tag
+// inserted within tr
+func (pmi *PartitionedMetricsIndex) GetCardinalityByTagName(tagNameStr string, tr TimeRange) int {
+	matchers := []types.Matcher{{
+		Type:    types.MatchExists,
+		TagName: types.TagName(tagNameStr),
+	}}
+	return pmi.countMetricIDs(tr, func(mi *MetricsIndex) int {
+		return mi.GetCardinalityByTagName(tagNameStr)
+	}, func(mi *MetricsIndex) (*MetricIDIterator, error) {
+		return mi.GetMetricIDsIteratorByMatchers(matchers)
+	}, nil)
+}
@@ -0,0 +1,324 @@
+package metricsindex
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spuzirev/metricsindex/types"
+)
+
+// newTestPartitioned returns PartitionedMetricsIndex with hour long blocks
+// using clock as time source
+func newTestPartitioned(t *testing.T, clock *testClock) *PartitionedMetricsIndex {
+	t.Helper()
+	pmi, err := NewPartitionedMetricsIndex(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pmi.now = clock.now
+	return pmi
+}
+
+// checkBlocks verifies MinTime of every block of pmi
+func checkBlocks(t *testing.T, pmi *PartitionedMetricsIndex, minTimes ...time.Time) {
+	t.Helper()
+	blocks := pmi.Blocks()
+	if len(blocks) != len(minTimes) {
+		t.Fatalf("index has %d blocks, want %d", len(blocks), len(minTimes))
+	}
+	for i, b := range blocks {
+		if !b.MinTime.Equal(minTimes[i]) || !b.MaxTime.Equal(minTimes[i].Add(time.Hour)) {
+			t.Fatalf("block %d covers %v - %v, want it to start at %v", i, b.MinTime, b.MaxTime, minTimes[i])
+		}
+	}
+}
+
+func TestNewPartitionedMetricsIndex(t *testing.T) {
+	for _, d := range []time.Duration{-time.Hour, 0} {
+		if _, err := NewPartitionedMetricsIndex(d); err != ErrBadBlockDuration {
+			t.Fatalf("NewPartitionedMetricsIndex(%v) returned %v, want ErrBadBlockDuration", d, err)
+		}
+	}
+}
+
+func TestPartitionedCutHead(t *testing.T) {
+	clock := newTestClock()
+	pmi := newTestPartitioned(t, clock)
+	// blocks are aligned to hours since zero time
+	first := clock.now().Truncate(time.Hour)
+	mustInsertPartitioned(t, pmi, "cpu;host=a")
+	checkBlocks(t, pmi, first)
+
+	// the last moment of the window still goes to the same block
+	clock.add(first.Add(time.Hour - time.Nanosecond).Sub(clock.now()))
+	mustInsertPartitioned(t, pmi, "cpu;host=b")
+	checkBlocks(t, pmi, first)
+
+	// the window is over, new head is cut and the old block is sealed
+	clock.add(time.Nanosecond)
+	mustInsertPartitioned(t, pmi, "cpu;host=c")
+	checkBlocks(t, pmi, first, first.Add(time.Hour))
+	blocks := pmi.Blocks()
+	if blocks[0].Index.MetricExistsByMetricStr("cpu;host=c") {
+		t.Fatal("metric is inserted to sealed block")
+	}
+	if !blocks[1].Index.MetricExistsByMetricStr("cpu;host=c") || blocks[1].Index.MetricExistsByMetricStr("cpu;host=a") {
+		t.Fatal("new head has wrong metrics")
+	}
+
+	// clock going backwards doesn't reopen sealed block
+	clock.add(-time.Minute)
+	mustInsertPartitioned(t, pmi, "cpu;host=d")
+	if blocks[0].Index.MetricExistsByMetricStr("cpu;host=d") || !blocks[1].Index.MetricExistsByMetricStr("cpu;host=d") {
+		t.Fatal("metric isn't inserted to head block")
+	}
+
+	// empty windows don't get blocks
+	clock.add(3 * time.Hour)
+	if err := pmi.InsertMetricsBatch([]string{"cpu;host=e"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pmi.InsertMetricBytes([]byte("cpu;host=f")); err != nil {
+		t.Fatal(err)
+	}
+	checkBlocks(t, pmi, first, first.Add(time.Hour), first.Add(3*time.Hour))
+	if n := pmi.Blocks()[2].Index.GetCardinalityByName("cpu"); n != 2 {
+		t.Fatalf("head has %d metrics, want 2", n)
+	}
+}
+
+func mustInsertPartitioned(t *testing.T, pmi *PartitionedMetricsIndex, metricsStr ...string) {
+	t.Helper()
+	for _, metricStr := range metricsStr {
+		if err := pmi.InsertMetric(metricStr); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// threeBlocks returns index with series reported in one, two and three
+// hour long blocks and beginning of the first block
+func threeBlocks(t *testing.T) (*PartitionedMetricsIndex, *testClock, time.Time) {
+	t.Helper()
+	clock := newTestClock()
+	pmi := newTestPartitioned(t, clock)
+	start := clock.now().Truncate(time.Hour)
+	mustInsertPartitioned(t, pmi, "cpu;dc=ams;host=a", "cpu;dc=ams;host=b", "mem;dc=ams")
+	clock.add(time.Hour)
+	mustInsertPartitioned(t, pmi, "cpu;dc=ams;host=a", "cpu;dc=fra;host=c", "mem;dc=ams")
+	clock.add(time.Hour)
+	mustInsertPartitioned(t, pmi, "cpu;dc=ams;host=a", "disk;dc=fra")
+	checkBlocks(t, pmi, start, start.Add(time.Hour), start.Add(2*time.Hour))
+	return pmi, clock, start
+}
+
+func TestPartitionedQueries(t *testing.T) {
+	pmi, _, start := threeBlocks(t)
+	all := TimeRange{}
+	first := TimeRange{To: start.Add(30 * time.Minute)}
+	// window ends right at the beginning of the third block
+	firstTwo := TimeRange{From: start.Add(30 * time.Minute), To: start.Add(2*time.Hour - time.Nanosecond)}
+
+	check := func(what string, got, want interface{}) {
+		t.Helper()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s = %v, want %v", what, got, want)
+		}
+	}
+	ids := func(metricsStr ...string) []types.MetricID {
+		res := make([]types.MetricID, 0, len(metricsStr))
+		for _, metricStr := range metricsStr {
+			metric, _ := types.ParseMetric(metricStr)
+			res = append(res, metric.ID())
+		}
+		sortMetricIDs(res)
+		return res
+	}
+	metricIDs := func(it *MetricIDIterator, err error) []types.MetricID {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := drainMetricIDs(t, it)
+		sortMetricIDs(res)
+		return res
+	}
+
+	check("GetMetricNames", pmi.GetMetricNames("", all), []string{"cpu", "disk", "mem"})
+	check("GetMetricNames of the first block", pmi.GetMetricNames("", first), []string{"cpu", "mem"})
+	check("GetTagNames", pmi.GetTagNames("", firstTwo), []string{"dc", "host"})
+	check("GetTagValues", pmi.GetTagValues("host", "", all), []string{"a", "b", "c"})
+	check("GetTagValues of the first block", pmi.GetTagValues("dc", "", first), []string{"ams"})
+
+	// series present in several blocks are returned once
+	check("GetMetricIDsIteratorByName",
+		metricIDs(pmi.GetMetricIDsIteratorByName("cpu", all)),
+		ids("cpu;dc=ams;host=a", "cpu;dc=ams;host=b", "cpu;dc=fra;host=c"))
+	check("GetMetricIDsIteratorByTag",
+		metricIDs(pmi.GetMetricIDsIteratorByTag("dc", "ams", firstTwo)),
+		ids("cpu;dc=ams;host=a", "cpu;dc=ams;host=b", "mem;dc=ams"))
+	check("GetMetricIDsIteratorByMatchers",
+		metricIDs(pmi.GetMetricIDsIteratorByMatchers([]types.Matcher{
+			matcher(types.MatchNotEqual, "host", "b"),
+		}, all)),
+		ids("cpu;dc=ams;host=a", "cpu;dc=fra;host=c", "mem;dc=ams", "disk;dc=fra"))
+	check("Select", metricIDs(pmi.Select(`{dc="fra"}`, all)), ids("cpu;dc=fra;host=c", "disk;dc=fra"))
+	if _, err := pmi.GetMetricIDsIteratorByName("disk", first); err != ErrNoSuchMetricName {
+		t.Errorf("GetMetricIDsIteratorByName of name missing in the block returned %v, want ErrNoSuchMetricName", err)
+	}
+	if _, err := pmi.GetMetricIDsIteratorByTag("dc", "ber", all); err != ErrNoSuchTagNameValue {
+		t.Errorf("GetMetricIDsIteratorByTag of unknown pair returned %v, want ErrNoSuchTagNameValue", err)
+	}
+	if _, err := pmi.Select(`{`, all); err == nil {
+		t.Error("Select of malformed selector succeeded")
+	}
+
+	got, err := pmi.SeriesByTag("seriesByTag('dc=ams')", all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("SeriesByTag", got, []string{"cpu;dc=ams;host=a", "cpu;dc=ams;host=b", "mem;dc=ams"})
+	if _, err := pmi.SeriesByTag("seriesByTag(", all); err == nil {
+		t.Error("SeriesByTag of malformed expression succeeded")
+	}
+
+	// seen times span every block
+	a := ids("cpu;dc=ams;host=a")[0]
+	firstSeen, lastSeen, err := pmi.GetMetricSeenTimesByID(a)
+	if err != nil || !firstSeen.Before(start.Add(time.Hour)) || lastSeen.Before(start.Add(2*time.Hour)) {
+		t.Errorf("cpu;dc=ams;host=a is seen %v - %v, %v", firstSeen, lastSeen, err)
+	}
+	if metricStr, err := pmi.GetMetricNameByID(a); err != nil || metricStr != "cpu;dc=ams;host=a" {
+		t.Errorf("GetMetricNameByID returned %q, %v", metricStr, err)
+	}
+	names, err := pmi.GetMetricsNamesByIDs([]types.MetricID{a, 1})
+	check("GetMetricsNamesByIDs", names, []string{"cpu;dc=ams;host=a", ""})
+	if err != ErrSomeMetricsNotFound {
+		t.Errorf("GetMetricsNamesByIDs returned %v, want ErrSomeMetricsNotFound", err)
+	}
+}
+
+func TestPartitionedCardinality(t *testing.T) {
+	pmi, _, start := threeBlocks(t)
+	all := TimeRange{}
+	// single block is asked directly
+	second := TimeRange{From: start.Add(time.Hour), To: start.Add(time.Hour)}
+	tests := []struct {
+		what string
+		got  int
+		want int
+	}{
+		// cpu;dc=ams;host=a is in all three blocks
+		{"GetCardinalityByName cpu", pmi.GetCardinalityByName("cpu", all), 3},
+		{"GetCardinalityByName cpu of the second block", pmi.GetCardinalityByName("cpu", second), 2},
+		{"GetCardinalityByName of unknown name", pmi.GetCardinalityByName("net", all), 0},
+		{"GetCardinalityByTag dc=ams", pmi.GetCardinalityByTag("dc", "ams", all), 3},
+		{"GetCardinalityByTag dc=fra", pmi.GetCardinalityByTag("dc", "fra", all), 2},
+		{"GetCardinalityByTag dc=fra of the second block", pmi.GetCardinalityByTag("dc", "fra", second), 1},
+		{"GetCardinalityByTagName host", pmi.GetCardinalityByTagName("host", all), 3},
+		{"GetCardinalityByTagName dc", pmi.GetCardinalityByTagName("dc", all), 5},
+		{"GetCardinalityByTagName dc of the second block", pmi.GetCardinalityByTagName("dc", second), 3},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %d, want %d", tt.what, tt.got, tt.want)
+		}
+	}
+}
+
+func TestPartitionedDelete(t *testing.T) {
+	pmi, _, _ := threeBlocks(t)
+	// deleted from every block
+	if err := pmi.DeleteMetric("cpu;dc=ams;host=a"); err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range pmi.Blocks() {
+		if b.Index.MetricExistsByMetricStr("cpu;dc=ams;host=a") {
+			t.Fatalf("block %d still has deleted metric", i)
+		}
+	}
+	if err := pmi.DeleteMetric("cpu;dc=ams;host=a"); err != ErrNoSuchMetric {
+		t.Fatalf("DeleteMetric of deleted metric returned %v, want ErrNoSuchMetric", err)
+	}
+	metric, _ := types.ParseMetric("mem;dc=ams")
+	if err := pmi.DeleteMetricByID(metric.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if pmi.MetricExistsByMetricID(metric.ID()) || pmi.MetricExistsByMetricStr("mem;dc=ams") {
+		t.Fatal("mem;dc=ams exists after DeleteMetricByID")
+	}
+}
+
+func TestPartitionedDropBlocksBefore(t *testing.T) {
+	pmi, clock, start := threeBlocks(t)
+	// the first block ends right at start+1h
+	if n := pmi.DropBlocksBefore(start.Add(time.Hour - time.Nanosecond)); n != 0 {
+		t.Fatalf("DropBlocksBefore dropped %d blocks which are not over", n)
+	}
+	if n := pmi.DropBlocksBefore(start.Add(time.Hour)); n != 1 {
+		t.Fatalf("DropBlocksBefore dropped %d blocks, want 1", n)
+	}
+	checkBlocks(t, pmi, start.Add(time.Hour), start.Add(2*time.Hour))
+	if pmi.MetricExistsByMetricStr("cpu;dc=ams;host=b") {
+		t.Fatal("series of dropped block still exists")
+	}
+	if !pmi.MetricExistsByMetricStr("cpu;dc=ams;host=a") {
+		t.Fatal("series of kept blocks is dropped along with the old block")
+	}
+
+	// head is never dropped
+	if n := pmi.DropBlocksBefore(start.Add(24 * time.Hour)); n != 1 {
+		t.Fatalf("DropBlocksBefore dropped %d blocks, want 1", n)
+	}
+	checkBlocks(t, pmi, start.Add(2*time.Hour))
+
+	// retention loop drops blocks as time passes
+	clock.add(time.Hour)
+	mustInsertPartitioned(t, pmi, "cpu;dc=ams;host=a")
+	clock.add(time.Hour)
+	mustInsertPartitioned(t, pmi, "cpu;dc=ams;host=a")
+	checkBlocks(t, pmi, start.Add(2*time.Hour), start.Add(3*time.Hour), start.Add(4*time.Hour))
+	pmi.StartRetention(time.Hour, time.Millisecond)
+	defer pmi.StopRetention()
+	waitFor(t, func() bool {
+		return len(pmi.Blocks()) == 2
+	})
+	checkBlocks(t, pmi, start.Add(3*time.Hour), start.Add(4*time.Hour))
+}
+
+// TestPartitionedCollisionAcrossBlocks shows that blocks resolve hash
+// collisions independently, so colliding series swap MetricIDs between
+// blocks they were inserted to in different order
+func TestPartitionedCollisionAcrossBlocks(t *testing.T) {
+	const a, b = "cpu;host=a", "cpu;host=b"
+	collideMetrics(t, a, b)
+	clock := newTestClock()
+	pmi := newTestPartitioned(t, clock)
+	mustInsertPartitioned(t, pmi, a, b)
+	clock.add(time.Hour)
+	mustInsertPartitioned(t, pmi, b, a)
+
+	blocks := pmi.Blocks()
+	checkMetricIDs(t, blocks[0].Index, map[string]types.MetricID{a: collidingHash, b: collidingHash + 1})
+	checkMetricIDs(t, blocks[1].Index, map[string]types.MetricID{b: collidingHash, a: collidingHash + 1})
+
+	// both MetricIDs are returned once though each of them stands for
+	// both series
+	it, err := pmi.GetMetricIDsIteratorByName("cpu", TimeRange{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := drainMetricIDs(t, it)
+	sortMetricIDs(got)
+	if want := []types.MetricID{collidingHash, collidingHash + 1}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("iterator returned %v, want %v", got, want)
+	}
+	if n := pmi.GetCardinalityByName("cpu", TimeRange{}); n != 2 {
+		t.Fatalf("GetCardinalityByName = %d, want 2", n)
+	}
+	// MetricID is resolved by the newest block
+	if metricStr, err := pmi.GetMetricNameByID(collidingHash); err != nil || metricStr != b {
+		t.Fatalf("GetMetricNameByID(%d) returned %q, %v, want %q", collidingHash, metricStr, err, b)
+	}
+}
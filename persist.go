@@ -0,0 +1,400 @@
+package metricsindex
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+
+	"github.com/spuzirev/metricsindex/types"
+)
+
+// Snapshot format (all integers are little endian or (u)varints):
+//
+//	magic    [4]byte "MIDX"
+//	version  uint32
+//	count    uvarint                  number of metrics
+//	metrics  count * metric
+//	checksum uint32                   CRC-32C of everything above
+//
+//	metric:  name string, tagsCount uvarint, tagsCount * (name string, value string),
+//	         firstSeen varint, lastSeen varint (unix nanoseconds), idDelta uvarint
+//	string:  length uvarint, bytes
+//
+// idDelta is MetricID minus hash of the metric, it is not zero only for
+// metrics moved by hash collision (see collisions.go), so MetricIDs
+// returned to callers stay the same after reload.
+// Besides MetricIDs of colliding metrics only metrics are stored, every
+// other tree is rebuilt on load. So other IDs are never persisted and
+// changing how they are computed (e.g. TagNameValueID switching from
+// "name:value" to length-prefixed key) needs no migration of snapshots
+// or write-ahead logs.
+const (
+	snapshotMagic   = "MIDX"
+	snapshotVersion = 1
+
+	// maxSnapshotStringLen protects from huge allocations
+	// when reading corrupted snapshot
+	maxSnapshotStringLen = 1 << 20
+)
+
+var (
+	// ErrBadSnapshot represents situation when data being loaded
+	// is not an index snapshot
+	ErrBadSnapshot = errors.New("not a metrics index snapshot")
+
+	// ErrUnsupportedSnapshotVersion represents situation when snapshot
+	// was written by incompatible version of the index
+	ErrUnsupportedSnapshotVersion = errors.New("unsupported snapshot version")
+
+	// ErrSnapshotChecksum represents situation when snapshot is corrupted
+	ErrSnapshotChecksum = errors.New("snapshot checksum mismatch")
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// snapshotWriter writes to underlying writer updating checksum and counting
+// bytes written
+type snapshotWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+	n   int64
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (sw *snapshotWriter) Write(p []byte) (int, error) {
+	n, err := sw.w.Write(p)
+	sw.crc.Write(p[:n])
+	sw.n += int64(n)
+	return n, err
+}
+
+func (sw *snapshotWriter) writeUvarint(v uint64) error {
+	n := binary.PutUvarint(sw.buf[:], v)
+	_, err := sw.Write(sw.buf[:n])
+	return err
+}
+
+func (sw *snapshotWriter) writeVarint(v int64) error {
+	n := binary.PutVarint(sw.buf[:], v)
+	_, err := sw.Write(sw.buf[:n])
+	return err
+}
+
+func (sw *snapshotWriter) writeString(s string) error {
+	if err := sw.writeUvarint(uint64(len(s))); err != nil {
+		return err
+	}
+	_, err := sw.w.WriteString(s)
+	sw.crc.Write([]byte(s))
+	sw.n += int64(len(s))
+	return err
+}
+
+// snapshotMetric is a metric with everything stored about it in snapshot
+type snapshotMetric struct {
+	metric    types.Metric
+	firstSeen int64
+	lastSeen  int64
+	delta     uint64
+}
+
+// snapshotMetrics copies metrics of the index in MetricID order
+func (mi *MetricsIndex) snapshotMetrics() []snapshotMetric {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+
+	metrics := make([]snapshotMetric, 0, mi.MetricIDToMetric.Len())
+	e, err := mi.MetricIDToMetric.SeekFirst()
+	if err != nil {
+		return metrics
+	}
+	defer e.Close()
+	for {
+		metricID, metric, err := e.Next()
+		if err == io.EOF {
+			return metrics
+		}
+		ref, _ := mi.refs.ref(metricID)
+		sm := snapshotMetric{
+			metric:    metric,
+			firstSeen: atomic.LoadInt64(&mi.refs.firstSeen[ref]),
+			lastSeen:  atomic.LoadInt64(&mi.refs.lastSeen[ref]),
+		}
+		if len(mi.metricIDOverrides) > 0 {
+			sm.delta = uint64(metricID - hashMetric(&metric))
+		}
+		metrics = append(metrics, sm)
+	}
+}
+
+// WriteTo writes snapshot of the index to w.
+// Metrics are copied under read lock, so writers are blocked only
+// for the copying, not for the I/O.
+// It implements io.WriterTo.
+func (mi *MetricsIndex) WriteTo(w io.Writer) (int64, error) {
+	metrics := mi.snapshotMetrics()
+
+	sw := &snapshotWriter{
+		w:   bufio.NewWriter(w),
+		crc: crc32.New(crc32c),
+	}
+
+	header := make([]byte, 8)
+	copy(header, snapshotMagic)
+	binary.LittleEndian.PutUint32(header[4:], snapshotVersion)
+	if _, err := sw.Write(header); err != nil {
+		return sw.n, err
+	}
+	if err := sw.writeUvarint(uint64(len(metrics))); err != nil {
+		return sw.n, err
+	}
+
+	tagNames := make([]string, 0)
+	for i := range metrics {
+		sm := &metrics[i]
+		if err := sw.writeString(sm.metric.Name); err != nil {
+			return sw.n, err
+		}
+		if err := sw.writeUvarint(uint64(len(sm.metric.Tags))); err != nil {
+			return sw.n, err
+		}
+		tagNames = tagNames[:0]
+		for tagName := range sm.metric.Tags {
+			tagNames = append(tagNames, tagName)
+		}
+		sort.Strings(tagNames)
+		for _, tagName := range tagNames {
+			if err := sw.writeString(tagName); err != nil {
+				return sw.n, err
+			}
+			if err := sw.writeString(sm.metric.Tags[tagName]); err != nil {
+				return sw.n, err
+			}
+		}
+		if err := sw.writeVarint(sm.firstSeen); err != nil {
+			return sw.n, err
+		}
+		if err := sw.writeVarint(sm.lastSeen); err != nil {
+			return sw.n, err
+		}
+		if err := sw.writeUvarint(sm.delta); err != nil {
+			return sw.n, err
+		}
+	}
+
+	checksum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(checksum, sw.crc.Sum32())
+	if _, err := sw.w.Write(checksum); err != nil {
+		return sw.n, err
+	}
+	sw.n += 4
+	return sw.n, sw.w.Flush()
+}
+
+// snapshotReader reads from underlying reader updating checksum and counting
+// bytes read
+type snapshotReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+	n   int64
+}
+
+func (sr *snapshotReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	sr.crc.Write(p[:n])
+	sr.n += int64(n)
+	return n, err
+}
+
+func (sr *snapshotReader) ReadByte() (byte, error) {
+	b, err := sr.r.ReadByte()
+	if err == nil {
+		sr.crc.Write([]byte{b})
+		sr.n++
+	}
+	return b, err
+}
+
+func (sr *snapshotReader) readUvarint() (uint64, error) {
+	v, err := binary.ReadUvarint(sr)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return v, err
+}
+
+func (sr *snapshotReader) readVarint() (int64, error) {
+	v, err := binary.ReadVarint(sr)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return v, err
+}
+
+func (sr *snapshotReader) readString() (string, error) {
+	l, err := sr.readUvarint()
+	if err != nil {
+		return "", err
+	}
+	if l > maxSnapshotStringLen {
+		return "", ErrBadSnapshot
+	}
+	b := make([]byte, l)
+	if _, err = io.ReadFull(sr, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return string(b), nil
+}
+
+// ReadFrom reads snapshot written by WriteTo from r and inserts
+// all metrics from it to the index.
+// Metrics keep their MetricIDs, including the ones resolved after hash
+// collision, unless the index already has other metric with the same ID.
+// Nothing is inserted unless the whole snapshot is read and its
+// checksum is verified.
+// It implements io.ReaderFrom.
+func (mi *MetricsIndex) ReadFrom(r io.Reader) (int64, error) {
+	sr := &snapshotReader{
+		r:   bufio.NewReader(r),
+		crc: crc32.New(crc32c),
+	}
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(sr, header); err != nil {
+		return sr.n, ErrBadSnapshot
+	}
+	if string(header[:4]) != snapshotMagic {
+		return sr.n, ErrBadSnapshot
+	}
+	version := binary.LittleEndian.Uint32(header[4:])
+	if version != snapshotVersion {
+		return sr.n, ErrUnsupportedSnapshotVersion
+	}
+
+	count, err := sr.readUvarint()
+	if err != nil {
+		return sr.n, err
+	}
+	metrics := make([]types.Metric, 0)
+	seen := make([]int64, 0)
+	deltas := make([]uint64, 0)
+	for i := uint64(0); i < count; i++ {
+		name, err := sr.readString()
+		if err != nil {
+			return sr.n, err
+		}
+		tagsCount, err := sr.readUvarint()
+		if err != nil {
+			return sr.n, err
+		}
+		tags := make(map[string]string)
+		for j := uint64(0); j < tagsCount; j++ {
+			tagName, err := sr.readString()
+			if err != nil {
+				return sr.n, err
+			}
+			tagValue, err := sr.readString()
+			if err != nil {
+				return sr.n, err
+			}
+			tags[tagName] = tagValue
+		}
+		firstSeen, err := sr.readVarint()
+		if err != nil {
+			return sr.n, err
+		}
+		lastSeen, err := sr.readVarint()
+		if err != nil {
+			return sr.n, err
+		}
+		seen = append(seen, firstSeen, lastSeen)
+		delta, err := sr.readUvarint()
+		if err != nil {
+			return sr.n, err
+		}
+		deltas = append(deltas, delta)
+		metrics = append(metrics, types.Metric{
+			Name: name,
+			Tags: tags,
+		})
+	}
+
+	expected := sr.crc.Sum32()
+	checksum := make([]byte, 4)
+	n, err := io.ReadFull(sr.r, checksum)
+	sr.n += int64(n)
+	if err != nil {
+		return sr.n, io.ErrUnexpectedEOF
+	}
+	if binary.LittleEndian.Uint32(checksum) != expected {
+		return sr.n, ErrSnapshotChecksum
+	}
+
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	for i := range metrics {
+		metricID, exists := mi.restoreMetricID(&metrics[i], deltas[i])
+		if err := mi.addMetric(&metrics[i], metricID, exists, seen[2*i], seen[2*i+1]); err != nil {
+			return sr.n, err
+		}
+	}
+	return sr.n, nil
+}
+
+// SaveToFile atomically writes snapshot of the index to file at path.
+// Snapshot is written to temporary file in the same directory which
+// is synced and renamed over path afterwards.
+func (mi *MetricsIndex) SaveToFile(path string) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err = mi.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	// make rename durable
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// LoadFromFile reads snapshot written by SaveToFile and inserts
+// all metrics from it to the index
+func (mi *MetricsIndex) LoadFromFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = mi.ReadFrom(f)
+	return err
+}
@@ -0,0 +1,210 @@
+package metricsindex
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spuzirev/metricsindex/types"
+)
+
+// metricsWithIDs returns every metric of mi with its MetricID
+func metricsWithIDs(t *testing.T, mi *MetricsIndex) map[string]types.MetricID {
+	t.Helper()
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	res := make(map[string]types.MetricID)
+	e, err := mi.MetricIDToMetric.SeekFirst()
+	if err != nil {
+		return res
+	}
+	defer e.Close()
+	for {
+		metricID, metric, err := e.Next()
+		if err == io.EOF {
+			return res
+		}
+		res[metric.Serialize()] = metricID
+	}
+}
+
+func snapshot(t *testing.T, mi *MetricsIndex) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	n, err := mi.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Fatalf("WriteTo returned %d, wrote %d bytes", n, buf.Len())
+	}
+	return buf.Bytes()
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	mi := NewMetricsIndex()
+	clock := time.Unix(1000, 0)
+	mi.now = func() time.Time { return clock }
+	mustInsert(t, mi, "cpu;dc=ams;host=a", "cpu;dc=fra;host=b", `path;dir=C:\\temp;q=a\=b`, "mem")
+	clock = clock.Add(time.Minute)
+	mustInsert(t, mi, "cpu;dc=ams;host=a", "disk;dc=ams")
+	if err := mi.DeleteMetric("mem"); err != nil {
+		t.Fatal(err)
+	}
+	data := snapshot(t, mi)
+
+	loaded := NewMetricsIndex()
+	loaded.now = func() time.Time { return time.Unix(5000, 0) }
+	n, err := loaded.ReadFrom(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) {
+		t.Fatalf("ReadFrom returned %d, snapshot is %d bytes", n, len(data))
+	}
+	if got, want := metricsWithIDs(t, loaded), metricsWithIDs(t, mi); !reflect.DeepEqual(got, want) {
+		t.Fatalf("loaded %v, want %v", got, want)
+	}
+	for metricStr, metricID := range metricsWithIDs(t, mi) {
+		first, last, _ := mi.GetMetricSeenTimesByID(metricID)
+		loadedFirst, loadedLast, err := loaded.GetMetricSeenTimesByID(metricID)
+		if err != nil || !first.Equal(loadedFirst) || !last.Equal(loadedLast) {
+			t.Fatalf("%s is seen %v - %v, loaded %v - %v, %v", metricStr, first, last, loadedFirst, loadedLast, err)
+		}
+	}
+	for _, tag := range [][2]string{{"dc", "ams"}, {"dc", "fra"}, {"host", "a"}, {"q", "a=b"}} {
+		if got, want := loaded.GetCardinalityByTag(tag[0], tag[1]), mi.GetCardinalityByTag(tag[0], tag[1]); got != want {
+			t.Fatalf("GetCardinalityByTag(%s, %s) = %d, want %d", tag[0], tag[1], got, want)
+		}
+	}
+	if got, want := loaded.GetAllMetricNames(), mi.GetAllMetricNames(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("loaded metric names %q, want %q", got, want)
+	}
+	checkRefs(t, loaded)
+
+	// snapshot of loaded index is the same
+	if !bytes.Equal(snapshot(t, loaded), data) {
+		t.Fatal("snapshot of loaded index differs")
+	}
+}
+
+func TestSnapshotFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.snapshot")
+	mi := NewMetricsIndex()
+	mustInsert(t, mi, "cpu;dc=ams", "mem")
+	if err := mi.SaveToFile(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewMetricsIndex()
+	if err := loaded.LoadFromFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := metricsWithIDs(t, loaded), metricsWithIDs(t, mi); !reflect.DeepEqual(got, want) {
+		t.Fatalf("loaded %v, want %v", got, want)
+	}
+}
+
+func TestSnapshotKeepsCollidedMetricIDs(t *testing.T) {
+	const a, b, c = "cpu;host=a", "cpu;host=b", "cpu;host=c"
+	collideMetrics(t, a, b, c)
+	mi := NewMetricsIndex()
+	mustInsert(t, mi, a, b, c)
+	if err := mi.DeleteMetric(a); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]types.MetricID{
+		b: collidingHash + 1,
+		c: collidingHash + 2,
+	}
+	data := snapshot(t, mi)
+
+	loaded := NewMetricsIndex()
+	if _, err := loaded.ReadFrom(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if got := metricsWithIDs(t, loaded); !reflect.DeepEqual(got, want) {
+		t.Fatalf("loaded %v, want %v", got, want)
+	}
+	// overrides are restored, so metrics are found by their strings
+	checkMetricIDs(t, loaded, want)
+	mustInsert(t, loaded, a, b)
+	want[a] = collidingHash
+	checkMetricIDs(t, loaded, want)
+	if n := loaded.MetricIDToMetric.Len(); n != 3 {
+		t.Fatalf("index has %d metrics, want 3", n)
+	}
+
+	// ID taken by other metric is reassigned
+	other := NewMetricsIndex()
+	mustInsert(t, other, a, c)
+	if _, err := other.ReadFrom(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	checkMetricIDs(t, other, map[string]types.MetricID{
+		a: collidingHash,
+		c: collidingHash + 1,
+		b: collidingHash + 2,
+	})
+	checkRefs(t, other)
+}
+
+func TestSnapshotCorrupted(t *testing.T) {
+	mi := NewMetricsIndex()
+	mustInsert(t, mi, "cpu;dc=ams", "cpu;dc=fra", "mem")
+	data := snapshot(t, mi)
+
+	tests := []struct {
+		name   string
+		damage func(data []byte) []byte
+		err    error
+	}{
+		{"empty", func(data []byte) []byte { return nil }, ErrBadSnapshot},
+		{"bad magic", func(data []byte) []byte { data[0] = 'X'; return data }, ErrBadSnapshot},
+		{"future version", func(data []byte) []byte { data[4] = snapshotVersion + 1; return data }, ErrUnsupportedSnapshotVersion},
+		{"zero version", func(data []byte) []byte { data[4] = 0; return data }, ErrUnsupportedSnapshotVersion},
+		{"flipped byte", func(data []byte) []byte { data[len(data)/2] ^= 0x20; return data }, ErrSnapshotChecksum},
+		{"bad checksum", func(data []byte) []byte { data[len(data)-1] ^= 0xff; return data }, ErrSnapshotChecksum},
+		{"no checksum", func(data []byte) []byte { return data[:len(data)-4] }, io.ErrUnexpectedEOF},
+		{"truncated", func(data []byte) []byte { return data[:len(data)/2] }, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			damaged := tt.damage(append([]byte{}, data...))
+			loaded := NewMetricsIndex()
+			if _, err := loaded.ReadFrom(bytes.NewReader(damaged)); err != tt.err {
+				t.Fatalf("ReadFrom returned %v, want %v", err, tt.err)
+			}
+			if n := loaded.MetricIDToMetric.Len(); n != 0 {
+				t.Fatalf("%d metrics are loaded from corrupted snapshot", n)
+			}
+		})
+	}
+}
+
+func BenchmarkReadFrom(b *testing.B) {
+	mi := NewMetricsIndex()
+	for i := 0; i < 100000; i++ {
+		metricStr := fmt.Sprintf("cpu.load;dc=dc%d;host=web-%d;role=r%d", i%10, i, i%100)
+		if err := mi.InsertMetric(metricStr); err != nil {
+			b.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := mi.WriteTo(&buf); err != nil {
+		b.Fatal(err)
+	}
+	data := buf.Bytes()
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		loaded := NewMetricsIndex()
+		if _, err := loaded.ReadFrom(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+// Package postings implements compressed sorted lists of series numbers.
+// Numbers are meant to be dense, so deltas between them are small.
+//
+// List is split into blocks of up to blockSize IDs. Block keeps its first
+// and last IDs uncompressed, so the block holding an ID is found with
+// binary search, and the rest of IDs as uvarint deltas from the previous
+// one. Block is decoded and encoded again on every change, which is cheap
+// for blocks this small.
+package postings
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+const blockSize = 128
+
+type block struct {
+	first uint64
+	last  uint64
+	n     int
+	// deltas of IDs following the first one
+	data []byte
+}
+
+// List is compressed sorted set of IDs.
+// It is not safe for concurrent use, but Iterator tolerates changes made
+// to the list between its Next calls.
+type List struct {
+	blocks []block
+	n      int
+	// version is bumped on every change so iterators know when to resync
+	version uint64
+}
+
+// New returns empty List
+func New() *List {
+	return &List{}
+}
+
+// FromSorted returns List of ids which must be sorted and have no
+// duplicates
+func FromSorted(ids []uint64) *List {
+	l := &List{
+		blocks: make([]block, 0, (len(ids)+blockSize-1)/blockSize),
+		n:      len(ids),
+	}
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > blockSize {
+			n = blockSize
+		}
+		l.blocks = append(l.blocks, encode(ids[:n]))
+		ids = ids[n:]
+	}
+	return l
+}
+
+func encode(ids []uint64) block {
+	b := block{
+		first: ids[0],
+		last:  ids[len(ids)-1],
+		n:     len(ids),
+		data:  make([]byte, 0, len(ids)*2),
+	}
+	var buf [binary.MaxVarintLen64]byte
+	for i := 1; i < len(ids); i++ {
+		n := binary.PutUvarint(buf[:], ids[i]-ids[i-1])
+		b.data = append(b.data, buf[:n]...)
+	}
+	return b
+}
+
+// decode appends IDs of the block to dst
+func (b *block) decode(dst []uint64) []uint64 {
+	id := b.first
+	dst = append(dst, id)
+	for data := b.data; len(data) > 0; {
+		delta, n := binary.Uvarint(data)
+		data = data[n:]
+		id += delta
+		dst = append(dst, id)
+	}
+	return dst
+}
+
+// contains reports if block has id without decoding it to slice
+func (b *block) contains(id uint64) bool {
+	if id < b.first || id > b.last {
+		return false
+	}
+	cur := b.first
+	for data := b.data; cur < id && len(data) > 0; {
+		delta, n := binary.Uvarint(data)
+		data = data[n:]
+		cur += delta
+	}
+	return cur == id
+}
+
+// find returns index of the first block which may contain id, it is
+// len(l.blocks) if id is greater than every ID in the list
+func (l *List) find(id uint64) int {
+	return sort.Search(len(l.blocks), func(i int) bool {
+		return l.blocks[i].last >= id
+	})
+}
+
+// Len returns number of IDs in the list
+func (l *List) Len() int {
+	return l.n
+}
+
+// Contains reports if id is in the list
+func (l *List) Contains(id uint64) bool {
+	i := l.find(id)
+	return i < len(l.blocks) && l.blocks[i].contains(id)
+}
+
+// Add adds id to the list. It returns false if id is already there.
+func (l *List) Add(id uint64) bool {
+	if len(l.blocks) == 0 {
+		l.blocks = append(l.blocks, encode([]uint64{id}))
+		l.n++
+		l.version++
+		return true
+	}
+	i := l.find(id)
+	if i == len(l.blocks) {
+		i--
+	}
+	b := &l.blocks[i]
+	if b.contains(id) {
+		return false
+	}
+	if id > b.last && b.n == blockSize {
+		// id is greater than every ID and the last block is full
+		l.blocks = append(l.blocks, encode([]uint64{id}))
+	} else if id > b.last {
+		// appending is the common case, no need to decode
+		var buf [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(buf[:], id-b.last)
+		b.data = append(b.data, buf[:n]...)
+		b.last = id
+		b.n++
+	} else {
+		ids := b.decode(make([]uint64, 0, b.n+1))
+		j := sort.Search(len(ids), func(j int) bool { return ids[j] > id })
+		ids = append(ids, 0)
+		copy(ids[j+1:], ids[j:])
+		ids[j] = id
+		if len(ids) <= blockSize {
+			l.blocks[i] = encode(ids)
+		} else {
+			half := len(ids) / 2
+			l.blocks = append(l.blocks, block{})
+			copy(l.blocks[i+2:], l.blocks[i+1:])
+			l.blocks[i] = encode(ids[:half])
+			l.blocks[i+1] = encode(ids[half:])
+		}
+	}
+	l.n++
+	l.version++
+	return true
+}
+
+// Remove removes id from the list. It returns false if there is no such id.
+func (l *List) Remove(id uint64) bool {
+	i := l.find(id)
+	if i == len(l.blocks) || !l.blocks[i].contains(id) {
+		return false
+	}
+	b := &l.blocks[i]
+	if b.n == 1 {
+		l.blocks = append(l.blocks[:i], l.blocks[i+1:]...)
+	} else {
+		ids := b.decode(make([]uint64, 0, b.n))
+		j := sort.Search(len(ids), func(j int) bool { return ids[j] >= id })
+		ids = append(ids[:j], ids[j+1:]...)
+		l.blocks[i] = encode(ids)
+	}
+	l.n--
+	l.version++
+	return true
+}
+
+// AppendTo appends all IDs of the list to dst in ascending order
+func (l *List) AppendTo(dst []uint64) []uint64 {
+	for i := range l.blocks {
+		dst = l.blocks[i].decode(dst)
+	}
+	return dst
+}
+
+// Iterator returns iterator over IDs of the list in ascending order
+func (l *List) Iterator() *Iterator {
+	return &Iterator{
+		l:       l,
+		version: l.version,
+	}
+}
+
+// Iterator iterates over IDs of List in ascending order. If the list is
+// changed between Next calls iteration continues from the first ID
+// greater than the last one returned.
+type Iterator struct {
+	l       *List
+	version uint64
+	block   int
+	buf     []uint64
+	pos     int
+	last    uint64
+	started bool
+}
+
+// Next returns next ID. ok is false when there are no more IDs.
+func (it *Iterator) Next() (id uint64, ok bool) {
+	if it.version != it.l.version {
+		it.version = it.l.version
+		it.buf = it.buf[:0]
+		it.pos = 0
+		if it.started {
+			if it.last == ^uint64(0) {
+				it.block = len(it.l.blocks)
+				return 0, false
+			}
+			it.seek(it.last + 1)
+		} else {
+			it.block = 0
+		}
+	}
+	for it.pos == len(it.buf) {
+		if it.block >= len(it.l.blocks) {
+			return 0, false
+		}
+		it.buf = it.l.blocks[it.block].decode(it.buf[:0])
+		it.pos = 0
+		it.block++
+	}
+	id = it.buf[it.pos]
+	it.pos++
+	it.last, it.started = id, true
+	return id, true
+}
+
+// Seek moves iterator so the next call to Next returns the first ID
+// which is not less than id
+func (it *Iterator) Seek(id uint64) {
+	if it.version != it.l.version {
+		// decoded block may be stale, so it is dropped as in Next
+		it.version = it.l.version
+		it.buf = it.buf[:0]
+		it.pos = 0
+	}
+	it.seek(id)
+	// so resync after the next change continues from id too
+	if id > 0 {
+		it.last, it.started = id-1, true
+	} else {
+		it.started = false
+	}
+}
+
+func (it *Iterator) seek(id uint64) {
+	// still within decoded block
+	if it.pos < len(it.buf) && it.buf[len(it.buf)-1] >= id && it.buf[it.pos] <= id {
+		it.pos += sort.Search(len(it.buf)-it.pos, func(j int) bool {
+			return it.buf[it.pos+j] >= id
+		})
+		return
+	}
+	it.block = it.l.find(id)
+	it.buf = it.buf[:0]
+	it.pos = 0
+	if it.block == len(it.l.blocks) {
+		return
+	}
+	it.buf = it.l.blocks[it.block].decode(it.buf)
+	it.block++
+	it.pos = sort.Search(len(it.buf), func(j int) bool {
+		return it.buf[j] >= id
+	})
+}
+
+// Intersect returns new List of IDs present in both a and b
+func Intersect(a, b *List) *List {
+	if a.Len() > b.Len() {
+		a, b = b, a
+	}
+	res := make([]uint64, 0, a.Len())
+	ia, ib := a.Iterator(), b.Iterator()
+	for {
+		id, ok := ia.Next()
+		if !ok {
+			break
+		}
+		ib.Seek(id)
+		other, ok := ib.Next()
+		if !ok {
+			break
+		}
+		if other == id {
+			res = append(res, id)
+		} else {
+			ia.Seek(other)
+		}
+	}
+	return FromSorted(res)
+}
+
+// Difference returns new List of IDs present in a but not in b
+func Difference(a, b *List) *List {
+	res := make([]uint64, 0, a.Len())
+	ia, ib := a.Iterator(), b.Iterator()
+	other, more := ib.Next()
+	for {
+		id, ok := ia.Next()
+		if !ok {
+			break
+		}
+		if more && other < id {
+			ib.Seek(id)
+			other, more = ib.Next()
+		}
+		if !more || other != id {
+			res = append(res, id)
+		}
+	}
+	return FromSorted(res)
+}
+
+// Union returns new List of IDs present in any of lists
+func Union(lists ...*List) *List {
+	n := 0
+	for _, l := range lists {
+		n += l.Len()
+	}
+	ids := make([]uint64, 0, n)
+	for _, l := range lists {
+		ids = l.AppendTo(ids)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	res := ids[:0]
+	for i, id := range ids {
+		if i == 0 || id != ids[i-1] {
+			res = append(res, id)
+		}
+	}
+	return FromSorted(res)
+}
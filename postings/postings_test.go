@@ -0,0 +1,404 @@
+package postings
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func seq(from, to uint64) []uint64 {
+	ids := make([]uint64, 0, to-from)
+	for id := from; id < to; id++ {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// every returns each n-th element of ids starting with the first one
+func every(ids []uint64, n int) []uint64 {
+	res := make([]uint64, 0, len(ids)/n+1)
+	for i := 0; i < len(ids); i += n {
+		res = append(res, ids[i])
+	}
+	return res
+}
+
+func checkList(t *testing.T, l *List, want []uint64) {
+	t.Helper()
+	got := l.AppendTo(nil)
+	if len(want) == 0 && len(got) == 0 {
+		got, want = nil, nil
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("list is %v, want %v", got, want)
+	}
+	if l.Len() != len(want) {
+		t.Fatalf("Len() = %d, want %d", l.Len(), len(want))
+	}
+	n := 0
+	for i := range l.blocks {
+		b := &l.blocks[i]
+		if b.n == 0 || b.n > blockSize {
+			t.Fatalf("block %d has %d IDs", i, b.n)
+		}
+		if i > 0 && l.blocks[i-1].last >= b.first {
+			t.Fatalf("block %d overlaps previous one", i)
+		}
+		n += b.n
+	}
+	if n != len(want) {
+		t.Fatalf("blocks hold %d IDs, want %d", n, len(want))
+	}
+	for _, id := range want {
+		if !l.Contains(id) {
+			t.Fatalf("Contains(%d) = false", id)
+		}
+	}
+}
+
+func TestAddRemove(t *testing.T) {
+	tests := []struct {
+		name    string
+		add     []uint64
+		remove  []uint64
+		want    []uint64
+		nBlocks int
+	}{
+		{
+			name:    "empty",
+			nBlocks: 0,
+		},
+		{
+			name:    "unordered",
+			add:     []uint64{5, 1, 3, 1<<63 + 1, 0},
+			want:    []uint64{0, 1, 3, 5, 1<<63 + 1},
+			nBlocks: 1,
+		},
+		{
+			name:    "duplicates",
+			add:     []uint64{7, 7, 3, 3},
+			want:    []uint64{3, 7},
+			nBlocks: 1,
+		},
+		{
+			name:    "full block",
+			add:     seq(0, blockSize),
+			want:    seq(0, blockSize),
+			nBlocks: 1,
+		},
+		{
+			name:    "append to full block starts new one",
+			add:     seq(0, blockSize+1),
+			want:    seq(0, blockSize+1),
+			nBlocks: 2,
+		},
+		{
+			name:    "append fills blocks",
+			add:     seq(0, 3*blockSize),
+			want:    seq(0, 3*blockSize),
+			nBlocks: 3,
+		},
+		{
+			name:    "insert into full block splits it",
+			add:     append(seq(1, blockSize+1), 0),
+			want:    seq(0, blockSize+1),
+			nBlocks: 2,
+		},
+		{
+			name:    "remove",
+			add:     seq(0, 10),
+			remove:  []uint64{0, 9, 5, 42},
+			want:    []uint64{1, 2, 3, 4, 6, 7, 8},
+			nBlocks: 1,
+		},
+		{
+			name:    "remove last ID of block drops it",
+			add:     seq(0, blockSize+1),
+			remove:  []uint64{blockSize},
+			want:    seq(0, blockSize),
+			nBlocks: 1,
+		},
+		{
+			name:    "remove everything",
+			add:     seq(0, 2*blockSize),
+			remove:  seq(0, 2*blockSize),
+			nBlocks: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New()
+			seen := make(map[uint64]bool)
+			for _, id := range tt.add {
+				if added := l.Add(id); added == seen[id] {
+					t.Fatalf("Add(%d) = %v", id, added)
+				}
+				seen[id] = true
+			}
+			for _, id := range tt.remove {
+				if removed := l.Remove(id); removed != seen[id] {
+					t.Fatalf("Remove(%d) = %v", id, removed)
+				}
+				delete(seen, id)
+			}
+			checkList(t, l, tt.want)
+			if len(l.blocks) != tt.nBlocks {
+				t.Fatalf("list has %d blocks, want %d", len(l.blocks), tt.nBlocks)
+			}
+		})
+	}
+}
+
+func TestAddRemoveRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, space := range []uint64{1000, 1 << 63} {
+		l := New()
+		seen := make(map[uint64]bool)
+		for i := 0; i < 20000; i++ {
+			id := r.Uint64() % space
+			if r.Intn(3) == 0 {
+				if l.Remove(id) != seen[id] {
+					t.Fatalf("Remove(%d) = %v", id, !seen[id])
+				}
+				delete(seen, id)
+			} else {
+				if l.Add(id) == seen[id] {
+					t.Fatalf("Add(%d) = %v", id, seen[id])
+				}
+				seen[id] = true
+			}
+		}
+		want := make([]uint64, 0, len(seen))
+		for id := range seen {
+			want = append(want, id)
+		}
+		sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+		checkList(t, l, want)
+	}
+}
+
+func TestFromSorted(t *testing.T) {
+	for _, ids := range [][]uint64{nil, {1}, seq(0, blockSize), seq(10, 10+3*blockSize+1)} {
+		checkList(t, FromSorted(ids), ids)
+	}
+}
+
+func TestSetOperations(t *testing.T) {
+	evens := make([]uint64, 0)
+	for id := uint64(0); id < 1000; id += 2 {
+		evens = append(evens, id)
+	}
+	tests := []struct {
+		name         string
+		a, b         []uint64
+		intersection []uint64
+		difference   []uint64
+		union        []uint64
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:       "empty b",
+			a:          []uint64{1, 2},
+			difference: []uint64{1, 2},
+			union:      []uint64{1, 2},
+		},
+		{
+			name:  "empty a",
+			b:     []uint64{1, 2},
+			union: []uint64{1, 2},
+		},
+		{
+			name:         "overlapping",
+			a:            []uint64{1, 3, 5, 7},
+			b:            []uint64{3, 4, 5, 6},
+			intersection: []uint64{3, 5},
+			difference:   []uint64{1, 7},
+			union:        []uint64{1, 3, 4, 5, 6, 7},
+		},
+		{
+			name:       "disjoint",
+			a:          []uint64{1, 2},
+			b:          []uint64{10, 20},
+			difference: []uint64{1, 2},
+			union:      []uint64{1, 2, 10, 20},
+		},
+		{
+			name:         "equal",
+			a:            seq(0, 300),
+			b:            seq(0, 300),
+			intersection: seq(0, 300),
+			union:        seq(0, 300),
+		},
+		{
+			name:         "many blocks",
+			a:            seq(0, 1000),
+			b:            evens,
+			intersection: evens,
+			difference:   every(seq(1, 1000), 2),
+			union:        seq(0, 1000),
+		},
+		{
+			name:         "large IDs",
+			a:            []uint64{1, 1 << 40, ^uint64(0)},
+			b:            []uint64{1 << 40, ^uint64(0)},
+			intersection: []uint64{1 << 40, ^uint64(0)},
+			difference:   []uint64{1},
+			union:        []uint64{1, 1 << 40, ^uint64(0)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := FromSorted(tt.a), FromSorted(tt.b)
+			checkList(t, Intersect(a, b), tt.intersection)
+			checkList(t, Intersect(b, a), tt.intersection)
+			checkList(t, Difference(a, b), tt.difference)
+			checkList(t, Union(a, b), tt.union)
+			checkList(t, Union(b, a, a), tt.union)
+		})
+	}
+}
+
+func collectIDs(it *Iterator) []uint64 {
+	var ids []uint64
+	for {
+		id, ok := it.Next()
+		if !ok {
+			return ids
+		}
+		ids = append(ids, id)
+	}
+}
+
+func TestIteratorResync(t *testing.T) {
+	tests := []struct {
+		name string
+		ids  []uint64
+		// number of IDs returned before change
+		before int
+		change func(l *List)
+		// ID to Seek after change, if any
+		seek *uint64
+		// Seek before change instead
+		seekFirst bool
+		want      []uint64
+	}{
+		{
+			name:   "add ahead",
+			ids:    []uint64{1, 2, 3},
+			before: 1,
+			change: func(l *List) { l.Add(10) },
+			want:   []uint64{2, 3, 10},
+		},
+		{
+			name:   "add behind is skipped",
+			ids:    []uint64{10, 20, 30},
+			before: 2,
+			change: func(l *List) { l.Add(5) },
+			want:   []uint64{30},
+		},
+		{
+			name:   "remove next",
+			ids:    []uint64{1, 2, 3},
+			before: 1,
+			change: func(l *List) { l.Remove(2) },
+			want:   []uint64{3},
+		},
+		{
+			name:   "remove returned",
+			ids:    seq(0, 10),
+			before: 5,
+			change: func(l *List) { l.Remove(4) },
+			want:   seq(5, 10),
+		},
+		{
+			name:   "split of current block",
+			ids:    every(seq(0, 2*blockSize), 2),
+			before: 10,
+			change: func(l *List) { l.Add(1) },
+			want:   every(seq(0, 2*blockSize), 2)[10:],
+		},
+		{
+			name:   "remove rest",
+			ids:    seq(0, 300),
+			before: 100,
+			change: func(l *List) {
+				for id := uint64(100); id < 300; id++ {
+					l.Remove(id)
+				}
+			},
+		},
+		{
+			name:   "change before start",
+			ids:    []uint64{2, 3},
+			change: func(l *List) { l.Add(1) },
+			want:   []uint64{1, 2, 3},
+		},
+		{
+			name:   "max ID",
+			ids:    []uint64{1, ^uint64(0)},
+			before: 2,
+			change: func(l *List) { l.Add(5) },
+		},
+		{
+			name:   "seek after change",
+			ids:    seq(0, 300),
+			before: 3,
+			change: func(l *List) { l.Remove(200) },
+			seek:   func() *uint64 { id := uint64(150); return &id }(),
+			want:   append(seq(150, 200), seq(201, 300)...),
+		},
+		{
+			name:   "seek after change within decoded block",
+			ids:    seq(0, 10),
+			before: 1,
+			change: func(l *List) { l.Remove(5) },
+			seek:   func() *uint64 { id := uint64(4); return &id }(),
+			want:   []uint64{4, 6, 7, 8, 9},
+		},
+		{
+			name:      "change after seek",
+			ids:       seq(0, 300),
+			seek:      func() *uint64 { id := uint64(200); return &id }(),
+			seekFirst: true,
+			change:    func(l *List) { l.Add(1000) },
+			want:      append(seq(200, 300), 1000),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := FromSorted(tt.ids)
+			it := l.Iterator()
+			for i := 0; i < tt.before; i++ {
+				if id, ok := it.Next(); !ok || id != tt.ids[i] {
+					t.Fatalf("Next() = %d, %v, want %d", id, ok, tt.ids[i])
+				}
+			}
+			if tt.seekFirst {
+				it.Seek(*tt.seek)
+			}
+			tt.change(l)
+			if tt.seek != nil && !tt.seekFirst {
+				it.Seek(*tt.seek)
+			}
+			if got := collectIDs(it); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIteratorSeek(t *testing.T) {
+	l := FromSorted(every(seq(0, 1000), 3))
+	for _, id := range []uint64{0, 1, 3, 500, 998, 999, 5000} {
+		it := l.Iterator()
+		it.Seek(id)
+		got, ok := it.Next()
+		want := (id + 2) / 3 * 3
+		if wantOK := want < 1000; ok != wantOK || ok && got != want {
+			t.Fatalf("Seek(%d): Next() = %d, %v, want %d, %v", id, got, ok, want, wantOK)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package metricsindex
+
+import (
+	"github.com/spuzirev/metricsindex/postings"
+	"github.com/spuzirev/metricsindex/types"
+)
+
+// MetricIDs are random 64-bit hashes, so postings keyed by them compress
+// badly and are costly to intersect. Instead every metric gets a dense
+// series number (ref) when it is inserted and postings hold refs. Refs of
+// deleted metrics are reused. Refs never leave the index: everything
+// public still takes and returns MetricIDs.
+// Per-series data which is not needed for lookups, like first and last
+// seen timestamps, is kept in slices indexed by ref.
+
+// seriesRefs maps MetricIDs to refs and back
+type seriesRefs struct {
+	byMetricID map[types.MetricID]uint64
+	metricIDs  []types.MetricID
+	free       []uint64
+
+	// assigned holds value of seq at the moment ref was assigned, so
+	// iterators can tell reused refs from the ones they have matched
+	seq      uint64
+	assigned []uint64
+
+	// unix nanoseconds, lastSeen is updated atomically as series are
+	// touched under read lock
+	firstSeen []int64
+	lastSeen  []int64
+}
+
+func newSeriesRefs() *seriesRefs {
+	return &seriesRefs{
+		byMetricID: make(map[types.MetricID]uint64),
+	}
+}
+
+// assign returns ref of metricID assigning a new one if necessary
+func (r *seriesRefs) assign(metricID types.MetricID) uint64 {
+	if ref, ok := r.byMetricID[metricID]; ok {
+		return ref
+	}
+	r.seq++
+	var ref uint64
+	if n := len(r.free); n > 0 {
+		ref = r.free[n-1]
+		r.free = r.free[:n-1]
+		r.metricIDs[ref] = metricID
+		r.firstSeen[ref], r.lastSeen[ref] = 0, 0
+		r.assigned[ref] = r.seq
+	} else {
+		ref = uint64(len(r.metricIDs))
+		r.metricIDs = append(r.metricIDs, metricID)
+		r.firstSeen = append(r.firstSeen, 0)
+		r.lastSeen = append(r.lastSeen, 0)
+		r.assigned = append(r.assigned, r.seq)
+	}
+	r.byMetricID[metricID] = ref
+	return ref
+}
+
+// release frees ref of metricID
+func (r *seriesRefs) release(metricID types.MetricID) {
+	ref, ok := r.byMetricID[metricID]
+	if !ok {
+		return
+	}
+	delete(r.byMetricID, metricID)
+	r.free = append(r.free, ref)
+}
+
+// ref returns ref of metricID
+func (r *seriesRefs) ref(metricID types.MetricID) (uint64, bool) {
+	ref, ok := r.byMetricID[metricID]
+	return ref, ok
+}
+
+// live returns true if ref is assigned to some metric
+func (r *seriesRefs) live(ref uint64) bool {
+	if ref >= uint64(len(r.metricIDs)) {
+		return false
+	}
+	cur, ok := r.byMetricID[r.metricIDs[ref]]
+	return ok && cur == ref
+}
+
+// refSet is set of refs selected by matchers: refs of include, or every
+// live ref if include is nil, except the ones present in any of excludes
+type refSet struct {
+	include  *postings.List
+	excludes []*postings.List
+}
+
+// iterator returns refIterator over refs of s
+func (r *seriesRefs) iterator(s refSet) *refIterator {
+	it := &refIterator{
+		refs:     r,
+		excludes: s.excludes,
+	}
+	if s.include != nil {
+		it.include = s.include.Iterator()
+	}
+	return it
+}
+
+// refIterator iterates over refs of refSet in ascending order.
+// Caller must hold read lock during every Next call.
+type refIterator struct {
+	refs     *seriesRefs
+	include  *postings.Iterator
+	next     uint64
+	excludes []*postings.List
+}
+
+// Next returns next ref. ok is false when there are no more refs.
+func (it *refIterator) Next() (ref uint64, ok bool) {
+	for {
+		if it.include != nil {
+			if ref, ok = it.include.Next(); !ok {
+				return 0, false
+			}
+		} else {
+			// no postings to iterate, so every live ref is checked
+			if it.next >= uint64(len(it.refs.metricIDs)) {
+				return 0, false
+			}
+			ref = it.next
+			it.next++
+			if !it.refs.live(ref) {
+				continue
+			}
+		}
+		if !it.excluded(ref) {
+			return ref, true
+		}
+	}
+}
+
+func (it *refIterator) excluded(ref uint64) bool {
+	for _, l := range it.excludes {
+		if l.Contains(ref) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,324 @@
+package metricsindex
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/spuzirev/metricsindex/types"
+)
+
+// drainMetricIDs returns everything left in it and closes it
+func drainMetricIDs(t testing.TB, it *MetricIDIterator) []types.MetricID {
+	t.Helper()
+	defer it.Close()
+	res := make([]types.MetricID, 0)
+	for {
+		metricID, err := it.Next()
+		if err == io.EOF {
+			return res
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, metricID)
+	}
+}
+
+func mustInsert(t testing.TB, mi *MetricsIndex, metricsStr ...string) {
+	t.Helper()
+	if err := mi.InsertMetricsBatch(metricsStr); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// metricIDOf returns MetricID of metricStr which must be in mi
+func metricIDOf(t testing.TB, mi *MetricsIndex, metricStr string) types.MetricID {
+	t.Helper()
+	metric, err := types.ParseMetric(metricStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	metricID, ok := mi.lookupMetricID(metric)
+	if !ok {
+		t.Fatalf("%s is not in index", metricStr)
+	}
+	return metricID
+}
+
+// checkRefs verifies that refs and postings of mi describe the same
+// metrics as MetricIDToMetric does
+func checkRefs(t *testing.T, mi *MetricsIndex) {
+	t.Helper()
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	live := 0
+	for ref := range mi.refs.metricIDs {
+		if mi.refs.live(uint64(ref)) {
+			live++
+		}
+	}
+	if live != len(mi.refs.byMetricID) || live != mi.MetricIDToMetric.Len() {
+		t.Fatalf("%d live refs, %d MetricIDs, %d metrics", live, len(mi.refs.byMetricID), mi.MetricIDToMetric.Len())
+	}
+	if live+len(mi.refs.free) != len(mi.refs.metricIDs) {
+		t.Fatalf("%d live and %d free refs out of %d", live, len(mi.refs.free), len(mi.refs.metricIDs))
+	}
+	for metricID, ref := range mi.refs.byMetricID {
+		metric, ok := mi.MetricIDToMetric.Get(metricID)
+		if !ok {
+			t.Fatalf("ref %d points to missing metric", ref)
+		}
+		names, _ := mi.getNameMetricIDs(types.MetricName(metric.Name))
+		if names == nil || !names.Contains(ref) {
+			t.Fatalf("%s: ref %d is missing in name postings", metric.Serialize(), ref)
+		}
+		for tn, tv := range metric.Tags {
+			tagPostings, _ := mi.getTagMetricIDs(types.TagName(tn))
+			valuePostings, _ := mi.getTagNameValueMetricIDs(types.TagNameValue{
+				TagName:  types.TagName(tn),
+				TagValue: types.TagValue(tv),
+			})
+			if tagPostings == nil || !tagPostings.Contains(ref) || valuePostings == nil || !valuePostings.Contains(ref) {
+				t.Fatalf("%s: ref %d is missing in postings of %s=%s", metric.Serialize(), ref, tn, tv)
+			}
+		}
+	}
+}
+
+func TestRefsReusedAfterDelete(t *testing.T) {
+	mi := NewMetricsIndex()
+	mustInsert(t, mi, "a;dc=ams;env=prod", "b;dc=ams;env=dev", "c;dc=fra")
+	bRef, _ := mi.refs.ref(metricIDOf(t, mi, "b;dc=ams;env=dev"))
+
+	if err := mi.DeleteMetric("b;dc=ams;env=dev"); err != nil {
+		t.Fatal(err)
+	}
+	checkRefs(t, mi)
+
+	mustInsert(t, mi, "d;dc=fra;env=dev")
+	dRef, _ := mi.refs.ref(metricIDOf(t, mi, "d;dc=fra;env=dev"))
+	if dRef != bRef {
+		t.Fatalf("new metric got ref %d, want freed ref %d", dRef, bRef)
+	}
+	if len(mi.refs.metricIDs) != 3 {
+		t.Fatalf("%d refs allocated, want 3", len(mi.refs.metricIDs))
+	}
+	checkRefs(t, mi)
+
+	// postings of the old metric must not see the new one
+	tests := []struct {
+		tagName, tagValue string
+		want              int
+	}{
+		{"dc", "ams", 1},
+		{"dc", "fra", 2},
+		{"env", "dev", 1},
+		{"env", "prod", 1},
+	}
+	for _, tt := range tests {
+		if got := mi.GetCardinalityByTag(tt.tagName, tt.tagValue); got != tt.want {
+			t.Errorf("GetCardinalityByTag(%s, %s) = %d, want %d", tt.tagName, tt.tagValue, got, tt.want)
+		}
+	}
+	if got := mi.GetCardinalityByName("b"); got != 0 {
+		t.Errorf("GetCardinalityByName(b) = %d, want 0", got)
+	}
+	it, err := mi.GetMetricIDsIteratorByTag("env", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := drainMetricIDs(t, it)
+	want := metricIDOf(t, mi, "d;dc=fra;env=dev")
+	if len(got) != 1 || got[0] != want {
+		t.Fatalf("env=dev iterator returned %v, want [%v]", got, want)
+	}
+}
+
+func TestRefsChurn(t *testing.T) {
+	mi := NewMetricsIndex()
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 100; i++ {
+			mustInsert(t, mi, fmt.Sprintf("m%d;round=%d;i=%d", i%7, round, i))
+		}
+		for i := 0; i < 100; i += 2 {
+			if err := mi.DeleteMetric(fmt.Sprintf("m%d;round=%d;i=%d", i%7, round, i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		checkRefs(t, mi)
+	}
+	// every round reused refs freed by the previous one
+	if n := len(mi.refs.metricIDs); n != 300 {
+		t.Fatalf("%d refs allocated, want 300", n)
+	}
+}
+
+func TestMetricIDIteratorOrder(t *testing.T) {
+	mi := NewMetricsIndex()
+	want := make([]types.MetricID, 0)
+	for i := 0; i < 1000; i++ {
+		metricStr := fmt.Sprintf("cpu;host=h%d", i)
+		mustInsert(t, mi, metricStr)
+		want = append(want, metricIDOf(t, mi, metricStr))
+	}
+	it, err := mi.GetMetricIDsIteratorByName("cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no refs were reused, so order of refs is order of insertion
+	if got := drainMetricIDs(t, it); !reflect.DeepEqual(got, want) {
+		t.Fatal("iterator returned MetricIDs not in order of insertion")
+	}
+}
+
+func TestMetricIDIteratorSkipsDeleted(t *testing.T) {
+	mi := NewMetricsIndex()
+	for i := 0; i < 100; i++ {
+		mustInsert(t, mi, fmt.Sprintf("cpu;host=h%d", i))
+	}
+	it, err := mi.GetMetricIDsIteratorByName("cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+
+	first, err := it.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// delete every other metric, reuse their refs for new metrics and
+	// delete the first one which was already returned
+	deleted := make(map[types.MetricID]bool)
+	for i := 0; i < 100; i += 2 {
+		metricStr := fmt.Sprintf("cpu;host=h%d", i)
+		metricID := metricIDOf(t, mi, metricStr)
+		if metricID == first {
+			continue
+		}
+		deleted[metricID] = true
+		if err := mi.DeleteMetric(metricStr); err != nil {
+			t.Fatal(err)
+		}
+		mustInsert(t, mi, fmt.Sprintf("cpu;host=new%d", i))
+	}
+	if err := mi.DeleteMetricByID(first); err != nil {
+		t.Fatal(err)
+	}
+
+	rest := drainMetricIDs(t, it)
+	if len(rest) != 100-1-len(deleted) {
+		t.Fatalf("iterator returned %d more metrics, want %d", len(rest), 100-1-len(deleted))
+	}
+	for _, metricID := range rest {
+		if deleted[metricID] {
+			t.Fatalf("iterator returned deleted metric %v", metricID)
+		}
+		if metricID == first {
+			t.Fatalf("iterator returned %v twice", metricID)
+		}
+		if !mi.MetricExistsByMetricID(metricID) {
+			t.Fatalf("iterator returned missing metric %v", metricID)
+		}
+	}
+	checkRefs(t, mi)
+}
+
+func TestNegativeMatchersScanLiveRefs(t *testing.T) {
+	mi := NewMetricsIndex()
+	for i := 0; i < 10; i++ {
+		mustInsert(t, mi, fmt.Sprintf("cpu;host=h%d;role=r%d", i, i%2))
+	}
+	// leave some refs free
+	for i := 0; i < 10; i += 3 {
+		if err := mi.DeleteMetric(fmt.Sprintf("cpu;host=h%d;role=r%d", i, i%2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	matchers := []types.Matcher{
+		matcher(types.MatchNotEqual, "role", "r0"),
+		matcher(types.MatchNotRegexp, "host", "h[15]"),
+	}
+	it, err := mi.GetMetricIDsIteratorByMatchers(matchers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	first, err := it.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := metricIDOf(t, mi, "cpu;host=h7;role=r1"); first != want {
+		t.Fatalf("iterator returned %v first, want %v", first, want)
+	}
+	// the last freed ref, which is past the first match, is taken by
+	// matching metric while iterating
+	mustInsert(t, mi, "mem;host=h10")
+	if rest := drainMetricIDs(t, it); len(rest) != 0 {
+		t.Fatalf("iterator returned %v after metrics were changed", rest)
+	}
+
+	it, err = mi.GetMetricIDsIteratorByMatchers(matchers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []types.MetricID{first, metricIDOf(t, mi, "mem;host=h10")}
+	if got := drainMetricIDs(t, it); !reflect.DeepEqual(got, want) {
+		t.Fatalf("iterator returned %v, want %v", got, want)
+	}
+
+	// every metric has a name
+	for _, tt := range []struct {
+		m    types.Matcher
+		want int
+	}{
+		{matcher(types.MatchNotEqual, types.NameTagName, ""), 7},
+		{matcher(types.MatchExists, types.NameTagName, ""), 7},
+		{matcher(types.MatchEqual, types.NameTagName, ""), 0},
+		{matcher(types.MatchNotExists, types.NameTagName, ""), 0},
+	} {
+		it, err := mi.GetMetricIDsIteratorByMatchers([]types.Matcher{tt.m})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := drainMetricIDs(t, it); len(got) != tt.want {
+			t.Errorf("%v matched %d metrics, want %d", tt.m, len(got), tt.want)
+		}
+	}
+}
+
+func BenchmarkMetricIDIterator(b *testing.B) {
+	for _, n := range []int{1000, 100000} {
+		mi := NewMetricsIndex()
+		for i := 0; i < n; i++ {
+			if err := mi.InsertMetric(fmt.Sprintf("cpu;host=h%d", i)); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.Run(fmt.Sprintf("first/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				it, _ := mi.GetMetricIDsIteratorByName("cpu")
+				if _, err := it.Next(); err != nil {
+					b.Fatal(err)
+				}
+				it.Close()
+			}
+		})
+		b.Run(fmt.Sprintf("all/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				it, _ := mi.GetMetricIDsIteratorByName("cpu")
+				for {
+					if _, err := it.Next(); err != nil {
+						break
+					}
+				}
+				it.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+// Package selector implements parser of Prometheus-style series selectors
+// like `cpu.load{env="prod",host=~"web-.*",role!="canary"}`.
+package selector
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/spuzirev/metricsindex/types"
+)
+
+// ParseError is returned by Parse when selector is malformed.
+// Pos is the byte offset in the selector string where the problem
+// was found.
+type ParseError struct {
+	Pos int
+	Msg string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("cannot parse selector at position %d: %s", e.Pos, e.Msg)
+}
+
+type parser struct {
+	s   string
+	pos int
+}
+
+// Parse parses selector and returns matchers it consists of.
+// Metric name, if present, is returned as types.MatchEqual matcher
+// on types.NameTagName, the same as `{__name__="name"}` would be.
+func Parse(s string) ([]types.Matcher, error) {
+	p := &parser{s: s}
+	return p.parse()
+}
+
+func (p *parser) errorf(pos int, format string, args ...interface{}) error {
+	return &ParseError{
+		Pos: pos,
+		Msg: fmt.Sprintf(format, args...),
+	}
+}
+
+func (p *parser) skipSpaces() {
+	for p.pos < len(p.s) && strings.IndexByte(" \t\r\n", p.s[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.s)
+}
+
+func isIdentChar(c byte, first bool) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+		return true
+	case c >= '0' && c <= '9', c == '.', c == '-':
+		return !first
+	}
+	return false
+}
+
+// ident reads metric or tag name
+func (p *parser) ident() (string, error) {
+	start := p.pos
+	if p.eof() || !isIdentChar(p.s[p.pos], true) {
+		return "", p.errorf(start, "expected name, got %s", p.describe())
+	}
+	for !p.eof() && isIdentChar(p.s[p.pos], false) {
+		p.pos++
+	}
+	return p.s[start:p.pos], nil
+}
+
+// describe returns human readable description of what is at current position
+func (p *parser) describe() string {
+	if p.eof() {
+		return "end of input"
+	}
+	r, _ := utf8.DecodeRuneInString(p.s[p.pos:])
+	return strconv.QuoteRune(r)
+}
+
+func (p *parser) parse() ([]types.Matcher, error) {
+	matchers := make([]types.Matcher, 0)
+
+	p.skipSpaces()
+	if p.eof() {
+		return nil, p.errorf(p.pos, "empty selector")
+	}
+	hasName := false
+	if p.s[p.pos] != '{' {
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		hasName = true
+		matchers = append(matchers, types.Matcher{
+			Type:     types.MatchEqual,
+			TagName:  types.NameTagName,
+			TagValue: types.TagValue(name),
+		})
+		p.skipSpaces()
+	}
+
+	if !p.eof() && p.s[p.pos] == '{' {
+		p.pos++
+		tagMatchers, err := p.matchers(hasName)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, tagMatchers...)
+		p.skipSpaces()
+	}
+
+	if !p.eof() {
+		return nil, p.errorf(p.pos, "unexpected %s", p.describe())
+	}
+	if len(matchers) == 0 {
+		return nil, p.errorf(0, "selector must contain at least one matcher")
+	}
+	return matchers, nil
+}
+
+// matchers parses comma separated list of matchers up to closing brace.
+// If hasName is true metric name was set before the brace and
+// __name__ matcher is an error.
+func (p *parser) matchers(hasName bool) ([]types.Matcher, error) {
+	res := make([]types.Matcher, 0)
+	for {
+		p.skipSpaces()
+		if p.eof() {
+			return nil, p.errorf(p.pos, "unclosed '{'")
+		}
+		if p.s[p.pos] == '}' {
+			p.pos++
+			return res, nil
+		}
+		start := p.pos
+		m, err := p.matcher()
+		if err != nil {
+			return nil, err
+		}
+		if hasName && m.TagName == types.NameTagName {
+			return nil, p.errorf(start, "metric name must not be set twice")
+		}
+		res = append(res, m)
+
+		p.skipSpaces()
+		if p.eof() {
+			return nil, p.errorf(p.pos, "unclosed '{'")
+		}
+		switch p.s[p.pos] {
+		case ',':
+			p.pos++
+		case '}':
+		default:
+			return nil, p.errorf(p.pos, "expected ',' or '}', got %s", p.describe())
+		}
+	}
+}
+
+// matcher parses single `name op "value"` matcher
+func (p *parser) matcher() (types.Matcher, error) {
+	name, err := p.ident()
+	if err != nil {
+		return types.Matcher{}, err
+	}
+	p.skipSpaces()
+
+	var mt types.MatchType
+	rest := p.s[p.pos:]
+	switch {
+	case strings.HasPrefix(rest, "=~"):
+		mt = types.MatchRegexp
+		p.pos += 2
+	case strings.HasPrefix(rest, "!~"):
+		mt = types.MatchNotRegexp
+		p.pos += 2
+	case strings.HasPrefix(rest, "!="):
+		mt = types.MatchNotEqual
+		p.pos += 2
+	case strings.HasPrefix(rest, "="):
+		mt = types.MatchEqual
+		p.pos++
+	default:
+		return types.Matcher{}, p.errorf(p.pos, "expected one of '=', '!=', '=~', '!~', got %s", p.describe())
+	}
+	p.skipSpaces()
+
+	value, err := p.str()
+	if err != nil {
+		return types.Matcher{}, err
+	}
+	return types.Matcher{
+		Type:     mt,
+		TagName:  types.TagName(name),
+		TagValue: types.TagValue(value),
+	}, nil
+}
+
+// str parses double quoted, single quoted or backquoted (raw) string
+func (p *parser) str() (string, error) {
+	start := p.pos
+	if p.eof() {
+		return "", p.errorf(p.pos, "expected quoted string, got end of input")
+	}
+	quote := p.s[p.pos]
+	if quote != '"' && quote != '\'' && quote != '`' {
+		return "", p.errorf(p.pos, "expected quoted string, got %s", p.describe())
+	}
+	p.pos++
+
+	var b strings.Builder
+	for {
+		if p.eof() {
+			return "", p.errorf(start, "unterminated string")
+		}
+		c := p.s[p.pos]
+		switch {
+		case c == quote:
+			p.pos++
+			return b.String(), nil
+		case c == '\\' && quote != '`':
+			value, multibyte, tail, err := strconv.UnquoteChar(p.s[p.pos:], quote)
+			if err != nil {
+				return "", p.errorf(p.pos, "invalid escape sequence")
+			}
+			if multibyte || value < utf8.RuneSelf {
+				b.WriteRune(value)
+			} else {
+				// \xNN and \NNN escapes produce single bytes
+				b.WriteByte(byte(value))
+			}
+			p.pos = len(p.s) - len(tail)
+		case c == '\n' && quote != '`':
+			return "", p.errorf(p.pos, "newline in string")
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package selector
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spuzirev/metricsindex/types"
+)
+
+func name(value string) types.Matcher {
+	return types.Matcher{Type: types.MatchEqual, TagName: types.NameTagName, TagValue: types.TagValue(value)}
+}
+
+func m(mt types.MatchType, tagName, tagValue string) types.Matcher {
+	return types.Matcher{Type: mt, TagName: types.TagName(tagName), TagValue: types.TagValue(tagValue)}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []types.Matcher
+	}{
+		{"cpu", []types.Matcher{name("cpu")}},
+		{"  cpu.load_1:m-5  ", []types.Matcher{name("cpu.load_1:m-5")}},
+		{"cpu{}", []types.Matcher{name("cpu")}},
+		{`cpu{dc="ams"}`, []types.Matcher{name("cpu"), m(types.MatchEqual, "dc", "ams")}},
+		{
+			`cpu.load { env = "prod" , host=~"web-.*",role!="canary", dc!~'fra|ams', }`,
+			[]types.Matcher{
+				name("cpu.load"),
+				m(types.MatchEqual, "env", "prod"),
+				m(types.MatchRegexp, "host", "web-.*"),
+				m(types.MatchNotEqual, "role", "canary"),
+				m(types.MatchNotRegexp, "dc", "fra|ams"),
+			},
+		},
+		{`{__name__="cpu"}`, []types.Matcher{name("cpu")}},
+		{`{__name__=~"cpu|mem",dc=""}`, []types.Matcher{m(types.MatchRegexp, "__name__", "cpu|mem"), m(types.MatchEqual, "dc", "")}},
+		{`{path="C:\\temp\t\"x\""}`, []types.Matcher{m(types.MatchEqual, "path", "C:\\temp\t\"x\"")}},
+		{"{path=`C:\\temp`}", []types.Matcher{m(types.MatchEqual, "path", `C:\temp`)}},
+		{`{q='it\'s'}`, []types.Matcher{m(types.MatchEqual, "q", "it's")}},
+		{`{city="z\u00fcrich",b="\xff"}`, []types.Matcher{m(types.MatchEqual, "city", "zürich"), m(types.MatchEqual, "b", "\xff")}},
+		{"{v=\"a}b,c\"}", []types.Matcher{m(types.MatchEqual, "v", "a}b,c")}},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if err != nil {
+			t.Errorf("Parse(%q) returned %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Parse(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		in  string
+		pos int
+		msg string
+	}{
+		{"", 0, "empty selector"},
+		{"   ", 3, "empty selector"},
+		{"{}", 0, "selector must contain at least one matcher"},
+		{"1cpu", 0, "expected name, got '1'"},
+		{"cpu mem", 4, "unexpected 'm'"},
+		{"cpu{", 4, "unclosed '{'"},
+		{`cpu{dc="ams"`, 12, "unclosed '{'"},
+		{`cpu{dc="ams";host="a"}`, 12, "expected ',' or '}', got ';'"},
+		{`cpu{dc}`, 6, "expected one of '=', '!=', '=~', '!~', got '}'"},
+		{`cpu{dc==""}`, 7, "expected quoted string, got '='"},
+		{`cpu{dc=ams}`, 7, "expected quoted string, got 'a'"},
+		{`cpu{dc=`, 7, "expected quoted string, got end of input"},
+		{`cpu{dc="ams}`, 7, "unterminated string"},
+		{`cpu{dc="a\qb"}`, 9, "invalid escape sequence"},
+		{"cpu{dc=\"a\nb\"}", 9, "newline in string"},
+		{`cpu{,dc="a"}`, 4, "expected name, got ','"},
+		{`cpu{dc="a"}}`, 11, "unexpected '}'"},
+		{`{dc="ü"}ü`, 9, "unexpected 'ü'"},
+		// position of the second name, not of the selector start
+		{`cpu{__name__="mem"}`, 4, "metric name must not be set twice"},
+		{`cpu{dc="ams", __name__=~"m.*"}`, 14, "metric name must not be set twice"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.in)
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("Parse(%q) returned %v, want *ParseError", tt.in, err)
+			continue
+		}
+		if perr.Pos != tt.pos || perr.Msg != tt.msg {
+			t.Errorf("Parse(%q) returned error at %d: %s, want at %d: %s", tt.in, perr.Pos, perr.Msg, tt.pos, tt.msg)
+		}
+	}
+}
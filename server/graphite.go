@@ -0,0 +1,369 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spuzirev/metricsindex"
+	"github.com/spuzirev/metricsindex/graphite"
+	"github.com/spuzirev/metricsindex/types"
+)
+
+// Graphite tags API as served by graphite-web and used by Grafana's
+// Graphite datasource. Metric name is exposed as graphite.NameTag tag.
+// Errors are returned as {"error":"..."}.
+
+var (
+	// ErrNoTagExprs represents situation when /tags/findSeries is
+	// requested without expr parameter
+	ErrNoTagExprs = errors.New("no tag expressions specified")
+
+	// ErrNoTag represents situation when /tags/autoComplete/values is
+	// requested without tag parameter
+	ErrNoTag = errors.New("no tag specified")
+)
+
+// defaultAutoCompleteLimit is graphite-web's default limit of
+// autocomplete results
+const defaultAutoCompleteLimit = 100
+
+type graphiteError struct {
+	Error string `json:"error"`
+}
+
+type graphiteTag struct {
+	Tag string `json:"tag"`
+}
+
+type graphiteTagValue struct {
+	Count int    `json:"count"`
+	Value string `json:"value"`
+}
+
+type graphiteTagValues struct {
+	Tag    string             `json:"tag"`
+	Values []graphiteTagValue `json:"values"`
+}
+
+func writeGraphiteError(w http.ResponseWriter, err error) {
+	writeJSON(w, http.StatusBadRequest, graphiteError{Error: err.Error()})
+}
+
+// parseGraphiteForm parses parameters of GET or POST request and returns
+// effective limit. It writes error response and returns false if
+// request is bad.
+func (s *Server) parseGraphiteForm(w http.ResponseWriter, r *http.Request, defLimit int) (limit int, ok bool) {
+	if !checkMethod(w, r) {
+		return 0, false
+	}
+	if err := r.ParseForm(); err != nil {
+		writeGraphiteError(w, err)
+		return 0, false
+	}
+	limit, err := s.parseLimit(r, defLimit)
+	if err != nil {
+		writeGraphiteError(w, err)
+		return 0, false
+	}
+	return limit, true
+}
+
+// parseTagExprs parses Graphite tag expressions like seriesByTag does
+func parseTagExprs(exprs []string) ([]types.Matcher, error) {
+	matchers := make([]types.Matcher, 0, len(exprs))
+	nonEmpty := false
+	for _, expr := range exprs {
+		m, matchesEmpty, err := graphite.ParseTagExpression(expr)
+		if err != nil {
+			return nil, err
+		}
+		if !matchesEmpty {
+			nonEmpty = true
+		}
+		matchers = append(matchers, m)
+	}
+	if !nonEmpty {
+		return nil, graphite.ErrNoNonEmptyMatcher
+	}
+	return matchers, nil
+}
+
+// compileFilter compiles filter parameter which, as in Graphite, has to
+// match the beginning of tag or value. Empty filter matches everything.
+func compileFilter(filter string) (*regexp.Regexp, error) {
+	if filter == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + filter + ")")
+}
+
+// stringIterator is implemented by name, tag and tag value iterators
+type stringIterator interface {
+	Next() (string, error)
+	Close()
+}
+
+// collectStrings reads it until limit items accepted by keep are
+// collected. Zero limit means no limit.
+func collectStrings(it stringIterator, limit int, keep func(s string) bool) []string {
+	defer it.Close()
+	res := make([]string, 0)
+	for limit <= 0 || len(res) < limit {
+		k, err := it.Next()
+		if err != nil {
+			break
+		}
+		if keep == nil || keep(k) {
+			res = append(res, k)
+		}
+	}
+	return res
+}
+
+// tagNames returns sorted tag names starting with prefix and accepted by
+// keep including graphite.NameTag. At most limit names are returned.
+func (s *Server) tagNames(prefix string, limit int, keep func(s string) bool) ([]string, error) {
+	it, err := s.index.GetTagNamesIterator(prefix)
+	if err != nil {
+		return nil, err
+	}
+	res := collectStrings(it, limit, keep)
+	if strings.HasPrefix(graphite.NameTag, prefix) && (keep == nil || keep(graphite.NameTag)) {
+		i := sort.SearchStrings(res, graphite.NameTag)
+		if i == len(res) || res[i] != graphite.NameTag {
+			res = append(res, "")
+			copy(res[i+1:], res[i:])
+			res[i] = graphite.NameTag
+		}
+		if limit > 0 && len(res) > limit {
+			res = res[:limit]
+		}
+	}
+	return res, nil
+}
+
+// tagValues returns sorted values of tag starting with prefix and accepted
+// by keep. At most limit values are returned.
+func (s *Server) tagValues(tag, prefix string, limit int, keep func(s string) bool) ([]string, error) {
+	var it stringIterator
+	var err error
+	if tag == graphite.NameTag {
+		it, err = s.index.GetMetricNamesIterator(prefix)
+	} else {
+		it, err = s.index.GetTagValuesIterator(tag, prefix)
+	}
+	if err != nil {
+		// unknown tag has no values
+		return make([]string, 0), nil
+	}
+	return collectStrings(it, limit, keep), nil
+}
+
+// limitSorted returns first limit items of sorted set
+func limitSorted(set map[string]struct{}, limit int) []string {
+	res := sortedKeys(set)
+	if limit > 0 && len(res) > limit {
+		res = res[:limit]
+	}
+	return res
+}
+
+// handleTags serves /tags?filter=<regexp>&limit=<n>
+func (s *Server) handleTags(w http.ResponseWriter, r *http.Request) {
+	limit, ok := s.parseGraphiteForm(w, r, 0)
+	if !ok {
+		return
+	}
+	re, err := compileFilter(r.Form.Get("filter"))
+	if err != nil {
+		writeGraphiteError(w, err)
+		return
+	}
+	var keep func(s string) bool
+	if re != nil {
+		keep = re.MatchString
+	}
+	names, err := s.tagNames("", limit, keep)
+	if err != nil {
+		writeGraphiteError(w, err)
+		return
+	}
+	res := make([]graphiteTag, len(names))
+	for i, name := range names {
+		res[i] = graphiteTag{Tag: name}
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// handleTagValues serves /tags/<tag>?filter=<regexp>&limit=<n>
+func (s *Server) handleTagValues(w http.ResponseWriter, r *http.Request) {
+	tag := strings.TrimPrefix(r.URL.Path, "/tags/")
+	if tag == "" || strings.Contains(tag, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	limit, ok := s.parseGraphiteForm(w, r, 0)
+	if !ok {
+		return
+	}
+	re, err := compileFilter(r.Form.Get("filter"))
+	if err != nil {
+		writeGraphiteError(w, err)
+		return
+	}
+	var keep func(s string) bool
+	if re != nil {
+		keep = re.MatchString
+	}
+	values, err := s.tagValues(tag, "", limit, keep)
+	if err != nil {
+		writeGraphiteError(w, err)
+		return
+	}
+	res := graphiteTagValues{
+		Tag:    tag,
+		Values: make([]graphiteTagValue, len(values)),
+	}
+	for i, value := range values {
+		count := 0
+		if tag == graphite.NameTag {
+			count = s.index.GetCardinalityByName(value)
+		} else {
+			count = s.index.GetCardinalityByTag(tag, value)
+		}
+		res.Values[i] = graphiteTagValue{Count: count, Value: value}
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// handleAutoCompleteTags serves
+// /tags/autoComplete/tags?tagPrefix=<prefix>&expr=<expr>&limit=<n>
+// With expressions only tags of matching series which are not used in
+// expressions already are suggested.
+func (s *Server) handleAutoCompleteTags(w http.ResponseWriter, r *http.Request) {
+	limit, ok := s.parseGraphiteForm(w, r, defaultAutoCompleteLimit)
+	if !ok {
+		return
+	}
+	prefix := r.Form.Get("tagPrefix")
+	exprs := r.Form["expr"]
+	if len(exprs) == 0 {
+		names, err := s.tagNames(prefix, limit, nil)
+		if err != nil {
+			writeGraphiteError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, names)
+		return
+	}
+
+	matchers, err := parseTagExprs(exprs)
+	if err != nil {
+		writeGraphiteError(w, err)
+		return
+	}
+	used := make(map[string]struct{}, len(matchers))
+	for _, m := range matchers {
+		tagName := string(m.TagName)
+		if m.TagName == types.NameTagName {
+			tagName = graphite.NameTag
+		}
+		used[tagName] = struct{}{}
+	}
+	set := make(map[string]struct{})
+	add := func(tagName string) {
+		if _, ok := used[tagName]; !ok && strings.HasPrefix(tagName, prefix) {
+			set[tagName] = struct{}{}
+		}
+	}
+	err = s.forEachMetric([][]types.Matcher{matchers}, metricsindex.TimeRange{}, func(metric *types.Metric) {
+		add(graphite.NameTag)
+		for tagName := range metric.Tags {
+			add(tagName)
+		}
+	})
+	if err != nil {
+		writeGraphiteError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, limitSorted(set, limit))
+}
+
+// handleAutoCompleteValues serves
+// /tags/autoComplete/values?tag=<tag>&valuePrefix=<prefix>&expr=<expr>&limit=<n>
+// With expressions only values of matching series are suggested.
+func (s *Server) handleAutoCompleteValues(w http.ResponseWriter, r *http.Request) {
+	limit, ok := s.parseGraphiteForm(w, r, defaultAutoCompleteLimit)
+	if !ok {
+		return
+	}
+	tag := r.Form.Get("tag")
+	if tag == "" {
+		writeGraphiteError(w, ErrNoTag)
+		return
+	}
+	prefix := r.Form.Get("valuePrefix")
+	exprs := r.Form["expr"]
+	if len(exprs) == 0 {
+		values, err := s.tagValues(tag, prefix, limit, nil)
+		if err != nil {
+			writeGraphiteError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, values)
+		return
+	}
+
+	matchers, err := parseTagExprs(exprs)
+	if err != nil {
+		writeGraphiteError(w, err)
+		return
+	}
+	set := make(map[string]struct{})
+	err = s.forEachMetric([][]types.Matcher{matchers}, metricsindex.TimeRange{}, func(metric *types.Metric) {
+		value, ok := metric.Name, true
+		if tag != graphite.NameTag {
+			value, ok = metric.Tags[tag]
+		}
+		if ok && strings.HasPrefix(value, prefix) {
+			set[value] = struct{}{}
+		}
+	})
+	if err != nil {
+		writeGraphiteError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, limitSorted(set, limit))
+}
+
+// handleFindSeries serves /tags/findSeries?expr=<expr>&expr=<expr>...
+// and returns sorted names of series matching all expressions
+func (s *Server) handleFindSeries(w http.ResponseWriter, r *http.Request) {
+	limit, ok := s.parseGraphiteForm(w, r, 0)
+	if !ok {
+		return
+	}
+	exprs := r.Form["expr"]
+	if len(exprs) == 0 {
+		writeGraphiteError(w, ErrNoTagExprs)
+		return
+	}
+	matchers, err := parseTagExprs(exprs)
+	if err != nil {
+		writeGraphiteError(w, err)
+		return
+	}
+	metrics, _, err := s.selectMetrics([][]types.Matcher{matchers}, metricsindex.TimeRange{}, limit)
+	if err != nil {
+		writeGraphiteError(w, err)
+		return
+	}
+	res := make([]string, len(metrics))
+	for i, metric := range metrics {
+		res[i] = metric.metricStr
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/spuzirev/metricsindex/graphite"
+)
+
+func TestGraphiteHandlers(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		code   int
+		want   string
+	}{
+		{"tags", "/tags", http.StatusOK, `[{"tag":"dc"},{"tag":"host"},{"tag":"mount"},{"tag":"name"}]`},
+		{"tags filter", "/tags?filter=" + url.QueryEscape("h|na"), http.StatusOK, `[{"tag":"host"},{"tag":"name"}]`},
+		{"tags filter is anchored", "/tags?filter=ost", http.StatusOK, `[]`},
+		{"tags limit", "/tags?limit=2", http.StatusOK, `[{"tag":"dc"},{"tag":"host"}]`},
+		{"tags bad filter", "/tags?filter=(", http.StatusBadRequest, ""},
+		{"tags bad limit", "/tags?limit=x", http.StatusBadRequest, `{"error":"` + ErrBadLimit.Error() + `"}`},
+
+		{
+			"tag values", "/tags/dc", http.StatusOK,
+			`{"tag":"dc","values":[{"count":2,"value":"ams"},{"count":2,"value":"fra"}]}`,
+		},
+		{
+			"name values", "/tags/name", http.StatusOK,
+			`{"tag":"name","values":[{"count":3,"value":"cpu"},{"count":1,"value":"disk"},{"count":1,"value":"mem"}]}`,
+		},
+		{
+			"tag values filter", "/tags/host?filter=web", http.StatusOK,
+			`{"tag":"host","values":[{"count":2,"value":"web-1"},{"count":1,"value":"web-2"}]}`,
+		},
+		{
+			"tag values limit", "/tags/host?limit=1", http.StatusOK,
+			`{"tag":"host","values":[{"count":2,"value":"db-1"}]}`,
+		},
+		{"unknown tag values", "/tags/unknown", http.StatusOK, `{"tag":"unknown","values":[]}`},
+		{"tag values bad filter", "/tags/dc?filter=[", http.StatusBadRequest, ""},
+		{"tag values subpath", "/tags/dc/values", http.StatusNotFound, ""},
+
+		{"autocomplete tags", "/tags/autoComplete/tags", http.StatusOK, `["dc","host","mount","name"]`},
+		{"autocomplete tags prefix", "/tags/autoComplete/tags?tagPrefix=h", http.StatusOK, `["host"]`},
+		{"autocomplete tags limit", "/tags/autoComplete/tags?limit=1", http.StatusOK, `["dc"]`},
+		{"autocomplete tags expr", "/tags/autoComplete/tags?expr=name%3Dcpu", http.StatusOK, `["dc","host"]`},
+		{"autocomplete tags expr prefix", "/tags/autoComplete/tags?expr=dc%3Dfra&tagPrefix=n", http.StatusOK, `["name"]`},
+		{"autocomplete tags bad expr", "/tags/autoComplete/tags?expr=dc", http.StatusBadRequest, `{"error":"invalid tag expression \"dc\""}`},
+
+		{"autocomplete values", "/tags/autoComplete/values?tag=dc", http.StatusOK, `["ams","fra"]`},
+		{"autocomplete values prefix", "/tags/autoComplete/values?tag=host&valuePrefix=web", http.StatusOK, `["web-1","web-2"]`},
+		{"autocomplete values expr", "/tags/autoComplete/values?tag=host&expr=dc%3Dfra", http.StatusOK, `["db-1"]`},
+		{"autocomplete name values expr", "/tags/autoComplete/values?tag=name&expr=host%3Dweb-1", http.StatusOK, `["cpu","disk"]`},
+		{"autocomplete values unknown tag", "/tags/autoComplete/values?tag=unknown", http.StatusOK, `[]`},
+		{"autocomplete values without tag", "/tags/autoComplete/values", http.StatusBadRequest, `{"error":"` + ErrNoTag.Error() + `"}`},
+
+		{
+			"find series", "/tags/findSeries?expr=dc%3Dams", http.StatusOK,
+			`["cpu;dc=ams;host=web-1","cpu;dc=ams;host=web-2"]`,
+		},
+		{
+			"find series several exprs", "/tags/findSeries?expr=" + url.QueryEscape("name=~c") + "&expr=" + url.QueryEscape("host!=web-2"), http.StatusOK,
+			`["cpu;dc=ams;host=web-1","cpu;dc=fra;host=db-1"]`,
+		},
+		{
+			"find series limit", "/tags/findSeries?limit=1&expr=" + url.QueryEscape("host=~.+"), http.StatusOK,
+			`["cpu;dc=ams;host=web-1"]`,
+		},
+		{"find series without exprs", "/tags/findSeries", http.StatusBadRequest, `{"error":"` + ErrNoTagExprs.Error() + `"}`},
+		{"find series matching empty", "/tags/findSeries?expr=dc%3D", http.StatusBadRequest, `{"error":"` + graphite.ErrNoNonEmptyMatcher.Error() + `"}`},
+	}
+	for name, s := range newTestServers(t, Options{}) {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				for _, method := range []string{http.MethodGet, http.MethodPost} {
+					code, body := serve(t, s, method, tt.target)
+					if code != tt.code {
+						t.Fatalf("%s returned %d, want %d: %s", method, code, tt.code, body)
+					}
+					if tt.want != "" && strings.TrimSpace(body) != tt.want {
+						t.Fatalf("%s returned %s, want %s", method, body, tt.want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestGraphiteLimitOption(t *testing.T) {
+	s := newTestServers(t, Options{Limit: 1})["MetricsIndex"]
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/tags", `[{"tag":"dc"}]`},
+		{"/tags/autoComplete/values?tag=dc&limit=10", `["ams"]`},
+		{"/tags/findSeries?expr=dc%3Dams", `["cpu;dc=ams;host=web-1"]`},
+	}
+	for _, tt := range tests {
+		code, body := serve(t, s, http.MethodGet, tt.target)
+		if code != http.StatusOK || strings.TrimSpace(body) != tt.want {
+			t.Fatalf("%s returned %d %s, want %s", tt.target, code, body, tt.want)
+		}
+	}
+	if code, _ := serve(t, s, http.MethodDelete, "/tags"); code != http.StatusMethodNotAllowed {
+		t.Fatalf("DELETE returned %d, want 405", code)
+	}
+}
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spuzirev/metricsindex"
+	"github.com/spuzirev/metricsindex/selector"
+	"github.com/spuzirev/metricsindex/types"
+)
+
+// Prometheus API. Responses have the same shape as Prometheus' ones:
+//
+//	{"status":"success","data":[...],"warnings":[...]}
+//	{"status":"error","errorType":"bad_data","error":"..."}
+//
+// Metric name is exposed as __name__ label. start and end parameters
+// limit results to series active within [start, end], i.e. first seen not
+// after end and last seen not before start, see metricsindex.TimeRange.
+
+var (
+	// ErrNoMatchers represents situation when /api/v1/series is requested
+	// without match[] parameter
+	ErrNoMatchers = errors.New("no match[] parameter provided")
+
+	// ErrBadTime represents situation when start or end parameter is
+	// neither RFC 3339 time nor unix timestamp
+	ErrBadTime = errors.New("time must be RFC 3339 or unix timestamp")
+
+	// ErrBadTimeRange represents situation when end is before start
+	ErrBadTimeRange = errors.New("end timestamp must not be before start time")
+)
+
+// truncatedWarning is the warning Prometheus returns when result is cut
+// by limit
+const truncatedWarning = "results truncated due to limit"
+
+type promResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Warnings  []string    `json:"warnings,omitempty"`
+}
+
+func writePromData(w http.ResponseWriter, data interface{}, truncated bool) {
+	resp := promResponse{
+		Status: "success",
+		Data:   data,
+	}
+	if truncated {
+		resp.Warnings = []string{truncatedWarning}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func writePromError(w http.ResponseWriter, code int, errorType string, err error) {
+	writeJSON(w, code, promResponse{
+		Status:    "error",
+		ErrorType: errorType,
+		Error:     err.Error(),
+	})
+}
+
+// parsePromTime parses time as Prometheus does: RFC 3339 or unix
+// timestamp with optional fraction. Empty string is zero time.
+func parsePromTime(timeStr string) (time.Time, error) {
+	if timeStr == "" {
+		return time.Time{}, nil
+	}
+	if ts, err := strconv.ParseFloat(timeStr, 64); err == nil {
+		if math.IsNaN(ts) || math.IsInf(ts, 0) {
+			return time.Time{}, ErrBadTime
+		}
+		sec, frac := math.Modf(ts)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, timeStr); err == nil {
+		return t, nil
+	}
+	return time.Time{}, ErrBadTime
+}
+
+// parsePromForm parses parameters of GET or POST request and returns
+// effective limit and time range. It writes error response and returns
+// false if request is bad.
+func (s *Server) parsePromForm(w http.ResponseWriter, r *http.Request) (limit int, tr metricsindex.TimeRange, ok bool) {
+	if !checkMethod(w, r) {
+		return 0, tr, false
+	}
+	if err := r.ParseForm(); err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err)
+		return 0, tr, false
+	}
+	limit, err := s.parseLimit(r, 0)
+	if err == nil {
+		tr.From, err = parsePromTime(r.Form.Get("start"))
+	}
+	if err == nil {
+		tr.To, err = parsePromTime(r.Form.Get("end"))
+	}
+	if err == nil && !tr.From.IsZero() && !tr.To.IsZero() && tr.To.Before(tr.From) {
+		err = ErrBadTimeRange
+	}
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err)
+		return 0, tr, false
+	}
+	return limit, tr, true
+}
+
+// parseSelectors parses match[] parameters
+func parseSelectors(selectors []string) ([][]types.Matcher, error) {
+	res := make([][]types.Matcher, len(selectors))
+	for i, selectorStr := range selectors {
+		matchers, err := selector.Parse(selectorStr)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = matchers
+	}
+	return res, nil
+}
+
+// forEachPromMetric calls f for every metric active within tr matching
+// any of selectors
+func (s *Server) forEachPromMetric(selectors []string, tr metricsindex.TimeRange, f func(metric *types.Metric)) error {
+	matchersSets, err := parseSelectors(selectors)
+	if err != nil {
+		return err
+	}
+	return s.forEachMetric(matchersSets, tr, f)
+}
+
+// truncate cuts sorted items to limit and reports if anything was cut.
+// Empty strings, i.e. empty tag values, are never returned as
+// Prometheus treats empty label as absent one.
+func truncate(items []string, limit int) ([]string, bool) {
+	res := items[:0]
+	for _, item := range items {
+		if item != "" {
+			res = append(res, item)
+		}
+	}
+	if limit > 0 && len(res) > limit {
+		return res[:limit], true
+	}
+	return res, false
+}
+
+// sortedKeys returns keys of set in ascending order
+func sortedKeys(set map[string]struct{}) []string {
+	res := make([]string, 0, len(set))
+	for k := range set {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (s *Server) handleLabels(w http.ResponseWriter, r *http.Request) {
+	limit, tr, ok := s.parsePromForm(w, r)
+	if !ok {
+		return
+	}
+	var names []string
+	if selectors := r.Form["match[]"]; len(selectors) > 0 {
+		set := make(map[string]struct{})
+		err := s.forEachPromMetric(selectors, tr, func(metric *types.Metric) {
+			set[string(types.NameTagName)] = struct{}{}
+			for tagName, tagValue := range metric.Tags {
+				if tagValue != "" {
+					set[tagName] = struct{}{}
+				}
+			}
+		})
+		if err != nil {
+			writePromError(w, http.StatusBadRequest, "bad_data", err)
+			return
+		}
+		names = sortedKeys(set)
+	} else {
+		names = s.index.GetTagNamesInRange("", tr)
+		if s.index.HasMetricsInRange(tr) {
+			names = append(names, string(types.NameTagName))
+			sort.Strings(names)
+		}
+	}
+	names, truncated := truncate(names, limit)
+	writePromData(w, names, truncated)
+}
+
+func (s *Server) handleLabelValues(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/label/")
+	if !strings.HasSuffix(name, "/values") {
+		http.NotFound(w, r)
+		return
+	}
+	name = strings.TrimSuffix(name, "/values")
+	limit, tr, ok := s.parsePromForm(w, r)
+	if !ok {
+		return
+	}
+	if name == "" || strings.Contains(name, "/") {
+		writePromError(w, http.StatusBadRequest, "bad_data", errors.New("invalid label name: "+strconv.Quote(name)))
+		return
+	}
+
+	isName := name == string(types.NameTagName)
+	var values []string
+	if selectors := r.Form["match[]"]; len(selectors) > 0 {
+		set := make(map[string]struct{})
+		err := s.forEachPromMetric(selectors, tr, func(metric *types.Metric) {
+			if isName {
+				set[metric.Name] = struct{}{}
+			} else if tagValue, ok := metric.Tags[name]; ok {
+				set[tagValue] = struct{}{}
+			}
+		})
+		if err != nil {
+			writePromError(w, http.StatusBadRequest, "bad_data", err)
+			return
+		}
+		values = sortedKeys(set)
+	} else if isName {
+		values = s.index.GetMetricNamesInRange("", tr)
+	} else {
+		values = s.index.GetTagValuesInRange(name, "", tr)
+	}
+	values, truncated := truncate(values, limit)
+	writePromData(w, values, truncated)
+}
+
+func (s *Server) handleSeries(w http.ResponseWriter, r *http.Request) {
+	limit, tr, ok := s.parsePromForm(w, r)
+	if !ok {
+		return
+	}
+	selectors := r.Form["match[]"]
+	if len(selectors) == 0 {
+		writePromError(w, http.StatusBadRequest, "bad_data", ErrNoMatchers)
+		return
+	}
+	matchersSets, err := parseSelectors(selectors)
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	metrics, truncated, err := s.selectMetrics(matchersSets, tr, limit)
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	series := make([]map[string]string, len(metrics))
+	for i, m := range metrics {
+		metric := &m.metric
+		labels := make(map[string]string, len(metric.Tags)+1)
+		for tagName, tagValue := range metric.Tags {
+			if tagValue != "" {
+				labels[tagName] = tagValue
+			}
+		}
+		labels[string(types.NameTagName)] = metric.Name
+		series[i] = labels
+	}
+	writePromData(w, series, truncated)
+}
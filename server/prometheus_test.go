@@ -0,0 +1,329 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spuzirev/metricsindex"
+	"github.com/spuzirev/metricsindex/types"
+)
+
+// testMetrics are inserted into index of every test server
+var testMetrics = []string{
+	"cpu;dc=ams;host=web-1",
+	"cpu;dc=ams;host=web-2",
+	"cpu;dc=fra;host=db-1",
+	"mem;dc=fra;host=db-1",
+	"disk;host=web-1;mount=",
+}
+
+// newTestServers returns servers on top of MetricsIndex and
+// ShardedMetricsIndex filled with testMetrics
+func newTestServers(t *testing.T, opts Options) map[string]*Server {
+	t.Helper()
+	// testMetrics have empty tag value
+	parseOptions := types.ParseOptions{AllowEmptyTagValues: true}
+	mi := metricsindex.NewMetricsIndex()
+	mi.SetParseOptions(parseOptions)
+	smi, err := metricsindex.NewShardedMetricsIndex(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, shard := range smi.Shards {
+		shard.SetParseOptions(parseOptions)
+	}
+	for _, metricStr := range testMetrics {
+		if err := mi.InsertMetric(metricStr); err != nil {
+			t.Fatal(err)
+		}
+		if err := smi.InsertMetric(metricStr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return map[string]*Server{
+		"MetricsIndex":        New(mi, opts),
+		"ShardedMetricsIndex": New(smi, opts),
+	}
+}
+
+// serve sends request to s and returns response code and body
+func serve(t *testing.T, s *Server, method, target string) (int, string) {
+	t.Helper()
+	r := httptest.NewRequest(method, target, nil)
+	if method == http.MethodPost {
+		u, err := url.Parse(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = httptest.NewRequest(method, u.Path, strings.NewReader(u.RawQuery))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w.Code, w.Body.String()
+}
+
+// promResult is decoded response of Prometheus API
+type promResult struct {
+	Status    string          `json:"status"`
+	Data      json.RawMessage `json:"data"`
+	ErrorType string          `json:"errorType"`
+	Error     string          `json:"error"`
+	Warnings  []string        `json:"warnings"`
+}
+
+func decodeProm(t *testing.T, body string) promResult {
+	t.Helper()
+	var res promResult
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		t.Fatalf("bad response %q: %v", body, err)
+	}
+	return res
+}
+
+func unixStr(t time.Time) string {
+	return fmt.Sprintf("%d", t.Unix())
+}
+
+func TestPromHandlers(t *testing.T) {
+	past := unixStr(time.Now().Add(-time.Hour))
+	future := unixStr(time.Now().Add(time.Hour))
+	match := url.QueryEscape(`{dc="fra"}`)
+	tests := []struct {
+		name      string
+		target    string
+		want      interface{}
+		truncated bool
+	}{
+		{
+			name:   "labels",
+			target: "/api/v1/labels",
+			want:   []string{"__name__", "dc", "host", "mount"},
+		},
+		{
+			name:   "labels match",
+			target: "/api/v1/labels?match[]=" + url.QueryEscape(`{host="web-1"}`),
+			want:   []string{"__name__", "dc", "host"},
+		},
+		{
+			name:      "labels limit",
+			target:    "/api/v1/labels?limit=2",
+			want:      []string{"__name__", "dc"},
+			truncated: true,
+		},
+		{
+			name:   "labels in range",
+			target: "/api/v1/labels?start=" + past + "&end=" + future,
+			want:   []string{"__name__", "dc", "host", "mount"},
+		},
+		{
+			name:   "labels ended before series",
+			target: "/api/v1/labels?end=" + past,
+			want:   []string{},
+		},
+		{
+			name:   "labels match started after series",
+			target: "/api/v1/labels?match[]=" + match + "&start=" + future,
+			want:   []string{},
+		},
+		{
+			name:   "name values",
+			target: "/api/v1/label/__name__/values",
+			want:   []string{"cpu", "disk", "mem"},
+		},
+		{
+			name:   "values",
+			target: "/api/v1/label/host/values",
+			want:   []string{"db-1", "web-1", "web-2"},
+		},
+		{
+			name:   "empty values are skipped",
+			target: "/api/v1/label/mount/values",
+			want:   []string{},
+		},
+		{
+			name:   "values match",
+			target: "/api/v1/label/host/values?match[]=" + match + "&match[]=" + url.QueryEscape(`cpu{dc="ams",host=~"web-2|x"}`),
+			want:   []string{"db-1", "web-2"},
+		},
+		{
+			name:      "values limit",
+			target:    "/api/v1/label/host/values?limit=1",
+			want:      []string{"db-1"},
+			truncated: true,
+		},
+		{
+			name:   "values out of range",
+			target: "/api/v1/label/__name__/values?start=" + future,
+			want:   []string{},
+		},
+		{
+			name:   "values in range",
+			target: "/api/v1/label/dc/values?start=" + past,
+			want:   []string{"ams", "fra"},
+		},
+		{
+			name:   "series",
+			target: "/api/v1/series?match[]=" + match,
+			want: []map[string]string{
+				{"__name__": "cpu", "dc": "fra", "host": "db-1"},
+				{"__name__": "mem", "dc": "fra", "host": "db-1"},
+			},
+		},
+		{
+			name:   "series without empty labels",
+			target: "/api/v1/series?match[]=disk",
+			want: []map[string]string{
+				{"__name__": "disk", "host": "web-1"},
+			},
+		},
+		{
+			name:   "series of several selectors",
+			target: "/api/v1/series?match[]=mem&match[]=" + url.QueryEscape(`cpu{host="web-2"}`) + "&match[]=" + match,
+			want: []map[string]string{
+				{"__name__": "cpu", "dc": "ams", "host": "web-2"},
+				{"__name__": "cpu", "dc": "fra", "host": "db-1"},
+				{"__name__": "mem", "dc": "fra", "host": "db-1"},
+			},
+		},
+		{
+			// the first series in order are returned, not any of them
+			name:   "series limit",
+			target: "/api/v1/series?limit=2&match[]=" + url.QueryEscape(`{host=~".+"}`),
+			want: []map[string]string{
+				{"__name__": "cpu", "dc": "ams", "host": "web-1"},
+				{"__name__": "cpu", "dc": "ams", "host": "web-2"},
+			},
+			truncated: true,
+		},
+		{
+			name:   "series out of range",
+			target: "/api/v1/series?match[]=" + match + "&end=" + past,
+			want:   []map[string]string{},
+		},
+	}
+	for name, s := range newTestServers(t, Options{}) {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				for _, method := range []string{http.MethodGet, http.MethodPost} {
+					code, body := serve(t, s, method, tt.target)
+					if code != http.StatusOK {
+						t.Fatalf("%s returned %d: %s", method, code, body)
+					}
+					res := decodeProm(t, body)
+					want, _ := json.Marshal(tt.want)
+					if res.Status != "success" || string(res.Data) != string(want) {
+						t.Fatalf("%s returned %s, want data %s", method, body, want)
+					}
+					if truncated := len(res.Warnings) > 0; truncated != tt.truncated {
+						t.Fatalf("%s returned warnings %q, want truncated %v", method, res.Warnings, tt.truncated)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestPromLimitOption(t *testing.T) {
+	s := newTestServers(t, Options{Limit: 2})["MetricsIndex"]
+	for _, target := range []string{
+		"/api/v1/label/host/values",
+		"/api/v1/label/host/values?limit=5",
+		"/api/v1/label/host/values?limit=0",
+	} {
+		code, body := serve(t, s, http.MethodGet, target)
+		res := decodeProm(t, body)
+		if code != http.StatusOK || string(res.Data) != `["db-1","web-1"]` || len(res.Warnings) != 1 {
+			t.Fatalf("%s returned %d %s", target, code, body)
+		}
+	}
+}
+
+func TestPromErrors(t *testing.T) {
+	s := newTestServers(t, Options{})["MetricsIndex"]
+	tests := []struct {
+		target string
+		code   int
+		err    string
+	}{
+		{"/api/v1/series", http.StatusBadRequest, ErrNoMatchers.Error()},
+		{"/api/v1/series?match[]=" + url.QueryEscape(`cpu{dc=`), http.StatusBadRequest, ""},
+		{"/api/v1/labels?match[]=" + url.QueryEscape(`{dc=~"("}`), http.StatusBadRequest, ""},
+		{"/api/v1/labels?limit=-1", http.StatusBadRequest, ErrBadLimit.Error()},
+		{"/api/v1/labels?limit=x", http.StatusBadRequest, ErrBadLimit.Error()},
+		{"/api/v1/labels?start=yesterday", http.StatusBadRequest, ErrBadTime.Error()},
+		{"/api/v1/label/dc/values?end=NaN", http.StatusBadRequest, ErrBadTime.Error()},
+		{"/api/v1/series?match[]=cpu&start=20&end=10", http.StatusBadRequest, ErrBadTimeRange.Error()},
+	}
+	for _, tt := range tests {
+		code, body := serve(t, s, http.MethodGet, tt.target)
+		if code != tt.code {
+			t.Fatalf("%s returned %d, want %d: %s", tt.target, code, tt.code, body)
+		}
+		res := decodeProm(t, body)
+		if res.Status != "error" || res.ErrorType != "bad_data" || (tt.err != "" && res.Error != tt.err) {
+			t.Fatalf("%s returned %s, want error %q", tt.target, body, tt.err)
+		}
+	}
+
+	if code, _ := serve(t, s, http.MethodPut, "/api/v1/labels"); code != http.StatusMethodNotAllowed {
+		t.Fatalf("PUT returned %d, want 405", code)
+	}
+	if code, _ := serve(t, s, http.MethodGet, "/api/v1/label/dc"); code != http.StatusNotFound {
+		t.Fatalf("label without /values returned %d, want 404", code)
+	}
+}
+
+func TestParsePromTime(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Time
+		err  error
+	}{
+		{"", time.Time{}, nil},
+		{"1600000000", time.Unix(1600000000, 0), nil},
+		{"1600000000.5", time.Unix(1600000000, 5e8), nil},
+		{"2020-09-13T12:26:40Z", time.Unix(1600000000, 0), nil},
+		{"2020-09-13T14:26:40.25+02:00", time.Unix(1600000000, 25e7), nil},
+		{"Inf", time.Time{}, ErrBadTime},
+		{"2020-09-13", time.Time{}, ErrBadTime},
+	}
+	for _, tt := range tests {
+		got, err := parsePromTime(tt.in)
+		if err != tt.err || !got.Equal(tt.want) {
+			t.Errorf("parsePromTime(%q) = %v, %v, want %v, %v", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestSelectMetricsSortsBeforeLimit(t *testing.T) {
+	// matches are iterated in insertion order, series are inserted in
+	// reverse, so keeping the first matches would return the last names
+	mi := metricsindex.NewMetricsIndex()
+	for i := 99; i >= 0; i-- {
+		if err := mi.InsertMetric(fmt.Sprintf("cpu;host=h%03d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := make([]map[string]string, 0)
+	for i := 0; i < 10; i++ {
+		want = append(want, map[string]string{"__name__": "cpu", "host": fmt.Sprintf("h%03d", i)})
+	}
+	s := New(mi, Options{})
+	code, body := serve(t, s, http.MethodGet, "/api/v1/series?match[]=cpu&limit=10")
+	res := decodeProm(t, body)
+	var got []map[string]string
+	if err := json.Unmarshal(res.Data, &got); err != nil || code != http.StatusOK {
+		t.Fatalf("series returned %d %s", code, body)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("series returned %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,192 @@
+// Package server implements HTTP API on top of the index, so it can be
+// queried by tools speaking Prometheus' labels and series API or Graphite's
+// tags API, e.g. Grafana's Prometheus and Graphite datasources.
+package server
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/spuzirev/metricsindex"
+	"github.com/spuzirev/metricsindex/types"
+)
+
+var (
+	// ErrBadLimit represents situation when limit parameter is not
+	// a non-negative integer
+	ErrBadLimit = errors.New("limit must be a non-negative integer")
+)
+
+// Index is the part of index API used by Server. It is implemented by
+// MetricsIndex and ShardedMetricsIndex.
+type Index interface {
+	GetMetricNamesIterator(prefix string) (*metricsindex.MetricNameIterator, error)
+	GetTagNamesIterator(prefix string) (*metricsindex.TagNameIterator, error)
+	GetTagValuesIterator(tagNameStr, prefix string) (*metricsindex.TagValueIterator, error)
+	GetCardinalityByName(metricNameStr string) int
+	GetCardinalityByTag(tagNameStr, tagValueStr string) int
+	GetMetricNamesInRange(prefix string, tr metricsindex.TimeRange) []string
+	GetTagNamesInRange(prefix string, tr metricsindex.TimeRange) []string
+	GetTagValuesInRange(tagNameStr, prefix string, tr metricsindex.TimeRange) []string
+	HasMetricsInRange(tr metricsindex.TimeRange) bool
+	GetMetricIDsIteratorByMatchersInRange(matchers []types.Matcher, tr metricsindex.TimeRange) (*metricsindex.MetricIDIterator, error)
+	GetMetricByID(metricID types.MetricID) (types.Metric, error)
+}
+
+// Options of Server
+type Options struct {
+	// Limit caps number of items returned by a single request. Request
+	// may ask for less with limit parameter. Zero means no limit.
+	Limit int
+}
+
+// Server is http.Handler serving index API
+type Server struct {
+	index Index
+	opts  Options
+	mux   *http.ServeMux
+}
+
+// New is *Server builder and initializer
+func New(index Index, opts Options) *Server {
+	s := &Server{
+		index: index,
+		opts:  opts,
+		mux:   http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/api/v1/labels", s.handleLabels)
+	s.mux.HandleFunc("/api/v1/label/", s.handleLabelValues)
+	s.mux.HandleFunc("/api/v1/series", s.handleSeries)
+	s.mux.HandleFunc("/tags", s.handleTags)
+	s.mux.HandleFunc("/tags/", s.handleTagValues)
+	s.mux.HandleFunc("/tags/autoComplete/tags", s.handleAutoCompleteTags)
+	s.mux.HandleFunc("/tags/autoComplete/values", s.handleAutoCompleteValues)
+	s.mux.HandleFunc("/tags/findSeries", s.handleFindSeries)
+	return s
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// forEachMetric calls f for every metric active within tr matching any
+// of matchers sets. Metric matching several sets is passed once.
+func (s *Server) forEachMetric(matchersSets [][]types.Matcher, tr metricsindex.TimeRange, f func(metric *types.Metric)) error {
+	var seen map[types.MetricID]struct{}
+	if len(matchersSets) > 1 {
+		seen = make(map[types.MetricID]struct{})
+	}
+	for _, matchers := range matchersSets {
+		it, err := s.index.GetMetricIDsIteratorByMatchersInRange(matchers, tr)
+		if err != nil {
+			return err
+		}
+		for {
+			metricID, err := it.Next()
+			if err != nil {
+				break
+			}
+			if seen != nil {
+				if _, ok := seen[metricID]; ok {
+					continue
+				}
+				seen[metricID] = struct{}{}
+			}
+			// metrics deleted meanwhile are skipped
+			if metric, err := s.index.GetMetricByID(metricID); err == nil {
+				f(&metric)
+			}
+		}
+		it.Close()
+	}
+	return nil
+}
+
+// sortedMetric is metric along with its string representation
+type sortedMetric struct {
+	metricStr string
+	metric    types.Metric
+}
+
+// metricsHeap is max-heap of metrics by their string representation
+type metricsHeap []sortedMetric
+
+func (h metricsHeap) Len() int            { return len(h) }
+func (h metricsHeap) Less(i, j int) bool  { return h[i].metricStr > h[j].metricStr }
+func (h metricsHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *metricsHeap) Push(x interface{}) { *h = append(*h, x.(sortedMetric)) }
+func (h *metricsHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// selectMetrics returns the first limit metrics in order of their string
+// representation active within tr matching any of matchers sets and
+// reports if some were left out. Only limit metrics are kept while
+// matches are iterated. Zero limit means no limit.
+func (s *Server) selectMetrics(matchersSets [][]types.Matcher, tr metricsindex.TimeRange, limit int) ([]sortedMetric, bool, error) {
+	h := make(metricsHeap, 0)
+	truncated := false
+	err := s.forEachMetric(matchersSets, tr, func(metric *types.Metric) {
+		metricStr := metric.Serialize()
+		switch {
+		case limit <= 0 || len(h) < limit:
+			heap.Push(&h, sortedMetric{metricStr: metricStr, metric: *metric})
+		case metricStr < h[0].metricStr:
+			h[0] = sortedMetric{metricStr: metricStr, metric: *metric}
+			heap.Fix(&h, 0)
+			truncated = true
+		default:
+			truncated = true
+		}
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	sort.Slice(h, func(i, j int) bool {
+		return h[i].metricStr < h[j].metricStr
+	})
+	return h, truncated, nil
+}
+
+// checkMethod returns true if request is GET or POST, otherwise it
+// responds with 405
+func checkMethod(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodPost {
+		return true
+	}
+	w.Header().Set("Allow", "GET, POST")
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	return false
+}
+
+// parseLimit returns limit parameter of the request capped by
+// Options.Limit, def is used if there is no such parameter. Zero means
+// no limit.
+func (s *Server) parseLimit(r *http.Request, def int) (int, error) {
+	limit := def
+	if limitStr := r.Form.Get("limit"); limitStr != "" {
+		n, err := strconv.Atoi(limitStr)
+		if err != nil || n < 0 {
+			return 0, ErrBadLimit
+		}
+		limit = n
+	}
+	if s.opts.Limit > 0 && (limit <= 0 || limit > s.opts.Limit) {
+		limit = s.opts.Limit
+	}
+	return limit, nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
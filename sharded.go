@@ -0,0 +1,573 @@
+package metricsindex
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/spuzirev/metricsindex/graphite"
+	"github.com/spuzirev/metricsindex/selector"
+	"github.com/spuzirev/metricsindex/types"
+)
+
+var (
+	// ErrBadShardsCount represents situation when ShardedMetricsIndex is
+	// created with number of shards which isn't a positive power of two
+	ErrBadShardsCount = errors.New("shards count must be a positive power of two")
+)
+
+// ShardedMetricsIndex partitions metrics by MetricID across several
+// MetricsIndex shards, so inserts to different shards don't contend for
+// the same lock. It exposes the same API as MetricsIndex, names and tags
+// returned by shards are merged in sorted order and MetricIDs are returned
+// shard by shard.
+type ShardedMetricsIndex struct {
+	Shards []*MetricsIndex
+
+	expiry *expiryLoop
+}
+
+// NewShardedMetricsIndex is *ShardedMetricsIndex builder and initializer
+// shardsCount must be a power of two, see shard.
+func NewShardedMetricsIndex(shardsCount int) (*ShardedMetricsIndex, error) {
+	if shardsCount <= 0 || shardsCount&(shardsCount-1) != 0 {
+		return nil, ErrBadShardsCount
+	}
+	smi := &ShardedMetricsIndex{
+		Shards: make([]*MetricsIndex, shardsCount),
+	}
+	for i := range smi.Shards {
+		smi.Shards[i] = NewMetricsIndex()
+		smi.Shards[i].metricIDStep = uint64(shardsCount)
+	}
+	return smi, nil
+}
+
+// SetParseOptions sets validation rules applied to metric strings
+// passed to the index. It must not be called concurrently with other
+// methods.
+func (smi *ShardedMetricsIndex) SetParseOptions(opts types.ParseOptions) {
+	for _, shard := range smi.Shards {
+		shard.SetParseOptions(opts)
+	}
+}
+
+// parseMetric parses metricStr according to index's ParseOptions
+func (smi *ShardedMetricsIndex) parseMetric(metricStr string) (*types.Metric, error) {
+	return smi.Shards[0].parseMetric(metricStr)
+}
+
+// shard returns shard responsible for given metricID.
+// Shards resolve MetricID collisions moving metric by number of shards,
+// so metric stays in the shard its hash points to. Number of shards is
+// a power of two, so it holds even if MetricID wraps around 2^64.
+func (smi *ShardedMetricsIndex) shard(metricID types.MetricID) *MetricsIndex {
+	return smi.Shards[uint64(metricID)%uint64(len(smi.Shards))]
+}
+
+// MetricExistsByMetricID returns true if metric with given metricID
+// exists in the index, otherwise it returns false
+func (smi *ShardedMetricsIndex) MetricExistsByMetricID(metricID types.MetricID) bool {
+	return smi.shard(metricID).MetricExistsByMetricID(metricID)
+}
+
+// MetricExistsByMetricStr returns true if metric with given full name (with tags)
+// exists in the index, otherwise it returns false
+func (smi *ShardedMetricsIndex) MetricExistsByMetricStr(metricStr string) bool {
+	metric, err := smi.parseMetric(metricStr)
+	if err != nil {
+		return false
+	}
+	return smi.shard(hashMetric(metric)).metricExistsByMetric(metric)
+}
+
+// InsertMetric inserts new metric to index by metric string representation
+func (smi *ShardedMetricsIndex) InsertMetric(metricStr string) error {
+	metric, err := smi.parseMetric(metricStr)
+	if err != nil {
+		return err
+	}
+	shard := smi.shard(hashMetric(metric))
+	if shard.touchMetric(metric) {
+		return nil
+	}
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	return shard.insertMetric(metric)
+}
+
+// InsertMetricBytes inserts metric to index by metric string representation.
+// Already known series are recognized without allocation, see
+// MetricsIndex.InsertMetricBytes.
+func (smi *ShardedMetricsIndex) InsertMetricBytes(b []byte) error {
+	metricID, ok := canonicalMetricID(b, smi.Shards[0].parseOptions)
+	if !ok {
+		return smi.InsertMetric(string(b))
+	}
+	shard := smi.shard(metricID)
+	shard.mu.RLock()
+	exists := shard.touchMetricBytes(b, metricID)
+	shard.mu.RUnlock()
+	if exists {
+		return nil
+	}
+	return smi.InsertMetric(string(b))
+}
+
+// InsertMetricsBatch takes slice of metric strings representations
+// and inserts them to shards in parallel.
+// If some metric can't be parsed nothing is inserted.
+func (smi *ShardedMetricsIndex) InsertMetricsBatch(metricsStr []string) error {
+	batches := make([][]*types.Metric, len(smi.Shards))
+	for _, metricStr := range metricsStr {
+		metric, err := smi.parseMetric(metricStr)
+		if err != nil {
+			return err
+		}
+		i := uint64(hashMetric(metric)) % uint64(len(smi.Shards))
+		batches[i] = append(batches[i], metric)
+	}
+
+	errs := make([]error, len(smi.Shards))
+	var wg sync.WaitGroup
+	for i, batch := range batches {
+		if len(batch) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, batch []*types.Metric) {
+			defer wg.Done()
+			shard := smi.Shards[i]
+			shard.mu.Lock()
+			defer shard.mu.Unlock()
+			for _, metric := range batch {
+				if err := shard.insertMetric(metric); err != nil {
+					errs[i] = err
+					return
+				}
+			}
+		}(i, batch)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteMetric removes metric from index by metric string representation
+// It returns ErrNoSuchMetric if there is no such metric in the index
+func (smi *ShardedMetricsIndex) DeleteMetric(metricStr string) error {
+	metric, err := smi.parseMetric(metricStr)
+	if err != nil {
+		return err
+	}
+	shard := smi.shard(hashMetric(metric))
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	metricID, ok := shard.lookupMetricID(metric)
+	if !ok {
+		return ErrNoSuchMetric
+	}
+	return shard.deleteMetric(metricID)
+}
+
+// DeleteMetricByID removes metric with given metricID from index
+// It returns ErrNoSuchMetric if there is no such metric in the index
+func (smi *ShardedMetricsIndex) DeleteMetricByID(metricID types.MetricID) error {
+	return smi.shard(metricID).DeleteMetricByID(metricID)
+}
+
+// GetMetricSeenTimesByID returns when metric with given metricID was
+// inserted first and last time
+func (smi *ShardedMetricsIndex) GetMetricSeenTimesByID(metricID types.MetricID) (firstSeen, lastSeen time.Time, err error) {
+	return smi.shard(metricID).GetMetricSeenTimesByID(metricID)
+}
+
+// ExpireOlderThan deletes series which were last seen before t from
+// all shards in parallel and returns number of deleted series
+func (smi *ShardedMetricsIndex) ExpireOlderThan(t time.Time) int {
+	expired := make([]int, len(smi.Shards))
+	var wg sync.WaitGroup
+	for i, shard := range smi.Shards {
+		wg.Add(1)
+		go func(i int, shard *MetricsIndex) {
+			defer wg.Done()
+			expired[i] = shard.ExpireOlderThan(t)
+		}(i, shard)
+	}
+	wg.Wait()
+	res := 0
+	for _, n := range expired {
+		res += n
+	}
+	return res
+}
+
+// StartExpiry starts background goroutine which deletes series not seen
+// for ttl every interval. See MetricsIndex.StartExpiry.
+func (smi *ShardedMetricsIndex) StartExpiry(ttl, interval time.Duration) {
+	smi.StopExpiry()
+	smi.expiry = startExpiryLoop(smi.ExpireOlderThan, smi.Shards[0].now, ttl, interval)
+}
+
+// StopExpiry stops background expiration started by StartExpiry
+func (smi *ShardedMetricsIndex) StopExpiry() {
+	smi.expiry.close()
+	smi.expiry = nil
+}
+
+// HasMetricsInRange returns true if any series was active within tr
+func (smi *ShardedMetricsIndex) HasMetricsInRange(tr TimeRange) bool {
+	for _, shard := range smi.Shards {
+		if shard.HasMetricsInRange(tr) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetMetricNamesInRange is GetMetricNames returning only names of series
+// active within tr
+func (smi *ShardedMetricsIndex) GetMetricNamesInRange(prefix string, tr TimeRange) []string {
+	slices := make([][]string, len(smi.Shards))
+	for i, shard := range smi.Shards {
+		slices[i] = shard.GetMetricNamesInRange(prefix, tr)
+	}
+	return mergeSortedStrings(slices)
+}
+
+// GetTagNamesInRange is GetTagNames returning only tag names of series
+// active within tr
+func (smi *ShardedMetricsIndex) GetTagNamesInRange(prefix string, tr TimeRange) []string {
+	slices := make([][]string, len(smi.Shards))
+	for i, shard := range smi.Shards {
+		slices[i] = shard.GetTagNamesInRange(prefix, tr)
+	}
+	return mergeSortedStrings(slices)
+}
+
+// GetTagValuesInRange is GetTagValues returning only tag values of series
+// active within tr
+func (smi *ShardedMetricsIndex) GetTagValuesInRange(tagNameStr, prefix string, tr TimeRange) []string {
+	slices := make([][]string, len(smi.Shards))
+	for i, shard := range smi.Shards {
+		slices[i] = shard.GetTagValuesInRange(tagNameStr, prefix, tr)
+	}
+	return mergeSortedStrings(slices)
+}
+
+// GetMetricIDsIteratorByTagInRange is GetMetricIDsIteratorByTag returning
+// only series active within tr
+func (smi *ShardedMetricsIndex) GetMetricIDsIteratorByTagInRange(tagNameStr, tagValueStr string, tr TimeRange) (*MetricIDIterator, error) {
+	return mergeMetricIDIterators(smi.Shards, func(mi *MetricsIndex) (*MetricIDIterator, error) {
+		return mi.GetMetricIDsIteratorByTagInRange(tagNameStr, tagValueStr, tr)
+	}, ErrNoSuchTagNameValue, false)
+}
+
+// GetMetricIDsIteratorByMatchersInRange is GetMetricIDsIteratorByMatchers
+// returning only series active within tr
+func (smi *ShardedMetricsIndex) GetMetricIDsIteratorByMatchersInRange(matchers []types.Matcher, tr TimeRange) (*MetricIDIterator, error) {
+	return mergeMetricIDIterators(smi.Shards, func(mi *MetricsIndex) (*MetricIDIterator, error) {
+		return mi.GetMetricIDsIteratorByMatchersInRange(matchers, tr)
+	}, nil, false)
+}
+
+// GetCardinalityByNameInRange returns number of series with given name
+// active within tr
+func (smi *ShardedMetricsIndex) GetCardinalityByNameInRange(metricNameStr string, tr TimeRange) int {
+	res := 0
+	for _, shard := range smi.Shards {
+		res += shard.GetCardinalityByNameInRange(metricNameStr, tr)
+	}
+	return res
+}
+
+// GetCardinalityByTagInRange returns number of series having given
+// tagNameStr:tagValueStr pair active within tr
+func (smi *ShardedMetricsIndex) GetCardinalityByTagInRange(tagNameStr, tagValueStr string, tr TimeRange) int {
+	res := 0
+	for _, shard := range smi.Shards {
+		res += shard.GetCardinalityByTagInRange(tagNameStr, tagValueStr, tr)
+	}
+	return res
+}
+
+// GetCardinalityByTagNameInRange returns number of series having given
+// tag active within tr
+func (smi *ShardedMetricsIndex) GetCardinalityByTagNameInRange(tagNameStr string, tr TimeRange) int {
+	res := 0
+	for _, shard := range smi.Shards {
+		res += shard.GetCardinalityByTagNameInRange(tagNameStr, tr)
+	}
+	return res
+}
+
+// GetMetricIDsIteratorByTag returns MetricIDIterator for given
+// tagNameStr:tagValueStr pair
+func (smi *ShardedMetricsIndex) GetMetricIDsIteratorByTag(tagNameStr, tagValueStr string) (*MetricIDIterator, error) {
+	return mergeMetricIDIterators(smi.Shards, func(mi *MetricsIndex) (*MetricIDIterator, error) {
+		return mi.GetMetricIDsIteratorByTag(tagNameStr, tagValueStr)
+	}, ErrNoSuchTagNameValue, false)
+}
+
+// GetMetricIDsIteratorByName returns MetricIDIterator over all metrics
+// with given name
+func (smi *ShardedMetricsIndex) GetMetricIDsIteratorByName(metricNameStr string) (*MetricIDIterator, error) {
+	return mergeMetricIDIterators(smi.Shards, func(mi *MetricsIndex) (*MetricIDIterator, error) {
+		return mi.GetMetricIDsIteratorByName(metricNameStr)
+	}, ErrNoSuchMetricName, false)
+}
+
+// GetMetricIDsIteratorByMatchers returns MetricIDIterator over metrics
+// matching all given matchers
+func (smi *ShardedMetricsIndex) GetMetricIDsIteratorByMatchers(matchers []types.Matcher) (*MetricIDIterator, error) {
+	return mergeMetricIDIterators(smi.Shards, func(mi *MetricsIndex) (*MetricIDIterator, error) {
+		return mi.GetMetricIDsIteratorByMatchers(matchers)
+	}, nil, false)
+}
+
+// GetMetricIDsIteratorByTagRegexp returns MetricIDIterator over metrics
+// having tagNameStr tag with value matching regular expression expr
+func (smi *ShardedMetricsIndex) GetMetricIDsIteratorByTagRegexp(tagNameStr, expr string) (*MetricIDIterator, error) {
+	return mergeMetricIDIterators(smi.Shards, func(mi *MetricsIndex) (*MetricIDIterator, error) {
+		return mi.GetMetricIDsIteratorByTagRegexp(tagNameStr, expr)
+	}, nil, false)
+}
+
+// Collisions returns number of hash collisions resolved by all shards
+func (smi *ShardedMetricsIndex) Collisions() uint64 {
+	var res uint64
+	for _, shard := range smi.Shards {
+		res += shard.Collisions()
+	}
+	return res
+}
+
+// InternStats returns sum of strings interning statistics of all shards.
+// Every shard has its own table, so string used by metrics in several
+// shards is counted once per shard.
+func (smi *ShardedMetricsIndex) InternStats() InternStats {
+	var res InternStats
+	for _, shard := range smi.Shards {
+		stats := shard.InternStats()
+		res.Strings += stats.Strings
+		res.Bytes += stats.Bytes
+		res.Refs += stats.Refs
+		res.SavedBytes += stats.SavedBytes
+	}
+	return res
+}
+
+// Select returns MetricIDIterator over metrics matching Prometheus-style
+// selector
+func (smi *ShardedMetricsIndex) Select(selectorStr string) (*MetricIDIterator, error) {
+	matchers, err := selector.Parse(selectorStr)
+	if err != nil {
+		return nil, err
+	}
+	return smi.GetMetricIDsIteratorByMatchers(matchers)
+}
+
+// SeriesByTag evaluates Graphite seriesByTag() expression and returns
+// sorted serialized names of matching metrics
+func (smi *ShardedMetricsIndex) SeriesByTag(expr string) ([]string, error) {
+	if _, err := graphite.ParseSeriesByTag(expr); err != nil {
+		return nil, err
+	}
+	slices := make([][]string, 0, len(smi.Shards))
+	for _, shard := range smi.Shards {
+		res, err := shard.SeriesByTag(expr)
+		if err != nil {
+			return nil, err
+		}
+		slices = append(slices, res)
+	}
+	return mergeSortedStrings(slices), nil
+}
+
+// GetCardinalityByName returns total number of metrics with given name
+func (smi *ShardedMetricsIndex) GetCardinalityByName(metricNameStr string) int {
+	res := 0
+	for _, shard := range smi.Shards {
+		res += shard.GetCardinalityByName(metricNameStr)
+	}
+	return res
+}
+
+// GetCardinalityByTag returns total number of metrics which matches
+// given condition
+func (smi *ShardedMetricsIndex) GetCardinalityByTag(tagNameStr, tagValueStr string) int {
+	res := 0
+	for _, shard := range smi.Shards {
+		res += shard.GetCardinalityByTag(tagNameStr, tagValueStr)
+	}
+	return res
+}
+
+// GetCardinalityByTagName returns total number of metric which has
+// given tag
+func (smi *ShardedMetricsIndex) GetCardinalityByTagName(tagNameStr string) int {
+	res := 0
+	for _, shard := range smi.Shards {
+		res += shard.GetCardinalityByTagName(tagNameStr)
+	}
+	return res
+}
+
+// GetMetricNames returns sorted slice of all metric names with prefix
+func (smi *ShardedMetricsIndex) GetMetricNames(prefix string) []string {
+	slices := make([][]string, len(smi.Shards))
+	for i, shard := range smi.Shards {
+		slices[i] = shard.GetMetricNames(prefix)
+	}
+	return mergeSortedStrings(slices)
+}
+
+// GetAllMetricNames is shortcut for GetMetricNames("")
+func (smi *ShardedMetricsIndex) GetAllMetricNames() []string {
+	return smi.GetMetricNames("")
+}
+
+// GetMetricNamesIterator returns a *MetricNameIterator which will return
+// all metric names with a given prefix
+func (smi *ShardedMetricsIndex) GetMetricNamesIterator(prefix string) (*MetricNameIterator, error) {
+	its := make([]stringIterator, 0, len(smi.Shards))
+	for _, shard := range smi.Shards {
+		it, err := shard.GetMetricNamesIterator(prefix)
+		if err != nil {
+			closeStringIterators(its)
+			return nil, err
+		}
+		its = append(its, it)
+	}
+	return &MetricNameIterator{merge: newStringMerge(its)}, nil
+}
+
+// GetTagNames returns sorted slice of all tag names with prefix
+func (smi *ShardedMetricsIndex) GetTagNames(prefix string) []string {
+	slices := make([][]string, len(smi.Shards))
+	for i, shard := range smi.Shards {
+		slices[i] = shard.GetTagNames(prefix)
+	}
+	return mergeSortedStrings(slices)
+}
+
+// GetAllTagNames is shortcut for GetTagNames("")
+func (smi *ShardedMetricsIndex) GetAllTagNames() []string {
+	return smi.GetTagNames("")
+}
+
+// GetTagNamesIterator returns a *TagNameIterator which will return
+// all tag names with a given prefix
+func (smi *ShardedMetricsIndex) GetTagNamesIterator(prefix string) (*TagNameIterator, error) {
+	its := make([]stringIterator, 0, len(smi.Shards))
+	for _, shard := range smi.Shards {
+		it, err := shard.GetTagNamesIterator(prefix)
+		if err != nil {
+			closeStringIterators(its)
+			return nil, err
+		}
+		its = append(its, it)
+	}
+	return &TagNameIterator{merge: newStringMerge(its)}, nil
+}
+
+// GetAllTagNamesIterator returns a *TagNameIterator over all tags in index
+// Like MetricsIndex.GetAllTagNamesIterator it returns io.EOF if there
+// are no tags at all.
+func (smi *ShardedMetricsIndex) GetAllTagNamesIterator() (*TagNameIterator, error) {
+	its := make([]stringIterator, 0, len(smi.Shards))
+	for _, shard := range smi.Shards {
+		it, err := shard.GetAllTagNamesIterator()
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			closeStringIterators(its)
+			return nil, err
+		}
+		its = append(its, it)
+	}
+	if len(its) == 0 {
+		return nil, io.EOF
+	}
+	return &TagNameIterator{merge: newStringMerge(its)}, nil
+}
+
+// GetTagValues returns sorted slice of all values with prefix for
+// given tagNameStr
+func (smi *ShardedMetricsIndex) GetTagValues(tagNameStr, prefix string) []string {
+	slices := make([][]string, len(smi.Shards))
+	for i, shard := range smi.Shards {
+		slices[i] = shard.GetTagValues(tagNameStr, prefix)
+	}
+	return mergeSortedStrings(slices)
+}
+
+// GetAllTagValues is a shortcut for GetTagValues(tagNameStr, "")
+func (smi *ShardedMetricsIndex) GetAllTagValues(tagNameStr string) []string {
+	return smi.GetTagValues(tagNameStr, "")
+}
+
+// GetTagValuesIterator returns a *TagValueIterator which will return
+// all tag values with a given prefix for given tag
+// It returns ErrNoSuchTag if none of shards has such tag
+func (smi *ShardedMetricsIndex) GetTagValuesIterator(tagNameStr, prefix string) (*TagValueIterator, error) {
+	its := make([]stringIterator, 0, len(smi.Shards))
+	for _, shard := range smi.Shards {
+		it, err := shard.GetTagValuesIterator(tagNameStr, prefix)
+		if err == ErrNoSuchTag {
+			continue
+		}
+		if err != nil {
+			closeStringIterators(its)
+			return nil, err
+		}
+		its = append(its, it)
+	}
+	if len(its) == 0 {
+		return nil, ErrNoSuchTag
+	}
+	return &TagValueIterator{merge: newStringMerge(its)}, nil
+}
+
+// GetAllTagValuesIterator returns a *TagValueIterator over all tag values
+// for given tag
+func (smi *ShardedMetricsIndex) GetAllTagValuesIterator(tagNameStr string) (*TagValueIterator, error) {
+	return smi.GetTagValuesIterator(tagNameStr, "")
+}
+
+// GetMetricNameByID returns metric name by metricID
+func (smi *ShardedMetricsIndex) GetMetricNameByID(metricID types.MetricID) (string, error) {
+	return smi.shard(metricID).GetMetricNameByID(metricID)
+}
+
+// GetMetricByID returns metric by metricID, see MetricsIndex.GetMetricByID
+func (smi *ShardedMetricsIndex) GetMetricByID(metricID types.MetricID) (types.Metric, error) {
+	return smi.shard(metricID).GetMetricByID(metricID)
+}
+
+// GetMetricsNamesByIDs is a batch version of GetMetricNameByID
+func (smi *ShardedMetricsIndex) GetMetricsNamesByIDs(metricIDs []types.MetricID) ([]string, error) {
+	res := make([]string, len(metricIDs))
+	var errRes error
+	for i, metricID := range metricIDs {
+		metricStr, err := smi.GetMetricNameByID(metricID)
+		if err != nil {
+			errRes = ErrSomeMetricsNotFound
+		}
+		res[i] = metricStr
+	}
+	return res, errRes
+}
+
+func closeStringIterators(its []stringIterator) {
+	for _, it := range its {
+		it.Close()
+	}
+}
@@ -0,0 +1,240 @@
+package metricsindex
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/OneOfOne/xxhash"
+	"github.com/spuzirev/metricsindex/types"
+)
+
+func TestNewShardedMetricsIndex(t *testing.T) {
+	for _, shardsCount := range []int{-1, 0, 3, 6, 12} {
+		if _, err := NewShardedMetricsIndex(shardsCount); err != ErrBadShardsCount {
+			t.Fatalf("NewShardedMetricsIndex(%d) returned %v, want ErrBadShardsCount", shardsCount, err)
+		}
+	}
+	for _, shardsCount := range []int{1, 2, 8} {
+		smi, err := NewShardedMetricsIndex(shardsCount)
+		if err != nil {
+			t.Fatalf("NewShardedMetricsIndex(%d) returned %v", shardsCount, err)
+		}
+		if len(smi.Shards) != shardsCount {
+			t.Fatalf("NewShardedMetricsIndex(%d) has %d shards", shardsCount, len(smi.Shards))
+		}
+	}
+}
+
+// TestShardedCollisionWrapsAround checks that metric moved by collision
+// past 2^64 stays in the shard of its hash
+func TestShardedCollisionWrapsAround(t *testing.T) {
+	const a, b = "cpu;host=a", "cpu;host=b"
+	const hash = math.MaxUint64 - 1
+	metricHash = func(data []byte) uint64 {
+		if s := string(data); s == a || s == b {
+			return hash
+		}
+		return xxhash.Checksum64(data)
+	}
+	t.Cleanup(func() {
+		metricHash = xxhash.Checksum64
+	})
+
+	smi, err := NewShardedMetricsIndex(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := smi.InsertMetricsBatch([]string{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	moved := types.MetricID(2) // hash + 4 wrapped around 2^64
+	checkMetricIDs(t, smi, map[string]types.MetricID{a: hash, b: moved})
+	if smi.shard(moved) != smi.shard(hash) {
+		t.Fatalf("MetricID %d is routed to other shard than its hash", moved)
+	}
+	if err := smi.DeleteMetricByID(moved); err != nil {
+		t.Fatalf("DeleteMetricByID(%d) returned %v", moved, err)
+	}
+	if smi.MetricExistsByMetricStr(b) || !smi.MetricExistsByMetricStr(a) {
+		t.Fatalf("DeleteMetricByID(%d) deleted wrong metric", moved)
+	}
+}
+
+// shardedAndPlain returns ShardedMetricsIndex and MetricsIndex with the
+// same metrics, results of the former are expected to be the same as
+// of the latter
+func shardedAndPlain(t *testing.T) (*ShardedMetricsIndex, *MetricsIndex) {
+	t.Helper()
+	smi, err := NewShardedMetricsIndex(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi := NewMetricsIndex()
+	metricsStr := make([]string, 0)
+	for i := 0; i < 50; i++ {
+		metricsStr = append(metricsStr,
+			fmt.Sprintf("cpu;dc=dc%d;host=web-%d", i%3, i),
+			fmt.Sprintf("mem;host=web-%d", i),
+		)
+	}
+	metricsStr = append(metricsStr, "disk;mount=root")
+	if err := smi.InsertMetricsBatch(metricsStr); err != nil {
+		t.Fatal(err)
+	}
+	mustInsert(t, mi, metricsStr...)
+	// every shard has some metrics, so names and tags are duplicated
+	// between shards
+	for i, shard := range smi.Shards {
+		if shard.GetCardinalityByName("cpu") == 0 {
+			t.Fatalf("shard %d has no cpu metrics", i)
+		}
+	}
+	return smi, mi
+}
+
+func TestShardedIterators(t *testing.T) {
+	smi, mi := shardedAndPlain(t)
+
+	metricIDIterators := []struct {
+		name string
+		get  func(index metricIDIteratorIndex) (*MetricIDIterator, error)
+	}{
+		{"GetMetricIDsIteratorByName", func(index metricIDIteratorIndex) (*MetricIDIterator, error) {
+			return index.GetMetricIDsIteratorByName("cpu")
+		}},
+		{"GetMetricIDsIteratorByTag", func(index metricIDIteratorIndex) (*MetricIDIterator, error) {
+			return index.GetMetricIDsIteratorByTag("dc", "dc1")
+		}},
+		{"GetMetricIDsIteratorByMatchers", func(index metricIDIteratorIndex) (*MetricIDIterator, error) {
+			return index.GetMetricIDsIteratorByMatchers([]types.Matcher{
+				matcher(types.MatchNotEqual, "dc", "dc0"),
+				matcher(types.MatchRegexp, "host", "web-1.*"),
+			})
+		}},
+		{"GetMetricIDsIteratorByTagRegexp", func(index metricIDIteratorIndex) (*MetricIDIterator, error) {
+			return index.GetMetricIDsIteratorByTagRegexp("host", "web-[0-9]")
+		}},
+		{"Select", func(index metricIDIteratorIndex) (*MetricIDIterator, error) {
+			return index.Select(`mem{host=~"web-4.*"}`)
+		}},
+	}
+	for _, tt := range metricIDIterators {
+		t.Run(tt.name, func(t *testing.T) {
+			it, err := tt.get(smi)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := drainMetricIDs(t, it)
+			it, err = tt.get(mi)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := drainMetricIDs(t, it)
+			if len(want) == 0 {
+				t.Fatal("nothing is matched")
+			}
+			// MetricIDs are returned shard by shard
+			sortMetricIDs(got)
+			sortMetricIDs(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("sharded index returned %v, want %v", got, want)
+			}
+		})
+	}
+
+	stringIterators := []struct {
+		name string
+		get  func(index stringIteratorIndex) (stringIterator, error)
+	}{
+		{"GetMetricNamesIterator", func(index stringIteratorIndex) (stringIterator, error) {
+			return index.GetMetricNamesIterator("")
+		}},
+		{"GetTagNamesIterator", func(index stringIteratorIndex) (stringIterator, error) {
+			return index.GetTagNamesIterator("h")
+		}},
+		{"GetAllTagNamesIterator", func(index stringIteratorIndex) (stringIterator, error) {
+			return index.GetAllTagNamesIterator()
+		}},
+		{"GetTagValuesIterator", func(index stringIteratorIndex) (stringIterator, error) {
+			return index.GetTagValuesIterator("host", "web-1")
+		}},
+		{"GetAllTagValuesIterator", func(index stringIteratorIndex) (stringIterator, error) {
+			return index.GetAllTagValuesIterator("dc")
+		}},
+	}
+	for _, tt := range stringIterators {
+		t.Run(tt.name, func(t *testing.T) {
+			it, err := tt.get(smi)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := drainStrings(t, it)
+			it, err = tt.get(mi)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := drainStrings(t, it)
+			if len(want) == 0 {
+				t.Fatal("nothing is returned")
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("sharded index returned %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestShardedIteratorsNotFound(t *testing.T) {
+	smi, err := NewShardedMetricsIndex(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same as MetricsIndex returns for empty index
+	if _, err := smi.GetAllTagNamesIterator(); err != io.EOF {
+		t.Fatalf("GetAllTagNamesIterator of empty index returned %v, want io.EOF", err)
+	}
+	if _, err := NewMetricsIndex().GetAllTagNamesIterator(); err != io.EOF {
+		t.Fatalf("GetAllTagNamesIterator of empty MetricsIndex returned %v, want io.EOF", err)
+	}
+
+	if err := smi.InsertMetric("cpu;dc=ams"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := smi.GetMetricIDsIteratorByName("mem"); err != ErrNoSuchMetricName {
+		t.Fatalf("GetMetricIDsIteratorByName returned %v, want ErrNoSuchMetricName", err)
+	}
+	if _, err := smi.GetMetricIDsIteratorByTag("dc", "fra"); err != ErrNoSuchTagNameValue {
+		t.Fatalf("GetMetricIDsIteratorByTag returned %v, want ErrNoSuchTagNameValue", err)
+	}
+	if _, err := smi.GetTagValuesIterator("host", ""); err != ErrNoSuchTag {
+		t.Fatalf("GetTagValuesIterator returned %v, want ErrNoSuchTag", err)
+	}
+}
+
+func sortMetricIDs(metricIDs []types.MetricID) {
+	sort.Slice(metricIDs, func(i, j int) bool { return metricIDs[i] < metricIDs[j] })
+}
+
+// metricIDIteratorIndex is part of API shared by MetricsIndex and
+// ShardedMetricsIndex returning MetricIDIterator
+type metricIDIteratorIndex interface {
+	GetMetricIDsIteratorByName(metricNameStr string) (*MetricIDIterator, error)
+	GetMetricIDsIteratorByTag(tagNameStr, tagValueStr string) (*MetricIDIterator, error)
+	GetMetricIDsIteratorByMatchers(matchers []types.Matcher) (*MetricIDIterator, error)
+	GetMetricIDsIteratorByTagRegexp(tagNameStr, expr string) (*MetricIDIterator, error)
+	Select(selectorStr string) (*MetricIDIterator, error)
+}
+
+// stringIteratorIndex is part of API shared by MetricsIndex and
+// ShardedMetricsIndex returning string iterators
+type stringIteratorIndex interface {
+	GetMetricNamesIterator(prefix string) (*MetricNameIterator, error)
+	GetTagNamesIterator(prefix string) (*TagNameIterator, error)
+	GetAllTagNamesIterator() (*TagNameIterator, error)
+	GetTagValuesIterator(tagNameStr, prefix string) (*TagValueIterator, error)
+	GetAllTagValuesIterator(tagNameStr string) (*TagValueIterator, error)
+}
@@ -0,0 +1,231 @@
+package metricsindex
+
+import (
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/spuzirev/metricsindex/postings"
+	"github.com/spuzirev/metricsindex/types"
+)
+
+// TimeRange is inclusive [From, To] window of series activity used by
+// *InRange queries. Series is active in the window if it was first seen
+// not after To and last seen not before From. Zero From or To leaves the
+// window open from that side.
+type TimeRange struct {
+	From time.Time
+	To   time.Time
+}
+
+// active returns true if series first and last seen at given unix
+// nanoseconds was active within tr
+func (tr TimeRange) active(firstSeen, lastSeen int64) bool {
+	if !tr.From.IsZero() && lastSeen < tr.From.UnixNano() {
+		return false
+	}
+	if !tr.To.IsZero() && firstSeen > tr.To.UnixNano() {
+		return false
+	}
+	return true
+}
+
+// refActive returns true if series with given ref was active within tr
+// Caller must hold read lock.
+func (mi *MetricsIndex) refActive(ref uint64, tr TimeRange) bool {
+	return tr.active(atomic.LoadInt64(&mi.refs.firstSeen[ref]), atomic.LoadInt64(&mi.refs.lastSeen[ref]))
+}
+
+// activePostings returns postings of series from refs active within tr
+// Caller must hold read lock.
+func (mi *MetricsIndex) activePostings(refs refSet, tr TimeRange) *postings.List {
+	res := make([]uint64, 0)
+	it := mi.refs.iterator(refs)
+	for {
+		ref, ok := it.Next()
+		if !ok {
+			break
+		}
+		if mi.refActive(ref, tr) {
+			res = append(res, ref)
+		}
+	}
+	return postings.FromSorted(res)
+}
+
+// countActive returns number of series from refs active within tr
+// Caller must hold read lock.
+func (mi *MetricsIndex) countActive(refs *postings.List, tr TimeRange) int {
+	res := 0
+	it := refs.Iterator()
+	for {
+		ref, ok := it.Next()
+		if !ok {
+			return res
+		}
+		if mi.refActive(ref, tr) {
+			res++
+		}
+	}
+}
+
+// anyActive returns true if any series from refs was active within tr
+// Caller must hold read lock.
+func (mi *MetricsIndex) anyActive(refs *postings.List, tr TimeRange) bool {
+	it := refs.Iterator()
+	for {
+		ref, ok := it.Next()
+		if !ok {
+			return false
+		}
+		if mi.refActive(ref, tr) {
+			return true
+		}
+	}
+}
+
+// HasMetricsInRange returns true if any series was active within tr
+func (mi *MetricsIndex) HasMetricsInRange(tr TimeRange) bool {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	for ref := range mi.refs.metricIDs {
+		if mi.refs.live(uint64(ref)) && mi.refActive(uint64(ref), tr) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetMetricNamesInRange is GetMetricNames returning only names of series
+// active within tr
+func (mi *MetricsIndex) GetMetricNamesInRange(prefix string, tr TimeRange) []string {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	res := make([]string, 0)
+	e, _ := mi.MetricNames.Seek(types.MetricName(prefix))
+	defer e.Close()
+	for {
+		metricName, _, err := e.Next()
+		if err == io.EOF || !strings.HasPrefix(string(metricName), prefix) {
+			break
+		}
+		if refs, ok := mi.getNameMetricIDs(metricName); ok && mi.anyActive(refs, tr) {
+			res = append(res, string(metricName))
+		}
+	}
+	return res
+}
+
+// GetTagNamesInRange is GetTagNames returning only tag names of series
+// active within tr
+func (mi *MetricsIndex) GetTagNamesInRange(prefix string, tr TimeRange) []string {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	res := make([]string, 0)
+	e, _ := mi.TagNames.Seek(types.TagName(prefix))
+	defer e.Close()
+	for {
+		tagName, _, err := e.Next()
+		if err == io.EOF || !strings.HasPrefix(string(tagName), prefix) {
+			break
+		}
+		if refs, ok := mi.getTagMetricIDs(tagName); ok && mi.anyActive(refs, tr) {
+			res = append(res, string(tagName))
+		}
+	}
+	return res
+}
+
+// GetTagValuesInRange is GetTagValues returning only tag values of series
+// active within tr
+func (mi *MetricsIndex) GetTagValuesInRange(tagNameStr, prefix string, tr TimeRange) []string {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	res := make([]string, 0)
+	tagName := types.TagName(tagNameStr)
+	tagValues, ok := mi.getTagValues(tagName)
+	if !ok {
+		return res
+	}
+	e, _ := tagValues.Seek(types.TagValue(prefix))
+	defer e.Close()
+	for {
+		tagValue, _, err := e.Next()
+		if err == io.EOF || !strings.HasPrefix(string(tagValue), prefix) {
+			break
+		}
+		refs, ok := mi.getTagNameValueMetricIDs(types.TagNameValue{
+			TagName:  tagName,
+			TagValue: tagValue,
+		})
+		if ok && mi.anyActive(refs, tr) {
+			res = append(res, string(tagValue))
+		}
+	}
+	return res
+}
+
+// GetMetricIDsIteratorByTagInRange is GetMetricIDsIteratorByTag returning
+// only series active within tr
+func (mi *MetricsIndex) GetMetricIDsIteratorByTagInRange(tagNameStr, tagValueStr string, tr TimeRange) (*MetricIDIterator, error) {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	refs, ok := mi.getTagNameValueMetricIDs(types.TagNameValue{
+		TagName:  types.TagName(tagNameStr),
+		TagValue: types.TagValue(tagValueStr),
+	})
+	if !ok {
+		return nil, ErrNoSuchTagNameValue
+	}
+	return mi.newMetricIDIterator(mi.activePostings(refSet{include: refs}, tr)), nil
+}
+
+// GetMetricIDsIteratorByMatchersInRange is GetMetricIDsIteratorByMatchers
+// returning only series active within tr
+func (mi *MetricsIndex) GetMetricIDsIteratorByMatchersInRange(matchers []types.Matcher, tr TimeRange) (*MetricIDIterator, error) {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	refs, err := mi.selectMetricIDs(matchers)
+	if err != nil {
+		return nil, err
+	}
+	return mi.newMetricIDIterator(mi.activePostings(refs, tr)), nil
+}
+
+// GetCardinalityByNameInRange returns number of series with given name
+// active within tr
+func (mi *MetricsIndex) GetCardinalityByNameInRange(metricNameStr string, tr TimeRange) int {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	if refs, ok := mi.getNameMetricIDs(types.MetricName(metricNameStr)); ok {
+		return mi.countActive(refs, tr)
+	}
+	return 0
+}
+
+// GetCardinalityByTagInRange returns number of series having given
+// tagNameStr:tagValueStr pair active within tr
+func (mi *MetricsIndex) GetCardinalityByTagInRange(tagNameStr, tagValueStr string, tr TimeRange) int {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	refs, ok := mi.getTagNameValueMetricIDs(types.TagNameValue{
+		TagName:  types.TagName(tagNameStr),
+		TagValue: types.TagValue(tagValueStr),
+	})
+	if ok {
+		return mi.countActive(refs, tr)
+	}
+	return 0
+}
+
+// GetCardinalityByTagNameInRange returns number of series having given
+// tag active within tr
+func (mi *MetricsIndex) GetCardinalityByTagNameInRange(tagNameStr string, tr TimeRange) int {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	if refs, ok := mi.getTagMetricIDs(types.TagName(tagNameStr)); ok {
+		return mi.countActive(refs, tr)
+	}
+	return 0
+}
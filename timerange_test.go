@@ -0,0 +1,186 @@
+package metricsindex
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spuzirev/metricsindex/types"
+)
+
+func TestTimeRangeActive(t *testing.T) {
+	at := func(min int64) time.Time {
+		return time.Unix(min*60, 0)
+	}
+	ns := func(min int64) int64 {
+		return at(min).UnixNano()
+	}
+	tr := TimeRange{From: at(10), To: at(20)}
+	tests := []struct {
+		tr                  TimeRange
+		firstSeen, lastSeen int64
+		want                bool
+	}{
+		{tr, ns(12), ns(15), true},
+		{tr, ns(5), ns(25), true},
+		{tr, ns(5), ns(15), true},
+		{tr, ns(15), ns(25), true},
+		// bounds are inclusive
+		{tr, ns(5), ns(10), true},
+		{tr, ns(20), ns(25), true},
+		{tr, ns(1), ns(9), false},
+		{tr, ns(21), ns(25), false},
+		// open window
+		{TimeRange{}, ns(1), ns(2), true},
+		{TimeRange{From: at(10)}, ns(1), ns(30), true},
+		{TimeRange{From: at(10)}, ns(1), ns(9), false},
+		{TimeRange{To: at(10)}, ns(1), ns(30), true},
+		{TimeRange{To: at(10)}, ns(11), ns(30), false},
+	}
+	for _, tt := range tests {
+		if got := tt.tr.active(tt.firstSeen, tt.lastSeen); got != tt.want {
+			t.Errorf("%+v active(%d, %d) = %v, want %v", tt.tr, tt.firstSeen, tt.lastSeen, got, tt.want)
+		}
+	}
+}
+
+// rangeIndex is part of API shared by MetricsIndex and ShardedMetricsIndex
+// used by TestInRange
+type rangeIndex interface {
+	InsertMetric(metricStr string) error
+	ExpireOlderThan(t time.Time) int
+	GetMetricNamesInRange(prefix string, tr TimeRange) []string
+	GetTagNamesInRange(prefix string, tr TimeRange) []string
+	GetTagValuesInRange(tagNameStr, prefix string, tr TimeRange) []string
+	HasMetricsInRange(tr TimeRange) bool
+	GetMetricIDsIteratorByTagInRange(tagNameStr, tagValueStr string, tr TimeRange) (*MetricIDIterator, error)
+	GetMetricIDsIteratorByMatchersInRange(matchers []types.Matcher, tr TimeRange) (*MetricIDIterator, error)
+	GetCardinalityByNameInRange(metricNameStr string, tr TimeRange) int
+	GetCardinalityByTagInRange(tagNameStr, tagValueStr string, tr TimeRange) int
+	GetCardinalityByTagNameInRange(tagNameStr string, tr TimeRange) int
+}
+
+func TestInRange(t *testing.T) {
+	newPlain := func(clock *testClock) rangeIndex {
+		mi := NewMetricsIndex()
+		mi.now = clock.now
+		return mi
+	}
+	newSharded := func(clock *testClock) rangeIndex {
+		smi, err := NewShardedMetricsIndex(4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, shard := range smi.Shards {
+			shard.now = clock.now
+		}
+		return smi
+	}
+	t.Run("MetricsIndex", func(t *testing.T) {
+		testInRange(t, newPlain)
+	})
+	t.Run("ShardedMetricsIndex", func(t *testing.T) {
+		testInRange(t, newSharded)
+	})
+}
+
+func testInRange(t *testing.T, newIndex func(clock *testClock) rangeIndex) {
+	const (
+		before   = "cpu;dc=ams;host=before"
+		straddle = "cpu;dc=ams;host=straddle"
+		inside   = "cpu;dc=fra;host=inside"
+		after    = "mem;dc=fra;host=after"
+	)
+	clock := newTestClock()
+	start := clock.now()
+	at := func(d time.Duration) time.Time {
+		return start.Add(d)
+	}
+	index := newIndex(clock)
+	insertAt := func(d time.Duration, metricStr string) {
+		clock.add(at(d).Sub(clock.now()))
+		if err := index.InsertMetric(metricStr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	insertAt(0, before)
+	insertAt(time.Minute, before)
+	insertAt(5*time.Minute, straddle)
+	insertAt(12*time.Minute, inside)
+	insertAt(15*time.Minute, straddle)
+	insertAt(25*time.Minute, after)
+
+	metricIDs := func(it *MetricIDIterator, err error) []types.MetricID {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := drainMetricIDs(t, it)
+		sortMetricIDs(res)
+		return res
+	}
+	ids := func(metricsStr ...string) []types.MetricID {
+		res := make([]types.MetricID, len(metricsStr))
+		for i, metricStr := range metricsStr {
+			metric, _ := types.ParseMetric(metricStr)
+			res[i] = metric.ID()
+		}
+		sortMetricIDs(res)
+		return res
+	}
+	check := func(what string, got, want interface{}) {
+		t.Helper()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s = %v, want %v", what, got, want)
+		}
+	}
+
+	tr := TimeRange{From: at(10 * time.Minute), To: at(20 * time.Minute)}
+	check("GetMetricNamesInRange", index.GetMetricNamesInRange("", tr), []string{"cpu"})
+	check("GetTagNamesInRange", index.GetTagNamesInRange("", tr), []string{"dc", "host"})
+	check("GetTagNamesInRange with prefix", index.GetTagNamesInRange("h", tr), []string{"host"})
+	check("GetTagValuesInRange dc", index.GetTagValuesInRange("dc", "", tr), []string{"ams", "fra"})
+	check("GetTagValuesInRange host", index.GetTagValuesInRange("host", "", tr), []string{"inside", "straddle"})
+	check("GetTagValuesInRange of unknown tag", index.GetTagValuesInRange("role", "", tr), []string{})
+	check("HasMetricsInRange", index.HasMetricsInRange(tr), true)
+	check("HasMetricsInRange since 30m", index.HasMetricsInRange(TimeRange{From: at(30 * time.Minute)}), false)
+	check("GetMetricIDsIteratorByTagInRange",
+		metricIDs(index.GetMetricIDsIteratorByTagInRange("dc", "ams", tr)), ids(straddle))
+	check("GetMetricIDsIteratorByTagInRange of series outside",
+		metricIDs(index.GetMetricIDsIteratorByTagInRange("host", "after", tr)), ids())
+	check("GetMetricIDsIteratorByMatchersInRange",
+		metricIDs(index.GetMetricIDsIteratorByMatchersInRange([]types.Matcher{
+			matcher(types.MatchEqual, types.NameTagName, "cpu"),
+		}, tr)), ids(straddle, inside))
+	check("GetMetricIDsIteratorByMatchersInRange with negative matcher only",
+		metricIDs(index.GetMetricIDsIteratorByMatchersInRange([]types.Matcher{
+			matcher(types.MatchNotEqual, "host", "inside"),
+		}, tr)), ids(straddle))
+	check("GetCardinalityByNameInRange cpu", index.GetCardinalityByNameInRange("cpu", tr), 2)
+	check("GetCardinalityByNameInRange mem", index.GetCardinalityByNameInRange("mem", tr), 0)
+	check("GetCardinalityByTagInRange", index.GetCardinalityByTagInRange("dc", "fra", tr), 1)
+	check("GetCardinalityByTagNameInRange", index.GetCardinalityByTagNameInRange("host", tr), 2)
+
+	// windows open from one side or both
+	all := ids(before, straddle, inside, after)
+	check("iterator over open window",
+		metricIDs(index.GetMetricIDsIteratorByMatchersInRange(nil, TimeRange{})), all)
+	check("names since 20m", index.GetMetricNamesInRange("", TimeRange{From: at(20 * time.Minute)}), []string{"mem"})
+	check("hosts until 4m", index.GetTagValuesInRange("host", "", TimeRange{To: at(4 * time.Minute)}), []string{"before"})
+	// bounds are inclusive
+	check("hosts seen exactly at 1m",
+		index.GetTagValuesInRange("host", "", TimeRange{From: at(time.Minute), To: at(time.Minute)}), []string{"before"})
+
+	// expired series are gone even if they were active within tr
+	if n := index.ExpireOlderThan(at(13 * time.Minute)); n != 2 {
+		t.Fatalf("ExpireOlderThan expired %d series, want 2", n)
+	}
+	check("GetTagValuesInRange after expiry", index.GetTagValuesInRange("host", "", tr), []string{"straddle"})
+	check("GetMetricIDsIteratorByMatchersInRange after expiry",
+		metricIDs(index.GetMetricIDsIteratorByMatchersInRange(nil, tr)), ids(straddle))
+	check("HasMetricsInRange until 4m after expiry", index.HasMetricsInRange(TimeRange{To: at(4 * time.Minute)}), false)
+	check("GetCardinalityByTagInRange after expiry", index.GetCardinalityByTagInRange("dc", "fra", tr), 0)
+	if _, err := index.GetMetricIDsIteratorByTagInRange("host", "inside", tr); err != ErrNoSuchTagNameValue {
+		t.Errorf("GetMetricIDsIteratorByTagInRange of expired series returned %v, want ErrNoSuchTagNameValue", err)
+	}
+}
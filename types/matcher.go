@@ -0,0 +1,59 @@
+package types
+
+// NameTagName is the pseudo tag name which is used by matchers
+// to match metric name instead of one of its tags
+const NameTagName TagName = "__name__"
+
+type MatchType int
+
+const (
+	// MatchEqual matches metrics having tag with given value
+	MatchEqual MatchType = iota
+	// MatchNotEqual matches metrics not having tag with given value
+	MatchNotEqual
+	// MatchExists matches metrics having tag with any value
+	MatchExists
+	// MatchNotExists matches metrics not having tag at all
+	MatchNotExists
+	// MatchRegexp matches metrics having tag with value matching
+	// regular expression
+	MatchRegexp
+	// MatchNotRegexp matches metrics not having tag with value matching
+	// regular expression
+	MatchNotRegexp
+)
+
+func (mt MatchType) String() string {
+	switch mt {
+	case MatchEqual:
+		return "="
+	case MatchNotEqual:
+		return "!="
+	case MatchExists:
+		return "exists"
+	case MatchNotExists:
+		return "not exists"
+	case MatchRegexp:
+		return "=~"
+	case MatchNotRegexp:
+		return "!~"
+	}
+	return "unknown"
+}
+
+// Matcher is a single condition on metric's tag.
+// For MatchRegexp and MatchNotRegexp TagValue holds regular expression
+// which has to match whole tag value.
+type Matcher struct {
+	Type     MatchType
+	TagName  TagName
+	TagValue TagValue
+}
+
+func (m Matcher) String() string {
+	switch m.Type {
+	case MatchExists, MatchNotExists:
+		return m.Type.String() + " " + string(m.TagName)
+	}
+	return string(m.TagName) + m.Type.String() + string(m.TagValue)
+}
@@ -0,0 +1,13 @@
+package types
+
+type MetricNameID uint64
+
+func CmpMetricNameIDs(a, b MetricNameID) int {
+	if a > b {
+		return 1
+	} else if a < b {
+		return -1
+	} else {
+		return 0
+	}
+}
@@ -0,0 +1,17 @@
+package types
+
+import (
+	"strings"
+
+	"github.com/OneOfOne/xxhash"
+)
+
+type MetricName string
+
+func CmpMetricNames(a, b MetricName) int {
+	return strings.Compare(string(a), string(b))
+}
+
+func (mn MetricName) ID() MetricNameID {
+	return MetricNameID(xxhash.ChecksumString64(string(mn)))
+}
@@ -0,0 +1,239 @@
+package types
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// Escaping: in metric name, tag names and tag values ';', '=' and '\'
+// are written as "\;", "\=" and "\\". Backslash followed by any other
+// character is taken literally, so strings written before escaping was
+// introduced, like `C:\temp`, keep their meaning. Tag is split on the
+// first unescaped '=', so the rest of it, '=' included, is the value.
+// Unescaped '=' is accepted in metric name as well.
+
+// ParseOptions configures validation done by ParseMetricWithOptions.
+// Zero value of a limit means no limit.
+type ParseOptions struct {
+	// AllowedChar reports if r may be used in metric name, tag names and
+	// tag values. Any character is allowed if it is nil.
+	AllowedChar func(r rune) bool
+
+	MaxNameLen     int
+	MaxTagNameLen  int
+	MaxTagValueLen int
+
+	AllowEmptyTagValues bool
+	// AllowDuplicateTags makes the last value win if tag is repeated
+	AllowDuplicateTags bool
+	// StrictEscapes makes backslash followed by anything but ';', '='
+	// or '\' an error instead of literal backslash
+	StrictEscapes bool
+}
+
+// defaultParseOptions are used by ParseMetric, they are never handed out
+// so nobody can change them
+var defaultParseOptions = ParseOptions{
+	AllowEmptyTagValues: true,
+	AllowDuplicateTags:  true,
+}
+
+// DefaultParseOptions returns copy of options used by ParseMetric
+func DefaultParseOptions() ParseOptions {
+	return defaultParseOptions
+}
+
+// ParseError is returned when metric string is malformed or doesn't pass
+// validation. Pos is the byte offset in the metric string where the
+// problem was found.
+type ParseError struct {
+	Pos int
+	Msg string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("cannot parse metric at position %d: %s", e.Pos, e.Msg)
+}
+
+// Unwrap makes errors.Is(err, ErrCannotParseMetricName) work
+func (e *ParseError) Unwrap() error {
+	return ErrCannotParseMetricName
+}
+
+// token kinds
+const (
+	tokenName = iota
+	tokenTagName
+	tokenTagValue
+)
+
+type metricParser struct {
+	s    string
+	pos  int
+	opts *ParseOptions
+	buf  []byte
+}
+
+func (p *metricParser) errorf(pos int, format string, args ...interface{}) error {
+	return &ParseError{
+		Pos: pos,
+		Msg: fmt.Sprintf(format, args...),
+	}
+}
+
+// token reads and unescapes metric name, tag name or tag value.
+// It stops at unescaped ';', tag name also stops at unescaped '='.
+// Unknown escape sequences are kept as is unless opts.StrictEscapes is set.
+func (p *metricParser) token(kind int) (string, error) {
+	start := p.pos
+	escaped := false
+	p.buf = p.buf[:0]
+loop:
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		switch c {
+		case ';':
+			break loop
+		case '=':
+			if kind == tokenTagName {
+				break loop
+			}
+		case '\\':
+			if p.pos+1 == len(p.s) {
+				if p.opts.StrictEscapes {
+					return "", p.errorf(p.pos, "unterminated escape sequence")
+				}
+				break
+			}
+			c = p.s[p.pos+1]
+			if c != ';' && c != '=' && c != '\\' {
+				if p.opts.StrictEscapes {
+					r, _ := utf8.DecodeRuneInString(p.s[p.pos+1:])
+					return "", p.errorf(p.pos, "invalid escape sequence \\%c", r)
+				}
+				// literal backslash
+				c = '\\'
+				break
+			}
+			if !escaped {
+				p.buf = append(p.buf, p.s[start:p.pos]...)
+				escaped = true
+			}
+			if err := p.checkChar(rune(c), p.pos+1); err != nil {
+				return "", err
+			}
+			p.buf = append(p.buf, c)
+			p.pos += 2
+			continue
+		}
+
+		r, size := rune(c), 1
+		if c >= utf8.RuneSelf {
+			r, size = utf8.DecodeRuneInString(p.s[p.pos:])
+		}
+		if err := p.checkChar(r, p.pos); err != nil {
+			return "", err
+		}
+		if escaped {
+			p.buf = append(p.buf, p.s[p.pos:p.pos+size]...)
+		}
+		p.pos += size
+	}
+	if escaped {
+		return string(p.buf), nil
+	}
+	return p.s[start:p.pos], nil
+}
+
+func (p *metricParser) checkChar(r rune, pos int) error {
+	if p.opts.AllowedChar != nil && !p.opts.AllowedChar(r) {
+		return p.errorf(pos, "character %q is not allowed", r)
+	}
+	return nil
+}
+
+func checkLen(kind string, s string, max, pos int) error {
+	if max > 0 && len(s) > max {
+		return &ParseError{
+			Pos: pos,
+			Msg: fmt.Sprintf("%s is longer than %d bytes", kind, max),
+		}
+	}
+	return nil
+}
+
+// ParseMetricWithOptions parses metric string representation
+// "name;tagName1=tagValue1;tagName2=tagValue2" validating it according
+// to opts. Errors are returned as *ParseError.
+func ParseMetricWithOptions(metricStr string, opts *ParseOptions) (*Metric, error) {
+	p := &metricParser{
+		s:    metricStr,
+		opts: opts,
+	}
+
+	name, err := p.token(tokenName)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkLen("metric name", name, opts.MaxNameLen, 0); err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string)
+	for p.pos < len(p.s) {
+		// skip ';'
+		p.pos++
+		tagNamePos := p.pos
+		tagName, err := p.token(tokenTagName)
+		if err != nil {
+			return nil, err
+		}
+		if tagName == "" {
+			return nil, p.errorf(tagNamePos, "empty tag name")
+		}
+		if err = checkLen("tag name", tagName, opts.MaxTagNameLen, tagNamePos); err != nil {
+			return nil, err
+		}
+		if p.pos == len(p.s) || p.s[p.pos] != '=' {
+			return nil, p.errorf(p.pos, "expected '=' after tag name")
+		}
+		p.pos++
+
+		tagValuePos := p.pos
+		tagValue, err := p.token(tokenTagValue)
+		if err != nil {
+			return nil, err
+		}
+		if tagValue == "" && !opts.AllowEmptyTagValues {
+			return nil, p.errorf(tagValuePos, "empty value of tag %q", tagName)
+		}
+		if err = checkLen("tag value", tagValue, opts.MaxTagValueLen, tagValuePos); err != nil {
+			return nil, err
+		}
+		if _, ok := tags[tagName]; ok && !opts.AllowDuplicateTags {
+			return nil, p.errorf(tagNamePos, "duplicate tag %q", tagName)
+		}
+		tags[tagName] = tagValue
+	}
+	return &Metric{
+		Name: name,
+		Tags: tags,
+	}, nil
+}
+
+// appendRaw appends s to b as is
+func appendRaw(b []byte, s string) []byte {
+	return append(b, s...)
+}
+
+// appendEscaped appends s to b escaping ';', '=' and '\'
+func appendEscaped(b []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case ';', '=', '\\':
+			b = append(b, '\\')
+		}
+		b = append(b, s[i])
+	}
+	return b
+}
@@ -0,0 +1,164 @@
+package types
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"unicode"
+
+	"github.com/OneOfOne/xxhash"
+)
+
+func TestParseMetric(t *testing.T) {
+	tests := []struct {
+		in   string
+		name string
+		tags map[string]string
+	}{
+		{"cpu", "cpu", map[string]string{}},
+		{"cpu;dc=ams;host=web-1", "cpu", map[string]string{"dc": "ams", "host": "web-1"}},
+		{"cpu;host=web-1;dc=ams", "cpu", map[string]string{"dc": "ams", "host": "web-1"}},
+		{"cpu;dc=", "cpu", map[string]string{"dc": ""}},
+		{"cpu;dc=ams;dc=fra", "cpu", map[string]string{"dc": "fra"}},
+
+		// escapes
+		{`a\;b;c\=d=e\;f`, "a;b", map[string]string{"c=d": "e;f"}},
+		{`a\\b;c=d\\`, `a\b`, map[string]string{"c": `d\`}},
+		{`a;b=\=\;\\`, "a", map[string]string{"b": `=;\`}},
+
+		// '=' in values and name
+		{"a;b=c=d", "a", map[string]string{"b": "c=d"}},
+		{"a;b==", "a", map[string]string{"b": "="}},
+		{"a;b=x=y=z;c=1", "a", map[string]string{"b": "x=y=z", "c": "1"}},
+		{"a=b;c=d", "a=b", map[string]string{"c": "d"}},
+		{`a;url=/q?x=1\;y=2`, "a", map[string]string{"url": "/q?x=1;y=2"}},
+
+		// backslash followed by other characters is literal
+		{`C:\temp;x=y`, `C:\temp`, map[string]string{"x": "y"}},
+		{`a;path=C:\temp\new`, "a", map[string]string{"path": `C:\temp\new`}},
+		{`a;re=\d+\.\d+`, "a", map[string]string{"re": `\d+\.\d+`}},
+		{`a\`, `a\`, map[string]string{}},
+		{`a;b=c\`, "a", map[string]string{"b": `c\`}},
+		{`a;b\x=c`, "a", map[string]string{`b\x`: "c"}},
+		{`a;b=\ü`, "a", map[string]string{"b": `\ü`}},
+	}
+	for _, tt := range tests {
+		m, err := ParseMetric(tt.in)
+		if err != nil {
+			t.Errorf("ParseMetric(%q): %v", tt.in, err)
+			continue
+		}
+		if m.Name != tt.name || !reflect.DeepEqual(m.Tags, tt.tags) {
+			t.Errorf("ParseMetric(%q) = %q %q, want %q %q", tt.in, m.Name, m.Tags, tt.name, tt.tags)
+		}
+		// serialized metric is parsed back to the same metric
+		back, err := ParseMetric(m.Serialize())
+		if err != nil {
+			t.Errorf("ParseMetric(%q): %v", m.Serialize(), err)
+			continue
+		}
+		if !reflect.DeepEqual(back, m) {
+			t.Errorf("%q is parsed back from %q as %q %q", tt.in, m.Serialize(), back.Name, back.Tags)
+		}
+	}
+}
+
+func TestParseMetricErrors(t *testing.T) {
+	ascii := func(r rune) bool { return r < unicode.MaxASCII }
+	tests := []struct {
+		in   string
+		opts ParseOptions
+		pos  int
+	}{
+		{"cpu;", DefaultParseOptions(), 4},
+		{"cpu;=a", DefaultParseOptions(), 4},
+		{"cpu;dc", DefaultParseOptions(), 6},
+		{"cpu;dc;a=b", DefaultParseOptions(), 6},
+		{"cpu;dc=", ParseOptions{}, 7},
+		{"cpu;dc=a;dc=b", ParseOptions{}, 9},
+		{"cpu;dc=amsterdam", ParseOptions{MaxTagValueLen: 3}, 7},
+		{"cpu;datacenter=a", ParseOptions{MaxTagNameLen: 3}, 4},
+		{"cpu.load", ParseOptions{MaxNameLen: 3}, 0},
+		{"cpu;dc=zürich", ParseOptions{AllowedChar: ascii}, 8},
+		{`cpu;dc=\;ü`, ParseOptions{AllowedChar: ascii}, 9},
+
+		// strict escaping
+		{`C:\temp;x=y`, ParseOptions{StrictEscapes: true}, 2},
+		{`a;b=c\`, ParseOptions{StrictEscapes: true}, 5},
+		{`a;b\x=c`, ParseOptions{StrictEscapes: true}, 3},
+	}
+	for _, tt := range tests {
+		_, err := ParseMetricWithOptions(tt.in, &tt.opts)
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("ParseMetricWithOptions(%q) returned %v, want *ParseError", tt.in, err)
+			continue
+		}
+		if !errors.Is(err, ErrCannotParseMetricName) {
+			t.Errorf("ParseMetricWithOptions(%q) error doesn't wrap ErrCannotParseMetricName", tt.in)
+		}
+		if parseErr.Pos != tt.pos {
+			t.Errorf("ParseMetricWithOptions(%q) error %q is at %d, want %d", tt.in, err, parseErr.Pos, tt.pos)
+		}
+	}
+}
+
+func TestParseMetricStrictEscapes(t *testing.T) {
+	opts := ParseOptions{StrictEscapes: true}
+	m, err := ParseMetricWithOptions(`a\;b;c=d\=e\\;f=g=h`, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"c": `d=e\`, "f": "g=h"}
+	if m.Name != "a;b" || !reflect.DeepEqual(m.Tags, want) {
+		t.Fatalf("got %q %q", m.Name, m.Tags)
+	}
+}
+
+func TestSerialize(t *testing.T) {
+	tests := []struct {
+		m    Metric
+		want string
+	}{
+		{Metric{Name: "cpu"}, "cpu"},
+		{Metric{Name: "cpu", Tags: map[string]string{"host": "a", "dc": "b"}}, "cpu;dc=b;host=a"},
+		{Metric{Name: "a;b", Tags: map[string]string{"c=d": `e\f`}}, `a\;b;c\=d=e\\f`},
+		{Metric{Name: "a=b", Tags: map[string]string{"x": "1=2"}}, `a\=b;x=1\=2`},
+	}
+	for _, tt := range tests {
+		if got := tt.m.Serialize(); got != tt.want {
+			t.Errorf("Serialize() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestHashKey(t *testing.T) {
+	tests := []struct {
+		m    Metric
+		want string
+	}{
+		{Metric{Name: "cpu", Tags: map[string]string{"host": "a", "dc": "b"}}, "cpu;dc=b;host=a"},
+		// not escaped, so MetricIDs are the same as before escaping
+		{Metric{Name: "path", Tags: map[string]string{"dir": `C:\temp`}}, `path;dir=C:\temp`},
+		{Metric{Name: "a=b", Tags: map[string]string{"x": "1=2"}}, "a=b;x=1=2"},
+	}
+	for _, tt := range tests {
+		if got := string(tt.m.HashKey()); got != tt.want {
+			t.Errorf("HashKey() = %q, want %q", got, tt.want)
+		}
+		if got, want := tt.m.ID(), MetricID(xxhash.ChecksumString64(tt.want)); got != want {
+			t.Errorf("ID() of %s = %d, want %d", tt.want, got, want)
+		}
+	}
+}
+
+func TestDefaultParseOptionsIsCopy(t *testing.T) {
+	opts := DefaultParseOptions()
+	opts.AllowEmptyTagValues = false
+	if !DefaultParseOptions().AllowEmptyTagValues {
+		t.Fatal("DefaultParseOptions are changed through returned value")
+	}
+	if _, err := ParseMetric("cpu;dc="); err != nil {
+		t.Fatalf("ParseMetric uses changed options: %v", err)
+	}
+}
@@ -9,6 +9,8 @@ import (
 )
 
 var (
+	// ErrCannotParseMetricName represents situation when metric string
+	// is malformed. Parse functions return *ParseError which wraps it.
 	ErrCannotParseMetricName error = errors.New("Cannot parse metric name")
 )
 
@@ -25,9 +27,26 @@ func (m *Metric) String() string {
 	return m.Serialize()
 }
 
+// SerializeToByteSlice returns canonical representation of metric:
+// tags are sorted by name and ';', '=' and '\' are escaped with '\',
+// so ParseMetric returns the same metric back.
 func (m *Metric) SerializeToByteSlice() []byte {
-	b := make([]byte, 0)
-	b = append(b, []byte(m.Name)...)
+	return m.appendTo(make([]byte, 0), appendEscaped)
+}
+
+// HashKey returns representation of metric hashed to MetricID. It is
+// SerializeToByteSlice without escaping, the form metrics were serialized
+// in before escaping was introduced, so MetricIDs of series stay the same.
+// It is ambiguous for metrics having ';' or '=' in names or values, such
+// metrics get the same hash and are told apart as hash collisions.
+func (m *Metric) HashKey() []byte {
+	return m.appendTo(make([]byte, 0), appendRaw)
+}
+
+// appendTo appends metric with tags sorted by name to b, every name and
+// value is appended by appendString
+func (m *Metric) appendTo(b []byte, appendString func(b []byte, s string) []byte) []byte {
+	b = appendString(b, m.Name)
 
 	tagNames := make([]string, 0)
 	for k := range m.Tags {
@@ -37,35 +56,25 @@ func (m *Metric) SerializeToByteSlice() []byte {
 		return strings.Compare(tagNames[i], tagNames[j]) == -1
 	})
 	for _, tagName := range tagNames {
-		b = append(b, []byte(";"+tagName+"="+m.Tags[tagName])...)
+		b = append(b, ';')
+		b = appendString(b, tagName)
+		b = append(b, '=')
+		b = appendString(b, m.Tags[tagName])
 	}
 	return b
 }
 
 func (m *Metric) Hash() uint64 {
-	return xxhash.Checksum64(m.SerializeToByteSlice())
+	return xxhash.Checksum64(m.HashKey())
 }
 
 func (m *Metric) ID() MetricID {
 	return MetricID(m.Hash())
 }
 
+// ParseMetric parses metric string representation
+// "name;tagName1=tagValue1;tagName2=tagValue2" using DefaultParseOptions.
+// See ParseMetricWithOptions for escaping rules.
 func ParseMetric(metricStr string) (*Metric, error) {
-	tokens := strings.Split(metricStr, ";")
-	name := tokens[0]
-	tags := make(map[string]string)
-	if len(tokens) > 1 {
-		tokens = tokens[1:]
-		for _, token := range tokens {
-			tntv := strings.Split(token, "=")
-			if len(tntv) != 2 {
-				return nil, ErrCannotParseMetricName
-			}
-			tags[tntv[0]] = tntv[1]
-		}
-	}
-	return &Metric{
-		Name: name,
-		Tags: tags,
-	}, nil
+	return ParseMetricWithOptions(metricStr, &defaultParseOptions)
 }
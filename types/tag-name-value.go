@@ -1,7 +1,7 @@
 package types
 
 import (
-	"fmt"
+	"strconv"
 
 	"github.com/OneOfOne/xxhash"
 )
@@ -11,6 +11,14 @@ type TagNameValue struct {
 	TagValue TagValue
 }
 
+// Key returns unambiguous string representation of the pair.
+// Tag name is prefixed with its length, e.g. "a:b"="c" is "3:a:bc" and
+// "a"="b:c" is "1:ab:c", so no two different pairs have the same key
+// whatever characters they contain.
+func (tnv TagNameValue) Key() string {
+	return strconv.Itoa(len(tnv.TagName)) + ":" + string(tnv.TagName) + string(tnv.TagValue)
+}
+
 func (tnv TagNameValue) ID() TagNameValueID {
-	return TagNameValueID(xxhash.ChecksumString64(fmt.Sprintf("%s:%s", string(tnv.TagName), string(tnv.TagValue))))
+	return TagNameValueID(xxhash.ChecksumString64(tnv.Key()))
 }
@@ -0,0 +1,48 @@
+package types
+
+import "testing"
+
+// ambiguousTagPairs are pairs of tags which were merged when key was
+// "name:value"
+var ambiguousTagPairs = [][2]TagNameValue{
+	{{"a:b", "c"}, {"a", "b:c"}},
+	{{"a", ":b"}, {"a:", "b"}},
+	{{"1:a", "b"}, {"1", "a:b"}},
+	{{"3:a", "b"}, {"", "3:a:b"}},
+	{{"12", "x"}, {"1", "2x"}},
+	{{"x", "1:a"}, {"x1", "a"}},
+	{{"x", "1:a"}, {"x:1", "a"}},
+	{{"a", ""}, {"", "a"}},
+	{{"", ""}, {"0", ""}},
+	{{"", "0:"}, {"0:", ""}},
+	{{"a", "1:"}, {"a1", ":"}},
+}
+
+func TestTagNameValueKeyIsUnambiguous(t *testing.T) {
+	for _, pair := range ambiguousTagPairs {
+		a, b := pair[0], pair[1]
+		if a.Key() == b.Key() {
+			t.Errorf("%q=%q and %q=%q have the same key %q", a.TagName, a.TagValue, b.TagName, b.TagValue, a.Key())
+		}
+		if a.ID() == b.ID() {
+			t.Errorf("%q=%q and %q=%q have the same ID", a.TagName, a.TagValue, b.TagName, b.TagValue)
+		}
+	}
+}
+
+func TestTagNameValueKey(t *testing.T) {
+	tests := []struct {
+		tnv  TagNameValue
+		want string
+	}{
+		{TagNameValue{"a:b", "c"}, "3:a:bc"},
+		{TagNameValue{"a", "b:c"}, "1:ab:c"},
+		{TagNameValue{"", ""}, "0:"},
+		{TagNameValue{"dc", "ams"}, "2:dcams"},
+	}
+	for _, tt := range tests {
+		if got := tt.tnv.Key(); got != tt.want {
+			t.Errorf("Key() of %q=%q is %q, want %q", tt.tnv.TagName, tt.tnv.TagValue, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+// Package wal implements append-only write-ahead log of index mutations.
+//
+// Every record is framed as
+//
+//	length  uint32  length of payload
+//	crc     uint32  CRC-32C of payload
+//	payload [length]byte: op byte followed by metric string
+//
+// (integers are little endian). Replay stops at the first damaged record
+// and, if no valid record follows it, truncates the log there: crash in
+// the middle of Append or file system leaving zeroes or garbage at the
+// end of the file never prevents the log from being opened again.
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Op is the kind of logged mutation
+type Op byte
+
+const (
+	// OpInsert is logged for InsertMetric
+	OpInsert Op = 1
+	// OpDelete is logged for DeleteMetric
+	OpDelete Op = 2
+)
+
+// SyncPolicy defines when log is fsync'ed
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs log after every appended record
+	SyncAlways SyncPolicy = iota
+	// SyncInterval fsyncs log every Options.SyncInterval in background
+	SyncInterval
+	// SyncNever never fsyncs log leaving it to operating system
+	SyncNever
+)
+
+const (
+	headerSize = 8
+
+	// maxRecordSize protects from huge allocations when reading
+	// corrupted log
+	maxRecordSize = 1 << 20
+)
+
+var (
+	// ErrCorrupted represents situation when record in the middle
+	// of the log is damaged
+	ErrCorrupted = errors.New("wal is corrupted")
+
+	// ErrRecordTooLarge represents situation when metric string is too
+	// long to be logged
+	ErrRecordTooLarge = errors.New("wal record is too large")
+
+	// ErrClosed represents situation when log is used after Close
+	ErrClosed = errors.New("wal is closed")
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// Options configures WAL
+type Options struct {
+	SyncPolicy SyncPolicy
+	// SyncInterval is used with SyncInterval policy, default is 1s
+	SyncInterval time.Duration
+}
+
+// WAL is the write-ahead log. It is safe for concurrent use.
+type WAL struct {
+	mu     sync.Mutex
+	f      *os.File
+	opts   Options
+	buf    []byte
+	dirty  bool
+	closed bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// Open opens log at path creating it if necessary.
+// Replay should be called before appending to freshly opened log.
+func Open(path string, opts Options) (*WAL, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := &WAL{
+		f:    f,
+		opts: opts,
+	}
+	if opts.SyncPolicy == SyncInterval {
+		if w.opts.SyncInterval <= 0 {
+			w.opts.SyncInterval = time.Second
+		}
+		w.stop = make(chan struct{})
+		w.done = make(chan struct{})
+		go w.syncLoop()
+	}
+	return w, nil
+}
+
+func (w *WAL) syncLoop() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.Sync()
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// Append appends record to the log
+func (w *WAL) Append(op Op, metricStr string) error {
+	size := 1 + len(metricStr)
+	if size > maxRecordSize {
+		return ErrRecordTooLarge
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+
+	w.buf = append(w.buf[:0], 0, 0, 0, 0, 0, 0, 0, 0)
+	w.buf = append(w.buf, byte(op))
+	w.buf = append(w.buf, metricStr...)
+	binary.LittleEndian.PutUint32(w.buf[0:], uint32(size))
+	binary.LittleEndian.PutUint32(w.buf[4:], crc32.Checksum(w.buf[headerSize:], crc32c))
+
+	// single write per record, so torn record may only be the last one
+	if _, err := w.f.Write(w.buf); err != nil {
+		return err
+	}
+	w.dirty = true
+	if w.opts.SyncPolicy == SyncAlways {
+		return w.sync()
+	}
+	return nil
+}
+
+// Sync fsyncs the log
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	return w.sync()
+}
+
+func (w *WAL) sync() error {
+	if !w.dirty {
+		return nil
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	w.dirty = false
+	return nil
+}
+
+// Replay calls fn for every record in the log in the order records were
+// appended. Damaged records at the end of the log are truncated,
+// ErrCorrupted is returned only if a valid record follows the damaged
+// one. If fn returns error replay stops and the error is returned.
+func (w *WAL) Replay(fn func(op Op, metricStr string) error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+
+	fi, err := w.f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+
+	r := bufio.NewReader(io.NewSectionReader(w.f, 0, size))
+	header := make([]byte, headerSize)
+	payload := make([]byte, 0)
+	var offset int64
+	for offset < size {
+		if _, err := io.ReadFull(r, header); err != nil {
+			// torn header
+			return w.truncateTail(offset, size)
+		}
+		length := int64(binary.LittleEndian.Uint32(header[0:]))
+		checksum := binary.LittleEndian.Uint32(header[4:])
+		end := offset + headerSize + length
+		if length < 1 || length > maxRecordSize || end > size {
+			return w.truncateTail(offset, size)
+		}
+		if int64(cap(payload)) < length {
+			payload = make([]byte, length)
+		}
+		payload = payload[:length]
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return err
+		}
+		if crc32.Checksum(payload, crc32c) != checksum {
+			return w.truncateTail(offset, size)
+		}
+		if err := fn(Op(payload[0]), string(payload[1:])); err != nil {
+			return err
+		}
+		offset = end
+	}
+	return nil
+}
+
+// truncateTail truncates log at damaged record at offset unless a valid
+// record is found after it, then ErrCorrupted is returned.
+// Record boundaries are lost after damaged record, so every following
+// byte is tried as the start of a record. Whole tail is read to memory,
+// it is expected to be small as log is truncated after every snapshot.
+func (w *WAL) truncateTail(offset, size int64) error {
+	tail := make([]byte, size-offset)
+	if _, err := w.f.ReadAt(tail, offset); err != nil {
+		return err
+	}
+	for i := 1; i+headerSize < len(tail); i++ {
+		length := int(binary.LittleEndian.Uint32(tail[i:]))
+		if length < 1 || length > maxRecordSize || i+headerSize+length > len(tail) {
+			continue
+		}
+		checksum := binary.LittleEndian.Uint32(tail[i+4:])
+		if crc32.Checksum(tail[i+headerSize:i+headerSize+length], crc32c) == checksum {
+			return ErrCorrupted
+		}
+	}
+	return w.truncate(offset)
+}
+
+// Truncate drops every record from the log. It is meant to be called
+// after successful snapshot of the index.
+func (w *WAL) Truncate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	return w.truncate(0)
+}
+
+func (w *WAL) truncate(size int64) error {
+	if err := w.f.Truncate(size); err != nil {
+		return err
+	}
+	w.dirty = false
+	return w.f.Sync()
+}
+
+// Close syncs and closes the log
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrClosed
+	}
+	w.closed = true
+	var err error
+	if w.opts.SyncPolicy != SyncNever {
+		err = w.sync()
+	}
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	w.mu.Unlock()
+
+	if w.stop != nil {
+		close(w.stop)
+		<-w.done
+	}
+	return err
+}
@@ -0,0 +1,356 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type record struct {
+	op        Op
+	metricStr string
+}
+
+var testRecords = []record{
+	{OpInsert, "cpu;dc=ams"},
+	{OpInsert, "cpu;dc=fra"},
+	{OpDelete, "cpu;dc=ams"},
+	{OpInsert, "mem"},
+}
+
+// writeLog writes records to new log and returns its path and offsets
+// of records, the last offset is the size of the log
+func writeLog(t *testing.T, records []record) (string, []int64) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.wal")
+	w, err := Open(path, Options{SyncPolicy: SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	offsets := []int64{0}
+	for _, rec := range records {
+		if err := w.Append(rec.op, rec.metricStr); err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, offsets[len(offsets)-1]+headerSize+1+int64(len(rec.metricStr)))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path, offsets
+}
+
+// replay opens log at path and returns records replayed from it
+func replay(t *testing.T, path string) ([]record, error) {
+	t.Helper()
+	w, err := Open(path, Options{SyncPolicy: SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	res := make([]record, 0)
+	err = w.Replay(func(op Op, metricStr string) error {
+		res = append(res, record{op, metricStr})
+		return nil
+	})
+	return res, err
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+func TestReplay(t *testing.T) {
+	path, offsets := writeLog(t, testRecords)
+	got, err := replay(t, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, testRecords) {
+		t.Fatalf("replayed %v, want %v", got, testRecords)
+	}
+	if size := fileSize(t, path); size != offsets[len(offsets)-1] {
+		t.Fatalf("log size is %d, want %d", size, offsets[len(offsets)-1])
+	}
+}
+
+func TestReplayDamagedTail(t *testing.T) {
+	last := len(testRecords) - 1
+	tests := []struct {
+		name string
+		// damage gets log and offsets of records and returns damaged log
+		damage func(data []byte, offsets []int64) []byte
+	}{
+		{
+			name: "torn header",
+			damage: func(data []byte, offsets []int64) []byte {
+				return data[:offsets[last]+3]
+			},
+		},
+		{
+			name: "torn payload",
+			damage: func(data []byte, offsets []int64) []byte {
+				return data[:offsets[last+1]-1]
+			},
+		},
+		{
+			name: "zero tail",
+			damage: func(data []byte, offsets []int64) []byte {
+				return append(data[:offsets[last]], make([]byte, 4096)...)
+			},
+		},
+		{
+			name: "zeroed payload",
+			damage: func(data []byte, offsets []int64) []byte {
+				copy(data[offsets[last]+headerSize:], make([]byte, 4))
+				return data
+			},
+		},
+		{
+			name: "garbage tail",
+			damage: func(data []byte, offsets []int64) []byte {
+				return append(data[:offsets[last]], bytes.Repeat([]byte{0xde, 0xad, 0xbe, 0xef, 0x01}, 100)...)
+			},
+		},
+		{
+			name: "invalid length",
+			damage: func(data []byte, offsets []int64) []byte {
+				data[offsets[last]+3] = 0xff
+				return data
+			},
+		},
+		{
+			name: "crc mismatch",
+			damage: func(data []byte, offsets []int64) []byte {
+				data[offsets[last+1]-1] ^= 0xff
+				return data
+			},
+		},
+		{
+			name: "crc mismatch followed by zeroes",
+			damage: func(data []byte, offsets []int64) []byte {
+				data[offsets[last+1]-1] ^= 0xff
+				return append(data, make([]byte, 100)...)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, offsets := writeLog(t, testRecords)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, tt.damage(data, offsets), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := replay(t, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, testRecords[:last]) {
+				t.Fatalf("replayed %v, want %v", got, testRecords[:last])
+			}
+			if size := fileSize(t, path); size != offsets[last] {
+				t.Fatalf("log is truncated to %d, want %d", size, offsets[last])
+			}
+
+			// log is usable after truncation
+			w, err := Open(path, Options{SyncPolicy: SyncNever})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Append(OpInsert, "new"); err != nil {
+				t.Fatal(err)
+			}
+			w.Close()
+			got, err = replay(t, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := append(testRecords[:last:last], record{OpInsert, "new"}); !reflect.DeepEqual(got, want) {
+				t.Fatalf("replayed %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestReplayCorrupted(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(data []byte, offsets []int64) []byte
+	}{
+		{
+			name: "crc mismatch",
+			damage: func(data []byte, offsets []int64) []byte {
+				data[offsets[2]-1] ^= 0xff
+				return data
+			},
+		},
+		{
+			name: "invalid length",
+			damage: func(data []byte, offsets []int64) []byte {
+				copy(data[offsets[1]:], []byte{0, 0, 0, 0})
+				return data
+			},
+		},
+		{
+			name: "zeroes in the middle",
+			damage: func(data []byte, offsets []int64) []byte {
+				res := append([]byte{}, data[:offsets[1]]...)
+				res = append(res, make([]byte, 512)...)
+				return append(res, data[offsets[1]:]...)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, offsets := writeLog(t, testRecords)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			damaged := tt.damage(data, offsets)
+			if err := os.WriteFile(path, damaged, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := replay(t, path); err != ErrCorrupted {
+				t.Fatalf("Replay returned %v, want ErrCorrupted", err)
+			}
+			// corrupted log is left as is
+			if size := fileSize(t, path); size != int64(len(damaged)) {
+				t.Fatalf("log size is %d, want %d", size, len(damaged))
+			}
+		})
+	}
+}
+
+func TestReplayCallbackError(t *testing.T) {
+	path, _ := writeLog(t, testRecords)
+	w, err := Open(path, Options{SyncPolicy: SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	errStop := errors.New("stop")
+	n := 0
+	err = w.Replay(func(op Op, metricStr string) error {
+		n++
+		return errStop
+	})
+	if err != errStop || n != 1 {
+		t.Fatalf("Replay returned %v after %d records", err, n)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	path, _ := writeLog(t, testRecords)
+	w, err := Open(path, Options{SyncPolicy: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Truncate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Append(OpInsert, "after"); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	got, err := replay(t, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []record{{OpInsert, "after"}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("replayed %v, want %v", got, want)
+	}
+}
+
+func TestSyncPolicy(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		// dirty is expected state right after Append
+		dirty bool
+	}{
+		{"always", Options{SyncPolicy: SyncAlways}, false},
+		{"never", Options{SyncPolicy: SyncNever}, true},
+		{"interval", Options{SyncPolicy: SyncInterval, SyncInterval: time.Hour}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := Open(filepath.Join(t.TempDir(), "test.wal"), tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Append(OpInsert, "cpu"); err != nil {
+				t.Fatal(err)
+			}
+			w.mu.Lock()
+			dirty := w.dirty
+			w.mu.Unlock()
+			if dirty != tt.dirty {
+				t.Fatalf("log is dirty: %v, want %v", dirty, tt.dirty)
+			}
+			if err := w.Sync(); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Append(OpInsert, "cpu"); err != ErrClosed {
+				t.Fatalf("Append after Close returned %v, want ErrClosed", err)
+			}
+			if err := w.Close(); err != ErrClosed {
+				t.Fatalf("second Close returned %v, want ErrClosed", err)
+			}
+		})
+	}
+}
+
+func TestSyncInterval(t *testing.T) {
+	w, err := Open(filepath.Join(t.TempDir(), "test.wal"), Options{
+		SyncPolicy:   SyncInterval,
+		SyncInterval: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Append(OpInsert, "cpu"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w.mu.Lock()
+		dirty := w.dirty
+		w.mu.Unlock()
+		if !dirty {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("log wasn't synced in background")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAppendTooLarge(t *testing.T) {
+	w, err := Open(filepath.Join(t.TempDir(), "test.wal"), Options{SyncPolicy: SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Append(OpInsert, string(make([]byte, maxRecordSize))); err != ErrRecordTooLarge {
+		t.Fatalf("Append returned %v, want ErrRecordTooLarge", err)
+	}
+}